@@ -10,6 +10,7 @@ package docker
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -54,6 +55,10 @@ var (
 	// ErrInactivityTimeout is returned when a streamable call has been inactive for some time.
 	ErrInactivityTimeout = errors.New("inactivity time exceeded timeout")
 
+	// ErrDaemonStarting is returned by Ping when the daemon is reachable but
+	// not ready to serve requests yet.
+	ErrDaemonStarting = errors.New("docker daemon is starting")
+
 	apiVersion112, _ = NewAPIVersion("1.12")
 	apiVersion119, _ = NewAPIVersion("1.19")
 	apiVersion124, _ = NewAPIVersion("1.24")
@@ -389,10 +394,16 @@ func (c *Client) Ping() error {
 // PingWithContext pings the docker server
 // The context object can be used to cancel the ping request.
 //
+// It returns ErrDaemonStarting when the daemon answers but isn't ready yet,
+// while transport errors, like ErrConnectionRefused, are returned as is.
+//
 // See https://goo.gl/wYfgY1 for more details.
 func (c *Client) PingWithContext(ctx context.Context) error {
 	path := "/_ping"
 	resp, err := c.do("GET", path, doOptions{context: ctx})
+	if e, ok := err.(*Error); ok && e.Status == http.StatusServiceUnavailable && strings.Contains(e.Message, "System not ready") {
+		return ErrDaemonStarting
+	}
 	if err != nil {
 		return err
 	}
@@ -492,6 +503,9 @@ func (c *Client) do(method, path string, doOptions doOptions) (*http.Response, e
 type streamOptions struct {
 	setRawTerminal bool
 	rawJSONStream  bool
+	// rawJSONErrors makes raw JSON streams return the error messages found
+	// in the stream.
+	rawJSONErrors  bool
 	useJSONDecoder bool
 	headers        map[string]string
 	in             io.Reader
@@ -611,6 +625,19 @@ func (c *Client) stream(method, path string, streamOptions streamOptions) error
 		resp.Body, ch = handleInactivityTimeout(resp.Body, streamOptions.inactivityTimeout, cancelRequest, &canceled)
 		defer close(ch)
 	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		// compressing proxies may gzip the response even though it
+		// wasn't requested, so the transport doesn't decompress it.
+		body, err := newGzipReadCloser(resp.Body)
+		if err == io.EOF {
+			return &Error{Status: http.StatusBadRequest, Message: "gzip-encoded response has an empty body"}
+		}
+		if err != nil {
+			return chooseError(subCtx, err)
+		}
+		resp.Body = body
+		defer body.Close()
+	}
 	err = handleStreamResponse(resp, &streamOptions)
 	if err != nil {
 		if atomic.LoadUint32(&canceled) != 0 {
@@ -634,6 +661,9 @@ func handleStreamResponse(resp *http.Response, streamOptions *streamOptions) err
 	// if we want to get raw json stream, just copy it back to output
 	// without decoding it
 	if streamOptions.rawJSONStream {
+		if streamOptions.rawJSONErrors {
+			return copyJSONStream(streamOptions.stdout, resp.Body)
+		}
 		_, err = io.Copy(streamOptions.stdout, resp.Body)
 		return err
 	}
@@ -649,6 +679,55 @@ func handleStreamResponse(resp *http.Response, streamOptions *streamOptions) err
 	return err
 }
 
+// copyJSONStream copies the JSON messages in src to dst as they are, returning
+// the first error message found in the stream. Streams that can't be decoded
+// are copied without checking for errors.
+func copyJSONStream(dst io.Writer, src io.Reader) error {
+	decoder := json.NewDecoder(io.TeeReader(src, dst))
+	var streamErr *jsonmessage.JSONError
+	for {
+		var msg jsonmessage.JSONMessage
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_, err = io.Copy(dst, src)
+			return err
+		}
+		if streamErr != nil {
+			continue
+		}
+		if msg.Error != nil {
+			streamErr = msg.Error
+		} else if msg.ErrorMessage != "" {
+			streamErr = &jsonmessage.JSONError{Message: msg.ErrorMessage}
+		}
+	}
+	if streamErr != nil {
+		return streamErr
+	}
+	return nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func newGzipReadCloser(body io.ReadCloser) (*gzipReadCloser, error) {
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: reader, body: body}, nil
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
 type proxyReader struct {
 	io.ReadCloser
 	calls uint64
@@ -6,6 +6,7 @@ package docker
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -456,6 +457,28 @@ func TestPingFailingWrongStatus(t *testing.T) {
 	}
 }
 
+func TestPingDaemonStarting(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: "System not ready", status: http.StatusServiceUnavailable}
+	client := newTestClient(fakeRT)
+	err := client.Ping()
+	if err != ErrDaemonStarting {
+		t.Fatalf("Ping: wrong error. Want %#v. Got %#v.", ErrDaemonStarting, err)
+	}
+}
+
+func TestPingUnreachable(t *testing.T) {
+	t.Parallel()
+	client, err := NewClient("http://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Ping()
+	if err != ErrConnectionRefused {
+		t.Fatalf("Ping: wrong error. Want %#v. Got %#v.", ErrConnectionRefused, err)
+	}
+}
+
 func TestPingErrorWithNativeClient(t *testing.T) {
 	t.Parallel()
 	srv, cleanup, err := newNativeServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -509,6 +532,68 @@ func TestClientStreamTimeoutNotHit(t *testing.T) {
 	}
 }
 
+func TestClientStreamGzipEncoding(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(gz, "%d\n", i)
+			gz.Flush()
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		gz.Close()
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+	// the transport must not decompress the response by itself, as it
+	// doesn't when the compression wasn't requested by the client.
+	client.HTTPClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	var w bytes.Buffer
+	err = client.stream("GET", "/containers/abc/logs", streamOptions{
+		setRawTerminal:    true,
+		stdout:            &w,
+		inactivityTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "0\n1\n2\n3\n4\n"
+	if result := w.String(); result != expected {
+		t.Fatalf("expected stream result %q, got: %q", expected, result)
+	}
+}
+
+func TestClientStreamGzipEncodingEmptyBody(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+	client.HTTPClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	var w bytes.Buffer
+	err = client.stream("GET", "/containers/abc/logs", streamOptions{
+		setRawTerminal: true,
+		stdout:         &w,
+	})
+	expected := &Error{Status: http.StatusBadRequest, Message: "gzip-encoded response has an empty body"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("expected error %#v, got: %#v", expected, err)
+	}
+}
+
 func TestClientStreamInactivityTimeout(t *testing.T) {
 	t.Parallel()
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -46,6 +46,7 @@ type APIPort struct {
 
 // APIMount represents a mount point for a container.
 type APIMount struct {
+	Type        string `json:"Type,omitempty" yaml:"Type,omitempty" toml:"Type,omitempty"`
 	Name        string `json:"Name,omitempty" yaml:"Name,omitempty" toml:"Name,omitempty"`
 	Source      string `json:"Source,omitempty" yaml:"Source,omitempty" toml:"Source,omitempty"`
 	Destination string `json:"Destination,omitempty" yaml:"Destination,omitempty" toml:"Destination,omitempty"`
@@ -310,6 +311,7 @@ type Config struct {
 	WorkingDir        string              `json:"WorkingDir,omitempty" yaml:"WorkingDir,omitempty" toml:"WorkingDir,omitempty"`
 	MacAddress        string              `json:"MacAddress,omitempty" yaml:"MacAddress,omitempty" toml:"MacAddress,omitempty"`
 	Entrypoint        []string            `json:"Entrypoint" yaml:"Entrypoint" toml:"Entrypoint"`
+	Shell             []string            `json:"Shell,omitempty" yaml:"Shell,omitempty" toml:"Shell,omitempty"`
 	SecurityOpts      []string            `json:"SecurityOpts,omitempty" yaml:"SecurityOpts,omitempty" toml:"SecurityOpts,omitempty"`
 	OnBuild           []string            `json:"OnBuild,omitempty" yaml:"OnBuild,omitempty" toml:"OnBuild,omitempty"`
 	Mounts            []Mount             `json:"Mounts,omitempty" yaml:"Mounts,omitempty" toml:"Mounts,omitempty"`
@@ -333,6 +335,9 @@ type Config struct {
 // It has been added in the version 1.20 of the Docker API, available since
 // Docker 1.8.
 type Mount struct {
+	// Type is one of "bind", "volume" or "tmpfs". It has been added in the
+	// version 1.25 of the Docker API.
+	Type        string
 	Name        string
 	Source      string
 	Destination string
@@ -433,6 +438,11 @@ type Container struct {
 	RestartCount int `json:"RestartCount,omitempty" yaml:"RestartCount,omitempty" toml:"RestartCount,omitempty"`
 
 	AppArmorProfile string `json:"AppArmorProfile,omitempty" yaml:"AppArmorProfile,omitempty" toml:"AppArmorProfile,omitempty"`
+	Platform        string `json:"Platform,omitempty" yaml:"Platform,omitempty" toml:"Platform,omitempty"`
+
+	// Warnings is only populated by CreateContainer, and contains the
+	// warnings emitted by the daemon when creating the container.
+	Warnings []string `json:"Warnings,omitempty" yaml:"Warnings,omitempty" toml:"Warnings,omitempty"`
 }
 
 // UpdateContainerOptions specify parameters to the UpdateContainer function.
@@ -558,13 +568,18 @@ type CreateContainerOptions struct {
 	HostConfig       *HostConfig       `qs:"-"`
 	NetworkingConfig *NetworkingConfig `qs:"-"`
 	Context          context.Context
+
+	// Platform selects the platform of the image used by the container, in
+	// the os[/arch[/variant]] format. Requires API version 1.41 or newer.
+	Platform string
 }
 
 // CreateContainer creates a new container, returning the container instance,
 // or an error in case of failure.
 //
-// The returned container instance contains only the container ID. To get more
-// details about the container after creating it, use InspectContainer.
+// The returned container instance contains only the container ID and the
+// warnings emitted by the daemon, if any. To get more details about the
+// container after creating it, use InspectContainer.
 //
 // See https://goo.gl/tyzwVM for more details.
 func (c *Client) CreateContainer(opts CreateContainerOptions) (*Container, error) {
@@ -888,6 +903,24 @@ type TopResult struct {
 	Processes [][]string
 }
 
+// Column returns the values of the column with the given title for all the
+// processes, and whether there's such a column in the result.
+func (r TopResult) Column(title string) ([]string, bool) {
+	for i, t := range r.Titles {
+		if t != title {
+			continue
+		}
+		values := make([]string, len(r.Processes))
+		for j, process := range r.Processes {
+			if i < len(process) {
+				values[j] = process[i]
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
+
 // TopContainer returns processes running inside a container
 //
 // See https://goo.gl/FLwpPl for more details.
@@ -895,7 +928,7 @@ func (c *Client) TopContainer(id string, psArgs string) (TopResult, error) {
 	var args string
 	var result TopResult
 	if psArgs != "" {
-		args = fmt.Sprintf("?ps_args=%s", psArgs)
+		args = "?ps_args=" + url.QueryEscape(psArgs)
 	}
 	path := fmt.Sprintf("/containers/%s/top%s", id, args)
 	resp, err := c.do("GET", path, doOptions{})
@@ -919,6 +952,7 @@ type Stats struct {
 	NumProcs  uint32    `json:"num_procs" yaml:"num_procs" toml:"num_procs"`
 	PidsStats struct {
 		Current uint64 `json:"current,omitempty" yaml:"current,omitempty"`
+		Limit   uint64 `json:"limit,omitempty" yaml:"limit,omitempty"`
 	} `json:"pids_stats,omitempty" yaml:"pids_stats,omitempty" toml:"pids_stats,omitempty"`
 	Network     NetworkStats            `json:"network,omitempty" yaml:"network,omitempty" toml:"network,omitempty"`
 	Networks    map[string]NetworkStats `json:"networks,omitempty" yaml:"networks,omitempty" toml:"networks,omitempty"`
@@ -1374,6 +1408,10 @@ type AttachToContainerOptions struct {
 
 	// Attach to stderr, and use ErrorStream.
 	Stderr bool
+
+	// Override the key sequence for detaching from the container, e.g.
+	// "ctrl-p,ctrl-q".
+	DetachKeys string `qs:"detachKeys"`
 }
 
 // AttachToContainer attaches to a container, using the given options.
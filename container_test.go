@@ -895,6 +895,56 @@ func TestCreateContainer(t *testing.T) {
 	}
 }
 
+func TestCreateContainerShell(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: `{"Id":"4fa6e0f0c678"}`, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	config := Config{Image: "mcr.microsoft.com/windows/nanoserver", Shell: []string{"powershell", "-Command"}}
+	_, err := client.CreateContainer(CreateContainerOptions{Config: &config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotBody Config
+	if err := json.NewDecoder(fakeRT.requests[0].Body).Decode(&gotBody); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotBody.Shell, config.Shell) {
+		t.Errorf("CreateContainer: wrong shell. Want %#v. Got %#v.", config.Shell, gotBody.Shell)
+	}
+}
+
+func TestCreateContainerPlatform(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: `{"Id":"4fa6e0f0c678"}`, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	config := Config{Image: "base"}
+	_, err := client.CreateContainer(CreateContainerOptions{Config: &config, Platform: "linux/arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if platform := fakeRT.requests[0].URL.Query().Get("platform"); platform != "linux/arm64" {
+		t.Errorf("CreateContainer: wrong platform. Want %q. Got %q.", "linux/arm64", platform)
+	}
+}
+
+func TestCreateContainerWithWarnings(t *testing.T) {
+	t.Parallel()
+	jsonContainer := `{
+             "Id": "4fa6e0f0c6786287e131c3852c58a2e01cc697a68231826813597e4994f1d6e2",
+	     "Warnings": ["Your kernel does not support swap limit capabilities."]
+}`
+	client := newTestClient(&FakeRoundTripper{message: jsonContainer, status: http.StatusOK})
+	config := Config{AttachStdout: true, AttachStdin: true}
+	container, err := client.CreateContainer(CreateContainerOptions{Config: &config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Your kernel does not support swap limit capabilities."}
+	if !reflect.DeepEqual(container.Warnings, expected) {
+		t.Errorf("CreateContainer: wrong warnings. Want %#v. Got %#v.", expected, container.Warnings)
+	}
+}
+
 func TestCreateContainerImageNotFound(t *testing.T) {
 	t.Parallel()
 	client := newTestClient(&FakeRoundTripper{message: "No such image", status: http.StatusNotFound})
@@ -1612,16 +1662,18 @@ func TestAttachToContainer(t *testing.T) {
 		Stderr:       true,
 		Stream:       true,
 		RawTerminal:  true,
+		DetachKeys:   "ctrl-p,ctrl-q",
 	}
 	err := client.AttachToContainer(opts)
 	if err != nil {
 		t.Fatal(err)
 	}
 	expected := map[string][]string{
-		"stdin":  {"1"},
-		"stdout": {"1"},
-		"stderr": {"1"},
-		"stream": {"1"},
+		"stdin":      {"1"},
+		"stdout":     {"1"},
+		"stderr":     {"1"},
+		"stream":     {"1"},
+		"detachKeys": {"ctrl-p,ctrl-q"},
 	}
 	got := map[string][]string(req.URL.Query())
 	if !reflect.DeepEqual(got, expected) {
@@ -2333,6 +2385,43 @@ func TestTopContainerWithPsArgs(t *testing.T) {
 	}
 }
 
+func TestTopContainerPsArgsEscaped(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: `{"Titles":["PID","COMMAND"],"Processes":[]}`, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	if _, err := client.TopContainer("abef348", "-o pid,comm"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fakeRT.requests[0].URL.Query().Get("ps_args"); got != "-o pid,comm" {
+		t.Errorf("TopContainer: wrong ps_args. Want %q. Got %q.", "-o pid,comm", got)
+	}
+}
+
+func TestTopResultColumn(t *testing.T) {
+	t.Parallel()
+	result := TopResult{
+		Titles: []string{"PID", "USER", "COMMAND"},
+		Processes: [][]string{
+			{"1", "root", "nginx: master process"},
+			{"7", "nginx"},
+		},
+	}
+	values, ok := result.Column("USER")
+	if !ok {
+		t.Fatal("Column: expected USER column to be found")
+	}
+	if expected := []string{"root", "nginx"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("Column: wrong values. Want %#v. Got %#v.", expected, values)
+	}
+	values, ok = result.Column("COMMAND")
+	if expected := []string{"nginx: master process", ""}; !ok || !reflect.DeepEqual(values, expected) {
+		t.Errorf("Column: wrong values. Want %#v. Got %#v.", expected, values)
+	}
+	if _, ok = result.Column("%CPU"); ok {
+		t.Error("Column: expected %CPU column not to be found")
+	}
+}
+
 func TestStats(t *testing.T) {
 	t.Parallel()
 	jsonStats1 := `{
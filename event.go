@@ -5,10 +5,13 @@
 package docker
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
@@ -58,10 +61,57 @@ type eventMonitoringState struct {
 	lastSeen int64
 	sync.RWMutex
 	sync.WaitGroup
-	enabled   bool
-	C         chan *APIEvents
-	errC      chan error
-	listeners []chan<- *APIEvents
+	enabled      bool
+	C            chan *APIEvents
+	errC         chan error
+	listeners    []chan<- *APIEvents
+	errListeners []chan<- error
+	bufMut       sync.Mutex
+	buffered     map[chan<- *APIEvents]*bufferedListener
+}
+
+// EventDropPolicy defines what happens to the events sent to a listener
+// added with AddEventListenerWithOptions when its buffer is full.
+type EventDropPolicy int
+
+const (
+	// EventDropNewest discards the incoming events while the buffer is
+	// full.
+	EventDropNewest EventDropPolicy = iota
+
+	// EventDropOldest discards the oldest event in the buffer to make room
+	// for the incoming one.
+	EventDropOldest
+
+	// EventBlock waits for room in the buffer, stalling the delivery of
+	// events to every listener until the listener catches up.
+	EventBlock
+)
+
+// EventListenerOptions specify parameters to the AddEventListenerWithOptions
+// function.
+type EventListenerOptions struct {
+	Listener chan<- *APIEvents
+
+	// Buffer is the number of events kept for the listener while it's not
+	// ready to receive them, in addition to the capacity of the channel.
+	Buffer int
+
+	DropPolicy EventDropPolicy
+}
+
+// bufferedListener forwards the events queued for a listener, so a slow
+// listener doesn't stall the event stream.
+type bufferedListener struct {
+	// `sync/atomic` expects the first word in an allocated struct to be 64-bit
+	// aligned on both ARM and x86-32. See https://goo.gl/zW7dgq for more details.
+	dropped  int64
+	listener chan<- *APIEvents
+	queue    chan *APIEvents
+	policy   EventDropPolicy
+	done     chan struct{}
+	exited   chan struct{}
+	once     sync.Once
 }
 
 const (
@@ -82,6 +132,11 @@ var (
 	// TLS (this applies to the Windows named pipe client).
 	ErrTLSNotSupported = errors.New("tls not supported by this client")
 
+	// ErrMalformedEvent is the error sent to event error listeners when the
+	// stream contains an event that can't be decoded. The malformed event is
+	// skipped and the stream continues.
+	ErrMalformedEvent = errors.New("malformed event in stream")
+
 	// EOFEvent is sent when the event listener receives an EOF error.
 	EOFEvent = &APIEvents{
 		Type:   "EOF",
@@ -103,6 +158,30 @@ func (c *Client) AddEventListener(listener chan<- *APIEvents) error {
 	return c.eventMonitor.addListener(listener)
 }
 
+// AddEventListenerWithOptions adds a new listener to container events in the
+// Docker API, buffering the events while the listener isn't ready to receive
+// them. The drop policy decides what happens once the buffer is full.
+//
+// Events sent to listeners added with AddEventListener are dropped when the
+// listener is not ready to receive them.
+func (c *Client) AddEventListenerWithOptions(opts EventListenerOptions) error {
+	var err error
+	if !c.eventMonitor.isEnabled() {
+		err = c.eventMonitor.enableEventMonitoring(c)
+		if err != nil {
+			return err
+		}
+	}
+	return c.eventMonitor.addBufferedListener(opts)
+}
+
+// DroppedEvents returns the number of events discarded for the given
+// listener, added with AddEventListenerWithOptions, because its buffer was
+// full. It returns 0 for any other listener.
+func (c *Client) DroppedEvents(listener chan<- *APIEvents) int64 {
+	return c.eventMonitor.droppedEvents(listener)
+}
+
 // RemoveEventListener removes a listener from the monitor.
 func (c *Client) RemoveEventListener(listener chan *APIEvents) error {
 	err := c.eventMonitor.removeListener(listener)
@@ -115,6 +194,28 @@ func (c *Client) RemoveEventListener(listener chan *APIEvents) error {
 	return nil
 }
 
+// AddEventErrorListener adds a channel that receives the errors found while
+// decoding events, like ErrMalformedEvent. Errors are dropped when the channel
+// is not ready to receive them.
+func (c *Client) AddEventErrorListener(listener chan<- error) {
+	c.eventMonitor.Lock()
+	defer c.eventMonitor.Unlock()
+	c.eventMonitor.errListeners = append(c.eventMonitor.errListeners, listener)
+}
+
+// RemoveEventErrorListener removes an error listener from the monitor.
+func (c *Client) RemoveEventErrorListener(listener chan<- error) {
+	c.eventMonitor.Lock()
+	defer c.eventMonitor.Unlock()
+	var newListeners []chan<- error
+	for _, l := range c.eventMonitor.errListeners {
+		if l != listener {
+			newListeners = append(newListeners, l)
+		}
+	}
+	c.eventMonitor.errListeners = newListeners
+}
+
 func (eventState *eventMonitoringState) addListener(listener chan<- *APIEvents) error {
 	eventState.Lock()
 	defer eventState.Unlock()
@@ -126,7 +227,66 @@ func (eventState *eventMonitoringState) addListener(listener chan<- *APIEvents)
 	return nil
 }
 
+func (eventState *eventMonitoringState) addBufferedListener(opts EventListenerOptions) error {
+	eventState.Lock()
+	defer eventState.Unlock()
+	if listenerExists(opts.Listener, &eventState.listeners) {
+		return ErrListenerAlreadyExists
+	}
+	buffer := opts.Buffer
+	if buffer < 0 {
+		buffer = 0
+	}
+	l := &bufferedListener{
+		listener: opts.Listener,
+		queue:    make(chan *APIEvents, buffer),
+		policy:   opts.DropPolicy,
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	go l.forward()
+	eventState.bufMut.Lock()
+	if eventState.buffered == nil {
+		eventState.buffered = make(map[chan<- *APIEvents]*bufferedListener)
+	}
+	eventState.buffered[opts.Listener] = l
+	eventState.bufMut.Unlock()
+	eventState.Add(1)
+	eventState.listeners = append(eventState.listeners, opts.Listener)
+	return nil
+}
+
+func (eventState *eventMonitoringState) bufferedListener(listener chan<- *APIEvents) *bufferedListener {
+	eventState.bufMut.Lock()
+	defer eventState.bufMut.Unlock()
+	return eventState.buffered[listener]
+}
+
+func (eventState *eventMonitoringState) droppedEvents(listener chan<- *APIEvents) int64 {
+	l := eventState.bufferedListener(listener)
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// stopBufferedListener stops forwarding events to the listener, unblocking
+// the senders waiting for room in its buffer. It's a no-op for listeners
+// without a buffer.
+func (eventState *eventMonitoringState) stopBufferedListener(listener chan<- *APIEvents) {
+	eventState.bufMut.Lock()
+	l := eventState.buffered[listener]
+	delete(eventState.buffered, listener)
+	eventState.bufMut.Unlock()
+	if l != nil {
+		l.stop()
+	}
+}
+
 func (eventState *eventMonitoringState) removeListener(listener chan<- *APIEvents) error {
+	// the listener must be stopped before locking, as sending an event to it
+	// may be holding the lock while waiting for room in its buffer.
+	eventState.stopBufferedListener(listener)
 	eventState.Lock()
 	defer eventState.Unlock()
 	if listenerExists(listener, &eventState.listeners) {
@@ -144,6 +304,7 @@ func (eventState *eventMonitoringState) removeListener(listener chan<- *APIEvent
 
 func (eventState *eventMonitoringState) closeListeners() {
 	for _, l := range eventState.listeners {
+		eventState.stopBufferedListener(l)
 		close(l)
 		eventState.Add(-1)
 	}
@@ -274,6 +435,10 @@ func (eventState *eventMonitoringState) sendEvent(event *APIEvents) {
 		}
 
 		for _, listener := range eventState.listeners {
+			if l := eventState.bufferedListener(listener); l != nil {
+				l.send(event)
+				continue
+			}
 			select {
 			case listener <- event:
 			default:
@@ -282,6 +447,62 @@ func (eventState *eventMonitoringState) sendEvent(event *APIEvents) {
 	}
 }
 
+func (l *bufferedListener) forward() {
+	defer close(l.exited)
+	for {
+		select {
+		case event := <-l.queue:
+			select {
+			case l.listener <- event:
+			case <-l.done:
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *bufferedListener) send(event *APIEvents) {
+	switch l.policy {
+	case EventBlock:
+		select {
+		case l.queue <- event:
+		case <-l.done:
+		}
+	case EventDropOldest:
+		for {
+			select {
+			case l.queue <- event:
+				return
+			case <-l.done:
+				return
+			default:
+			}
+			if cap(l.queue) == 0 {
+				atomic.AddInt64(&l.dropped, 1)
+				return
+			}
+			select {
+			case <-l.queue:
+				atomic.AddInt64(&l.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case l.queue <- event:
+		default:
+			atomic.AddInt64(&l.dropped, 1)
+		}
+	}
+}
+
+func (l *bufferedListener) stop() {
+	l.once.Do(func() { close(l.done) })
+	<-l.exited
+}
+
 func (eventState *eventMonitoringState) updateLastSeen(e *APIEvents) {
 	eventState.Lock()
 	defer eventState.Unlock()
@@ -327,7 +548,9 @@ func (c *Client) eventHijack(startTime int64, eventChan chan *APIEvents, errChan
 	go func(res *http.Response, conn *httputil.ClientConn) {
 		defer conn.Close()
 		defer res.Body.Close()
-		decoder := json.NewDecoder(res.Body)
+		reader := bufio.NewReader(res.Body)
+		buffered := bytes.NewReader(nil)
+		decoder := json.NewDecoder(reader)
 		for {
 			var event APIEvents
 			if err = decoder.Decode(&event); err != nil {
@@ -340,7 +563,19 @@ func (c *Client) eventHijack(startTime int64, eventChan chan *APIEvents, errChan
 					c.eventMonitor.RUnlock()
 					break
 				}
+				if _, ok := err.(*json.SyntaxError); ok {
+					c.eventMonitor.sendError(ErrMalformedEvent)
+					buffered = skipLine(decoder, buffered, reader)
+					decoder = json.NewDecoder(io.MultiReader(buffered, reader))
+					continue
+				}
+				if _, ok := err.(*json.UnmarshalTypeError); ok {
+					// the decoder already consumed the whole value
+					c.eventMonitor.sendError(ErrMalformedEvent)
+					continue
+				}
 				errChan <- err
+				break
 			}
 			if event.Time == 0 {
 				continue
@@ -356,6 +591,32 @@ func (c *Client) eventHijack(startTime int64, eventChan chan *APIEvents, errChan
 	return nil
 }
 
+func (eventState *eventMonitoringState) sendError(err error) {
+	eventState.RLock()
+	defer eventState.RUnlock()
+	for _, listener := range eventState.errListeners {
+		select {
+		case listener <- err:
+		default:
+		}
+	}
+}
+
+// skipLine discards the line with the invalid value where the decoder
+// stopped, returning the data read from the stream but not consumed yet. A
+// decoder can't be used after a syntax error, and the data it buffered starts
+// at the whitespace before the invalid value. The data not consumed from the
+// previous call is in buffered.
+func skipLine(decoder *json.Decoder, buffered *bytes.Reader, r *bufio.Reader) *bytes.Reader {
+	rest, _ := ioutil.ReadAll(io.MultiReader(decoder.Buffered(), buffered))
+	rest = bytes.TrimLeft(rest, " \t\r\n")
+	if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+		return bytes.NewReader(rest[i+1:])
+	}
+	r.ReadBytes('\n')
+	return bytes.NewReader(nil)
+}
+
 // transformEvent takes an event and determines what version it is from
 // then populates both versions of the event
 func transformEvent(event *APIEvents) {
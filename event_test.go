@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -301,3 +302,275 @@ func TestEventListenerReAdding(t *testing.T) {
 	// Give the goroutine of the first eventHijack() time to handle the EOF.
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestEventListenerMalformedEvent(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		name     string
+		response string
+		errors   int
+	}{
+		{
+			"separated",
+			`{"status":"create","id":"dfdf82bd3881","from":"base:latest","time":1374067924}
+{"status":"start","id":"dfdf82bd3881",
+{"status":"stop","id":"dfdf82bd3881","from":"base:latest","time":1374067966}
+not json at all
+{"status":"destroy","id":"dfdf82bd3881","from":"base:latest","time":1374067970}
+`,
+			2,
+		},
+		{
+			"consecutive",
+			`{"status":"create","id":"dfdf82bd3881","from":"base:latest","time":1374067924}
+not json at all
+{"status":"start","id":
+]]]
+  still not json
+{"status":"stop","id":"dfdf82bd3881","from":"base:latest","time":1374067966}
+{"status":"destroy","id":"dfdf82bd3881","from":"base:latest","time":1374067970}
+`,
+			4,
+		},
+	}
+	for _, tt := range tests {
+		testEventListenerMalformedEvent(t, tt.name, tt.response, tt.errors)
+	}
+}
+
+func testEventListenerMalformedEvent(t *testing.T, name, response string, errCount int) {
+	endChan := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+		w.(http.Flusher).Flush()
+		<-endChan
+	}))
+	defer server.Close()
+	defer close(endChan)
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	client.AddEventErrorListener(errs)
+	defer client.RemoveEventErrorListener(errs)
+	listener := make(chan *APIEvents, 10)
+	if err = client.AddEventListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	defer client.RemoveEventListener(listener)
+	var statuses []string
+	timeout := time.After(5 * time.Second)
+	for len(statuses) < 3 {
+		select {
+		case event := <-listener:
+			statuses = append(statuses, event.Status)
+		case <-timeout:
+			t.Fatalf("%s: timed out waiting for events. Got %v.", name, statuses)
+		}
+	}
+	expected := "create,stop,destroy"
+	if got := strings.Join(statuses, ","); got != expected {
+		t.Errorf("%s: wrong events. Want %q. Got %q.", name, expected, got)
+	}
+	// errors are reported before the events that follow the malformed lines.
+	if len(errs) != errCount {
+		t.Errorf("%s: wrong number of errors. Want %d. Got %d.", name, errCount, len(errs))
+	}
+	for len(errs) > 0 {
+		if err = <-errs; err != ErrMalformedEvent {
+			t.Errorf("%s: wrong error. Want %#v. Got %#v.", name, ErrMalformedEvent, err)
+		}
+	}
+}
+
+func TestEventListenerTypeMismatchedEvent(t *testing.T) {
+	t.Parallel()
+	response := `{"status":"create","id":"dfdf82bd3881","from":"base:latest","time":"1374067924"}
+{"status":"start","id":"dfdf82bd3881","from":"base:latest","time":1374067966}
+`
+	endChan := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+		w.(http.Flusher).Flush()
+		<-endChan
+	}))
+	defer server.Close()
+	defer close(endChan)
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	client.AddEventErrorListener(errs)
+	defer client.RemoveEventErrorListener(errs)
+	listener := make(chan *APIEvents, 10)
+	if err = client.AddEventListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	defer client.RemoveEventListener(listener)
+	timeout := time.After(5 * time.Second)
+	select {
+	case event := <-listener:
+		if event.Status != "start" {
+			t.Errorf("wrong event. Want %q. Got %q.", "start", event.Status)
+		}
+	case <-timeout:
+		t.Fatal("timed out waiting for the event after the type mismatched one")
+	}
+	select {
+	case err = <-errs:
+		if err != ErrMalformedEvent {
+			t.Errorf("wrong error. Want %#v. Got %#v.", ErrMalformedEvent, err)
+		}
+	case <-timeout:
+		t.Fatal("timed out waiting for the malformed event error")
+	}
+}
+
+func TestEventListenerDropPolicy(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		policy   EventDropPolicy
+		expected []int64
+		dropped  int64
+	}{
+		{EventDropNewest, []int64{1, 2, 3}, 3},
+		{EventDropOldest, []int64{1, 5, 6}, 3},
+		{EventBlock, []int64{1, 2, 3, 4, 5, 6}, 0},
+	}
+	for _, tt := range tests {
+		var state eventMonitoringState
+		listener := make(chan *APIEvents)
+		err := state.addBufferedListener(EventListenerOptions{Listener: listener, Buffer: 2, DropPolicy: tt.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := state.bufferedListener(listener)
+		l.send(&APIEvents{Time: 1})
+		// wait for the first event to be held by the forwarder, so the
+		// remaining events fill the buffer.
+		for len(l.queue) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		sent := make(chan struct{})
+		go func() {
+			for i := int64(2); i <= 6; i++ {
+				l.send(&APIEvents{Time: i})
+			}
+			close(sent)
+		}()
+		if tt.policy != EventBlock {
+			<-sent
+		}
+		var got []int64
+		for range tt.expected {
+			select {
+			case event := <-listener:
+				got = append(got, event.Time)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("policy %d: timed out waiting for events. Got %v.", tt.policy, got)
+			}
+		}
+		<-sent
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("policy %d: wrong events. Want %v. Got %v.", tt.policy, tt.expected, got)
+		}
+		if dropped := state.droppedEvents(listener); dropped != tt.dropped {
+			t.Errorf("policy %d: wrong number of dropped events. Want %d. Got %d.", tt.policy, tt.dropped, dropped)
+		}
+		state.stopBufferedListener(listener)
+	}
+}
+
+func TestDroppedEvents(t *testing.T) {
+	t.Parallel()
+	response := `{"status":"create","id":"dfdf82bd3881","from":"base:latest","time":1374067924}
+{"status":"start","id":"dfdf82bd3881","from":"base:latest","time":1374067924}
+{"status":"stop","id":"dfdf82bd3881","from":"base:latest","time":1374067966}
+{"status":"destroy","id":"dfdf82bd3881","from":"base:latest","time":1374067970}
+`
+	endChan := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+		w.(http.Flusher).Flush()
+		<-endChan
+	}))
+	defer server.Close()
+	defer close(endChan)
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := make(chan *APIEvents)
+	err = client.AddEventListenerWithOptions(EventListenerOptions{Listener: listener, Buffer: 1, DropPolicy: EventDropNewest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.RemoveEventListener(listener)
+	// the listener never receives: one event is held by the forwarder, one
+	// is kept in the buffer and the other two are dropped.
+	timeout := time.After(5 * time.Second)
+	for client.DroppedEvents(listener) < 2 {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for dropped events. Got %d.", client.DroppedEvents(listener))
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if dropped := client.DroppedEvents(listener); dropped != 2 {
+		t.Errorf("wrong number of dropped events. Want 2. Got %d.", dropped)
+	}
+	if dropped := client.DroppedEvents(make(chan *APIEvents)); dropped != 0 {
+		t.Errorf("wrong number of dropped events for unknown listener. Want 0. Got %d.", dropped)
+	}
+}
+
+func TestAddEventListenerWithOptions(t *testing.T) {
+	t.Parallel()
+	response := `{"status":"create","id":"dfdf82bd3881","from":"base:latest","time":1374067924}
+{"status":"start","id":"dfdf82bd3881","from":"base:latest","time":1374067924}
+{"status":"stop","id":"dfdf82bd3881","from":"base:latest","time":1374067966}
+{"status":"destroy","id":"dfdf82bd3881","from":"base:latest","time":1374067970}
+`
+	endChan := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+		w.(http.Flusher).Flush()
+		<-endChan
+	}))
+	defer server.Close()
+	defer close(endChan)
+	client, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := make(chan *APIEvents)
+	err = client.AddEventListenerWithOptions(EventListenerOptions{Listener: listener, Buffer: 1, DropPolicy: EventBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AddEventListenerWithOptions(EventListenerOptions{Listener: listener})
+	if err != ErrListenerAlreadyExists {
+		t.Errorf("wrong error adding the listener twice. Want %#v. Got %#v.", ErrListenerAlreadyExists, err)
+	}
+	var statuses []string
+	timeout := time.After(5 * time.Second)
+	for len(statuses) < 4 {
+		select {
+		case event := <-listener:
+			statuses = append(statuses, event.Status)
+			// a slow listener doesn't lose events with the block policy.
+			time.Sleep(10 * time.Millisecond)
+		case <-timeout:
+			t.Fatalf("timed out waiting for events. Got %v.", statuses)
+		}
+	}
+	expected := "create,start,stop,destroy"
+	if got := strings.Join(statuses, ","); got != expected {
+		t.Errorf("wrong events. Want %q. Got %q.", expected, got)
+	}
+	if err = client.RemoveEventListener(listener); err != nil {
+		t.Fatal(err)
+	}
+}
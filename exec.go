@@ -62,7 +62,8 @@ func (c *Client) CreateExec(opts CreateExecOptions) (*Exec, error) {
 	return &exec, nil
 }
 
-// StartExecOptions specify parameters to the StartExecContainer function.
+// StartExecOptions specify parameters to the StartExec, StartExecNonBlocking and
+// StartExecWithHandle functions.
 //
 // See https://goo.gl/1EeDWi for more details
 type StartExecOptions struct {
@@ -136,6 +137,27 @@ func (c *Client) StartExecNonBlocking(id string, opts StartExecOptions) (CloseWa
 	})
 }
 
+// StartExecWithHandle starts a previously set up exec instance id and returns
+// without waiting for the exec command to finish. The returned handle is
+// never nil: callers use it to close the interactive session or wait for it
+// to end. For detached execs, the handle's Close and Wait return immediately.
+func (c *Client) StartExecWithHandle(id string, opts StartExecOptions) (CloseWaiter, error) {
+	cw, err := c.StartExecNonBlocking(id, opts)
+	if err != nil {
+		return nil, err
+	}
+	if cw == nil {
+		cw = struct {
+			closerFunc
+			waiterFunc
+		}{
+			closerFunc(func() error { return nil }),
+			waiterFunc(func() error { return nil }),
+		}
+	}
+	return cw, nil
+}
+
 // ResizeExecTTY resizes the tty session used by the exec command id. This API
 // is valid only if Tty was specified as part of creating and starting the exec
 // command.
@@ -174,6 +196,7 @@ type ExecInspect struct {
 	ID            string            `json:"ID,omitempty" yaml:"ID,omitempty" toml:"ID,omitempty"`
 	ExitCode      int               `json:"ExitCode,omitempty" yaml:"ExitCode,omitempty" toml:"ExitCode,omitempty"`
 	Running       bool              `json:"Running,omitempty" yaml:"Running,omitempty" toml:"Running,omitempty"`
+	Pid           int               `json:"Pid,omitempty" yaml:"Pid,omitempty" toml:"Pid,omitempty"`
 	OpenStdin     bool              `json:"OpenStdin,omitempty" yaml:"OpenStdin,omitempty" toml:"OpenStdin,omitempty"`
 	OpenStderr    bool              `json:"OpenStderr,omitempty" yaml:"OpenStderr,omitempty" toml:"OpenStderr,omitempty"`
 	OpenStdout    bool              `json:"OpenStdout,omitempty" yaml:"OpenStdout,omitempty" toml:"OpenStdout,omitempty"`
@@ -14,6 +14,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestExecCreate(t *testing.T) {
@@ -178,6 +179,71 @@ func TestExecStartAndAttach(t *testing.T) {
 	<-success
 }
 
+func TestExecStartWithHandle(t *testing.T) {
+	t.Parallel()
+	unleash := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-unleash
+	}))
+	defer server.Close()
+	client, _ := NewClient(server.URL)
+	client.SkipServerVersionCheck = true
+	var stdout bytes.Buffer
+	execID := "4fa6e0f0c6786287e131c3852c58a2e01cc697a68231826813597e4994f1d6e2"
+	cw, err := client.StartExecWithHandle(execID, StartExecOptions{
+		OutputStream: &stdout,
+		RawTerminal:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cw.Wait()
+	}()
+	select {
+	case <-done:
+		t.Fatal("StartExecWithHandle: handle finished before the exec exited")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unleash)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartExecWithHandle: timed out waiting for the exec to exit")
+	}
+	if !strings.Contains(stdout.String(), "hello") {
+		t.Errorf("StartExecWithHandle: wrong output. Want %q. Got %q.", "hello", stdout.String())
+	}
+}
+
+func TestExecStartWithHandleDetached(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	cw, err := client.StartExecWithHandle("4fa6e0f0c678", StartExecOptions{Detach: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw == nil {
+		t.Fatal("StartExecWithHandle: expected a handle for detached exec, got nil")
+	}
+	if err := cw.Wait(); err != nil {
+		t.Error(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(fakeRT.requests) != 1 {
+		t.Errorf("StartExecWithHandle: wrong number of requests. Want 1. Got %d.", len(fakeRT.requests))
+	}
+}
+
 func TestExecResize(t *testing.T) {
 	t.Parallel()
 	execID := "4fa6e0f0c6786287e131c3852c58a2e01cc697a68231826813597e4994f1d6e2"
@@ -218,7 +284,8 @@ func TestExecInspect(t *testing.T) {
 	    "tty": true,
 	    "user": "1000"
 	  },
-	  "Running": false
+	  "Running": false,
+	  "Pid": 4242
 	}`
 	var expected ExecInspect
 	err := json.Unmarshal([]byte(jsonExec), &expected)
@@ -235,6 +302,9 @@ func TestExecInspect(t *testing.T) {
 	if !reflect.DeepEqual(*execObj, expected) {
 		t.Errorf("ExecInspect: Expected %#v. Got %#v.", expected, *execObj)
 	}
+	if execObj.Pid != 4242 {
+		t.Errorf("ExecInspect: wrong Pid. Want %d. Got %d.", 4242, execObj.Pid)
+	}
 	req := fakeRT.requests[0]
 	if req.Method != "GET" {
 		t.Errorf("ExecInspect: wrong HTTP method. Want %q. Got %q.", "GET", req.Method)
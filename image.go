@@ -29,6 +29,15 @@ type APIImages struct {
 	ParentID    string            `json:"ParentId,omitempty" yaml:"ParentId,omitempty" toml:"ParentId,omitempty"`
 	RepoDigests []string          `json:"RepoDigests,omitempty" yaml:"RepoDigests,omitempty" toml:"RepoDigests,omitempty"`
 	Labels      map[string]string `json:"Labels,omitempty" yaml:"Labels,omitempty" toml:"Labels,omitempty"`
+
+	// Containers is the number of containers using the image, or -1 when
+	// the daemon didn't compute it.
+	Containers int64 `json:"Containers,omitempty" yaml:"Containers,omitempty" toml:"Containers,omitempty"`
+
+	// SharedSize is the size of the layers the image shares with other
+	// images, or -1 when the daemon didn't compute it. Set the SharedSize
+	// flag in ListImagesOptions for getting it computed.
+	SharedSize int64 `json:"SharedSize,omitempty" yaml:"SharedSize,omitempty" toml:"SharedSize,omitempty"`
 }
 
 // RootFS represents the underlying layers used by an image
@@ -55,6 +64,7 @@ type Image struct {
 	RepoDigests     []string  `json:"RepoDigests,omitempty" yaml:"RepoDigests,omitempty" toml:"RepoDigests,omitempty"`
 	RootFS          *RootFS   `json:"RootFS,omitempty" yaml:"RootFS,omitempty" toml:"RootFS,omitempty"`
 	OS              string    `json:"Os,omitempty" yaml:"Os,omitempty" toml:"Os,omitempty"`
+	Variant         string    `json:"Variant,omitempty" yaml:"Variant,omitempty" toml:"Variant,omitempty"`
 }
 
 // ImagePre012 serves the same purpose as the Image type except that it is for
@@ -98,11 +108,12 @@ var (
 //
 // See https://goo.gl/BVzauZ for more details.
 type ListImagesOptions struct {
-	Filters map[string][]string
-	All     bool
-	Digests bool
-	Filter  string
-	Context context.Context
+	Filters    map[string][]string
+	All        bool
+	Digests    bool
+	Filter     string
+	SharedSize bool `qs:"shared-size"`
+	Context    context.Context
 }
 
 // ListImages returns the list of available images in the server.
@@ -130,6 +141,7 @@ type ImageHistory struct {
 	Created   int64    `json:"Created,omitempty" yaml:"Created,omitempty" toml:"Tags,omitempty"`
 	CreatedBy string   `json:"CreatedBy,omitempty" yaml:"CreatedBy,omitempty" toml:"CreatedBy,omitempty"`
 	Size      int64    `json:"Size,omitempty" yaml:"Size,omitempty" toml:"Size,omitempty"`
+	Comment   string   `json:"Comment,omitempty" yaml:"Comment,omitempty" toml:"Comment,omitempty"`
 }
 
 // ImageHistory returns the history of the image by its name or ID.
@@ -166,6 +178,35 @@ func (c *Client) RemoveImage(name string) error {
 	return nil
 }
 
+// ImageDelete is an entry in the result of an image removal, reporting either
+// a reference that was untagged or an image that was deleted.
+//
+// See https://goo.gl/Vd2Pck for more details.
+type ImageDelete struct {
+	Untagged string `json:",omitempty"`
+	Deleted  string `json:",omitempty"`
+}
+
+// RemoveImageWithResult removes an image by its name or ID, returning the
+// references that were untagged and the images that were deleted.
+//
+// See https://goo.gl/Vd2Pck for more details.
+func (c *Client) RemoveImageWithResult(name string) ([]ImageDelete, error) {
+	resp, err := c.do("DELETE", "/images/"+name, doOptions{})
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Status == http.StatusNotFound {
+			return nil, ErrNoSuchImage
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result []ImageDelete
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return result, nil
+}
+
 // RemoveImageOptions present the set of options available for removing an image
 // from a registry.
 //
@@ -197,7 +238,11 @@ func (c *Client) RemoveImageExtended(name string, opts RemoveImageOptions) error
 //
 // See https://goo.gl/ncLTG8 for more details.
 func (c *Client) InspectImage(name string) (*Image, error) {
-	resp, err := c.do("GET", "/images/"+name+"/json", doOptions{})
+	return c.inspectImage(name, doOptions{})
+}
+
+func (c *Client) inspectImage(name string, opts doOptions) (*Image, error) {
+	resp, err := c.do("GET", "/images/"+name+"/json", opts)
 	if err != nil {
 		if e, ok := err.(*Error); ok && e.Status == http.StatusNotFound {
 			return nil, ErrNoSuchImage
@@ -248,6 +293,11 @@ type PushImageOptions struct {
 	// Registry server to push the image
 	Registry string
 
+	// CheckLocalImage makes PushImage inspect the image before pushing it,
+	// returning ErrNoSuchImage if the given name and tag don't reference an
+	// existing local image.
+	CheckLocalImage bool `qs:"-"`
+
 	OutputStream      io.Writer     `qs:"-"`
 	RawJSONStream     bool          `qs:"-"`
 	InactivityTimeout time.Duration `qs:"-"`
@@ -265,6 +315,15 @@ func (c *Client) PushImage(opts PushImageOptions, auth AuthConfiguration) error
 	if opts.Name == "" {
 		return ErrNoSuchImage
 	}
+	if opts.CheckLocalImage {
+		image := opts.Name
+		if opts.Tag != "" {
+			image += ":" + opts.Tag
+		}
+		if _, err := c.inspectImage(image, doOptions{context: opts.Context}); err != nil {
+			return err
+		}
+	}
 	headers, err := headersWithAuth(auth)
 	if err != nil {
 		return err
@@ -295,6 +354,11 @@ type PullImageOptions struct {
 	// This parameter was removed in Docker Engine 1.11
 	Registry string
 
+	// Platform selects the image to pull from a multi-platform image, in
+	// the os[/arch[/variant]] format (for example, linux/arm/v7). Requires
+	// API version 1.32 or newer.
+	Platform string
+
 	OutputStream      io.Writer     `qs:"-"`
 	RawJSONStream     bool          `qs:"-"`
 	InactivityTimeout time.Duration `qs:"-"`
@@ -356,6 +420,57 @@ func (c *Client) LoadImage(opts LoadImageOptions) error {
 	})
 }
 
+// ImageLoad imports a tarball docker image, like LoadImage, returning the
+// references of the loaded images. Images without tags are referenced by
+// their IDs. The messages sent by the daemon are written to opts.OutputStream.
+//
+// See https://goo.gl/rEsBV3 for more details.
+func (c *Client) ImageLoad(opts LoadImageOptions) ([]string, error) {
+	var buf bytes.Buffer
+	err := c.stream("POST", "/images/load?quiet=1", streamOptions{
+		setRawTerminal: true,
+		rawJSONStream:  true,
+		in:             opts.InputStream,
+		stdout:         &buf,
+		context:        opts.Context,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseLoadedImages(&buf, opts.OutputStream)
+}
+
+func parseLoadedImages(r io.Reader, w io.Writer) ([]string, error) {
+	var loaded []string
+	decoder := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			return loaded, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if msg.Error != "" {
+			return nil, errors.New(msg.Error)
+		}
+		if w != nil {
+			io.WriteString(w, msg.Stream)
+		}
+		for _, line := range strings.Split(msg.Stream, "\n") {
+			if ref := strings.TrimPrefix(line, "Loaded image: "); ref != line {
+				loaded = append(loaded, strings.TrimSpace(ref))
+			} else if id := strings.TrimPrefix(line, "Loaded image ID: "); id != line {
+				loaded = append(loaded, strings.TrimSpace(id))
+			}
+		}
+	}
+}
+
 // ExportImageOptions represent the options for ExportImage Docker API call.
 //
 // See https://goo.gl/AuySaA for more details.
@@ -399,6 +514,7 @@ func (c *Client) ExportImages(opts ExportImagesOptions) error {
 		setRawTerminal:    true,
 		stdout:            opts.OutputStream,
 		inactivityTimeout: opts.InactivityTimeout,
+		context:           opts.Context,
 	})
 }
 
@@ -472,6 +588,8 @@ type BuildImageOptions struct {
 	NetworkMode         string             `qs:"networkmode"`
 	InactivityTimeout   time.Duration      `qs:"-"`
 	CgroupParent        string             `qs:"cgroupparent"`
+	Isolation           string             `qs:"isolation"`
+	ShmSize             int64              `qs:"shmsize"`
 	Context             context.Context
 }
 
@@ -488,6 +606,10 @@ type BuildArg struct {
 // BuildImage builds an image from a tarball's url or a Dockerfile in the input
 // stream.
 //
+// A failed build is reported by the daemon in the output stream. BuildImage
+// returns it as a *jsonmessage.JSONError holding the error code and message,
+// even when RawJSONStream is set.
+//
 // See https://goo.gl/4nYHwV for more details.
 func (c *Client) BuildImage(opts BuildImageOptions) error {
 	if opts.OutputStream == nil {
@@ -510,10 +632,27 @@ func (c *Client) BuildImage(opts BuildImageOptions) error {
 		if opts.InputStream != nil {
 			return ErrMultipleContexts
 		}
-		var err error
-		if opts.InputStream, err = createTarStream(opts.ContextDir, opts.Dockerfile); err != nil {
+		tarStream, err := createTarStream(opts.ContextDir, opts.Dockerfile)
+		if err != nil {
 			return err
 		}
+		if opts.Context != nil {
+			// release the goroutine producing the tar stream if the build
+			// is canceled before the whole context is sent.
+			done := make(chan struct{})
+			defer close(done)
+			go func(ctx context.Context) {
+				select {
+				case <-ctx.Done():
+					tarStream.Close()
+				case <-done:
+				}
+			}(opts.Context)
+		}
+		opts.InputStream = tarStream
+	}
+	if opts.InputStream != nil && opts.Context != nil {
+		opts.InputStream = &contextReader{ctx: opts.Context, reader: opts.InputStream}
 	}
 	qs := queryString(&opts)
 
@@ -548,6 +687,7 @@ func (c *Client) BuildImage(opts BuildImageOptions) error {
 	return c.stream("POST", fmt.Sprintf("/build?%s", qs), streamOptions{
 		setRawTerminal:    true,
 		rawJSONStream:     opts.RawJSONStream,
+		rawJSONErrors:     true,
 		headers:           headers,
 		in:                opts.InputStream,
 		stdout:            opts.OutputStream,
@@ -556,6 +696,22 @@ func (c *Client) BuildImage(opts BuildImageOptions) error {
 	})
 }
 
+// contextReader stops reading from the underlying reader once the context is
+// done, so a canceled build doesn't keep sending its context.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	default:
+		return r.reader.Read(p)
+	}
+}
+
 func (c *Client) versionedAuthConfigs(authConfigs AuthConfigurations) interface{} {
 	if c.serverAPIVersion == nil {
 		c.checkAPIVersion()
@@ -6,17 +6,22 @@ package docker
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
 )
 
 func newTestClient(rt http.RoundTripper) Client {
@@ -144,6 +149,15 @@ func TestListImagesParameters(t *testing.T) {
 	if len(filters["dangling"]) != 1 || filters["dangling"][0] != "true" {
 		t.Errorf("ListImages(dangling=[true]): Wrong filter map. Want dangling=[true], got dangling=%v", filters["dangling"])
 	}
+	fakeRT.Reset()
+	_, err = client.ListImages(ListImagesOptions{SharedSize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = fakeRT.requests[0]
+	if sharedSize := req.URL.Query().Get("shared-size"); sharedSize != "1" {
+		t.Errorf("ListImages({SharedSize: true}): Wrong parameter. Want shared-size=1. Got shared-size=%s", sharedSize)
+	}
 }
 
 func TestImageHistory(t *testing.T) {
@@ -171,7 +185,8 @@ func TestImageHistory(t *testing.T) {
 		"Tags": [
 			"scratch:latest"
 		],
-		"Created": 1371157430
+		"Created": 1371157430,
+		"Comment": "Imported from -"
 	}
 ]`
 	var expected []ImageHistory
@@ -187,6 +202,9 @@ func TestImageHistory(t *testing.T) {
 	if !reflect.DeepEqual(history, expected) {
 		t.Errorf("ImageHistory: Wrong return value. Want %#v. Got %#v.", expected, history)
 	}
+	if len(history) != 3 || history[2].Comment != "Imported from -" {
+		t.Errorf("ImageHistory: Wrong comment. Want %q. Got %#v.", "Imported from -", history)
+	}
 }
 
 func TestRemoveImage(t *testing.T) {
@@ -218,6 +236,38 @@ func TestRemoveImageNotFound(t *testing.T) {
 	}
 }
 
+func TestRemoveImageWithResult(t *testing.T) {
+	t.Parallel()
+	body := `[{"Untagged":"test:latest"},{"Deleted":"sha256:abc"},{"Deleted":"sha256:def"}]`
+	fakeRT := &FakeRoundTripper{message: body, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	result, err := client.RemoveImageWithResult("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ImageDelete{{Untagged: "test:latest"}, {Deleted: "sha256:abc"}, {Deleted: "sha256:def"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("RemoveImageWithResult: wrong result. Want %#v. Got %#v.", expected, result)
+	}
+	req := fakeRT.requests[0]
+	if req.Method != "DELETE" {
+		t.Errorf("RemoveImageWithResult: Wrong HTTP method. Want DELETE. Got %s.", req.Method)
+	}
+	u, _ := url.Parse(client.getURL("/images/test"))
+	if req.URL.Path != u.Path {
+		t.Errorf("RemoveImageWithResult: Wrong request path. Want %q. Got %q.", u.Path, req.URL.Path)
+	}
+}
+
+func TestRemoveImageWithResultNotFound(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(&FakeRoundTripper{message: "no such image", status: http.StatusNotFound})
+	_, err := client.RemoveImageWithResult("test")
+	if err != ErrNoSuchImage {
+		t.Errorf("RemoveImageWithResult: wrong error. Want %#v. Got %#v.", ErrNoSuchImage, err)
+	}
+}
+
 func TestRemoveImageExtended(t *testing.T) {
 	t.Parallel()
 	name := "test"
@@ -431,6 +481,48 @@ func TestPushImageCustomRegistry(t *testing.T) {
 	}
 }
 
+func TestPushImageCheckLocalImage(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: "no such image", status: http.StatusNotFound}
+	client := newTestClient(fakeRT)
+	opts := PushImageOptions{Name: "test", Tag: "v1", CheckLocalImage: true}
+	err := client.PushImage(opts, AuthConfiguration{})
+	if err != ErrNoSuchImage {
+		t.Errorf("PushImage: got wrong error. Want %#v. Got %#v.", ErrNoSuchImage, err)
+	}
+	if len(fakeRT.requests) != 1 {
+		t.Fatalf("PushImage: wrong number of requests. Want 1. Got %d.", len(fakeRT.requests))
+	}
+	req := fakeRT.requests[0]
+	if req.Method != "GET" {
+		t.Errorf("PushImage: Wrong HTTP method. Want GET. Got %s.", req.Method)
+	}
+	u, _ := url.Parse(client.getURL("/images/test:v1/json"))
+	if req.URL.Path != u.Path {
+		t.Errorf("PushImage: Wrong request path. Want %q. Got %q.", u.Path, req.URL.Path)
+	}
+}
+
+func TestPushImageCheckLocalImageContext(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: "no such image", status: http.StatusNotFound}
+	client := newTestClient(fakeRT)
+	type contextKey string
+	key := contextKey("push")
+	ctx := context.WithValue(context.Background(), key, "check")
+	opts := PushImageOptions{Name: "test", Tag: "v1", CheckLocalImage: true, Context: ctx}
+	err := client.PushImage(opts, AuthConfiguration{})
+	if err != ErrNoSuchImage {
+		t.Errorf("PushImage: got wrong error. Want %#v. Got %#v.", ErrNoSuchImage, err)
+	}
+	if len(fakeRT.requests) != 1 {
+		t.Fatalf("PushImage: wrong number of requests. Want 1. Got %d.", len(fakeRT.requests))
+	}
+	if value := fakeRT.requests[0].Context().Value(key); value != "check" {
+		t.Errorf("PushImage: the local image check did not use the given context")
+	}
+}
+
 func TestPushImageNoName(t *testing.T) {
 	t.Parallel()
 	client := Client{}
@@ -631,6 +723,28 @@ func TestPullImageTag(t *testing.T) {
 	}
 }
 
+func TestPullImagePlatform(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: "Pulling 1/100", status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	var buf bytes.Buffer
+	opts := PullImageOptions{
+		Repository:   "base",
+		Platform:     "linux/arm/v7",
+		OutputStream: &buf,
+	}
+	err := client.PullImage(opts, AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := fakeRT.requests[0]
+	expected := map[string][]string{"fromImage": {"base"}, "platform": {"linux/arm/v7"}}
+	got := map[string][]string(req.URL.Query())
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("PullImage: wrong query string. Want %#v. Got %#v.", expected, got)
+	}
+}
+
 func TestPullImageNoRepository(t *testing.T) {
 	t.Parallel()
 	var opts PullImageOptions
@@ -801,6 +915,8 @@ func TestBuildImageParameters(t *testing.T) {
 		Labels:              map[string]string{"k": "v"},
 		NetworkMode:         "host",
 		CgroupParent:        "cgparent",
+		Isolation:           "hyperv",
+		ShmSize:             67108864,
 	}
 	err := client.BuildImage(opts)
 	if err != nil && !strings.Contains(err.Error(), "build image fail") {
@@ -825,6 +941,8 @@ func TestBuildImageParameters(t *testing.T) {
 		"buildargs":    {`{"SOME_VAR":"some_value"}`},
 		"networkmode":  {"host"},
 		"cgroupparent": {"cgparent"},
+		"isolation":    {"hyperv"},
+		"shmsize":      {"67108864"},
 	}
 	got := map[string][]string(req.URL.Query())
 	if !reflect.DeepEqual(got, expected) {
@@ -921,6 +1039,82 @@ func TestBuildImageWithRawJSON(t *testing.T) {
 	}
 }
 
+type endlessReader struct {
+	reads int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	atomic.AddInt64(&r.reads, 1)
+	time.Sleep(time.Millisecond)
+	return copy(p, "context"), nil
+}
+
+func TestBuildImageStreamError(t *testing.T) {
+	t.Parallel()
+	body := `{"stream":"Step 1/2 : FROM base\n"}
+{"stream":"Step 2/2 : RUN make\n"}
+{"errorDetail":{"code":2,"message":"The command '/bin/sh -c make' returned a non-zero code: 2"},"error":"The command '/bin/sh -c make' returned a non-zero code: 2"}
+`
+	for _, raw := range []bool{false, true} {
+		fakeRT := &FakeRoundTripper{
+			message: body,
+			status:  http.StatusOK,
+			header: map[string]string{
+				"Content-Type": "application/json",
+			},
+		}
+		client := newTestClient(fakeRT)
+		var buf bytes.Buffer
+		err := client.BuildImage(BuildImageOptions{
+			Name:          "testImage",
+			Remote:        "http://localhost/Dockerfile",
+			OutputStream:  &buf,
+			RawJSONStream: raw,
+		})
+		jsonErr, ok := err.(*jsonmessage.JSONError)
+		if !ok {
+			t.Fatalf("BuildImage(raw=%v): wrong error. Want *jsonmessage.JSONError. Got %#v.", raw, err)
+		}
+		expected := jsonmessage.JSONError{Code: 2, Message: "The command '/bin/sh -c make' returned a non-zero code: 2"}
+		if *jsonErr != expected {
+			t.Errorf("BuildImage(raw=%v): wrong error. Want %#v. Got %#v.", raw, expected, *jsonErr)
+		}
+		if raw && buf.String() != body {
+			t.Errorf("BuildImage(raw=%v): wrong raw output. Want %q. Got %q.", raw, body, buf.String())
+		}
+	}
+}
+
+func TestBuildImageCancelContext(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	input := &endlessReader{}
+	err = client.BuildImage(BuildImageOptions{
+		Name:         "testImage",
+		InputStream:  input,
+		OutputStream: &bytes.Buffer{},
+		Context:      ctx,
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("BuildImage: wrong error. Want %#v. Got %#v.", context.DeadlineExceeded, err)
+	}
+	reads := atomic.LoadInt64(&input.reads)
+	time.Sleep(50 * time.Millisecond)
+	if current := atomic.LoadInt64(&input.reads); current != reads {
+		t.Errorf("BuildImage: build context still being read after cancellation (%d reads, then %d)", reads, current)
+	}
+}
+
 func TestBuildImageRemoteWithoutName(t *testing.T) {
 	t.Parallel()
 	fakeRT := &FakeRoundTripper{message: "", status: http.StatusOK}
@@ -1010,6 +1204,47 @@ func TestLoadImage(t *testing.T) {
 	}
 }
 
+func TestImageLoad(t *testing.T) {
+	t.Parallel()
+	body := `{"stream":"Loaded image: busybox:latest\n"}
+{"stream":"Loaded image: busybox:1.0\n"}
+{"stream":"Loaded image ID: sha256:abc123\n"}
+`
+	fakeRT := &FakeRoundTripper{message: body, status: http.StatusOK, header: map[string]string{"Content-Type": "application/json"}}
+	client := newTestClient(fakeRT)
+	var buf bytes.Buffer
+	loaded, err := client.ImageLoad(LoadImageOptions{InputStream: strings.NewReader("tar"), OutputStream: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"busybox:latest", "busybox:1.0", "sha256:abc123"}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("ImageLoad: wrong loaded images. Want %#v. Got %#v.", expected, loaded)
+	}
+	expectedOutput := "Loaded image: busybox:latest\nLoaded image: busybox:1.0\nLoaded image ID: sha256:abc123\n"
+	if buf.String() != expectedOutput {
+		t.Errorf("ImageLoad: wrong output. Want %q. Got %q.", expectedOutput, buf.String())
+	}
+	req := fakeRT.requests[0]
+	if req.Method != "POST" || req.URL.Path != "/images/load" {
+		t.Errorf("ImageLoad: wrong request. Got %s %s.", req.Method, req.URL.Path)
+	}
+}
+
+func TestImageLoadError(t *testing.T) {
+	t.Parallel()
+	body := `{"error":"invalid archive"}`
+	fakeRT := &FakeRoundTripper{message: body, status: http.StatusOK, header: map[string]string{"Content-Type": "application/json"}}
+	client := newTestClient(fakeRT)
+	loaded, err := client.ImageLoad(LoadImageOptions{InputStream: strings.NewReader("tar")})
+	if err == nil || err.Error() != "invalid archive" {
+		t.Errorf("ImageLoad: wrong error. Want %q. Got %v.", "invalid archive", err)
+	}
+	if loaded != nil {
+		t.Errorf("ImageLoad: expected no loaded images, got %#v", loaded)
+	}
+}
+
 func TestExportImage(t *testing.T) {
 	t.Parallel()
 	var buf bytes.Buffer
@@ -84,6 +84,7 @@ type DockerInfo struct {
 	DefaultRuntime     string
 	LiveRestoreEnabled bool
 	Swarm              swarm.Info
+	Warnings           []string
 }
 
 // PluginsInfo is a struct with the plugins registered with the docker daemon
@@ -79,6 +79,7 @@ func TestInfo(t *testing.T) {
      "NGoroutines":21,
      "MemoryLimit":true,
      "SwapLimit":false,
+     "Warnings":["WARNING: No swap limit support"],
      "RegistryConfig":{
        "InsecureRegistryCIDRs":["127.0.0.0/8"],
        "IndexConfigs":{
@@ -102,6 +103,7 @@ func TestInfo(t *testing.T) {
 		NGoroutines: 21,
 		MemoryLimit: true,
 		SwapLimit:   false,
+		Warnings:    []string{"WARNING: No swap limit support"},
 		RegistryConfig: &ServiceConfig{
 			InsecureRegistryCIDRs: []*NetIPNet{
 				{
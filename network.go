@@ -29,6 +29,7 @@ type Network struct {
 	Options    map[string]string
 	Internal   bool
 	EnableIPv6 bool `json:"EnableIPv6"`
+	Attachable bool
 	Labels     map[string]string
 }
 
@@ -117,6 +118,7 @@ type CreateNetworkOptions struct {
 	CheckDuplicate bool                   `json:"CheckDuplicate" yaml:"CheckDuplicate" toml:"CheckDuplicate"`
 	Internal       bool                   `json:"Internal" yaml:"Internal" toml:"Internal"`
 	EnableIPv6     bool                   `json:"EnableIPv6" yaml:"EnableIPv6" toml:"EnableIPv6"`
+	Attachable     bool                   `json:"Attachable" yaml:"Attachable" toml:"Attachable"`
 	Context        context.Context        `json:"-"`
 }
 
@@ -152,6 +154,9 @@ func (c *Client) CreateNetwork(opts CreateNetworkOptions) (*Network, error) {
 		},
 	)
 	if err != nil {
+		if e, ok := err.(*Error); ok && e.Status == http.StatusConflict {
+			return nil, ErrNetworkAlreadyExists
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -271,6 +276,9 @@ func (c *Client) DisconnectNetwork(id string, opts NetworkConnectionOptions) err
 //
 // See https://goo.gl/kX0S9h for more details.
 type PruneNetworksOptions struct {
+	// Filters narrows down the networks to prune. Besides "label" and
+	// "until", the "label!" key can be used to preserve networks having the
+	// given label (e.g. {"label!": {"com.docker.compose.network"}}).
 	Filters map[string][]string
 	Context context.Context
 }
@@ -132,6 +132,15 @@ func TestNetworkCreate(t *testing.T) {
 	}
 }
 
+func TestNetworkCreateAlreadyExists(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(&FakeRoundTripper{message: "network with name foobar already exists", status: http.StatusConflict})
+	_, err := client.CreateNetwork(CreateNetworkOptions{Name: "foobar", CheckDuplicate: true})
+	if err != ErrNetworkAlreadyExists {
+		t.Errorf("CreateNetwork: wrong error. Want %#v. Got %#v.", ErrNetworkAlreadyExists, err)
+	}
+}
+
 func TestNetworkRemove(t *testing.T) {
 	t.Parallel()
 	id := "8dfafdbc3a40"
@@ -274,3 +283,20 @@ func TestPruneNetworks(t *testing.T) {
 		t.Errorf("PruneNetworks: Expected %#v. Got %#v.", expected, got)
 	}
 }
+
+func TestPruneNetworksNegatedLabelFilter(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: `{"NetworksDeleted":["a"]}`, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	_, err := client.PruneNetworks(PruneNetworksOptions{
+		Filters: map[string][]string{"label!": {"com.docker.compose.network"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := fakeRT.requests[0]
+	expected := `{"label!":["com.docker.compose.network"]}`
+	if got := req.URL.Query().Get("filters"); got != expected {
+		t.Errorf("PruneNetworks: Wrong filters. Want %q. Got %q.", expected, got)
+	}
+}
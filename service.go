@@ -7,10 +7,12 @@ package docker
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/swarm"
@@ -77,16 +79,44 @@ type RemoveServiceOptions struct {
 //
 // See https://goo.gl/Tqrtya for more details.
 func (c *Client) RemoveService(opts RemoveServiceOptions) error {
+	_, err := c.RemoveServiceWithResult(opts)
+	return err
+}
+
+// RemoveServiceResult holds the IDs of the configs and secrets that were
+// referenced by a removed service and are no longer referenced by any other
+// service. Only the fake server in the testing package reports them, so both
+// lists are empty when talking to a real daemon.
+type RemoveServiceResult struct {
+	UnreferencedConfigs []string
+	UnreferencedSecrets []string
+}
+
+// RemoveServiceWithResult removes a service, returning the configs and
+// secrets left unreferenced by the removal, or an error in case of failure.
+//
+// See https://goo.gl/Tqrtya for more details.
+func (c *Client) RemoveServiceWithResult(opts RemoveServiceOptions) (*RemoveServiceResult, error) {
 	path := "/services/" + opts.ID
 	resp, err := c.do("DELETE", path, doOptions{context: opts.Context})
 	if err != nil {
 		if e, ok := err.(*Error); ok && e.Status == http.StatusNotFound {
-			return &NoSuchService{ID: opts.ID}
+			return nil, &NoSuchService{ID: opts.ID}
 		}
-		return err
+		return nil, err
 	}
 	resp.Body.Close()
-	return nil
+	return &RemoveServiceResult{
+		UnreferencedConfigs: splitHeaderList(resp.Header.Get("X-Unreferenced-Configs")),
+		UnreferencedSecrets: splitHeaderList(resp.Header.Get("X-Unreferenced-Secrets")),
+	}, nil
+}
+
+func splitHeaderList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
 }
 
 // UpdateServiceOptions specify parameters to the UpdateService function.
@@ -97,6 +127,14 @@ type UpdateServiceOptions struct {
 	swarm.ServiceSpec
 	Context context.Context
 	Version uint64
+
+	// MergeSpec makes UpdateService inspect the service and apply only the
+	// fields set in ServiceSpec on top of its current spec, instead of
+	// replacing the whole spec. Fields holding zero values are considered
+	// unset, except that setting one of the replicated and global modes
+	// clears the other. When Version is zero, the current version of the
+	// service is used.
+	MergeSpec bool `qs:"-"`
 }
 
 // UpdateService updates the service at ID with the options
@@ -107,6 +145,19 @@ func (c *Client) UpdateService(id string, opts UpdateServiceOptions) error {
 	if err != nil {
 		return err
 	}
+	if opts.MergeSpec {
+		service, err := c.inspectService(id, doOptions{context: opts.Context})
+		if err != nil {
+			return err
+		}
+		opts.ServiceSpec, err = mergeServiceSpec(service.Spec, opts.ServiceSpec)
+		if err != nil {
+			return err
+		}
+		if opts.Version == 0 {
+			opts.Version = service.Version.Index
+		}
+	}
 	params := make(url.Values)
 	params.Set("version", strconv.FormatUint(opts.Version, 10))
 	resp, err := c.do("POST", "/services/"+id+"/update?"+params.Encode(), doOptions{
@@ -125,12 +176,101 @@ func (c *Client) UpdateService(id string, opts UpdateServiceOptions) error {
 	return nil
 }
 
+// mergeServiceSpec returns the current spec with the non-zero fields of the
+// given patch applied on top of it. Objects are merged recursively, while any
+// other value set in the patch replaces the current one. A service runs in a
+// single mode, so setting one mode in the patch drops the other.
+func mergeServiceSpec(current, patch swarm.ServiceSpec) (swarm.ServiceSpec, error) {
+	var base, changes map[string]interface{}
+	for _, item := range []struct {
+		spec swarm.ServiceSpec
+		dst  *map[string]interface{}
+	}{{current, &base}, {patch, &changes}} {
+		data, err := json.Marshal(item.spec)
+		if err != nil {
+			return swarm.ServiceSpec{}, err
+		}
+		if err := json.Unmarshal(data, item.dst); err != nil {
+			return swarm.ServiceSpec{}, err
+		}
+	}
+	mergeJSONObjects(base, changes)
+	data, err := json.Marshal(base)
+	if err != nil {
+		return swarm.ServiceSpec{}, err
+	}
+	var merged swarm.ServiceSpec
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return swarm.ServiceSpec{}, err
+	}
+	if patch.Mode.Replicated != nil && patch.Mode.Global == nil {
+		merged.Mode.Global = nil
+	}
+	if patch.Mode.Global != nil && patch.Mode.Replicated == nil {
+		merged.Mode.Replicated = nil
+	}
+	return merged, nil
+}
+
+func mergeJSONObjects(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			if v == "" {
+				continue
+			}
+		case float64:
+			if v == 0 {
+				continue
+			}
+		case bool:
+			if !v {
+				continue
+			}
+		case map[string]interface{}:
+			if current, ok := dst[key].(map[string]interface{}); ok {
+				mergeJSONObjects(current, v)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// UpdateServiceImage updates the image used by the service at ID, keeping the
+// rest of its spec untouched. It inspects the service for getting the current
+// spec and version before submitting the update.
+func (c *Client) UpdateServiceImage(id, image string) error {
+	service, err := c.InspectService(id)
+	if err != nil {
+		return err
+	}
+	spec := service.Spec
+	if spec.TaskTemplate.ContainerSpec == nil {
+		spec.TaskTemplate.ContainerSpec = &swarm.ContainerSpec{}
+	} else {
+		containerSpec := *spec.TaskTemplate.ContainerSpec
+		spec.TaskTemplate.ContainerSpec = &containerSpec
+	}
+	spec.TaskTemplate.ContainerSpec.Image = image
+	return c.UpdateService(service.ID, UpdateServiceOptions{
+		ServiceSpec: spec,
+		Version:     service.Version.Index,
+	})
+}
+
 // InspectService returns information about a service by its ID.
 //
 // See https://goo.gl/dHmr75 for more details.
 func (c *Client) InspectService(id string) (*swarm.Service, error) {
+	return c.inspectService(id, doOptions{})
+}
+
+func (c *Client) inspectService(id string, opts doOptions) (*swarm.Service, error) {
 	path := "/services/" + id
-	resp, err := c.do("GET", path, doOptions{})
+	resp, err := c.do("GET", path, opts)
 	if err != nil {
 		if e, ok := err.(*Error); ok && e.Status == http.StatusNotFound {
 			return nil, &NoSuchService{ID: id}
@@ -150,6 +290,9 @@ func (c *Client) InspectService(id string) (*swarm.Service, error) {
 // See https://goo.gl/DwvNMd for more details.
 type ListServicesOptions struct {
 	Filters map[string][]string
+	// Status makes the daemon include the number of running and desired
+	// tasks of each service in the ServiceStatus field.
+	Status  bool
 	Context context.Context
 }
 
@@ -170,6 +313,43 @@ func (c *Client) ListServices(opts ListServicesOptions) ([]swarm.Service, error)
 	return services, nil
 }
 
+// ListServicesStream lists the services matching the given criteria, like
+// ListServices, but decodes the response incrementally, calling fn for each
+// service instead of keeping the whole list in memory. Listing stops at the
+// first error returned by fn, which is then returned.
+//
+// See https://goo.gl/DwvNMd for more details.
+func (c *Client) ListServicesStream(opts ListServicesOptions, fn func(*swarm.Service) error) error {
+	path := "/services?" + queryString(opts)
+	resp, err := c.do("GET", path, doOptions{context: opts.Context})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("unexpected token in the list of services: %v", token)
+	}
+	for decoder.More() {
+		var service swarm.Service
+		if err := decoder.Decode(&service); err != nil {
+			return err
+		}
+		if err := fn(&service); err != nil {
+			return err
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
 // LogsServiceOptions represents the set of options used when getting logs from a
 // service.
 type LogsServiceOptions struct {
@@ -183,6 +363,7 @@ type LogsServiceOptions struct {
 	// Use raw terminal? Usually true when the container contains a TTY.
 	RawTerminal bool `qs:"-"`
 	Since       int64
+	Until       int64
 	Follow      bool
 	Stdout      bool
 	Stderr      bool
@@ -6,7 +6,9 @@ package docker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -149,6 +151,64 @@ func TestRemoveServiceNotFound(t *testing.T) {
 	}
 }
 
+func TestRemoveServiceWithResult(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		configs  string
+		secrets  string
+		expected RemoveServiceResult
+	}{
+		{"", "", RemoveServiceResult{}},
+		{"cfg1", "", RemoveServiceResult{UnreferencedConfigs: []string{"cfg1"}}},
+		{"cfg1,cfg2", "sec1", RemoveServiceResult{
+			UnreferencedConfigs: []string{"cfg1", "cfg2"},
+			UnreferencedSecrets: []string{"sec1"},
+		}},
+	}
+	for _, tt := range tests {
+		var gotMethod, gotPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotMethod, gotPath = r.Method, r.URL.Path
+			if tt.configs != "" {
+				w.Header().Set("X-Unreferenced-Configs", tt.configs)
+			}
+			if tt.secrets != "" {
+				w.Header().Set("X-Unreferenced-Secrets", tt.secrets)
+			}
+		}))
+		client, err := NewClient(server.URL)
+		if err != nil {
+			server.Close()
+			t.Fatal(err)
+		}
+		client.SkipServerVersionCheck = true
+		result, err := client.RemoveServiceWithResult(RemoveServiceOptions{ID: "svc"})
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotMethod != "DELETE" || gotPath != "/services/svc" {
+			t.Errorf("RemoveServiceWithResult: wrong request. Want DELETE /services/svc. Got %s %s.", gotMethod, gotPath)
+		}
+		if !reflect.DeepEqual(*result, tt.expected) {
+			t.Errorf("RemoveServiceWithResult: wrong result. Want %#v. Got %#v.", tt.expected, *result)
+		}
+	}
+}
+
+func TestRemoveServiceWithResultNotFound(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(&FakeRoundTripper{message: "no such service", status: http.StatusNotFound})
+	result, err := client.RemoveServiceWithResult(RemoveServiceOptions{ID: "a2334"})
+	expected := &NoSuchService{ID: "a2334"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("RemoveServiceWithResult: Wrong error returned. Want %#v. Got %#v.", expected, err)
+	}
+	if result != nil {
+		t.Errorf("RemoveServiceWithResult: unexpected result %#v.", result)
+	}
+}
+
 func TestUpdateService(t *testing.T) {
 	t.Parallel()
 	fakeRT := &FakeRoundTripper{message: "", status: http.StatusOK}
@@ -241,6 +301,192 @@ func TestUpdateServiceNotFound(t *testing.T) {
 	}
 }
 
+func TestUpdateServiceImage(t *testing.T) {
+	t.Parallel()
+	jsonService := `{
+  "ID": "ak7w3gjqoa3kuz8xcpnyy0pvl",
+  "Version": {"Index": 95},
+  "Spec": {
+    "Name": "redis",
+    "TaskTemplate": {
+      "ContainerSpec": {
+        "Image": "redis:3.0.6",
+        "Args": ["--appendonly", "yes"]
+      }
+    }
+  }
+}`
+	fakeRT := &FakeRoundTripper{message: jsonService, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	err := client.UpdateServiceImage("redis", "redis:3.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeRT.requests) != 2 {
+		t.Fatalf("UpdateServiceImage: wrong number of requests. Want 2. Got %d.", len(fakeRT.requests))
+	}
+	req := fakeRT.requests[1]
+	if req.Method != "POST" {
+		t.Errorf("UpdateServiceImage: wrong HTTP method. Want %q. Got %q.", "POST", req.Method)
+	}
+	expectedURL, _ := url.Parse(client.getURL("/services/ak7w3gjqoa3kuz8xcpnyy0pvl/update?version=95"))
+	if gotURI := req.URL.RequestURI(); gotURI != expectedURL.RequestURI() {
+		t.Errorf("UpdateServiceImage: Wrong path in request. Want %q. Got %q.", expectedURL.RequestURI(), gotURI)
+	}
+	var spec swarm.ServiceSpec
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	expected := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "redis"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image: "redis:3.2",
+				Args:  []string{"--appendonly", "yes"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Errorf("UpdateServiceImage: wrong spec\ngot  %#v\nwant %#v", spec, expected)
+	}
+}
+
+func TestUpdateServiceMergeSpec(t *testing.T) {
+	t.Parallel()
+	jsonService := `{
+  "ID": "ak7w3gjqoa3kuz8xcpnyy0pvl",
+  "Version": {"Index": 95},
+  "Spec": {
+    "Name": "redis",
+    "Labels": {"app": "cache"},
+    "TaskTemplate": {
+      "ContainerSpec": {
+        "Image": "redis:3.0.6",
+        "Args": ["--appendonly", "yes"],
+        "Env": ["DEBUG=1"]
+      }
+    },
+    "Mode": {"Replicated": {"Replicas": 2}}
+  }
+}`
+	fakeRT := &FakeRoundTripper{message: jsonService, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	err := client.UpdateService("redis", UpdateServiceOptions{
+		ServiceSpec: swarm.ServiceSpec{
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{
+					Args: []string{"--maxmemory", "1gb"},
+				},
+			},
+		},
+		MergeSpec: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeRT.requests) != 2 {
+		t.Fatalf("UpdateService: wrong number of requests. Want 2. Got %d.", len(fakeRT.requests))
+	}
+	req := fakeRT.requests[1]
+	expectedURL, _ := url.Parse(client.getURL("/services/redis/update?version=95"))
+	if gotURI := req.URL.RequestURI(); gotURI != expectedURL.RequestURI() {
+		t.Errorf("UpdateService: Wrong path in request. Want %q. Got %q.", expectedURL.RequestURI(), gotURI)
+	}
+	var spec swarm.ServiceSpec
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	replicas := uint64(2)
+	expected := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "redis", Labels: map[string]string{"app": "cache"}},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image: "redis:3.0.6",
+				Args:  []string{"--maxmemory", "1gb"},
+				Env:   []string{"DEBUG=1"},
+			},
+		},
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Errorf("UpdateService: wrong spec\ngot  %#v\nwant %#v", spec, expected)
+	}
+}
+
+func TestUpdateServiceMergeSpecMode(t *testing.T) {
+	t.Parallel()
+	replicas := uint64(3)
+	var tests = []struct {
+		current  string
+		patch    swarm.ServiceMode
+		expected swarm.ServiceMode
+	}{
+		{
+			`{"Replicated": {"Replicas": 2}}`,
+			swarm.ServiceMode{Global: &swarm.GlobalService{}},
+			swarm.ServiceMode{Global: &swarm.GlobalService{}},
+		},
+		{
+			`{"Global": {}}`,
+			swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+			swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		},
+	}
+	for _, tt := range tests {
+		jsonService := `{"ID": "redis", "Version": {"Index": 95}, "Spec": {"Name": "redis", "Mode": ` + tt.current + `}}`
+		fakeRT := &FakeRoundTripper{message: jsonService, status: http.StatusOK}
+		client := newTestClient(fakeRT)
+		err := client.UpdateService("redis", UpdateServiceOptions{
+			ServiceSpec: swarm.ServiceSpec{Mode: tt.patch},
+			MergeSpec:   true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spec swarm.ServiceSpec
+		if err := json.NewDecoder(fakeRT.requests[1].Body).Decode(&spec); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(spec.Mode, tt.expected) {
+			t.Errorf("UpdateService: wrong mode merging %s\ngot  %#v\nwant %#v", tt.current, spec.Mode, tt.expected)
+		}
+	}
+}
+
+func TestUpdateServiceMergeSpecContext(t *testing.T) {
+	t.Parallel()
+	type contextKey string
+	key := contextKey("update")
+	ctx := context.WithValue(context.Background(), key, "merge")
+	fakeRT := &FakeRoundTripper{message: `{"ID": "redis", "Spec": {"Name": "redis"}}`, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	err := client.UpdateService("redis", UpdateServiceOptions{
+		Context:   ctx,
+		MergeSpec: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fakeRT.requests) != 2 {
+		t.Fatalf("UpdateService: wrong number of requests. Want 2. Got %d.", len(fakeRT.requests))
+	}
+	for _, req := range fakeRT.requests {
+		if value := req.Context().Value(key); value != "merge" {
+			t.Errorf("UpdateService: %s %s did not use the given context", req.Method, req.URL.Path)
+		}
+	}
+}
+
+func TestUpdateServiceImageNotFound(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(&FakeRoundTripper{message: "no such service", status: http.StatusNotFound})
+	err := client.UpdateServiceImage("notfound", "redis:3.2")
+	expected := &NoSuchService{ID: "notfound"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("UpdateServiceImage: Wrong error returned. Want %#v. Got %#v.", expected, err)
+	}
+}
+
 func TestInspectServiceNotFound(t *testing.T) {
 	t.Parallel()
 	client := newTestClient(&FakeRoundTripper{message: "no such service", status: http.StatusNotFound})
@@ -416,6 +662,84 @@ func TestListServices(t *testing.T) {
 	}
 }
 
+func TestListServicesWithStatus(t *testing.T) {
+	t.Parallel()
+	jsonServices := `[{"ID": "9mnpnzenvg8p8tdbtq4wvbkcz", "ServiceStatus": {"RunningTasks": 1, "DesiredTasks": 2}}]`
+	fakeRT := &FakeRoundTripper{message: jsonServices, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	services, err := client.ListServices(ListServicesOptions{Status: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fakeRT.requests[0].URL.Query().Get("status"); got != "1" {
+		t.Errorf("ListServices: wrong status parameter. Want %q. Got %q.", "1", got)
+	}
+	expected := &swarm.ServiceStatus{RunningTasks: 1, DesiredTasks: 2}
+	if len(services) != 1 || !reflect.DeepEqual(services[0].ServiceStatus, expected) {
+		t.Errorf("ListServices: wrong service status. Want %#v. Got %#v.", expected, services)
+	}
+}
+
+func TestListServicesStream(t *testing.T) {
+	t.Parallel()
+	jsonServices := `[{"ID": "a123", "Spec": {"Name": "web"}}, {"ID": "b123", "Spec": {"Name": "db"}}, {"ID": "c123", "Spec": {"Name": "cache"}}]`
+	fakeRT := &FakeRoundTripper{message: jsonServices, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	var names []string
+	err := client.ListServicesStream(ListServicesOptions{Filters: map[string][]string{"label": {"app"}}}, func(service *swarm.Service) error {
+		names = append(names, service.Spec.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"web", "db", "cache"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("ListServicesStream: wrong services. Want %#v. Got %#v.", expected, names)
+	}
+	if got := fakeRT.requests[0].URL.Query().Get("filters"); got != `{"label":["app"]}` {
+		t.Errorf("ListServicesStream: wrong filters. Got %q.", got)
+	}
+	errStop := errors.New("stop")
+	var calls int
+	err = client.ListServicesStream(ListServicesOptions{}, func(service *swarm.Service) error {
+		calls++
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("ListServicesStream: wrong error. Want %v. Got %v.", errStop, err)
+	}
+	if calls != 1 {
+		t.Errorf("ListServicesStream: wrong number of calls after error. Want 1. Got %d.", calls)
+	}
+}
+
+func TestListServicesStreamInvalidResponse(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		body string
+		err  bool
+	}{
+		{"null", false},
+		{"[]", false},
+		{`{"ID": "a123"}`, true},
+		{`[{"ID": "a123"},`, true},
+	}
+	for _, tt := range tests {
+		client := newTestClient(&FakeRoundTripper{message: tt.body, status: http.StatusOK})
+		var calls int
+		err := client.ListServicesStream(ListServicesOptions{}, func(*swarm.Service) error {
+			calls++
+			return nil
+		})
+		if (err != nil) != tt.err {
+			t.Errorf("ListServicesStream(%s): unexpected error result: %v", tt.body, err)
+		}
+		if tt.body == "null" && calls != 0 {
+			t.Errorf("ListServicesStream(%s): unexpected calls: %d", tt.body, calls)
+		}
+	}
+}
+
 /// ##################################################""
 
 func TestGetServiceLogs(t *testing.T) {
@@ -559,6 +883,38 @@ func TestGetServiceLogsSpecifyingTail(t *testing.T) {
 	}
 }
 
+func TestGetServiceLogsSpecifyingSinceAndUntil(t *testing.T) {
+	var req http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = *r
+	}))
+	defer server.Close()
+	client, _ := NewClient(server.URL)
+	client.SkipServerVersionCheck = true
+	opts := LogsServiceOptions{
+		Service:      "a123456",
+		OutputStream: &bytes.Buffer{},
+		Stdout:       true,
+		Since:        1500000000,
+		Until:        1500000060,
+		Tail:         "10",
+	}
+	err := client.GetServiceLogs(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedQs := map[string][]string{
+		"stdout": {"1"},
+		"since":  {"1500000000"},
+		"until":  {"1500000060"},
+		"tail":   {"10"},
+	}
+	got := map[string][]string(req.URL.Query())
+	if !reflect.DeepEqual(got, expectedQs) {
+		t.Errorf("Logs: wrong query string. Want %#v. Got %#v.", expectedQs, got)
+	}
+}
+
 func TestGetServiceLogsRawTerminal(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("something happened!"))
@@ -154,3 +154,25 @@ func (c *Client) InspectSwarm(ctx context.Context) (swarm.Swarm, error) {
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	return response, err
 }
+
+// GetSwarmUnlockKey returns the key used for unlocking the swarm managers,
+// which is empty when autolock is disabled.
+func (c *Client) GetSwarmUnlockKey(ctx context.Context) (string, error) {
+	resp, err := c.do("GET", "/swarm/unlockkey", doOptions{
+		context: ctx,
+	})
+	if err != nil {
+		if e, ok := err.(*Error); ok && (e.Status == http.StatusNotAcceptable || e.Status == http.StatusServiceUnavailable) {
+			return "", ErrNodeNotInSwarm
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		UnlockKey string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	return response.UnlockKey, nil
+}
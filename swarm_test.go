@@ -208,3 +208,33 @@ func TestInspectSwarmNotInSwarm(t *testing.T) {
 		t.Errorf("InspectSwarm: Wrong error type. Want %#v. Got %#v", ErrNodeNotInSwarm, err)
 	}
 }
+
+func TestGetSwarmUnlockKey(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: `{"UnlockKey":"SWMKEY-1-abc"}`, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	key, err := client.GetSwarmUnlockKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "SWMKEY-1-abc" {
+		t.Errorf("GetSwarmUnlockKey: wrong key. Want %q. Got %q.", "SWMKEY-1-abc", key)
+	}
+	req := fakeRT.requests[0]
+	if req.Method != "GET" {
+		t.Errorf("GetSwarmUnlockKey: Wrong HTTP method. Want GET. Got %s.", req.Method)
+	}
+	u, _ := url.Parse(client.getURL("/swarm/unlockkey"))
+	if req.URL.Path != u.Path {
+		t.Errorf("GetSwarmUnlockKey: Wrong request path. Want %q. Got %q.", u.Path, req.URL.Path)
+	}
+}
+
+func TestGetSwarmUnlockKeyNotInSwarm(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(&FakeRoundTripper{message: "", status: http.StatusServiceUnavailable})
+	_, err := client.GetSwarmUnlockKey(nil)
+	if err != ErrNodeNotInSwarm {
+		t.Errorf("GetSwarmUnlockKey: Wrong error type. Want %#v. Got %#v", ErrNodeNotInSwarm, err)
+	}
+}
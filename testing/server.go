@@ -8,6 +8,9 @@ package testing
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -21,19 +24,51 @@ import (
 	"net/http"
 	libpath "path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gorilla/mux"
 )
 
 var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
 
+// validFilters maps each listing endpoint to the filter keys accepted by the
+// Docker daemon. Any other key is rejected with a 400, as the daemon does.
+var validFilters = map[string][]string{
+	"containers":       {"ancestor", "before", "expose", "exited", "health", "id", "isolation", "is-task", "label", "name", "network", "publish", "since", "status", "volume"},
+	"events":           {"config", "container", "daemon", "event", "image", "label", "network", "node", "plugin", "scope", "secret", "service", "type", "volume"},
+	"images":           {"before", "dangling", "label", "reference", "since"},
+	"networks":         {"dangling", "driver", "id", "label", "name", "scope", "type"},
+	"containers/prune": {"label", "label!", "until"},
+	"networks/prune":   {"label", "label!", "until"},
+	"nodes":            {"id", "label", "membership", "name", "node.label", "role"},
+	"services":         {"id", "label", "mode", "name"},
+	"tasks":            {"desired-state", "id", "label", "name", "node", "service"},
+	"volumes":          {"dangling", "driver", "label", "name"},
+}
+
+// endpointVersions lists the API version in which each endpoint was
+// introduced, for emulating older daemons (see SetMinAPIVersion). The first
+// matching entry wins.
+var endpointVersions = []struct {
+	path    *regexp.Regexp
+	version docker.APIVersion
+}{
+	{regexp.MustCompile(`^/services/[^/]+/logs$`), docker.APIVersion{1, 29}},
+	{regexp.MustCompile(`^/(containers|networks)/prune$`), docker.APIVersion{1, 25}},
+	{regexp.MustCompile(`^/(swarm|nodes|services|tasks)(/|$)`), docker.APIVersion{1, 24}},
+}
+
+var versionPrefixRegexp = regexp.MustCompile(`^/v([0-9]+\.[0-9]+)(/.*)$`)
+
 // DockerServer represents a programmable, concurrent (not much), HTTP server
 // implementing a fake version of the Docker remote API.
 //
@@ -43,14 +78,35 @@ var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
 // For more details on the remote API, check http://goo.gl/G3plxW.
 type DockerServer struct {
 	containers     []*docker.Container
-	uploadedFiles  map[string]string
+	store          ContainerStore
+	imageStore     ImageStore
+	volumeStore    VolumeStore
+	containerIndex containerIndex
+	uploadedFiles  map[string]map[string]containerFile
+	logs           map[string][]ContainerLogEntry
+	logsRotated    map[string]int
+	stdin          map[string][]byte
+	stdinClosed    map[string]bool
+	statsSamples   map[string]uint64
+	pidsStats      map[string]pidsStats
+	createWarnings []string
+	appArmor       string
+	infoWarnings   []string
+	versionFields  map[string]string
 	execs          []*docker.ExecInspect
 	execMut        sync.RWMutex
 	cMut           sync.RWMutex
 	images         []docker.Image
 	iMut           sync.RWMutex
 	imgIDs         map[string]string
+	removedImages  map[string]bool
+	imgPlatforms   map[string][]string
+	imgHistory     map[string][]docker.ImageHistory
+	imgContainers  bool
+	lastBuild      *BuildSettings
+	buildError     *jsonmessage.JSONError
 	networks       []*docker.Network
+	netCreated     map[string]time.Time
 	netMut         sync.RWMutex
 	listener       net.Listener
 	mux            *mux.Router
@@ -61,18 +117,70 @@ type DockerServer struct {
 	statsCallbacks map[string]func(string) docker.Stats
 	customHandlers map[string]http.Handler
 	handlerMutex   sync.RWMutex
+	maxRequests    int
+	inFlight       int
+	requestMut     sync.Mutex
+	clock          func() time.Time
+	clockMut       sync.RWMutex
+	apiVersion     docker.APIVersion
+	starting       bool
+	pingLatency    time.Duration
+	headers        http.Header
+	encoding       string
+	headerMut      sync.RWMutex
+	events         []docker.APIEvents
+	eventSubs      map[chan docker.APIEvents]struct{}
+	eventMut       sync.RWMutex
 	cChan          chan<- *docker.Container
 	volStore       map[string]*volumeCounter
+	volUsage       map[string]docker.VolumeUsageData
 	volMut         sync.RWMutex
 	swarmMut       sync.RWMutex
 	swarm          *swarm.Swarm
+	unlockKey      string
 	swarmServer    *swarmServer
 	nodes          []swarm.Node
 	nodeID         string
 	tasks          []*swarm.Task
+	shutdownTimers map[string]*time.Timer
 	services       []*swarm.Service
+	secrets        []swarm.Secret
+	configs        []swarm.Config
 	nodeRR         int
 	servicePorts   int
+	svcWarnings    []string
+}
+
+// containerFile is a file stored in a container or image, either uploaded
+// through the archive endpoint or materialized by the server, like a swarm
+// secret or config.
+type containerFile struct {
+	mode    int64
+	content []byte
+}
+
+// copyFiles returns a copy of the given set of files, keyed by path.
+func copyFiles(files map[string]containerFile) map[string]containerFile {
+	result := make(map[string]containerFile, len(files))
+	for path, file := range files {
+		result[path] = file
+	}
+	return result
+}
+
+// pidsStats is the number of processes of a container, reported in its stats
+// along with the maximum number of processes allowed.
+type pidsStats struct {
+	current uint64
+	limit   uint64
+}
+
+// ContainerLogEntry is a line of output produced by a container in the fake
+// server.
+type ContainerLogEntry struct {
+	Time   time.Time
+	Stderr bool
+	Line   string
 }
 
 type volumeCounter struct {
@@ -89,7 +197,7 @@ func buildDockerServer(listener net.Listener, containerChan chan<- *docker.Conta
 		execCallbacks:  make(map[string]func()),
 		statsCallbacks: make(map[string]func(string) docker.Stats),
 		customHandlers: make(map[string]http.Handler),
-		uploadedFiles:  make(map[string]string),
+		uploadedFiles:  make(map[string]map[string]containerFile),
 		cChan:          containerChan,
 	}
 	server.buildMuxer()
@@ -161,13 +269,16 @@ func (s *DockerServer) buildMuxer() {
 	s.mux = mux.NewRouter()
 	s.mux.Path("/commit").Methods("POST").HandlerFunc(s.handlerWrapper(s.commitContainer))
 	s.mux.Path("/containers/json").Methods("GET").HandlerFunc(s.handlerWrapper(s.listContainers))
+	s.mux.Path("/containers/prune").Methods("POST").HandlerFunc(s.handlerWrapper(s.pruneContainers))
 	s.mux.Path("/containers/create").Methods("POST").HandlerFunc(s.handlerWrapper(s.createContainer))
 	s.mux.Path("/containers/{id:.*}/json").Methods("GET").HandlerFunc(s.handlerWrapper(s.inspectContainer))
 	s.mux.Path("/containers/{id:.*}/rename").Methods("POST").HandlerFunc(s.handlerWrapper(s.renameContainer))
+	s.mux.Path("/containers/{id:.*}/update").Methods("POST").HandlerFunc(s.handlerWrapper(s.updateContainer))
 	s.mux.Path("/containers/{id:.*}/top").Methods("GET").HandlerFunc(s.handlerWrapper(s.topContainer))
 	s.mux.Path("/containers/{id:.*}/start").Methods("POST").HandlerFunc(s.handlerWrapper(s.startContainer))
-	s.mux.Path("/containers/{id:.*}/kill").Methods("POST").HandlerFunc(s.handlerWrapper(s.stopContainer))
+	s.mux.Path("/containers/{id:.*}/kill").Methods("POST").HandlerFunc(s.handlerWrapper(s.killContainer))
 	s.mux.Path("/containers/{id:.*}/stop").Methods("POST").HandlerFunc(s.handlerWrapper(s.stopContainer))
+	s.mux.Path("/containers/{id:.*}/restart").Methods("POST").HandlerFunc(s.handlerWrapper(s.restartContainer))
 	s.mux.Path("/containers/{id:.*}/pause").Methods("POST").HandlerFunc(s.handlerWrapper(s.pauseContainer))
 	s.mux.Path("/containers/{id:.*}/unpause").Methods("POST").HandlerFunc(s.handlerWrapper(s.unpauseContainer))
 	s.mux.Path("/containers/{id:.*}/wait").Methods("POST").HandlerFunc(s.handlerWrapper(s.waitContainer))
@@ -186,16 +297,20 @@ func (s *DockerServer) buildMuxer() {
 	s.mux.Path("/images/json").Methods("GET").HandlerFunc(s.handlerWrapper(s.listImages))
 	s.mux.Path("/images/{id:.*}").Methods("DELETE").HandlerFunc(s.handlerWrapper(s.removeImage))
 	s.mux.Path("/images/{name:.*}/json").Methods("GET").HandlerFunc(s.handlerWrapper(s.inspectImage))
+	s.mux.Path("/images/{name:.*}/history").Methods("GET").HandlerFunc(s.handlerWrapper(s.imageHistory))
 	s.mux.Path("/images/{name:.*}/push").Methods("POST").HandlerFunc(s.handlerWrapper(s.pushImage))
 	s.mux.Path("/images/{name:.*}/tag").Methods("POST").HandlerFunc(s.handlerWrapper(s.tagImage))
 	s.mux.Path("/events").Methods("GET").HandlerFunc(s.listEvents)
 	s.mux.Path("/_ping").Methods("GET").HandlerFunc(s.handlerWrapper(s.pingDocker))
 	s.mux.Path("/images/load").Methods("POST").HandlerFunc(s.handlerWrapper(s.loadImage))
+	s.mux.Path("/images/get").Methods("GET").HandlerFunc(s.handlerWrapper(s.getImage))
 	s.mux.Path("/images/{id:.*}/get").Methods("GET").HandlerFunc(s.handlerWrapper(s.getImage))
 	s.mux.Path("/networks").Methods("GET").HandlerFunc(s.handlerWrapper(s.listNetworks))
 	s.mux.Path("/networks/{id:.*}").Methods("GET").HandlerFunc(s.handlerWrapper(s.networkInfo))
 	s.mux.Path("/networks/{id:.*}").Methods("DELETE").HandlerFunc(s.handlerWrapper(s.removeNetwork))
 	s.mux.Path("/networks/create").Methods("POST").HandlerFunc(s.handlerWrapper(s.createNetwork))
+	s.mux.Path("/networks/{id:.+}/connect").Methods("POST").HandlerFunc(s.handlerWrapper(s.connectNetwork))
+	s.mux.Path("/networks/prune").Methods("POST").HandlerFunc(s.handlerWrapper(s.pruneNetworks))
 	s.mux.Path("/volumes").Methods("GET").HandlerFunc(s.handlerWrapper(s.listVolumes))
 	s.mux.Path("/volumes/create").Methods("POST").HandlerFunc(s.handlerWrapper(s.createVolume))
 	s.mux.Path("/volumes/{name:.*}").Methods("GET").HandlerFunc(s.handlerWrapper(s.inspectVolume))
@@ -204,6 +319,7 @@ func (s *DockerServer) buildMuxer() {
 	s.mux.Path("/version").Methods("GET").HandlerFunc(s.handlerWrapper(s.versionDocker))
 	s.mux.Path("/swarm/init").Methods("POST").HandlerFunc(s.handlerWrapper(s.swarmInit))
 	s.mux.Path("/swarm").Methods("GET").HandlerFunc(s.handlerWrapper(s.swarmInspect))
+	s.mux.Path("/swarm/unlockkey").Methods("GET").HandlerFunc(s.handlerWrapper(s.swarmUnlockKey))
 	s.mux.Path("/swarm/join").Methods("POST").HandlerFunc(s.handlerWrapper(s.swarmJoin))
 	s.mux.Path("/swarm/leave").Methods("POST").HandlerFunc(s.handlerWrapper(s.swarmLeave))
 	s.mux.Path("/nodes/{id:.+}/update").Methods("POST").HandlerFunc(s.handlerWrapper(s.nodeUpdate))
@@ -211,6 +327,7 @@ func (s *DockerServer) buildMuxer() {
 	s.mux.Path("/nodes/{id:.+}").Methods("DELETE").HandlerFunc(s.handlerWrapper(s.nodeDelete))
 	s.mux.Path("/nodes").Methods("GET").HandlerFunc(s.handlerWrapper(s.nodeList))
 	s.mux.Path("/services/create").Methods("POST").HandlerFunc(s.handlerWrapper(s.serviceCreate))
+	s.mux.Path("/services/{id:.+}/logs").Methods("GET").HandlerFunc(s.handlerWrapper(s.serviceLogs))
 	s.mux.Path("/services/{id:.+}").Methods("GET").HandlerFunc(s.handlerWrapper(s.serviceInspect))
 	s.mux.Path("/services").Methods("GET").HandlerFunc(s.handlerWrapper(s.serviceList))
 	s.mux.Path("/services/{id:.+}").Methods("DELETE").HandlerFunc(s.handlerWrapper(s.serviceDelete))
@@ -219,6 +336,81 @@ func (s *DockerServer) buildMuxer() {
 	s.mux.Path("/tasks/{id:.+}").Methods("GET").HandlerFunc(s.handlerWrapper(s.taskInspect))
 }
 
+// SetMinAPIVersion makes the server behave like a daemon that speaks the given
+// version of the API: endpoints introduced in later versions respond with 404,
+// requests for newer versions are rejected with 400 and the /version endpoint
+// reports it. An empty or invalid version restores the default behavior.
+func (s *DockerServer) SetMinAPIVersion(v string) {
+	version, _ := docker.NewAPIVersion(v)
+	s.handlerMutex.Lock()
+	s.apiVersion = version
+	s.handlerMutex.Unlock()
+}
+
+// SetDaemonStarting makes the /_ping endpoint respond as a daemon that is still
+// starting up, with a 503 "System not ready" error.
+func (s *DockerServer) SetDaemonStarting(starting bool) {
+	s.handlerMutex.Lock()
+	s.starting = starting
+	s.handlerMutex.Unlock()
+}
+
+// SetPingLatency makes the /_ping endpoint wait for the given duration
+// before responding. The wait is interrupted when the client cancels the
+// request, in which case no response is sent.
+func (s *DockerServer) SetPingLatency(latency time.Duration) {
+	s.handlerMutex.Lock()
+	s.pingLatency = latency
+	s.handlerMutex.Unlock()
+}
+
+// SetMaxConcurrentRequests limits the number of requests handled by the
+// server at the same time. Once the limit is reached, the server responds to
+// new requests with a 503 "server too busy" error, until some of the requests
+// in flight finish. Use a value lower than 1 for disabling the limit.
+func (s *DockerServer) SetMaxConcurrentRequests(n int) {
+	s.requestMut.Lock()
+	s.maxRequests = n
+	s.requestMut.Unlock()
+}
+
+// acquireRequest reports whether there's room for handling another request,
+// counting it as in flight in that case.
+func (s *DockerServer) acquireRequest() bool {
+	s.requestMut.Lock()
+	defer s.requestMut.Unlock()
+	if s.maxRequests > 0 && s.inFlight >= s.maxRequests {
+		return false
+	}
+	s.inFlight++
+	return true
+}
+
+func (s *DockerServer) releaseRequest() {
+	s.requestMut.Lock()
+	s.inFlight--
+	s.requestMut.Unlock()
+}
+
+// SetClock changes the function used by the server for getting the current
+// time, used for the creation time of containers and for resolving durations
+// in the until filter of the prune endpoints. Use nil for restoring the system
+// clock.
+func (s *DockerServer) SetClock(clock func() time.Time) {
+	s.clockMut.Lock()
+	s.clock = clock
+	s.clockMut.Unlock()
+}
+
+func (s *DockerServer) now() time.Time {
+	s.clockMut.RLock()
+	defer s.clockMut.RUnlock()
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
 // SetHook changes the hook function used by the server.
 //
 // The hook function is a function called on every request.
@@ -246,6 +438,10 @@ func (s *DockerServer) SetHook(hook func(*http.Request)) {
 //    server.PrepareExec(exec.ID, func() {time.Sleep(2 * time.Second)})
 //    err = client.StartExec(exec.ID, docker.StartExecOptions{Tty: true}) // will block for 2 seconds
 //    // handle error
+//
+// When the exec is not started in detached mode, the hijacked connection is
+// kept open while the function runs, so the CloseWaiter returned by
+// StartExecWithHandle can be used for managing the interactive session.
 func (s *DockerServer) PrepareExec(id string, callback func()) {
 	s.execCallbacks[id] = callback
 }
@@ -259,6 +455,24 @@ func (s *DockerServer) PrepareStats(id string, callback func(string) docker.Stat
 	s.statsCallbacks[id] = callback
 }
 
+// SetContainerPidsStats sets the number of processes running in the container
+// and its limit, reported in the stats of containers with no stats callback.
+// By default, running containers report a single process and the limit comes
+// from the PidsLimit of the container.
+func (s *DockerServer) SetContainerPidsStats(id string, current, limit uint64) error {
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	container, err := s.getContainer(id)
+	if err != nil {
+		return err
+	}
+	if s.pidsStats == nil {
+		s.pidsStats = make(map[string]pidsStats)
+	}
+	s.pidsStats[container.ID] = pidsStats{current: current, limit: limit}
+	return nil
+}
+
 // PrepareFailure adds a new expected failure based on a URL regexp it receives
 // an id for the failure.
 func (s *DockerServer) PrepareFailure(id string, urlRegexp string) {
@@ -294,28 +508,381 @@ func (s *DockerServer) CustomHandler(path string, handler http.Handler) {
 	s.handlerMutex.Unlock()
 }
 
+// SetResponseHeader sets a header that will be included in every response sent
+// by the server. Using an empty value removes the header.
+func (s *DockerServer) SetResponseHeader(key, value string) {
+	s.headerMut.Lock()
+	defer s.headerMut.Unlock()
+	if s.headers == nil {
+		s.headers = make(http.Header)
+	}
+	if value == "" {
+		s.headers.Del(key)
+		return
+	}
+	s.headers.Set(key, value)
+}
+
+// SetResponseEncoding makes the server compress every response using the
+// given encoding, like a compressing proxy in front of the daemon would do.
+// The only supported encoding is "gzip", and an empty value disables the
+// compression.
+func (s *DockerServer) SetResponseEncoding(encoding string) {
+	s.headerMut.Lock()
+	defer s.headerMut.Unlock()
+	s.encoding = encoding
+}
+
+func (s *DockerServer) responseEncoding() string {
+	s.headerMut.RLock()
+	defer s.headerMut.RUnlock()
+	return s.encoding
+}
+
+func (s *DockerServer) writeResponseHeaders(w http.ResponseWriter) {
+	s.headerMut.RLock()
+	defer s.headerMut.RUnlock()
+	for key, values := range s.headers {
+		w.Header()[key] = values
+	}
+}
+
 // MutateContainer changes the state of a container, returning an error if the
 // given id does not match to any container "running" in the server.
+//
+// A running container that exits through this function is restarted
+// according to its restart policy, as the daemon would do.
 func (s *DockerServer) MutateContainer(id string, state docker.State) error {
 	s.cMut.Lock()
 	defer s.cMut.Unlock()
-	for _, container := range s.containers {
+	for _, container := range s.allContainers() {
 		if container.ID == id {
+			wasRunning := container.State.Running
 			container.State = state
+			if wasRunning && !state.Running && shouldRestart(container) {
+				container.State.Running = true
+				container.State.StartedAt = time.Now()
+				container.RestartCount++
+			}
 			return nil
 		}
 	}
 	return errors.New("container not found")
 }
 
-// Stop stops the server.
+// SetContainerHealth sets the health status of the container, returning an
+// error if there's no such container. Changing the status emits a
+// "health_status: <status>" event, as the daemon does.
+func (s *DockerServer) SetContainerHealth(id string, status string) error {
+	s.cMut.Lock()
+	container, err := s.findContainerWithLock(id, false)
+	if err != nil {
+		s.cMut.Unlock()
+		return err
+	}
+	changed := container.State.Health.Status != status
+	container.State.Health.Status = status
+	event := containerEvent(container, "health_status: "+status)
+	s.cMut.Unlock()
+	if changed {
+		s.emitEvent(event)
+	}
+	return nil
+}
+
+// SetContainerGraphDriver sets the storage driver information returned when
+// inspecting the given container, returning an error if there's no such
+// container.
+func (s *DockerServer) SetContainerGraphDriver(id string, driver docker.GraphDriver) error {
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	container, err := s.findContainerWithLock(id, false)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]string, len(driver.Data))
+	for key, value := range driver.Data {
+		data[key] = value
+	}
+	container.GraphDriver = &docker.GraphDriver{Name: driver.Name, Data: data}
+	return nil
+}
+
+// SetCreateWarnings sets the warnings returned by the server whenever a
+// container is created. Use nil for not returning any warnings.
+func (s *DockerServer) SetCreateWarnings(warnings []string) {
+	s.cMut.Lock()
+	s.createWarnings = warnings
+	s.cMut.Unlock()
+}
+
+// SetAppArmorProfile sets the AppArmor profile recorded in containers created
+// after the call, unless they're privileged or set their own profile with the
+// apparmor security option. Use the empty string for hosts without AppArmor.
+func (s *DockerServer) SetAppArmorProfile(profile string) {
+	s.cMut.Lock()
+	s.appArmor = profile
+	s.cMut.Unlock()
+}
+
+// SetImageContainersCount makes the server count the containers using each
+// image when listing images. The count is reported as -1 otherwise, as the
+// daemon does when it doesn't compute it.
+func (s *DockerServer) SetImageContainersCount(enabled bool) {
+	s.cMut.Lock()
+	s.imgContainers = enabled
+	s.cMut.Unlock()
+}
+
+// SetInfoWarnings sets the warnings reported by the server in the info
+// endpoint. Use nil for not returning any warnings.
+func (s *DockerServer) SetInfoWarnings(warnings []string) {
+	s.cMut.Lock()
+	s.infoWarnings = warnings
+	s.cMut.Unlock()
+}
+
+// SetVersion sets fields reported by the server in the version endpoint, like
+// Os, Arch, KernelVersion and BuildTime, overriding the default values. Use
+// nil for restoring the defaults.
+func (s *DockerServer) SetVersion(fields map[string]string) {
+	s.cMut.Lock()
+	s.versionFields = make(map[string]string, len(fields))
+	for key, value := range fields {
+		s.versionFields[key] = value
+	}
+	s.cMut.Unlock()
+}
+
+// SetVolumeUsage sets the usage data returned when inspecting the volume with
+// the given name.
+func (s *DockerServer) SetVolumeUsage(name string, size int64, refCount int) {
+	s.volMut.Lock()
+	defer s.volMut.Unlock()
+	if s.volUsage == nil {
+		s.volUsage = make(map[string]docker.VolumeUsageData)
+	}
+	s.volUsage[name] = docker.VolumeUsageData{Size: size, RefCount: int64(refCount)}
+}
+
+// SetImageLayers sets the layers, identified by their diff IDs, listed in the
+// RootFS of the given image, returning an error if there's no such image.
+// Listing images with shared-size=1 reports the layers the image has in
+// common with other images as shared, counting sharedLayerSize bytes for each
+// of them.
+func (s *DockerServer) SetImageLayers(name string, layers []string) error {
+	return s.mutateImage(name, func(image *docker.Image) {
+		image.RootFS = &docker.RootFS{Type: "layers", Layers: layers}
+	})
+}
+
+// SetImageConfig sets both the runtime configuration and the configuration of
+// the container that created the given image, returning an error if there's
+// no such image.
+func (s *DockerServer) SetImageConfig(name string, cfg docker.Config) error {
+	return s.mutateImage(name, func(image *docker.Image) {
+		image.Config = &cfg
+		image.ContainerConfig = cfg
+	})
+}
+
+// SetImagePlatforms sets the platforms, in the os/arch[/variant] format,
+// available for the given repository in the fake registry. Pulls of the
+// repository select the first platform matching the requested one, or the
+// first platform when no platform is requested, and fail when no platform
+// matches.
+func (s *DockerServer) SetImagePlatforms(repository string, platforms []string) {
+	s.iMut.Lock()
+	defer s.iMut.Unlock()
+	if s.imgPlatforms == nil {
+		s.imgPlatforms = make(map[string][]string)
+	}
+	s.imgPlatforms[repository] = platforms
+}
+
+// SetImageHistory sets the history returned for the given image, returning an
+// error if there's no such image. Use nil for returning the default history,
+// derived from the image and its parents.
+func (s *DockerServer) SetImageHistory(name string, history []docker.ImageHistory) error {
+	s.iMut.Lock()
+	defer s.iMut.Unlock()
+	image, ok := s.imageByName(name)
+	if !ok {
+		return errors.New("image not found")
+	}
+	if s.imgHistory == nil {
+		s.imgHistory = make(map[string][]docker.ImageHistory)
+	}
+	if history == nil {
+		delete(s.imgHistory, image.ID)
+		return nil
+	}
+	s.imgHistory[image.ID] = append([]docker.ImageHistory(nil), history...)
+	return nil
+}
+
+// BuildSettings holds the settings of a build request received by the server.
+type BuildSettings struct {
+	// Tag is the name given to the built image, if any.
+	Tag string
+
+	// Remove tells whether intermediate containers should be removed after
+	// a successful build (rm=1 or rm=true).
+	Remove bool
+
+	// ForceRemove tells whether intermediate containers should always be
+	// removed (forcerm=1 or forcerm=true).
+	ForceRemove bool
+
+	// Isolation is the isolation technology requested for the build
+	// containers, if any.
+	Isolation string
+
+	// ShmSize is the size of /dev/shm requested for the build containers, in
+	// bytes.
+	ShmSize int64
+}
+
+// SetBuildError makes the builds requested to the server fail, reporting the
+// given error code and message in the output stream. Use an empty message for
+// successful builds.
+func (s *DockerServer) SetBuildError(code int, message string) {
+	s.iMut.Lock()
+	defer s.iMut.Unlock()
+	if message == "" {
+		s.buildError = nil
+		return
+	}
+	s.buildError = &jsonmessage.JSONError{Code: code, Message: message}
+}
+
+// LastBuildSettings returns the settings of the last build request received by
+// the server, or nil if no image was built.
+func (s *DockerServer) LastBuildSettings() *BuildSettings {
+	s.iMut.RLock()
+	defer s.iMut.RUnlock()
+	if s.lastBuild == nil {
+		return nil
+	}
+	settings := *s.lastBuild
+	return &settings
+}
+
+func (s *DockerServer) mutateImage(name string, f func(*docker.Image)) error {
+	s.iMut.Lock()
+	defer s.iMut.Unlock()
+	id, ok := s.imgIDs[name]
+	if !ok {
+		id = name
+	}
+	image, ok := s.imageByID(id)
+	if !ok {
+		return errors.New("image not found")
+	}
+	f(&image)
+	s.replaceImage(image)
+	return nil
+}
+
+// AddContainerLogs appends log entries to the output of a container, returning
+// an error if the given id does not match to any container in the server.
+//
+// Entries are replayed to clients attaching with logs=1 and streamed to the
+// ones attached with stream=1. Entries added to containers backing swarm tasks
+// are also served by the service logs endpoint.
+//
+// When the container is configured with the max-size log option, the oldest
+// entries are dropped once the stored lines exceed max-size times max-file,
+// like the json-file driver does when rotating logs.
+func (s *DockerServer) AddContainerLogs(id string, entries ...ContainerLogEntry) error {
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	container, err := s.findContainerWithLock(id, false)
+	if err != nil {
+		return err
+	}
+	if s.logs == nil {
+		s.logs = make(map[string][]ContainerLogEntry)
+	}
+	s.logs[container.ID] = append(s.logs[container.ID], entries...)
+	s.rotateLogs(container)
+	return nil
+}
+
+var errLogsNotReadable = errors.New("configured logging driver does not support reading")
+
+// logsReadable reports whether the logging driver of the container supports
+// reading logs back. Must be called with cMut held.
+func logsReadable(container *docker.Container) bool {
+	if container.HostConfig == nil {
+		return true
+	}
+	switch container.HostConfig.LogConfig.Type {
+	case "", "json-file", "local", "journald":
+		return true
+	}
+	return false
+}
+
+// ContainerStdin returns the input received by the container through clients
+// attached to its stdin, and whether its stdin has been closed, returning an
+// error if the given id does not match to any container in the server.
+func (s *DockerServer) ContainerStdin(id string) ([]byte, bool, error) {
+	s.cMut.RLock()
+	defer s.cMut.RUnlock()
+	container, err := s.findContainerWithLock(id, false)
+	if err != nil {
+		return nil, false, err
+	}
+	data := append([]byte(nil), s.stdin[container.ID]...)
+	return data, s.stdinClosed[container.ID], nil
+}
+
+// rotateLogs must be called with cMut held.
+func (s *DockerServer) rotateLogs(container *docker.Container) {
+	if container.HostConfig == nil {
+		return
+	}
+	config := container.HostConfig.LogConfig.Config
+	maxSize, err := units.RAMInBytes(config["max-size"])
+	if err != nil || maxSize <= 0 {
+		return
+	}
+	maxFile := int64(1)
+	if value, err := strconv.ParseInt(config["max-file"], 10, 64); err == nil && value > 0 {
+		maxFile = value
+	}
+	entries := s.logs[container.ID]
+	var size int64
+	start := len(entries)
+	for start > 0 && size+int64(len(entries[start-1].Line)+1) <= maxSize*maxFile {
+		start--
+		size += int64(len(entries[start].Line) + 1)
+	}
+	if start == 0 {
+		return
+	}
+	if s.logsRotated == nil {
+		s.logsRotated = make(map[string]int)
+	}
+	s.logsRotated[container.ID] += start
+	s.logs[container.ID] = entries[start:]
+}
+
+// Stop stops the server, cancelling any pending task shutdown.
 func (s *DockerServer) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.swarmMut.Lock()
+	for id, timer := range s.shutdownTimers {
+		timer.Stop()
+		delete(s.shutdownTimers, id)
+	}
 	if s.swarmServer != nil {
 		s.swarmServer.listener.Close()
 	}
+	s.swarmMut.Unlock()
 }
 
 // URL returns the HTTP URL of the server.
@@ -329,19 +896,115 @@ func (s *DockerServer) URL() string {
 // ServeHTTP handles HTTP requests sent to the server.
 func (s *DockerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.handlerMutex.RLock()
-	defer s.handlerMutex.RUnlock()
+	var custom http.Handler
 	for re, handler := range s.customHandlers {
 		if m, _ := regexp.MatchString(re, r.URL.Path); m {
-			handler.ServeHTTP(w, r)
+			custom = handler
+			break
+		}
+	}
+	apiVersion := s.apiVersion
+	s.handlerMutex.RUnlock()
+	if custom != nil {
+		custom.ServeHTTP(w, r)
+		return
+	}
+	if apiVersion != nil {
+		if status, err := checkAPIVersion(r, apiVersion); err != nil {
+			http.Error(w, err.Error(), status)
 			return
 		}
 	}
+	if s.responseEncoding() == "gzip" {
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		w = gw
+	}
 	s.mux.ServeHTTP(w, r)
 	if s.hook != nil {
 		s.hook(r)
 	}
 }
 
+// gzipResponseWriter compresses the response body written by handlers. Hijacked
+// connections are left untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Write(data)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("cannot hijack connection")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil || w.hijacked {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+// checkAPIVersion strips the version prefix from the request path and checks
+// whether a daemon speaking the given version supports both the requested
+// version and the endpoint.
+func checkAPIVersion(r *http.Request, apiVersion docker.APIVersion) (int, error) {
+	if m := versionPrefixRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		requested, err := docker.NewAPIVersion(m[1])
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if requested.GreaterThan(apiVersion) {
+			return http.StatusBadRequest, fmt.Errorf("client version %s is too new. Maximum supported API version is %s", requested, apiVersion)
+		}
+		r.URL.Path = m[2]
+	}
+	for _, endpoint := range endpointVersions {
+		if endpoint.path.MatchString(r.URL.Path) {
+			if apiVersion.LessThan(endpoint.version) {
+				return http.StatusNotFound, errors.New("page not found")
+			}
+			break
+		}
+	}
+	return 0, nil
+}
+
 // DefaultHandler returns default http.Handler mux, it allows customHandlers to
 // call the default behavior if wanted.
 func (s *DockerServer) DefaultHandler() http.Handler {
@@ -350,6 +1013,12 @@ func (s *DockerServer) DefaultHandler() http.Handler {
 
 func (s *DockerServer) handlerWrapper(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		s.writeResponseHeaders(w)
+		if !s.acquireRequest() {
+			http.Error(w, "server too busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.releaseRequest()
 		for errorID, urlRegexp := range s.failures {
 			matched, err := regexp.MatchString(urlRegexp, r.URL.Path)
 			if err != nil {
@@ -379,26 +1048,79 @@ func (s *DockerServer) handlerWrapper(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// validateFilters checks the keys of the filters parameter in the request
+// against the ones accepted by the given endpoint.
+func validateFilters(r *http.Request, endpoint string) error {
+	raw := r.FormValue("filters")
+	if raw == "" {
+		return nil
+	}
+	var filters map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(filters))
+	for key := range filters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !inFilter(validFilters[endpoint], key) {
+			return fmt.Errorf("invalid filter '%s'", key)
+		}
+	}
+	return nil
+}
+
 func (s *DockerServer) listContainers(w http.ResponseWriter, r *http.Request) {
+	if err := validateFilters(r, "containers"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var filters map[string][]string
+	if raw := r.FormValue("filters"); raw != "" {
+		json.Unmarshal([]byte(raw), &filters)
+	}
+	expose, err := parsePortFilters("expose", filters["expose"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	publish, err := parsePortFilters("publish", filters["publish"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	all := r.URL.Query().Get("all")
 	s.cMut.RLock()
-	result := make([]docker.APIContainers, 0, len(s.containers))
-	for _, container := range s.containers {
+	containers := s.allContainers()
+	result := make([]docker.APIContainers, 0, len(containers))
+	for _, container := range containers {
+		if (len(expose) > 0 || len(publish) > 0) &&
+			!matchPortFilters(expose, exposedPorts(container)) &&
+			!matchPortFilters(publish, publishedPorts(container)) {
+			continue
+		}
 		if all == "1" || container.State.Running {
 			var ports []docker.APIPort
 			if container.NetworkSettings != nil {
 				ports = container.NetworkSettings.PortMappingAPI()
 			}
-			result = append(result, docker.APIContainers{
-				ID:      container.ID,
-				Image:   container.Image,
-				Command: fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " ")),
-				Created: container.Created.Unix(),
-				Status:  container.State.String(),
-				State:   container.State.StateString(),
-				Ports:   ports,
-				Names:   []string{fmt.Sprintf("/%s", container.Name)},
-			})
+			apiContainer := docker.APIContainers{
+				ID:       container.ID,
+				Image:    container.Image,
+				Command:  fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " ")),
+				Created:  container.Created.Unix(),
+				Status:   container.State.String(),
+				State:    container.State.StateString(),
+				Ports:    ports,
+				Names:    []string{fmt.Sprintf("/%s", container.Name)},
+				Networks: docker.NetworkList{Networks: containerNetworks(container)},
+			}
+			if container.Config != nil {
+				apiContainer.Labels = container.Config.Labels
+			}
+			result = append(result, apiContainer)
 		}
 	}
 	s.cMut.RUnlock()
@@ -407,46 +1129,221 @@ func (s *DockerServer) listContainers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-func (s *DockerServer) listImages(w http.ResponseWriter, r *http.Request) {
-	s.cMut.RLock()
-	result := make([]docker.APIImages, len(s.images))
-	for i, image := range s.images {
-		result[i] = docker.APIImages{
-			ID:      image.ID,
-			Created: image.Created.Unix(),
+// portFilter is a port or range of ports given in the "expose" and "publish"
+// filters of the containers listing, in the form
+// <port>[/<proto>] or <startport-endport>[/<proto>].
+type portFilter struct {
+	start, end int
+	proto      string
+}
+
+func parsePortFilters(name string, values []string) ([]portFilter, error) {
+	filters := make([]portFilter, 0, len(values))
+	for _, value := range values {
+		if strings.Contains(value, ":") {
+			return nil, fmt.Errorf("filter for '%s' should not contain ':': %s", name, value)
 		}
-		for tag, id := range s.imgIDs {
-			if id == image.ID {
-				result[i].RepoTags = append(result[i].RepoTags, tag)
+		port := docker.Port(value)
+		f := portFilter{proto: port.Proto()}
+		parts := strings.SplitN(port.Port(), "-", 2)
+		start, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid port specification: %q", value)
+		}
+		f.start, f.end = start, start
+		if len(parts) == 2 {
+			if f.end, err = strconv.Atoi(parts[1]); err != nil || f.end < f.start {
+				return nil, fmt.Errorf("invalid port specification: %q", value)
 			}
 		}
+		filters = append(filters, f)
 	}
-	s.cMut.RUnlock()
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(result)
+	return filters, nil
 }
 
-func (s *DockerServer) findImage(id string) (string, error) {
-	s.iMut.RLock()
-	defer s.iMut.RUnlock()
+// matchPortFilters reports whether any of the given ports is matched by any
+// of the filters. Like the daemon, the listing keeps containers matching
+// either the "expose" or the "publish" filter.
+func matchPortFilters(filters []portFilter, ports []docker.Port) bool {
+	for _, port := range ports {
+		number, err := strconv.Atoi(port.Port())
+		if err != nil {
+			continue
+		}
+		for _, f := range filters {
+			if f.proto == port.Proto() && number >= f.start && number <= f.end {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func exposedPorts(container *docker.Container) []docker.Port {
+	if container.Config == nil {
+		return nil
+	}
+	ports := make([]docker.Port, 0, len(container.Config.ExposedPorts))
+	for port := range container.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// publishedPorts returns the host ports the container ports are bound to,
+// either in the host config or in the network settings of the container,
+// along with the protocol of the container port.
+func publishedPorts(container *docker.Container) []docker.Port {
+	var ports []docker.Port
+	addBindings := func(bindings map[docker.Port][]docker.PortBinding) {
+		for port, portBindings := range bindings {
+			for _, binding := range portBindings {
+				if binding.HostPort != "" {
+					ports = append(ports, docker.Port(binding.HostPort+"/"+port.Proto()))
+				}
+			}
+		}
+	}
+	if container.HostConfig != nil {
+		addBindings(container.HostConfig.PortBindings)
+	}
+	if container.NetworkSettings != nil {
+		addBindings(container.NetworkSettings.Ports)
+	}
+	return ports
+}
+
+// containerNetworks summarizes the networks the container is attached to,
+// including the default bridge network when the container has an address in
+// it.
+func containerNetworks(container *docker.Container) map[string]docker.ContainerNetwork {
+	settings := container.NetworkSettings
+	if settings == nil {
+		return nil
+	}
+	networks := make(map[string]docker.ContainerNetwork, len(settings.Networks)+1)
+	if settings.IPAddress != "" {
+		networks["bridge"] = docker.ContainerNetwork{
+			IPAddress:   settings.IPAddress,
+			IPPrefixLen: settings.IPPrefixLen,
+			Gateway:     settings.Gateway,
+			MacAddress:  settings.MacAddress,
+		}
+	}
+	for name, network := range settings.Networks {
+		networks[name] = network
+	}
+	return networks
+}
+
+func (s *DockerServer) listImages(w http.ResponseWriter, r *http.Request) {
+	if err := validateFilters(r, "images"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.cMut.RLock()
+	var containers map[string]int64
+	if s.imgContainers {
+		containers = make(map[string]int64)
+		for _, container := range s.allContainers() {
+			id, ok := s.imgIDs[container.Image]
+			if !ok {
+				id = container.Image
+			}
+			containers[id]++
+		}
+	}
+	sharedSize := r.URL.Query().Get("shared-size") == "1"
+	var layerImages map[string]int
+	if sharedSize {
+		layerImages = make(map[string]int)
+		for _, image := range s.allImages() {
+			for _, layer := range imageLayers(image) {
+				layerImages[layer]++
+			}
+		}
+	}
+	images := s.allImages()
+	result := make([]docker.APIImages, len(images))
+	for i, image := range images {
+		result[i] = docker.APIImages{
+			ID:         image.ID,
+			Created:    image.Created.Unix(),
+			Containers: -1,
+			SharedSize: -1,
+		}
+		if containers != nil {
+			result[i].Containers = containers[image.ID]
+		}
+		if sharedSize {
+			result[i].SharedSize = imageSharedSize(image, layerImages)
+		}
+		if image.Config != nil {
+			result[i].Labels = image.Config.Labels
+		}
+		for tag, id := range s.imgIDs {
+			if id == image.ID {
+				result[i].RepoTags = append(result[i].RepoTags, tag)
+			}
+		}
+	}
+	s.cMut.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// sharedLayerSize is the synthetic size of each layer shared between images,
+// used when computing the shared size of images.
+const sharedLayerSize = 1 << 20
+
+// imageLayers returns the distinct layers listed in the RootFS of the given
+// image.
+func imageLayers(image docker.Image) []string {
+	if image.RootFS == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(image.RootFS.Layers))
+	var layers []string
+	for _, layer := range image.RootFS.Layers {
+		if !seen[layer] {
+			seen[layer] = true
+			layers = append(layers, layer)
+		}
+	}
+	return layers
+}
+
+// imageSharedSize computes the size of the layers of the given image that are
+// also used by other images, given the number of images using each layer.
+func imageSharedSize(image docker.Image, layerImages map[string]int) int64 {
+	var size int64
+	for _, layer := range imageLayers(image) {
+		if layerImages[layer] > 1 {
+			size += sharedLayerSize
+		}
+	}
+	return size
+}
+
+func (s *DockerServer) findImage(id string) (string, error) {
+	s.iMut.RLock()
+	defer s.iMut.RUnlock()
 	image, ok := s.imgIDs[id]
 	if ok {
 		return image, nil
 	}
-	image, _, err := s.findImageByID(id)
+	image, err := s.findImageByID(id)
 	return image, err
 }
 
-func (s *DockerServer) findImageByID(id string) (string, int, error) {
+func (s *DockerServer) findImageByID(id string) (string, error) {
 	s.iMut.RLock()
 	defer s.iMut.RUnlock()
-	for i, image := range s.images {
-		if image.ID == id {
-			return image.ID, i, nil
-		}
+	if image, ok := s.imageByID(id); ok {
+		return image.ID, nil
 	}
-	return "", -1, errors.New("No such image")
+	return "", errors.New("No such image")
 }
 
 func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
@@ -462,7 +1359,12 @@ func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
 	}
 	name := r.URL.Query().Get("name")
 	if name != "" && !nameRegexp.MatchString(name) {
-		http.Error(w, "Invalid container name", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Invalid container name (%s), only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name), http.StatusBadRequest)
+		return
+	}
+	platform, err := parsePlatform(r.URL.Query().Get("platform"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	imageID, err := s.findImage(config.Image)
@@ -470,6 +1372,16 @@ func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	containerOS := "linux"
+	if platform != nil {
+		containerOS = platform[0]
+	} else {
+		s.iMut.RLock()
+		if img, ok := s.imageByID(imageID); ok && img.OS != "" {
+			containerOS = img.OS
+		}
+		s.iMut.RUnlock()
+	}
 	ports := map[docker.Port][]docker.PortBinding{}
 	for port := range config.ExposedPorts {
 		ports[port] = []docker.PortBinding{{
@@ -488,12 +1400,29 @@ func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
 		args = config.Cmd[1:]
 	}
 
+	if config.MacAddress != "" {
+		if _, err := net.ParseMAC(config.MacAddress); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = validateResources(config.Memory, config.MemorySwap, config.CPUShares, config.CPUSet)
+	if err == nil && config.HostConfig != nil {
+		hc := config.HostConfig
+		err = validateResources(hc.Memory, hc.MemorySwap, hc.CPUShares, hc.CPUSetCPUs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	generatedID := s.generateID()
-	config.Config.Hostname = generatedID[:12]
+	if config.Config.Hostname == "" {
+		config.Config.Hostname = generatedID[:12]
+	}
 	container := docker.Container{
 		Name:       name,
 		ID:         generatedID,
-		Created:    time.Now(),
+		Created:    s.now(),
 		Path:       path,
 		Args:       args,
 		Config:     config.Config,
@@ -503,7 +1432,8 @@ func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
 			Pid:      mathrand.Int() % 50000,
 			ExitCode: 0,
 		},
-		Image: config.Image,
+		Image:  config.Image,
+		Mounts: s.containerMounts(config.Config, config.HostConfig),
 		NetworkSettings: &docker.NetworkSettings{
 			IPAddress:   fmt.Sprintf("172.16.42.%d", mathrand.Int()%250+2),
 			IPPrefixLen: 24,
@@ -511,26 +1441,167 @@ func (s *DockerServer) createContainer(w http.ResponseWriter, r *http.Request) {
 			Bridge:      "docker0",
 			Ports:       ports,
 		},
+		Platform: containerOS,
 	}
 	s.cMut.Lock()
-	if val, ok := s.uploadedFiles[imageID]; ok {
-		s.uploadedFiles[container.ID] = val
+	container.AppArmorProfile = appArmorProfile(config.HostConfig, s.appArmor)
+	if files, ok := s.uploadedFiles[imageID]; ok {
+		s.uploadedFiles[container.ID] = copyFiles(files)
 	}
 	if container.Name != "" {
-		for _, c := range s.containers {
-			if c.Name == container.Name {
-				defer s.cMut.Unlock()
-				http.Error(w, "there's already a container with this name", http.StatusConflict)
-				return
-			}
+		if c, _ := s.getContainer(container.Name); c != nil && c.Name == container.Name {
+			defer s.cMut.Unlock()
+			http.Error(w, "there's already a container with this name", http.StatusConflict)
+			return
 		}
 	}
-	s.containers = append(s.containers, &container)
+	s.addContainer(&container)
+	result := container
+	result.Warnings = s.createWarnings
 	s.cMut.Unlock()
 	w.WriteHeader(http.StatusCreated)
 	s.notify(&container)
 
-	json.NewEncoder(w).Encode(container)
+	json.NewEncoder(w).Encode(result)
+}
+
+// appArmorProfile returns the AppArmor profile of a container with the given
+// host config, in the same way the daemon does: the profile set with the
+// apparmor security option wins, privileged containers are unconfined and the
+// remaining containers get the default profile.
+func appArmorProfile(hostConfig *docker.HostConfig, defaultProfile string) string {
+	if hostConfig == nil {
+		return defaultProfile
+	}
+	for _, opt := range hostConfig.SecurityOpt {
+		for _, sep := range []string{"=", ":"} {
+			if strings.HasPrefix(opt, "apparmor"+sep) {
+				return strings.TrimPrefix(opt, "apparmor"+sep)
+			}
+		}
+	}
+	if hostConfig.Privileged {
+		return "unconfined"
+	}
+	return defaultProfile
+}
+
+// validateResources checks resource limits the same way the daemon does when
+// creating a container, returning the daemon's error message.
+func validateResources(memory, memorySwap, cpuShares int64, cpuset string) error {
+	if memory > 0 && memorySwap > 0 && memorySwap < memory {
+		return errors.New("Minimum memoryswap limit should be larger than memory limit, see usage")
+	}
+	if cpuShares < 0 {
+		return fmt.Errorf("Invalid CPU shares (%d): value must be a positive integer", cpuShares)
+	}
+	if cpuset != "" && !validCPUSet(cpuset) {
+		return fmt.Errorf("Invalid value %s for cpuset cpus", cpuset)
+	}
+	return nil
+}
+
+// validCPUSet reports whether the given value is a valid list of CPUs, in the
+// format accepted by cpuset (e.g. "0-3,5").
+func validCPUSet(value string) bool {
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return false
+		}
+		if len(bounds) == 2 {
+			last, err := strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || last < first {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseTimestamp parses timestamps in the format used by the since and until
+// parameters of the API: seconds since epoch, optionally followed by a dot and
+// the nanoseconds.
+func parseTimestamp(value string) (time.Time, error) {
+	parts := strings.SplitN(value, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if len(parts) > 1 {
+		nsec, err = strconv.ParseInt((parts[1] + "000000000")[:9], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// containerMounts builds the list of mounts of a container, telling bind
+// mounts of host paths from named or anonymous volumes and tmpfs mounts.
+func (s *DockerServer) containerMounts(config *docker.Config, hostConfig *docker.HostConfig) []docker.Mount {
+	var mounts []docker.Mount
+	mounted := make(map[string]bool)
+	if hostConfig != nil {
+		for _, bind := range hostConfig.Binds {
+			parts := strings.Split(bind, ":")
+			mount := docker.Mount{RW: true}
+			switch len(parts) {
+			case 1:
+				mount.Destination = parts[0]
+			case 2:
+				mount.Source, mount.Destination = parts[0], parts[1]
+			default:
+				mount.Source, mount.Destination, mount.Mode = parts[0], parts[1], parts[2]
+			}
+			for _, opt := range strings.Split(mount.Mode, ",") {
+				if opt == "ro" {
+					mount.RW = false
+				}
+			}
+			if libpath.IsAbs(mount.Source) {
+				mount.Type = "bind"
+			} else {
+				mount.Type = "volume"
+				mount.Name = mount.Source
+				if mount.Name == "" {
+					mount.Name = s.generateID()
+				}
+				mount.Source = "/var/lib/docker/volumes/" + mount.Name + "/_data"
+				mount.Driver = "local"
+			}
+			mounted[mount.Destination] = true
+			mounts = append(mounts, mount)
+		}
+		for destination, options := range hostConfig.Tmpfs {
+			mounted[destination] = true
+			mounts = append(mounts, docker.Mount{
+				Type:        "tmpfs",
+				Destination: destination,
+				Mode:        options,
+				RW:          true,
+			})
+		}
+	}
+	if config != nil {
+		for destination := range config.Volumes {
+			if mounted[destination] {
+				continue
+			}
+			name := s.generateID()
+			mounts = append(mounts, docker.Mount{
+				Type:        "volume",
+				Name:        name,
+				Source:      "/var/lib/docker/volumes/" + name + "/_data",
+				Destination: destination,
+				Driver:      "local",
+				RW:          true,
+			})
+		}
+	}
+	return mounts
 }
 
 func (s *DockerServer) generateID() string {
@@ -541,7 +1612,7 @@ func (s *DockerServer) generateID() string {
 
 func (s *DockerServer) renameContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, index, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -550,15 +1621,113 @@ func (s *DockerServer) renameContainer(w http.ResponseWriter, r *http.Request) {
 	copy.Name = r.URL.Query().Get("name")
 	s.cMut.Lock()
 	defer s.cMut.Unlock()
-	if s.containers[index].ID == copy.ID {
-		s.containers[index] = &copy
-	}
+	s.replaceContainer(&copy)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// updateContainer applies the resources and the restart policy in the request
+// to the host config of the container. Zero values and an empty restart policy
+// keep the current configuration.
+func (s *DockerServer) updateContainer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var update docker.HostConfig
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	container, err := s.findContainerWithLock(id, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := validateResources(update.Memory, update.MemorySwap, update.CPUShares, update.CPUSetCPUs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.RestartPolicy.Name != "" {
+		if err := validateRestartPolicy(update.RestartPolicy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if container.HostConfig != nil && container.HostConfig.AutoRemove && update.RestartPolicy.Name != "no" {
+			http.Error(w, "Restart policy cannot be updated because AutoRemove is enabled for the container", http.StatusBadRequest)
+			return
+		}
+	}
+	if container.HostConfig == nil {
+		container.HostConfig = &docker.HostConfig{}
+	}
+	hc := container.HostConfig
+	updateInt64 := func(dst *int64, value int64) {
+		if value != 0 {
+			*dst = value
+		}
+	}
+	updateInt64(&hc.BlkioWeight, update.BlkioWeight)
+	updateInt64(&hc.CPUShares, update.CPUShares)
+	updateInt64(&hc.CPUPeriod, update.CPUPeriod)
+	updateInt64(&hc.CPUQuota, update.CPUQuota)
+	updateInt64(&hc.CPURealtimePeriod, update.CPURealtimePeriod)
+	updateInt64(&hc.CPURealtimeRuntime, update.CPURealtimeRuntime)
+	updateInt64(&hc.Memory, update.Memory)
+	updateInt64(&hc.MemorySwap, update.MemorySwap)
+	updateInt64(&hc.MemoryReservation, update.MemoryReservation)
+	updateInt64(&hc.KernelMemory, update.KernelMemory)
+	if update.CPUSetCPUs != "" {
+		hc.CPUSetCPUs = update.CPUSetCPUs
+	}
+	if update.CPUSetMEMs != "" {
+		hc.CPUSetMEMs = update.CPUSetMEMs
+	}
+	if update.RestartPolicy.Name != "" {
+		hc.RestartPolicy = update.RestartPolicy
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{"Warnings": {}})
+}
+
+// validateRestartPolicy checks the name of the policy and that the maximum
+// retry count is only used along with "on-failure".
+func validateRestartPolicy(policy docker.RestartPolicy) error {
+	switch policy.Name {
+	case "", "no", "always", "unless-stopped":
+		if policy.MaximumRetryCount != 0 {
+			return fmt.Errorf("maximum retry count cannot be used with restart policy '%s'", policy.Name)
+		}
+	case "on-failure":
+		if policy.MaximumRetryCount < 0 {
+			return errors.New("maximum retry count cannot be negative")
+		}
+	default:
+		return fmt.Errorf("invalid restart policy '%s'", policy.Name)
+	}
+	return nil
+}
+
+// shouldRestart reports whether the restart policy of the container asks for
+// restarting it after it exited with its current exit code.
+func shouldRestart(container *docker.Container) bool {
+	if container.HostConfig == nil {
+		return false
+	}
+	policy := container.HostConfig.RestartPolicy
+	switch policy.Name {
+	case "always", "unless-stopped":
+		return true
+	case "on-failure":
+		return container.State.ExitCode != 0 &&
+			(policy.MaximumRetryCount == 0 || container.RestartCount < policy.MaximumRetryCount)
+	}
+	return false
+}
+
 func (s *DockerServer) inspectContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -570,7 +1739,7 @@ func (s *DockerServer) inspectContainer(w http.ResponseWriter, r *http.Request)
 
 func (s *DockerServer) statsContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	_, _, err := s.findContainer(id)
+	_, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -580,61 +1749,132 @@ func (s *DockerServer) statsContainer(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	encoder := json.NewEncoder(w)
+	// like the daemon, each sample carries the CPU usage of the previous one
+	// as PreCPUStats, so clients can compute CPU percentages.
+	var previous *docker.Stats
+	if callback == nil {
+		sample := s.generateStats(id)
+		previous = &sample
+	}
 	for {
 		var stats docker.Stats
 		if callback != nil {
 			stats = callback(id)
+		} else {
+			stats = s.generateStats(id)
+		}
+		if previous != nil && stats.PreCPUStats.SystemCPUUsage == 0 {
+			stats.PreCPUStats = previous.CPUStats
+			stats.PreRead = previous.Read
 		}
 		encoder.Encode(stats)
 		if !stream {
 			break
 		}
+		previous = &stats
+	}
+}
+
+// generateStats returns the next stats sample of a container with no stats
+// callback. The CPU usage grows across samples as if the container used half
+// of the two CPUs in the host, one second of wall time after the other.
+func (s *DockerServer) generateStats(id string) docker.Stats {
+	s.cMut.Lock()
+	container, err := s.getContainer(id)
+	if err == nil {
+		// samples are counted by container ID, so that they're dropped
+		// along with the container whatever name the request used.
+		id = container.ID
+	}
+	if s.statsSamples == nil {
+		s.statsSamples = make(map[string]uint64)
+	}
+	s.statsSamples[id]++
+	n := s.statsSamples[id]
+	var pids pidsStats
+	if err == nil {
+		var ok bool
+		if pids, ok = s.pidsStats[container.ID]; !ok {
+			if container.State.Running {
+				pids.current = 1
+			}
+			if container.HostConfig != nil && container.HostConfig.PidsLimit > 0 {
+				pids.limit = uint64(container.HostConfig.PidsLimit)
+			}
+		}
 	}
+	s.cMut.Unlock()
+	var stats docker.Stats
+	stats.Read = time.Now()
+	stats.PidsStats.Current = pids.current
+	stats.PidsStats.Limit = pids.limit
+	stats.CPUStats.SystemCPUUsage = n * 2e9
+	stats.CPUStats.CPUUsage.TotalUsage = n * 1e9
+	stats.CPUStats.CPUUsage.PercpuUsage = []uint64{n * 5e8, n * 5e8}
+	return stats
 }
 
 func (s *DockerServer) uploadToContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	_, _, err := s.findContainer(id)
+	_, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	path := r.URL.Query().Get("path")
+	var file containerFile
 	if r.Body != nil {
 		tr := tar.NewReader(r.Body)
 		if hdr, _ := tr.Next(); hdr != nil {
 			path = libpath.Join(path, hdr.Name)
+			file.mode = hdr.Mode
+			file.content, _ = ioutil.ReadAll(tr)
 		}
 	}
 	s.cMut.Lock()
-	s.uploadedFiles[id] = path
+	if s.uploadedFiles == nil {
+		s.uploadedFiles = make(map[string]map[string]containerFile)
+	}
+	if s.uploadedFiles[id] == nil {
+		s.uploadedFiles[id] = make(map[string]containerFile)
+	}
+	s.uploadedFiles[id][path] = file
 	s.cMut.Unlock()
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *DockerServer) downloadFromContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	_, _, err := s.findContainer(id)
+	_, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	path := r.URL.Query().Get("path")
 	s.cMut.RLock()
-	val, ok := s.uploadedFiles[id]
+	file, ok := s.uploadedFiles[id][path]
 	s.cMut.RUnlock()
-	if !ok || val != path {
+	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Path %s not found", path)
 		return
 	}
 	w.Header().Set("Content-Type", "application/x-tar")
 	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	tw.WriteHeader(&tar.Header{
+		Name:    libpath.Base(path),
+		Mode:    file.mode,
+		Size:    int64(len(file.content)),
+		ModTime: time.Now(),
+	})
+	tw.Write(file.content)
+	tw.Close()
 }
 
 func (s *DockerServer) topContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -644,27 +1884,108 @@ func (s *DockerServer) topContainer(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Container %s is not running", id)
 		return
 	}
+	result, err := topResult(container, r.URL.Query().Get("ps_args"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	result := docker.TopResult{
+	json.NewEncoder(w).Encode(result)
+}
+
+// topColumns maps the format specifiers accepted by ps -o to the column
+// title and the value reported for the container process.
+var topColumns = map[string]struct {
+	title string
+	value func(cmd string) string
+}{
+	"user":  {"USER", func(string) string { return "root" }},
+	"uid":   {"UID", func(string) string { return "0" }},
+	"pid":   {"PID", func(string) string { return "7535" }},
+	"ppid":  {"PPID", func(string) string { return "7516" }},
+	"stat":  {"STAT", func(string) string { return "Ss" }},
+	"tty":   {"TT", func(string) string { return "?" }},
+	"time":  {"TIME", func(string) string { return "00:00:00" }},
+	"etime": {"ELAPSED", func(string) string { return "01:02" }},
+	"comm":  {"COMMAND", func(cmd string) string { return libpath.Base(strings.SplitN(cmd, " ", 2)[0]) }},
+	"args":  {"COMMAND", func(cmd string) string { return cmd }},
+	"cmd":   {"CMD", func(cmd string) string { return cmd }},
+}
+
+// topResult builds the output of ps for the container process, honoring the
+// user-defined format (-o) and the BSD style (aux) arguments.
+func topResult(container *docker.Container, psArgs string) (docker.TopResult, error) {
+	cmd := container.Path + " " + strings.Join(container.Args, " ")
+	var format []string
+	bsd := false
+	args := strings.Fields(psArgs)
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" || arg == "o" || arg == "--format":
+			if i+1 < len(args) {
+				i++
+				format = append(format, strings.Split(args[i], ",")...)
+			}
+		case strings.HasPrefix(arg, "-o"):
+			format = append(format, strings.Split(arg[2:], ",")...)
+		case strings.TrimPrefix(arg, "-") == "aux":
+			bsd = true
+		}
+	}
+	if len(format) > 0 {
+		var result docker.TopResult
+		process := make([]string, 0, len(format))
+		for _, spec := range format {
+			parts := strings.SplitN(spec, "=", 2)
+			column, ok := topColumns[parts[0]]
+			if !ok {
+				return docker.TopResult{}, fmt.Errorf("Error running top: ps: error: unknown user-defined format specifier %q", parts[0])
+			}
+			title := column.title
+			if len(parts) == 2 {
+				title = parts[1]
+			}
+			result.Titles = append(result.Titles, title)
+			process = append(process, column.value(cmd))
+		}
+		result.Processes = [][]string{process}
+		return result, nil
+	}
+	if bsd {
+		return docker.TopResult{
+			Titles: []string{"USER", "PID", "%CPU", "%MEM", "VSZ", "RSS", "TTY", "STAT", "START", "TIME", "COMMAND"},
+			Processes: [][]string{
+				{"root", "7535", "0.0", "0.1", "4340", "756", "?", "Ss", "03:20", "0:00", cmd},
+			},
+		}, nil
+	}
+	return docker.TopResult{
 		Titles: []string{"UID", "PID", "PPID", "C", "STIME", "TTY", "TIME", "CMD"},
 		Processes: [][]string{
-			{"root", "7535", "7516", "0", "03:20", "?", "00:00:00", container.Path + " " + strings.Join(container.Args, " ")},
+			{"root", "7535", "7516", "0", "03:20", "?", "00:00:00", cmd},
 		},
-	}
-	json.NewEncoder(w).Encode(result)
+	}, nil
 }
 
 func (s *DockerServer) startContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if s.imageRemoved(container.Image) {
+		http.Error(w, "No such image: "+container.Image, http.StatusInternalServerError)
+		return
+	}
 	s.cMut.Lock()
 	defer s.cMut.Unlock()
 	defer r.Body.Close()
+	if container.State.Paused {
+		http.Error(w, "container is paused", http.StatusConflict)
+		return
+	}
 	if container.State.Running {
 		http.Error(w, "", http.StatusNotModified)
 		return
@@ -701,14 +2022,30 @@ func (s *DockerServer) startContainer(w http.ResponseWriter, r *http.Request) {
 		}
 		container.NetworkSettings.Ports = ports
 	}
+	if container.NetworkSettings != nil {
+		container.NetworkSettings.MacAddress = containerMacAddress(container)
+	}
 	container.State.Running = true
 	container.State.StartedAt = time.Now()
 	s.notify(container)
 }
 
+// containerMacAddress returns the MAC address configured for the container,
+// or one derived from its IP address, like the Docker daemon does.
+func containerMacAddress(container *docker.Container) string {
+	if container.Config != nil && container.Config.MacAddress != "" {
+		return container.Config.MacAddress
+	}
+	ip := net.ParseIP(container.NetworkSettings.IPAddress).To4()
+	if ip == nil {
+		return ""
+	}
+	return fmt.Sprintf("02:42:%02x:%02x:%02x:%02x", ip[0], ip[1], ip[2], ip[3])
+}
+
 func (s *DockerServer) stopContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -721,12 +2058,61 @@ func (s *DockerServer) stopContainer(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 	container.State.Running = false
+	container.State.FinishedAt = time.Now()
 	s.notify(container)
 }
 
+func (s *DockerServer) restartContainer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	container, err := s.findContainer(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	if container.State.Running {
+		container.State.FinishedAt = time.Now()
+	}
+	container.State.Running = true
+	container.State.StartedAt = time.Now()
+	container.RestartCount++
+	w.WriteHeader(http.StatusNoContent)
+	s.notify(container)
+}
+
+func (s *DockerServer) killContainer(w http.ResponseWriter, r *http.Request) {
+	if signal := r.URL.Query().Get("signal"); signal != "" && !isValidSignal(signal) {
+		http.Error(w, "Invalid signal: "+signal, http.StatusBadRequest)
+		return
+	}
+	s.stopContainer(w, r)
+}
+
+// isValidSignal reports whether the given signal, either a number or a name
+// with or without the SIG prefix, is known by the daemon.
+func isValidSignal(signal string) bool {
+	if n, err := strconv.Atoi(signal); err == nil {
+		return n > 0 && n <= 64
+	}
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if strings.HasPrefix(name, "RTMIN+") || strings.HasPrefix(name, "RTMAX-") {
+		n, err := strconv.Atoi(name[6:])
+		return err == nil && n > 0 && n < 15
+	}
+	return inFilter(signalNames, name)
+}
+
+var signalNames = []string{
+	"ABRT", "ALRM", "BUS", "CHLD", "CLD", "CONT", "FPE", "HUP", "ILL", "INT",
+	"IO", "IOT", "KILL", "PIPE", "POLL", "PROF", "PWR", "QUIT", "RTMAX",
+	"RTMIN", "SEGV", "STKFLT", "STOP", "SYS", "TERM", "TRAP", "TSTP", "TTIN",
+	"TTOU", "UNUSED", "URG", "USR1", "USR2", "VTALRM", "WINCH", "XCPU", "XFSZ",
+}
+
 func (s *DockerServer) pauseContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -743,7 +2129,7 @@ func (s *DockerServer) pauseContainer(w http.ResponseWriter, r *http.Request) {
 
 func (s *DockerServer) unpauseContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -760,11 +2146,17 @@ func (s *DockerServer) unpauseContainer(w http.ResponseWriter, r *http.Request)
 
 func (s *DockerServer) attachContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if keys := r.URL.Query().Get("detachKeys"); keys != "" {
+		if err := validateDetachKeys(keys); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "cannot hijack connection", http.StatusInternalServerError)
@@ -781,50 +2173,172 @@ func (s *DockerServer) attachContainer(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("stdin") == "1" {
 		wg.Add(1)
 		go func() {
-			ioutil.ReadAll(conn)
-			wg.Done()
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					s.writeStdin(container, buf[:n])
+				}
+				if err != nil {
+					break
+				}
+			}
+			s.detachStdin(container)
 		}()
 	}
+	query := r.URL.Query()
+	stdout := query.Get("stdout") == "1"
+	stderr := query.Get("stderr") == "1"
+	if !stdout && !stderr {
+		stdout, stderr = true, true
+	}
 	outStream := stdcopy.NewStdWriter(conn, stdcopy.Stdout)
-	if container.State.Running {
-		fmt.Fprintf(outStream, "Container is running\n")
-	} else {
-		fmt.Fprintf(outStream, "Container is not running\n")
+	errStream := stdcopy.NewStdWriter(conn, stdcopy.Stderr)
+	s.cMut.RLock()
+	entries := s.logs[container.ID]
+	rotated := s.logsRotated[container.ID]
+	s.cMut.RUnlock()
+	// existing logs are fully replayed before streaming starts, so the
+	// client never sees history and live output interleaved.
+	if len(entries) == 0 {
+		if container.State.Running {
+			fmt.Fprintf(outStream, "Container is running\n")
+		} else {
+			fmt.Fprintf(outStream, "Container is not running\n")
+		}
+		fmt.Fprintln(outStream, "What happened?")
+		fmt.Fprintln(outStream, "Something happened")
+	} else if query.Get("logs") == "1" {
+		writeLogEntries(outStream, errStream, entries, stdout, stderr)
 	}
-	fmt.Fprintln(outStream, "What happened?")
-	fmt.Fprintln(outStream, "Something happened")
+	// sent counts all the entries written, including the ones that were
+	// dropped from the stored logs by rotation since.
+	sent := rotated + len(entries)
 	wg.Wait()
-	if r.URL.Query().Get("stream") == "1" {
+	if query.Get("stream") == "1" {
 		for {
 			time.Sleep(1e6)
 			s.cMut.RLock()
-			if !container.State.StartedAt.IsZero() && !container.State.Running {
-				s.cMut.RUnlock()
-				break
+			stored := s.logs[container.ID]
+			next := sent - s.logsRotated[container.ID]
+			if next < 0 {
+				next = 0
 			}
+			entries = stored[next:]
+			stopped := !container.State.StartedAt.IsZero() && !container.State.Running
 			s.cMut.RUnlock()
+			writeLogEntries(outStream, errStream, entries, stdout, stderr)
+			sent += len(entries)
+			if stopped {
+				break
+			}
 		}
 	}
 	conn.Close()
 }
 
+// writeStdin records input sent to the container by a client attached to its
+// stdin, as it arrives. Input sent after the stdin is closed is discarded.
+func (s *DockerServer) writeStdin(container *docker.Container, data []byte) {
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	if s.stdinClosed[container.ID] {
+		return
+	}
+	if s.stdin == nil {
+		s.stdin = make(map[string][]byte)
+	}
+	s.stdin[container.ID] = append(s.stdin[container.ID], data...)
+}
+
+// detachStdin is called when a client attached to the stdin of the container
+// closes its side of the stream. The stdin of the container is closed when the
+// container is configured with StdinOnce.
+func (s *DockerServer) detachStdin(container *docker.Container) {
+	if container.Config == nil || !container.Config.StdinOnce {
+		return
+	}
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	if s.stdinClosed == nil {
+		s.stdinClosed = make(map[string]bool)
+	}
+	s.stdinClosed[container.ID] = true
+}
+
+// validateDetachKeys checks a detach sequence: a comma separated list of
+// keys, each one in the form ctrl-<value>, where <value> is a lowercase letter
+// or one of @, [, \, ], ^ and _. Plain characters are rejected, as they would
+// swallow regular input sent to the container.
+func validateDetachKeys(keys string) error {
+	for _, key := range strings.Split(keys, ",") {
+		value := strings.TrimPrefix(key, "ctrl-")
+		if value == key || len(value) != 1 || !(value[0] >= 'a' && value[0] <= 'z' || strings.Contains("@[\\]^_", value)) {
+			return fmt.Errorf("Invalid detach keys (%s) provided: Unknown character: '%s'", keys, key)
+		}
+	}
+	return nil
+}
+
+func writeLogEntries(outStream, errStream io.Writer, entries []ContainerLogEntry, stdout, stderr bool) {
+	for _, entry := range entries {
+		if entry.Stderr && stderr {
+			fmt.Fprintln(errStream, entry.Line)
+		} else if !entry.Stderr && stdout {
+			fmt.Fprintln(outStream, entry.Line)
+		}
+	}
+}
+
 func (s *DockerServer) waitContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	condition := r.URL.Query().Get("condition")
+	switch condition {
+	case "", "not-running", "next-exit", "removed":
+	default:
+		http.Error(w, fmt.Sprintf("invalid condition: %q", condition), http.StatusBadRequest)
+		return
+	}
+	// next-exit waits for the container to exit after the request, either
+	// by seeing it running and then stopped or by a new finish time.
+	s.cMut.RLock()
+	finishedAt := container.State.FinishedAt
+	sawRunning := container.State.Running
+	s.cMut.RUnlock()
 	for {
 		time.Sleep(1e6)
 		s.cMut.RLock()
-		if !container.State.Running {
-			s.cMut.RUnlock()
+		_, err = s.findContainerWithLock(container.ID, false)
+		removed := err != nil
+		var done bool
+		switch condition {
+		case "removed":
+			done = removed
+		case "next-exit":
+			stopped := !container.State.Running
+			done = removed || (stopped && (sawRunning || !container.State.FinishedAt.Equal(finishedAt)))
+			sawRunning = sawRunning || container.State.Running
+		default:
+			done = removed || !container.State.Running
+		}
+		s.cMut.RUnlock()
+		if done {
 			break
 		}
+	}
+	// removed containers have no state left to report.
+	result := map[string]int{"StatusCode": 0}
+	if condition != "removed" {
+		s.cMut.RLock()
+		result["StatusCode"] = container.State.ExitCode
 		s.cMut.RUnlock()
 	}
-	result := map[string]int{"StatusCode": container.State.ExitCode}
 	json.NewEncoder(w).Encode(result)
 }
 
@@ -833,7 +2347,7 @@ func (s *DockerServer) removeContainer(w http.ResponseWriter, r *http.Request) {
 	force := r.URL.Query().Get("force")
 	s.cMut.Lock()
 	defer s.cMut.Unlock()
-	container, index, err := s.findContainerWithLock(id, false)
+	container, err := s.findContainerWithLock(id, false)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -844,13 +2358,88 @@ func (s *DockerServer) removeContainer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
-	s.containers[index] = s.containers[len(s.containers)-1]
-	s.containers = s.containers[:len(s.containers)-1]
+	if container.State.Running {
+		// force removal kills the container, waking up any waiters.
+		container.State.Running = false
+		container.State.FinishedAt = time.Now()
+		s.notify(container)
+	}
+	s.deleteContainer(container.ID)
+}
+
+// pruneContainers removes the containers that are not running, keeping the
+// ones created after the until filter and the ones matching any of the
+// "label!" filters.
+func (s *DockerServer) pruneContainers(w http.ResponseWriter, r *http.Request) {
+	if err := validateFilters(r, "containers/prune"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var filters map[string][]string
+	if raw := r.FormValue("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	until, err := s.untilFilter(filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := docker.PruneContainersResults{ContainersDeleted: []string{}}
+	s.cMut.Lock()
+	for _, container := range s.allContainers() {
+		var labels map[string]string
+		if container.Config != nil {
+			labels = container.Config.Labels
+		}
+		if container.State.Running ||
+			(!until.IsZero() && !container.Created.Before(until)) ||
+			!inLabelFilter(filters["label"], labels) ||
+			(len(filters["label!"]) > 0 && inLabelFilter(filters["label!"], labels)) {
+			continue
+		}
+		result.ContainersDeleted = append(result.ContainersDeleted, container.ID)
+	}
+	for _, id := range result.ContainersDeleted {
+		s.deleteContainer(id)
+	}
+	s.cMut.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// untilFilter returns the time given in the until filter of the prune
+// endpoints, or the zero time when the filter is not set.
+func (s *DockerServer) untilFilter(filters map[string][]string) (time.Time, error) {
+	switch values := filters["until"]; len(values) {
+	case 0:
+		return time.Time{}, nil
+	case 1:
+		return s.parseUntil(values[0])
+	default:
+		return time.Time{}, errors.New("more than one until filter specified")
+	}
+}
+
+// parseUntil parses the until filter of the prune endpoints, given either as
+// a duration, relative to the current time of the server, or as a timestamp.
+func (s *DockerServer) parseUntil(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return s.now().Add(-d), nil
+	}
+	until, err := parseTimestamp(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse value as time or duration: %q", value)
+	}
+	return until, nil
 }
 
 func (s *DockerServer) commitContainer(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("container")
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -859,24 +2448,42 @@ func (s *DockerServer) commitContainer(w http.ResponseWriter, r *http.Request) {
 	runConfig := r.URL.Query().Get("run")
 	if runConfig != "" {
 		err = json.Unmarshal([]byte(runConfig), config)
-		if err != nil {
+	} else if r.Body != nil {
+		err = json.NewDecoder(r.Body).Decode(config)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.cMut.RLock()
+	config = mergeCommitConfig(config, container.Config)
+	s.cMut.RUnlock()
+	for _, change := range r.URL.Query()["changes"] {
+		if err = applyCommitChange(config, change); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
+	comment := r.URL.Query().Get("comment")
+	if comment == "" {
+		comment = r.URL.Query().Get("m")
+	}
 	w.WriteHeader(http.StatusOK)
 	image := docker.Image{
 		ID:        "img-" + container.ID,
 		Parent:    container.Image,
 		Container: container.ID,
-		Comment:   r.URL.Query().Get("m"),
+		Comment:   comment,
 		Author:    r.URL.Query().Get("author"),
 		Config:    config,
 	}
 	repository := r.URL.Query().Get("repo")
 	tag := r.URL.Query().Get("tag")
 	s.iMut.Lock()
-	s.images = append(s.images, image)
+	s.addImage(image)
 	if repository != "" {
 		if tag != "" {
 			repository += ":" + tag
@@ -885,46 +2492,210 @@ func (s *DockerServer) commitContainer(w http.ResponseWriter, r *http.Request) {
 	}
 	s.iMut.Unlock()
 	s.cMut.Lock()
-	if val, ok := s.uploadedFiles[container.ID]; ok {
-		s.uploadedFiles[image.ID] = val
+	if files, ok := s.uploadedFiles[container.ID]; ok {
+		s.uploadedFiles[image.ID] = copyFiles(files)
 	}
 	s.cMut.Unlock()
 	fmt.Fprintf(w, `{"ID":%q}`, image.ID)
 }
 
-func (s *DockerServer) findContainer(idOrName string) (*docker.Container, int, error) {
+// mergeCommitConfig returns the config of an image committed from a container
+// with the given config, like the daemon does: the fields set in the config
+// sent with the commit win, the remaining ones come from the container. Env
+// entries, exposed ports, volumes and labels are merged.
+func mergeCommitConfig(override, base *docker.Config) *docker.Config {
+	merged := new(docker.Config)
+	if base != nil {
+		data, _ := json.Marshal(base)
+		json.Unmarshal(data, merged)
+	}
+	cmd, entrypoint := merged.Cmd, merged.Entrypoint
+	env := append([]string(nil), merged.Env...)
+	data, _ := json.Marshal(override)
+	json.Unmarshal(data, merged)
+	if override.Cmd == nil {
+		merged.Cmd = cmd
+	}
+	if override.Entrypoint == nil {
+		merged.Entrypoint = entrypoint
+	}
+	merged.Env = env
+	for _, kv := range override.Env {
+		merged.Env = setEnv(merged.Env, kv)
+	}
+	return merged
+}
+
+// setEnv sets the variable in the KEY=value format in the environment,
+// replacing the previous value of the variable.
+func setEnv(env []string, kv string) []string {
+	key := strings.SplitN(kv, "=", 2)[0]
+	for i, current := range env {
+		if strings.SplitN(current, "=", 2)[0] == key {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+// applyCommitChange applies a Dockerfile instruction sent in the changes
+// parameter of the commit endpoint to the config of the new image.
+func applyCommitChange(config *docker.Config, change string) error {
+	parts := strings.SplitN(strings.TrimSpace(change), " ", 2)
+	instruction := strings.ToUpper(parts[0])
+	var args string
+	if len(parts) == 2 {
+		args = strings.TrimSpace(parts[1])
+	}
+	switch instruction {
+	case "CMD":
+		config.Cmd = commandArgs(args)
+	case "ENTRYPOINT":
+		config.Entrypoint = commandArgs(args)
+	case "ENV", "LABEL":
+		pairs, err := keyValuePairs(instruction, args)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			if instruction == "ENV" {
+				config.Env = setEnv(config.Env, pair[0]+"="+pair[1])
+				continue
+			}
+			if config.Labels == nil {
+				config.Labels = make(map[string]string)
+			}
+			config.Labels[pair[0]] = pair[1]
+		}
+	case "EXPOSE":
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = make(map[docker.Port]struct{})
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			config.ExposedPorts[docker.Port(port)] = struct{}{}
+		}
+	case "VOLUME":
+		if config.Volumes == nil {
+			config.Volumes = make(map[string]struct{})
+		}
+		var volumes []string
+		if json.Unmarshal([]byte(args), &volumes) != nil {
+			volumes = strings.Fields(args)
+		}
+		for _, volume := range volumes {
+			config.Volumes[volume] = struct{}{}
+		}
+	case "USER":
+		config.User = args
+	case "WORKDIR":
+		config.WorkingDir = args
+	case "STOPSIGNAL":
+		config.StopSignal = args
+	case "ONBUILD":
+		config.OnBuild = append(config.OnBuild, args)
+	default:
+		return fmt.Errorf("%s is not a valid change command", parts[0])
+	}
+	return nil
+}
+
+// commandArgs parses the arguments of CMD and ENTRYPOINT, either in the exec
+// form (a JSON array) or in the shell form.
+func commandArgs(args string) []string {
+	var cmd []string
+	if json.Unmarshal([]byte(args), &cmd) == nil {
+		return cmd
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// keyValuePairs parses the arguments of ENV and LABEL, either a list of
+// key=value pairs or a single key followed by its value.
+func keyValuePairs(instruction, args string) ([][2]string, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s requires at least one argument", instruction)
+	}
+	if !strings.Contains(fields[0], "=") {
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%s must have two arguments", instruction)
+		}
+		return [][2]string{{parts[0], strings.TrimSpace(parts[1])}}, nil
+	}
+	pairs := make([][2]string, 0, len(fields))
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s names can not be blank", instruction)
+		}
+		pairs = append(pairs, [2]string{kv[0], strings.Trim(kv[1], `"`)})
+	}
+	return pairs, nil
+}
+
+func (s *DockerServer) findContainer(idOrName string) (*docker.Container, error) {
 	return s.findContainerWithLock(idOrName, true)
 }
 
-func (s *DockerServer) findContainerWithLock(idOrName string, shouldLock bool) (*docker.Container, int, error) {
+func (s *DockerServer) findContainerWithLock(idOrName string, shouldLock bool) (*docker.Container, error) {
 	if shouldLock {
 		s.cMut.RLock()
 		defer s.cMut.RUnlock()
 	}
-	for i, container := range s.containers {
-		if container.ID == idOrName || container.Name == idOrName {
-			return container, i, nil
-		}
-	}
-	return nil, -1, errors.New("No such container")
+	return s.getContainer(idOrName)
 }
 
 func (s *DockerServer) logContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	s.cMut.RLock()
+	readable := logsReadable(container)
+	entries := s.logs[container.ID]
+	s.cMut.RUnlock()
+	if !readable {
+		http.Error(w, errLogsNotReadable.Error(), http.StatusNotImplemented)
+		return
+	}
+	query := r.URL.Query()
+	stdout := query.Get("stdout") == "1"
+	stderr := query.Get("stderr") == "1"
+	if !stdout && !stderr {
+		stdout, stderr = true, true
+	}
 	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
 	w.WriteHeader(http.StatusOK)
-	if container.State.Running {
-		fmt.Fprintf(w, "Container is running\n")
-	} else {
-		fmt.Fprintf(w, "Container is not running\n")
+	if len(entries) > 0 {
+		if tail, err := strconv.Atoi(query.Get("tail")); err == nil && tail >= 0 && tail < len(entries) {
+			entries = entries[len(entries)-tail:]
+		}
+		// the output of containers with a TTY is a single stream, sent
+		// without the multiplexing headers.
+		if container.Config != nil && container.Config.Tty {
+			writeLogEntries(w, w, entries, stdout, stderr)
+		} else {
+			outStream := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+			errStream := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+			writeLogEntries(outStream, errStream, entries, stdout, stderr)
+		}
+	} else if stdout {
+		// the placeholder output goes to stdout only.
+		if container.State.Running {
+			fmt.Fprintf(w, "Container is running\n")
+		} else {
+			fmt.Fprintf(w, "Container is not running\n")
+		}
+		fmt.Fprintln(w, "What happened?")
+		fmt.Fprintln(w, "Something happened")
 	}
-	fmt.Fprintln(w, "What happened?")
-	fmt.Fprintln(w, "Something happened")
 	if r.URL.Query().Get("follow") == "1" {
 		for {
 			time.Sleep(1e6)
@@ -939,14 +2710,36 @@ func (s *DockerServer) logContainer(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *DockerServer) buildImage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	isolation := query.Get("isolation")
+	switch isolation {
+	case "", "default", "process", "hyperv":
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported isolation: %q", isolation), http.StatusBadRequest)
+		return
+	}
+	var shmSize int64
+	if value := query.Get("shmsize"); value != "" {
+		var err error
+		if shmSize, err = strconv.ParseInt(value, 10, 64); err != nil || shmSize < 0 {
+			http.Error(w, fmt.Sprintf("invalid shmsize: %q", value), http.StatusBadRequest)
+			return
+		}
+	}
 	if ct := r.Header.Get("Content-Type"); ct == "application/tar" {
 		gotDockerFile := false
 		tr := tar.NewReader(r.Body)
 		for {
 			header, err := tr.Next()
-			if err != nil {
+			if err == io.EOF {
 				break
 			}
+			if err != nil {
+				// the client hung up before sending the whole context,
+				// so the build is canceled.
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if header.Name == "Dockerfile" {
 				gotDockerFile = true
 			}
@@ -957,63 +2750,184 @@ func (s *DockerServer) buildImage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	var labels map[string]string
+	if value := query.Get("labels"); value != "" {
+		if err := json.Unmarshal([]byte(value), &labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.iMut.RLock()
+	buildError := s.buildError
+	s.iMut.RUnlock()
+	if buildError != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(jsonmessage.JSONMessage{
+			Error:        buildError,
+			ErrorMessage: buildError.Message,
+		})
+		return
+	}
 	//we did not use that Dockerfile to build image cause we are a fake Docker daemon
 	image := docker.Image{
 		ID:      s.generateID(),
 		Created: time.Now(),
 	}
+	if len(labels) > 0 {
+		image.Config = &docker.Config{Labels: labels}
+		image.ContainerConfig.Labels = labels
+	}
 
-	query := r.URL.Query()
+	remove, _ := strconv.ParseBool(query.Get("rm"))
+	forceRemove, _ := strconv.ParseBool(query.Get("forcerm"))
+	settings := BuildSettings{
+		Tag:         query.Get("t"),
+		Remove:      remove,
+		ForceRemove: forceRemove,
+		Isolation:   isolation,
+		ShmSize:     shmSize,
+	}
 	repository := image.ID
-	if t := query.Get("t"); t != "" {
-		repository = t
+	if settings.Tag != "" {
+		repository = settings.Tag
 	}
 	s.iMut.Lock()
-	s.images = append(s.images, image)
+	s.addImage(image)
 	s.imgIDs[repository] = image.ID
+	s.lastBuild = &settings
 	s.iMut.Unlock()
+	if settings.Remove {
+		fmt.Fprintf(w, "Removing intermediate container %s\n", s.generateID()[:12])
+	}
 	w.Write([]byte(fmt.Sprintf("Successfully built %s", image.ID)))
 }
 
 func (s *DockerServer) pullImage(w http.ResponseWriter, r *http.Request) {
-	fromImageName := r.URL.Query().Get("fromImage")
-	tag := r.URL.Query().Get("tag")
+	query := r.URL.Query()
+	// images are either pulled (fromImage) or imported (fromSrc), in which
+	// case the name comes from repo.
+	name := query.Get("fromImage")
+	if query.Get("fromSrc") != "" {
+		name = query.Get("repo")
+	}
+	// "pull -a" may send a name with a trailing colon.
+	name = strings.TrimSuffix(name, ":")
+	repository, _ := docker.ParseRepositoryTag(name)
+	if tag := query.Get("tag"); name != "" && tag != "" {
+		separator := ":"
+		if strings.HasPrefix(tag, "sha256") {
+			separator = "@"
+		}
+		name = repository + separator + tag
+	}
+	platform := query.Get("platform")
+	if _, err := parsePlatform(platform); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	image := docker.Image{
 		ID:     s.generateID(),
 		Config: &docker.Config{},
 	}
 	s.iMut.Lock()
-	s.images = append(s.images, image)
-	if fromImageName != "" {
-		if tag != "" {
-			separator := ":"
-			if strings.HasPrefix(tag, "sha256") {
-				separator = "@"
-			}
-			fromImageName = fmt.Sprintf("%s%s%s", fromImageName, separator, tag)
-		}
-		s.imgIDs[fromImageName] = image.ID
+	selected, err := selectPlatform(s.imgPlatforms[repository], platform)
+	if err != nil {
+		s.iMut.Unlock()
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if parts, _ := parsePlatform(selected); parts != nil {
+		image.OS, image.Architecture, image.Variant = parts[0], parts[1], parts[2]
+	}
+	s.addImage(image)
+	if name != "" {
+		s.imgIDs[name] = image.ID
 	}
 	s.iMut.Unlock()
 }
 
+// parsePlatform splits a platform in the os[/arch[/variant]] format, returning
+// nil for the empty platform.
+func parsePlatform(platform string) ([]string, error) {
+	if platform == "" {
+		return nil, nil
+	}
+	parts := strings.Split(platform, "/")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid platform %q: unknown format", platform)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid platform %q: unknown format", platform)
+		}
+	}
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts, nil
+}
+
+// selectPlatform picks the first of the available platforms matching the
+// requested one, which may omit the architecture and the variant. With no
+// platform requested the first available platform is picked, and with no
+// platforms available the requested one is used as is.
+func selectPlatform(available []string, requested string) (string, error) {
+	if len(available) == 0 {
+		return requested, nil
+	}
+	if requested == "" {
+		return available[0], nil
+	}
+	want, _ := parsePlatform(requested)
+	for _, platform := range available {
+		parts, err := parsePlatform(platform)
+		if err != nil || parts == nil {
+			continue
+		}
+		if parts[0] == want[0] && (want[1] == "" || parts[1] == want[1]) && (want[2] == "" || parts[2] == want[2]) {
+			return platform, nil
+		}
+	}
+	return "", fmt.Errorf("no matching manifest for %s in the manifest list entries", requested)
+}
+
 func (s *DockerServer) pushImage(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 	tag := r.URL.Query().Get("tag")
-	if tag != "" {
-		name += ":" + tag
-	}
 	s.iMut.RLock()
-	if _, ok := s.imgIDs[name]; !ok {
-		s.iMut.RUnlock()
+	found := s.hasImageTag(name, tag)
+	s.iMut.RUnlock()
+	if !found {
 		http.Error(w, "No such image", http.StatusNotFound)
 		return
 	}
-	s.iMut.RUnlock()
 	fmt.Fprintln(w, "Pushing...")
 	fmt.Fprintln(w, "Pushed")
 }
 
+// hasImageTag reports whether the given repository has the given tag. An empty
+// tag matches any tag in the repository, and "latest" matches the untagged
+// name. Must be called with iMut held.
+func (s *DockerServer) hasImageTag(repo, tag string) bool {
+	if tag == "" {
+		if _, ok := s.imgIDs[repo]; ok {
+			return true
+		}
+		for name := range s.imgIDs {
+			if strings.HasPrefix(name, repo+":") {
+				return true
+			}
+		}
+		return false
+	}
+	if _, ok := s.imgIDs[repo+":"+tag]; ok {
+		return true
+	}
+	_, ok := s.imgIDs[repo]
+	return ok && tag == "latest"
+}
+
 func (s *DockerServer) tagImage(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 	s.iMut.RLock()
@@ -1048,21 +2962,47 @@ func (s *DockerServer) removeImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	s.iMut.RUnlock()
-	_, index, err := s.findImageByID(id)
+	_, err := s.findImageByID(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	var result []docker.ImageDelete
 	s.iMut.Lock()
 	defer s.iMut.Unlock()
-	if len(tags) < 2 {
-		s.images[index] = s.images[len(s.images)-1]
-		s.images = s.images[:len(s.images)-1]
-	}
 	if tag != "" {
 		delete(s.imgIDs, tag)
+		result = append(result, docker.ImageDelete{Untagged: tag})
+	}
+	if len(tags) < 2 {
+		s.deleteImage(id)
+		if s.removedImages == nil {
+			s.removedImages = make(map[string]bool)
+		}
+		s.removedImages[id] = true
+		for _, t := range tags {
+			s.removedImages[t] = true
+		}
+		result = append(result, docker.ImageDelete{Deleted: id})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// imageRemoved reports whether the image with the given name or ID was
+// removed and not recreated since.
+func (s *DockerServer) imageRemoved(name string) bool {
+	s.iMut.RLock()
+	defer s.iMut.RUnlock()
+	if !s.removedImages[name] {
+		return false
+	}
+	if _, ok := s.imgIDs[name]; ok {
+		return false
 	}
+	_, ok := s.imageByID(name)
+	return !ok
 }
 
 func (s *DockerServer) inspectImage(w http.ResponseWriter, r *http.Request) {
@@ -1070,38 +3010,189 @@ func (s *DockerServer) inspectImage(w http.ResponseWriter, r *http.Request) {
 	s.iMut.RLock()
 	defer s.iMut.RUnlock()
 	if id, ok := s.imgIDs[name]; ok {
-		for _, img := range s.images {
-			if img.ID == id {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
-				json.NewEncoder(w).Encode(img)
-				return
+		if img, ok := s.imageByID(id); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(img)
+			return
+		}
+	}
+	http.Error(w, "not found", http.StatusNotFound)
+}
+
+// imageHistory returns the history set with SetImageHistory or, by default,
+// one entry for the image and for each of its known parents.
+func (s *DockerServer) imageHistory(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	s.iMut.RLock()
+	defer s.iMut.RUnlock()
+	image, ok := s.imageByName(name)
+	if !ok {
+		http.Error(w, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+	history, custom := s.imgHistory[image.ID]
+	if !custom {
+		visited := make(map[string]bool)
+		for ok && !visited[image.ID] {
+			visited[image.ID] = true
+			var tags []string
+			for tag, id := range s.imgIDs {
+				if id == image.ID && tag != id {
+					tags = append(tags, tag)
+				}
 			}
+			sort.Strings(tags)
+			history = append(history, docker.ImageHistory{
+				ID:        image.ID,
+				Tags:      tags,
+				Created:   image.Created.Unix(),
+				CreatedBy: strings.Join(image.ContainerConfig.Cmd, " "),
+				Size:      image.Size,
+				Comment:   image.Comment,
+			})
+			image, ok = s.imageByName(image.Parent)
 		}
 	}
-	http.Error(w, "not found", http.StatusNotFound)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(history)
+}
+
+// imageByName finds an image by name or ID. It must be called with iMut
+// held.
+func (s *DockerServer) imageByName(name string) (docker.Image, bool) {
+	if name == "" {
+		return docker.Image{}, false
+	}
+	id, ok := s.imgIDs[name]
+	if !ok {
+		id = name
+	}
+	return s.imageByID(id)
 }
 
+// eventsLimit is the number of generated events kept by the server for
+// replaying to clients listening with the since parameter.
+const eventsLimit = 256
+
 func (s *DockerServer) listEvents(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var events [][]byte
-	count := mathrand.Intn(20)
-	for i := 0; i < count; i++ {
-		data, err := json.Marshal(s.generateEvent())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+	s.writeResponseHeaders(w)
+	if err := validateFilters(r, "events"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since, until time.Time
+	var err error
+	if value := r.URL.Query().Get("since"); value != "" {
+		if since, err = parseTimestamp(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("until"); value != "" {
+		if until, err = parseTimestamp(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		events = append(events, data)
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	for _, d := range events {
-		fmt.Fprintln(w, d)
-		time.Sleep(time.Duration(mathrand.Intn(200)) * time.Millisecond)
+	// subscribing along with the copy of the buffered events makes sure
+	// that emitted events are sent exactly once. Buffered events are only
+	// replayed to clients listening with since or until.
+	sub := make(chan docker.APIEvents, eventsLimit)
+	s.eventMut.Lock()
+	var events []docker.APIEvents
+	if !since.IsZero() || !until.IsZero() {
+		events = make([]docker.APIEvents, len(s.events))
+		copy(events, s.events)
+	}
+	if s.eventSubs == nil {
+		s.eventSubs = make(map[chan docker.APIEvents]struct{})
+	}
+	s.eventSubs[sub] = struct{}{}
+	s.eventMut.Unlock()
+	defer func() {
+		s.eventMut.Lock()
+		delete(s.eventSubs, sub)
+		s.eventMut.Unlock()
+	}()
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		eventTime := time.Unix(0, event.TimeNano)
+		if eventTime.Before(since) || (!until.IsZero() && eventTime.After(until)) {
+			continue
+		}
+		encoder.Encode(event)
+	}
+	// after replaying the buffered events, live events are streamed until
+	// the client hangs up or the until timestamp is reached. Clients
+	// listening without since or until get a finite burst of random events,
+	// along with the events emitted in the meantime.
+	var deadline <-chan time.Time
+	if !until.IsZero() {
+		timer := time.NewTimer(until.Sub(time.Now()))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	burst := -1
+	if since.IsZero() && until.IsZero() {
+		burst = mathrand.Intn(20)
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if burst == 0 {
+			// events emitted before the end of the burst are still sent.
+			for {
+				select {
+				case event := <-sub:
+					encoder.Encode(event)
+				default:
+					return
+				}
+			}
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline:
+			return
+		case event := <-sub:
+			encoder.Encode(event)
+			continue
+		case <-time.After(time.Duration(mathrand.Intn(200)) * time.Millisecond):
+		}
+		encoder.Encode(s.generateEvent())
+		if burst > 0 {
+			burst--
+		}
 	}
 }
 
 func (s *DockerServer) pingDocker(w http.ResponseWriter, r *http.Request) {
+	s.handlerMutex.RLock()
+	latency := s.pingLatency
+	s.handlerMutex.RUnlock()
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	s.handlerMutex.RLock()
+	starting := s.starting
+	s.handlerMutex.RUnlock()
+	if starting {
+		http.Error(w, "System not ready", http.StatusServiceUnavailable)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -1117,30 +3208,234 @@ func (s *DockerServer) generateEvent() *docker.APIEvents {
 	case 3:
 		eventType = "destroy"
 	}
-	return &docker.APIEvents{
-		ID:     s.generateID(),
-		Status: eventType,
-		From:   "mybase:latest",
-		Time:   time.Now().Unix(),
+	now := time.Now()
+	event := docker.APIEvents{
+		ID:       s.generateID(),
+		Status:   eventType,
+		From:     "mybase:latest",
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+	defer s.recordEvent(&event)
+	s.cMut.RLock()
+	defer s.cMut.RUnlock()
+	if containers := s.allContainers(); len(containers) > 0 {
+		event = containerEvent(containers[mathrand.Intn(len(containers))], eventType)
+		event.Time = now.Unix()
+		event.TimeNano = now.UnixNano()
+	}
+	return &event
+}
+
+// containerEvent builds an event with the given action for the container,
+// using the current time.
+func containerEvent(container *docker.Container, action string) docker.APIEvents {
+	now := time.Now()
+	event := docker.APIEvents{
+		ID:       container.ID,
+		Status:   action,
+		Type:     "container",
+		Action:   action,
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+	attributes := make(map[string]string)
+	if container.Config != nil {
+		for k, v := range container.Config.Labels {
+			attributes[k] = v
+		}
+		attributes["image"] = container.Config.Image
+		event.From = container.Config.Image
+	}
+	attributes["name"] = strings.TrimPrefix(container.Name, "/")
+	event.Actor = docker.APIActor{ID: container.ID, Attributes: attributes}
+	return event
+}
+
+func (s *DockerServer) recordEvent(event *docker.APIEvents) {
+	s.eventMut.Lock()
+	defer s.eventMut.Unlock()
+	s.appendEvent(*event)
+}
+
+// appendEvent adds the event to the buffer replayed to clients, must be
+// called with eventMut held.
+func (s *DockerServer) appendEvent(event docker.APIEvents) {
+	s.events = append(s.events, event)
+	if len(s.events) > eventsLimit {
+		s.events = s.events[len(s.events)-eventsLimit:]
+	}
+}
+
+// emitEvent records the event and sends it to all the clients streaming
+// events. Both happen under the same lock, so a client subscribing
+// concurrently either gets the event in the replay or in the stream.
+func (s *DockerServer) emitEvent(event docker.APIEvents) {
+	s.eventMut.Lock()
+	defer s.eventMut.Unlock()
+	s.appendEvent(event)
+	for sub := range s.eventSubs {
+		select {
+		case sub <- event:
+		default:
+		}
 	}
 }
 
 func (s *DockerServer) loadImage(w http.ResponseWriter, r *http.Request) {
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+	}
+	tr := tar.NewReader(r.Body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	s.iMut.Lock()
+	defer s.iMut.Unlock()
+	if s.imgIDs == nil {
+		s.imgIDs = make(map[string]string)
+	}
+	encoder := json.NewEncoder(w)
+	for _, entry := range manifest {
+		id := strings.TrimSuffix(libpath.Base(entry.Config), ".json")
+		if entry.Config == "" {
+			id = s.generateID()
+		}
+		id = "sha256:" + strings.TrimPrefix(id, "sha256:")
+		if _, found := s.imageByID(id); !found {
+			s.addImage(docker.Image{ID: id, Created: time.Now()})
+		}
+		if len(entry.RepoTags) == 0 {
+			encoder.Encode(map[string]string{"stream": "Loaded image ID: " + id + "\n"})
+		}
+		for _, tag := range entry.RepoTags {
+			s.imgIDs[tag] = id
+			encoder.Encode(map[string]string{"stream": "Loaded image: " + tag + "\n"})
+		}
+	}
 }
 
+type savedImage struct {
+	image docker.Image
+	tags  []string
+}
+
+// getImage writes a tarball with the config of the requested images and a
+// manifest listing them in the order they were requested. Names referring to
+// the same image are merged into a single entry. Timestamps in the tarball are
+// fixed, so saving the same images always produces the same bytes.
 func (s *DockerServer) getImage(w http.ResponseWriter, r *http.Request) {
+	names := r.URL.Query()["names"]
+	if id := mux.Vars(r)["id"]; id != "" {
+		names = []string{id}
+	}
+	var saved []*savedImage
+	s.iMut.RLock()
+	for _, name := range names {
+		image, ok := s.imageByName(name)
+		if !ok {
+			s.iMut.RUnlock()
+			http.Error(w, "No such image: "+name, http.StatusNotFound)
+			return
+		}
+		var entry *savedImage
+		for _, si := range saved {
+			if si.image.ID == image.ID {
+				entry = si
+				break
+			}
+		}
+		if entry == nil {
+			entry = &savedImage{image: image}
+			saved = append(saved, entry)
+		}
+		if _, tagged := s.imgIDs[name]; tagged {
+			entry.tags = append(entry.tags, name)
+		}
+	}
+	s.iMut.RUnlock()
+	type manifestEntry struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	manifest := make([]manifestEntry, 0, len(saved))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	modTime := time.Unix(0, 0)
+	writeFile := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	for _, si := range saved {
+		config, err := json.Marshal(map[string]interface{}{
+			"architecture": si.image.Architecture,
+			"os":           si.image.OS,
+			"created":      si.image.Created,
+			"config":       si.image.Config,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		configFile := strings.TrimPrefix(si.image.ID, "sha256:") + ".json"
+		if err := writeFile(configFile, config); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		manifest = append(manifest, manifestEntry{Config: configFile, RepoTags: si.tags, Layers: []string{}})
+	}
+	data, err := json.Marshal(manifest)
+	if err == nil {
+		err = writeFile("manifest.json", data)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
 	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/tar")
+	w.Write(buf.Bytes())
 }
 
 func (s *DockerServer) createExecContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	container, _, err := s.findContainer(id)
+	container, err := s.findContainer(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if !container.State.Running {
+		http.Error(w, fmt.Sprintf("Container %s is not running", container.ID), http.StatusConflict)
+		return
+	}
+	if container.State.Paused {
+		http.Error(w, fmt.Sprintf("Container %s is paused, unpause the container before exec", container.ID), http.StatusConflict)
+		return
+	}
 
 	execID := s.generateID()
 	container.ExecIDs = append(container.ExecIDs, execID)
@@ -1165,6 +3460,10 @@ func (s *DockerServer) createExecContainer(w http.ResponseWriter, r *http.Reques
 
 	exec.ProcessConfig.User = params.User
 	exec.ProcessConfig.Tty = params.Tty
+	exec.ProcessConfig.Privileged = params.Privileged
+	exec.OpenStdin = params.AttachStdin
+	exec.OpenStdout = params.AttachStdout
+	exec.OpenStderr = params.AttachStderr
 
 	s.execMut.Lock()
 	s.execs = append(s.execs, &exec)
@@ -1176,24 +3475,51 @@ func (s *DockerServer) createExecContainer(w http.ResponseWriter, r *http.Reques
 
 func (s *DockerServer) startExecContainer(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if exec, err := s.getExec(id, false); err == nil {
-		s.execMut.Lock()
-		exec.Running = true
-		s.execMut.Unlock()
-		if callback, ok := s.execCallbacks[id]; ok {
-			callback()
-			delete(s.execCallbacks, id)
-		} else if callback, ok := s.execCallbacks["*"]; ok {
-			callback()
-			delete(s.execCallbacks, "*")
-		}
-		s.execMut.Lock()
-		exec.Running = false
-		s.execMut.Unlock()
+	exec, err := s.getExec(id, false)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var opts struct {
+		Detach bool
+	}
+	json.NewDecoder(r.Body).Decode(&opts)
+	s.execMut.Lock()
+	exec.Running = true
+	exec.Pid = mathrand.Intn(30000) + 1000
+	s.execMut.Unlock()
+	hijacker, ok := w.(http.Hijacker)
+	if opts.Detach || !ok {
+		s.runExec(exec)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the connection is kept open while the exec is running, so attached
+	// clients only see the end of the stream when the exec exits.
+	defer conn.Close()
+	s.runExec(exec)
+}
+
+// runExec blocks until the callback prepared for the given exec (see
+// PrepareExec) returns, and then marks the exec as not running.
+func (s *DockerServer) runExec(exec *docker.ExecInspect) {
+	if callback, ok := s.execCallbacks[exec.ID]; ok {
+		callback()
+		delete(s.execCallbacks, exec.ID)
+	} else if callback, ok := s.execCallbacks["*"]; ok {
+		callback()
+		delete(s.execCallbacks, "*")
+	}
+	s.execMut.Lock()
+	exec.Running = false
+	s.execMut.Unlock()
 }
 
 func (s *DockerServer) resizeExecContainer(w http.ResponseWriter, r *http.Request) {
@@ -1243,6 +3569,10 @@ func (s *DockerServer) findNetwork(idOrName string) (*docker.Network, int, error
 }
 
 func (s *DockerServer) listNetworks(w http.ResponseWriter, r *http.Request) {
+	if err := validateFilters(r, "networks"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	s.netMut.RLock()
 	result := make([]docker.Network, 0, len(s.networks))
 	for _, network := range s.networks {
@@ -1287,44 +3617,210 @@ func (s *DockerServer) createNetwork(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if n, _, _ := s.findNetwork(config.Name); n != nil {
+		if config.CheckDuplicate {
+			http.Error(w, fmt.Sprintf("network with name %s already exists", config.Name), http.StatusConflict)
+			return
+		}
 		http.Error(w, "network already exists", http.StatusForbidden)
 		return
 	}
 
+	if config.EnableIPv6 && !hasIPv6Subnet(config.IPAM) {
+		http.Error(w, "non-overlapping IPv6 address pool(s) must be provided when enabling IPv6", http.StatusBadRequest)
+		return
+	}
 	generatedID := s.generateID()
 	network := docker.Network{
-		Name:   config.Name,
-		ID:     generatedID,
-		Driver: config.Driver,
+		Name:       config.Name,
+		ID:         generatedID,
+		Driver:     config.Driver,
+		IPAM:       config.IPAM,
+		Internal:   config.Internal,
+		EnableIPv6: config.EnableIPv6,
+		Attachable: config.Attachable,
+		Labels:     config.Labels,
 	}
+	created := s.now()
 	s.netMut.Lock()
 	s.networks = append(s.networks, &network)
+	if s.netCreated == nil {
+		s.netCreated = make(map[string]time.Time)
+	}
+	s.netCreated[network.ID] = created
 	s.netMut.Unlock()
 	w.WriteHeader(http.StatusCreated)
 	var c = struct{ ID string }{ID: network.ID}
 	json.NewEncoder(w).Encode(c)
 }
 
+// hasIPv6Subnet reports whether any of the IPAM configs has an IPv6 subnet.
+func hasIPv6Subnet(ipam docker.IPAMOptions) bool {
+	for _, config := range ipam.Config {
+		if ip, _, err := net.ParseCIDR(config.Subnet); err == nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DockerServer) connectNetwork(w http.ResponseWriter, r *http.Request) {
+	var opts docker.NetworkConnectionOptions
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Container == "" {
+		http.Error(w, "container is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateEndpointConfig(opts.EndpointConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	network, _, err := s.findNetwork(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	container, err := s.findContainer(opts.Container)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	endpoint := docker.Endpoint{
+		Name: strings.TrimPrefix(container.Name, "/"),
+		ID:   s.generateID(),
+	}
+	settings := docker.ContainerNetwork{
+		NetworkID:  network.ID,
+		EndpointID: endpoint.ID,
+	}
+	if config := opts.EndpointConfig; config != nil {
+		settings.Aliases = config.Aliases
+		settings.MacAddress = config.MacAddress
+		endpoint.MacAddress = config.MacAddress
+		if config.IPAMConfig != nil {
+			settings.IPAddress = config.IPAMConfig.IPv4Address
+			settings.GlobalIPv6Address = config.IPAMConfig.IPv6Address
+			endpoint.IPv4Address = config.IPAMConfig.IPv4Address
+			endpoint.IPv6Address = config.IPAMConfig.IPv6Address
+		}
+	}
+	s.netMut.Lock()
+	if _, ok := network.Containers[container.ID]; ok {
+		s.netMut.Unlock()
+		http.Error(w, fmt.Sprintf("endpoint already exists in network %s", network.Name), http.StatusForbidden)
+		return
+	}
+	if network.Containers == nil {
+		network.Containers = make(map[string]docker.Endpoint)
+	}
+	network.Containers[container.ID] = endpoint
+	s.netMut.Unlock()
+	s.cMut.Lock()
+	if container.NetworkSettings == nil {
+		container.NetworkSettings = &docker.NetworkSettings{}
+	}
+	if container.NetworkSettings.Networks == nil {
+		container.NetworkSettings.Networks = make(map[string]docker.ContainerNetwork)
+	}
+	container.NetworkSettings.Networks[network.Name] = settings
+	s.cMut.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateEndpointConfig checks the addresses in the endpoint configuration
+// sent when connecting a container to a network.
+func validateEndpointConfig(config *docker.EndpointConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.MacAddress != "" {
+		if _, err := net.ParseMAC(config.MacAddress); err != nil {
+			return err
+		}
+	}
+	if ipam := config.IPAMConfig; ipam != nil {
+		if ipam.IPv4Address != "" {
+			if ip := net.ParseIP(ipam.IPv4Address); ip == nil || ip.To4() == nil {
+				return fmt.Errorf("invalid IPv4 address: %s", ipam.IPv4Address)
+			}
+		}
+		if ipam.IPv6Address != "" {
+			if ip := net.ParseIP(ipam.IPv6Address); ip == nil || ip.To4() != nil {
+				return fmt.Errorf("invalid IPv6 address: %s", ipam.IPv6Address)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *DockerServer) removeNetwork(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	_, index, err := s.findNetwork(id)
+	network, index, err := s.findNetwork(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	s.netMut.Lock()
 	defer s.netMut.Unlock()
+	delete(s.netCreated, network.ID)
 	s.networks[index] = s.networks[len(s.networks)-1]
 	s.networks = s.networks[:len(s.networks)-1]
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// pruneNetworks removes the networks that have no containers attached. Networks
+// matching any of the "label!" filters, and the ones created after the until
+// filter, are preserved.
+func (s *DockerServer) pruneNetworks(w http.ResponseWriter, r *http.Request) {
+	if err := validateFilters(r, "networks/prune"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var filters map[string][]string
+	if raw := r.FormValue("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	until, err := s.untilFilter(filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var result docker.PruneNetworksResults
+	s.netMut.Lock()
+	kept := s.networks[:0]
+	for _, network := range s.networks {
+		// networks not created through the API have no creation time and
+		// are always older than the until filter.
+		if len(network.Containers) > 0 ||
+			(!until.IsZero() && !s.netCreated[network.ID].Before(until)) ||
+			!inLabelFilter(filters["label"], network.Labels) ||
+			(len(filters["label!"]) > 0 && inLabelFilter(filters["label!"], network.Labels)) {
+			kept = append(kept, network)
+			continue
+		}
+		result.NetworksDeleted = append(result.NetworksDeleted, network.ID)
+		delete(s.netCreated, network.ID)
+	}
+	s.networks = kept
+	s.netMut.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
 func (s *DockerServer) listVolumes(w http.ResponseWriter, r *http.Request) {
-	s.volMut.RLock()
-	result := make([]docker.Volume, 0, len(s.volStore))
-	for _, volumeCounter := range s.volStore {
-		result = append(result, volumeCounter.volume)
+	if err := validateFilters(r, "volumes"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	s.volMut.RLock()
+	result := s.allVolumes()
 	s.volMut.RUnlock()
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -1356,20 +3852,13 @@ func (s *DockerServer) createVolume(w http.ResponseWriter, r *http.Request) {
 	// Mount point is a default one with name
 	volume.Mountpoint = "/var/lib/docker/volumes/" + volume.Name
 
-	// If the volume already exists, don't re-add it.
-	exists := false
+	// If the volume already exists, don't re-add it. Like the daemon, the
+	// existing volume is returned as if it was created.
 	s.volMut.Lock()
-	if s.volStore != nil {
-		_, exists = s.volStore[volume.Name]
+	if existing, err := s.findVolume(volume.Name); err == nil {
+		volume = &existing.volume
 	} else {
-		// No volumes, create volStore
-		s.volStore = make(map[string]*volumeCounter)
-	}
-	if !exists {
-		s.volStore[volume.Name] = &volumeCounter{
-			volume: *volume,
-			count:  0,
-		}
+		s.addVolume(*volume)
 	}
 	s.volMut.Unlock()
 	w.WriteHeader(http.StatusCreated)
@@ -1385,43 +3874,65 @@ func (s *DockerServer) inspectVolume(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	volume := vol.volume
+	if usage, ok := s.volUsage[name]; ok {
+		volume.UsageData = &usage
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(vol.volume)
-}
-
-func (s *DockerServer) findVolume(name string) (*volumeCounter, error) {
-	vol, ok := s.volStore[name]
-	if !ok {
-		return nil, errors.New("no such volume")
-	}
-	return vol, nil
+	json.NewEncoder(w).Encode(volume)
 }
 
 func (s *DockerServer) removeVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	s.cMut.RLock()
+	users := s.volumeUsers(name)
+	s.cMut.RUnlock()
 	s.volMut.Lock()
 	defer s.volMut.Unlock()
-	name := mux.Vars(r)["name"]
 	vol, err := s.findVolume(name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	if vol.count != 0 {
-		http.Error(w, "volume in use and cannot be removed", http.StatusConflict)
-		return
+	if !force {
+		if len(users) > 0 {
+			http.Error(w, fmt.Sprintf("remove %s: volume is in use - [%s]", name, strings.Join(users, ", ")), http.StatusConflict)
+			return
+		}
+		if vol.count != 0 {
+			http.Error(w, "volume in use and cannot be removed", http.StatusConflict)
+			return
+		}
 	}
-	delete(s.volStore, vol.volume.Name)
+	s.deleteVolume(vol.volume.Name)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// volumeUsers returns the IDs of the containers mounting the given volume.
+// Must be called with cMut held.
+func (s *DockerServer) volumeUsers(name string) []string {
+	var users []string
+	for _, container := range s.allContainers() {
+		for _, mount := range container.Mounts {
+			if mount.Type == "volume" && mount.Name == name {
+				users = append(users, container.ID)
+				break
+			}
+		}
+	}
+	return users
+}
+
 func (s *DockerServer) infoDocker(w http.ResponseWriter, r *http.Request) {
 	s.cMut.RLock()
 	defer s.cMut.RUnlock()
 	s.iMut.RLock()
 	defer s.iMut.RUnlock()
+	containers := s.allContainers()
 	var running, stopped, paused int
-	for _, c := range s.containers {
+	for _, c := range containers {
 		if c.State.Running {
 			running++
 		} else {
@@ -1437,6 +3948,9 @@ func (s *DockerServer) infoDocker(w http.ResponseWriter, r *http.Request) {
 			NodeID: s.nodeID,
 		}
 		for _, n := range s.nodes {
+			if n.ManagerStatus == nil {
+				continue
+			}
 			swarmInfo.RemoteManagers = append(swarmInfo.RemoteManagers, swarm.Peer{
 				NodeID: n.ID,
 				Addr:   n.ManagerStatus.Addr,
@@ -1445,11 +3959,11 @@ func (s *DockerServer) infoDocker(w http.ResponseWriter, r *http.Request) {
 	}
 	envs := map[string]interface{}{
 		"ID":                "AAAA:XXXX:0000:BBBB:AAAA:XXXX:0000:BBBB:AAAA:XXXX:0000:BBBB",
-		"Containers":        len(s.containers),
+		"Containers":        len(containers),
 		"ContainersRunning": running,
 		"ContainersPaused":  paused,
 		"ContainersStopped": stopped,
-		"Images":            len(s.images),
+		"Images":            len(s.allImages()),
 		"Driver":            "aufs",
 		"DriverStatus":      [][]string{},
 		"SystemStatus":      nil,
@@ -1506,6 +4020,7 @@ func (s *DockerServer) infoDocker(w http.ResponseWriter, r *http.Request) {
 		"ClusterStore":      "",
 		"ClusterAdvertise":  "",
 		"Swarm":             swarmInfo,
+		"Warnings":          s.infoWarnings,
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(envs)
@@ -1523,6 +4038,16 @@ func (s *DockerServer) versionDocker(w http.ResponseWriter, r *http.Request) {
 		"BuildTime":     "2015-12-01T07:09:13.444803460+00:00",
 		"Experimental":  false,
 	}
+	s.handlerMutex.RLock()
+	if s.apiVersion != nil {
+		envs["ApiVersion"] = s.apiVersion.String()
+	}
+	s.handlerMutex.RUnlock()
+	s.cMut.RLock()
+	for key, value := range s.versionFields {
+		envs[key] = value
+	}
+	s.cMut.RUnlock()
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(envs)
 }
@@ -1535,7 +4060,9 @@ func (s *DockerServer) SwarmAddress() string {
 	return s.swarmServer.listener.Addr().String()
 }
 
-func (s *DockerServer) initSwarmNode(listenAddr, advertiseAddr string) (swarm.Node, error) {
+// initSwarmNode starts the swarm listener and returns the local node along
+// with the address other managers reach it at.
+func (s *DockerServer) initSwarmNode(listenAddr, advertiseAddr string) (swarm.Node, string, error) {
 	_, portPart, _ := net.SplitHostPort(listenAddr)
 	if portPart == "" {
 		portPart = "0"
@@ -1543,7 +4070,7 @@ func (s *DockerServer) initSwarmNode(listenAddr, advertiseAddr string) (swarm.No
 	var err error
 	s.swarmServer, err = newSwarmServer(s, fmt.Sprintf("127.0.0.1:%s", portPart))
 	if err != nil {
-		return swarm.Node{}, err
+		return swarm.Node{}, "", err
 	}
 	if advertiseAddr == "" {
 		advertiseAddr = s.SwarmAddress()
@@ -1558,11 +4085,15 @@ func (s *DockerServer) initSwarmNode(listenAddr, advertiseAddr string) (swarm.No
 	s.nodeID = s.generateID()
 	return swarm.Node{
 		ID: s.nodeID,
+		Spec: swarm.NodeSpec{
+			Role: swarm.NodeRoleManager,
+		},
+		Description: swarm.NodeDescription{
+			Hostname: "node-" + s.nodeID[:12],
+		},
 		Status: swarm.NodeStatus{
 			State: swarm.NodeStateReady,
+			Addr:  hostPart,
 		},
-		ManagerStatus: &swarm.ManagerStatus{
-			Addr: fmt.Sprintf("%s:%s", hostPart, portPart),
-		},
-	}, nil
+	}, fmt.Sprintf("%s:%s", hostPart, portPart), nil
 }
@@ -8,13 +8,16 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
@@ -23,6 +26,8 @@ import (
 	"time"
 
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/fsouza/go-dockerclient"
 )
 
@@ -182,6 +187,33 @@ func TestCustomHandlerRegexp(t *testing.T) {
 	}
 }
 
+func TestSetResponseHeader(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{failures: make(map[string]string)}
+	server.buildMuxer()
+	server.SetResponseHeader("Server", "Docker/1.10.1 (linux)")
+	server.SetResponseHeader("X-Request-Id", "abc123")
+	server.PrepareFailure("ping-failure", "/_ping")
+	for _, path := range []string{"/containers/json", "/_ping"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if got := recorder.Header().Get("Server"); got != "Docker/1.10.1 (linux)" {
+			t.Errorf("%s: wrong Server header. Want %q. Got %q.", path, "Docker/1.10.1 (linux)", got)
+		}
+		if got := recorder.Header().Get("X-Request-Id"); got != "abc123" {
+			t.Errorf("%s: wrong X-Request-Id header. Want %q. Got %q.", path, "abc123", got)
+		}
+	}
+	server.SetResponseHeader("X-Request-Id", "")
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/containers/json", nil)
+	server.ServeHTTP(recorder, request)
+	if _, ok := recorder.Header()["X-Request-Id"]; ok {
+		t.Error("SetResponseHeader: header should have been removed")
+	}
+}
+
 func TestListContainers(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -204,6 +236,13 @@ func TestListContainers(t *testing.T) {
 			Ports:   container.NetworkSettings.PortMappingAPI(),
 			Names:   []string{"/" + container.Name},
 			State:   container.State.StateString(),
+			Networks: docker.NetworkList{Networks: map[string]docker.ContainerNetwork{
+				"bridge": {
+					IPAddress:   container.NetworkSettings.IPAddress,
+					IPPrefixLen: container.NetworkSettings.IPPrefixLen,
+					Gateway:     container.NetworkSettings.Gateway,
+				},
+			}},
 		}
 	}
 	var got []docker.APIContainers
@@ -237,108 +276,386 @@ func TestListRunningContainers(t *testing.T) {
 	}
 }
 
-func TestCreateContainer(t *testing.T) {
+func TestListContainersLabels(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	server.imgIDs = map[string]string{"base": "a1234"}
-	server.uploadedFiles = map[string]string{"a1234": "/abcd"}
+	addContainers(&server, 2)
+	server.containers[0].Config.Labels = map[string]string{"app": "web", "tier": "frontend"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	body := `{"Hostname":"", "User":"ubuntu", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
-"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":"","HostConfig":{"Binds":["/var/run/docker.sock:/var/run/docker.sock:rw"]}}`
-	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
+	request, _ := http.NewRequest("GET", "/containers/json?all=1", nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusCreated {
-		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("ListContainers: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	var returned docker.Container
-	err := json.NewDecoder(recorder.Body).Decode(&returned)
+	var got []docker.APIContainers
+	err := json.NewDecoder(recorder.Body).Decode(&got)
 	if err != nil {
 		t.Fatal(err)
 	}
-	stored := server.containers[0]
-	if returned.ID != stored.ID {
-		t.Errorf("CreateContainer: ID mismatch. Stored: %q. Returned: %q.", stored.ID, returned.ID)
-	}
-	if stored.State.Running {
-		t.Errorf("CreateContainer should not set container to running state.")
-	}
-	if !stored.State.StartedAt.IsZero() {
-		t.Errorf("CreateContainer should not set startedAt in container state.")
+	if !reflect.DeepEqual(got[0].Labels, server.containers[0].Config.Labels) {
+		t.Errorf("ListContainers: wrong labels. Want %#v. Got %#v.", server.containers[0].Config.Labels, got[0].Labels)
 	}
-	if stored.Config.User != "ubuntu" {
-		t.Errorf("CreateContainer: wrong config. Expected: %q. Returned: %q.", "ubuntu", stored.Config.User)
+	if got[1].Labels != nil {
+		t.Errorf("ListContainers: wrong labels. Want <nil>. Got %#v.", got[1].Labels)
 	}
-	if stored.Config.Hostname != returned.ID[:12] {
-		t.Errorf("CreateContainer: wrong hostname. Expected: %q. Returned: %q.", returned.ID[:12], stored.Config.Hostname)
+}
+
+func TestListContainersPortFilters(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 3)
+	server.containers[0].Config.ExposedPorts = map[docker.Port]struct{}{"80/tcp": {}, "53/udp": {}}
+	server.containers[1].HostConfig = &docker.HostConfig{
+		PortBindings: map[docker.Port][]docker.PortBinding{"8080/tcp": {{HostPort: "80"}}},
 	}
-	expectedBind := []string{"/var/run/docker.sock:/var/run/docker.sock:rw"}
-	if !reflect.DeepEqual(stored.HostConfig.Binds, expectedBind) {
-		t.Errorf("CreateContainer: wrong host config. Expected: %v. Returned %v.", expectedBind, stored.HostConfig.Binds)
+	server.containers[2].NetworkSettings.Ports = nil
+	server.buildMuxer()
+	var tests = []struct {
+		filters  string
+		expected []int
+	}{
+		{`{"expose":["80"]}`, []int{0}},
+		{`{"expose":["80/udp"]}`, nil},
+		{`{"expose":["53/udp"]}`, []int{0}},
+		{`{"expose":["50-100/tcp"]}`, []int{0}},
+		{`{"publish":["80"]}`, []int{1}},
+		{`{"publish":["80/udp"]}`, nil},
+		{`{"publish":["8080"]}`, nil},
+		{`{"publish":["8888/tcp"]}`, nil},
+		{`{"publish":["49600"]}`, []int{0}},
+		{`{"publish":["49600-49601/tcp"]}`, []int{0, 1}},
+		{`{"publish":["8080","8888"],"expose":["80"]}`, []int{0}},
+		{`{"publish":["80"],"expose":["53/udp"]}`, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/containers/json?all=1&filters="+url.QueryEscape(tt.filters), nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ListContainers(%s): wrong status. Want %d. Got %d.", tt.filters, http.StatusOK, recorder.Code)
+		}
+		var got []docker.APIContainers
+		if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, c := range got {
+			ids = append(ids, c.ID)
+		}
+		var expected []string
+		for _, i := range tt.expected {
+			expected = append(expected, server.containers[i].ID)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("ListContainers(%s): wrong containers. Want %v. Got %v.", tt.filters, expected, ids)
+		}
 	}
-	if val, ok := server.uploadedFiles[stored.ID]; !ok {
-		t.Error("CreateContainer: uploadedFiles should exist.")
-	} else if val != "/abcd" {
-		t.Errorf("CreateContainer: wrong uploadedFile. Want '/abcd', got %s.", val)
+}
+
+func TestListContainersInvalidPortFilter(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	for _, filters := range []string{`{"expose":["8080:80"]}`, `{"publish":["http"]}`, `{"publish":["90-80"]}`} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/containers/json?all=1&filters="+url.QueryEscape(filters), nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("ListContainers(%s): wrong status. Want %d. Got %d.", filters, http.StatusBadRequest, recorder.Code)
+		}
 	}
 }
 
-func TestCreateContainerWithNotifyChannel(t *testing.T) {
+func TestListContainersInvalidFilter(t *testing.T) {
 	t.Parallel()
-	ch := make(chan *docker.Container, 1)
 	server := DockerServer{}
-	server.imgIDs = map[string]string{"base": "a1234"}
-	server.cChan = ch
+	addContainers(&server, 2)
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
-"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":""}`
-	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
+	request, _ := http.NewRequest("GET", `/containers/json?all=1&filters={"labels":["a=b"]}`, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusCreated {
-		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("ListContainers: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
-	if notified := <-ch; notified != server.containers[0] {
-		t.Errorf("CreateContainer: did not notify the proper container. Want %q. Got %q.", server.containers[0].ID, notified.ID)
+	expected := "invalid filter 'labels'\n"
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("ListContainers: wrong body. Want %q. Got %q.", expected, got)
 	}
 }
 
-func TestCreateContainerInvalidBody(t *testing.T) {
+func TestListEventsFilters(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader("whaaaaaat---"))
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusBadRequest {
-		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	var tests = []struct {
+		filters string
+		code    int
+	}{
+		{`{"type":["container"],"event":["start"]}`, http.StatusOK},
+		{`{"container":["abc"],"label":["a=b"]}`, http.StatusOK},
+		{`{"types":["container"]}`, http.StatusBadRequest},
+		{`{"status":["start"]}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/events?filters="+url.QueryEscape(tt.filters), nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("ListEvents(%s): wrong status. Want %d. Got %d.", tt.filters, tt.code, recorder.Code)
+		}
 	}
 }
 
-func TestCreateContainerDuplicateName(t *testing.T) {
+func TestListEventsSinceKeepsStreaming(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	start := time.Now()
+	var buffered []string
+	for i := 0; i < 3; i++ {
+		buffered = append(buffered, server.generateEvent().ID)
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/events?since=%d", server.URL(), start.Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	var lastTime int64
+	for i, id := range buffered {
+		var event docker.APIEvents
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID != id {
+			t.Errorf("ListEvents: wrong replayed event at position %d. Want %q. Got %q.", i, id, event.ID)
+		}
+		lastTime = event.TimeNano
+	}
+	var event docker.APIEvents
+	if err := decoder.Decode(&event); err != nil {
+		t.Fatalf("ListEvents: expected the stream to continue after the replay: %s", err)
+	}
+	if event.TimeNano < lastTime {
+		t.Errorf("ListEvents: expected a live event after the replay. Got %#v.", event)
+	}
+}
+
+func TestListEventsStopsWhenClientGoes(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
-	server.imgIDs = map[string]string{"base": "a1234"}
-	addContainers(&server, 1)
-	server.containers[0].Name = "mycontainer"
-	recorder := httptest.NewRecorder()
-	body := `{"Hostname":"", "User":"ubuntu", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
-"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":"","HostConfig":{"Binds":["/var/run/docker.sock:/var/run/docker.sock:rw"]}}`
-	request, _ := http.NewRequest("POST", "/containers/create?name=mycontainer", strings.NewReader(body))
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusConflict {
-		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusConflict, recorder.Code)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", fmt.Sprintf("/events?since=%d", time.Now().Unix()), nil)
+		server.ServeHTTP(recorder, request.WithContext(ctx))
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListEvents: stream kept going after the request was canceled")
 	}
 }
 
-func TestCreateMultipleContainersEmptyName(t *testing.T) {
+func TestSetContainerHealthEvents(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addContainers(server, 1)
+	container := server.containers[0]
+	resp, err := http.Get(fmt.Sprintf("%s/events?since=%d", server.URL(), time.Now().Unix()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	healthEvents := make(chan docker.APIEvents, 10)
+	go func() {
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event docker.APIEvents
+			if err := decoder.Decode(&event); err != nil {
+				close(healthEvents)
+				return
+			}
+			if strings.HasPrefix(event.Action, "health_status: ") {
+				healthEvents <- event
+			}
+		}
+	}()
+	for _, status := range []string{"healthy", "healthy", "unhealthy"} {
+		if err := server.SetContainerHealth(container.ID, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, status := range []string{"healthy", "unhealthy"} {
+		select {
+		case event := <-healthEvents:
+			if event.Action != "health_status: "+status || event.Status != event.Action {
+				t.Errorf("SetContainerHealth: wrong event. Want action %q. Got %#v.", "health_status: "+status, event)
+			}
+			if event.Type != "container" || event.Actor.ID != container.ID {
+				t.Errorf("SetContainerHealth: wrong event actor. Got %#v.", event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("SetContainerHealth: timed out waiting for the %s event", status)
+		}
+	}
+	select {
+	case event := <-healthEvents:
+		t.Errorf("SetContainerHealth: unexpected extra event %#v", event)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if got := server.containers[0].State.Health.Status; got != "unhealthy" {
+		t.Errorf("SetContainerHealth: wrong status. Want %q. Got %q.", "unhealthy", got)
+	}
+	var recorded int
+	server.eventMut.RLock()
+	for _, event := range server.events {
+		if strings.HasPrefix(event.Action, "health_status: ") {
+			recorded++
+		}
+	}
+	server.eventMut.RUnlock()
+	if recorded != 2 {
+		t.Errorf("SetContainerHealth: wrong number of recorded health events. Want 2. Got %d.", recorded)
+	}
+}
+
+func TestListEventsBurstReceivesEmittedEvents(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/events", nil)
+		server.ServeHTTP(recorder, request)
+		done <- recorder
+	}()
+	var subscribed bool
+	for !subscribed {
+		select {
+		case <-done:
+			// the random burst was empty and the stream ended before the
+			// event could be emitted.
+			return
+		case <-time.After(time.Millisecond):
+		}
+		// the event is sent under the lock, so the stream can't end between
+		// the subscription check and the delivery.
+		server.eventMut.Lock()
+		if subscribed = len(server.eventSubs) > 0; subscribed {
+			for sub := range server.eventSubs {
+				sub <- docker.APIEvents{Action: "emitted", Time: 1}
+			}
+		}
+		server.eventMut.Unlock()
+	}
+	select {
+	case recorder := <-done:
+		if !strings.Contains(recorder.Body.String(), `"action":"emitted"`) {
+			t.Errorf("ListEvents: emitted event missing from the stream %q", recorder.Body.String())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ListEvents: expected the stream to end after the burst of random events")
+	}
+}
+
+func TestSetContainerHealthNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	if err := server.SetContainerHealth("abc", "healthy"); err == nil {
+		t.Error("SetContainerHealth: expected error for unknown container")
+	}
+}
+
+func TestListEventsSinceUntil(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	start := time.Now().Add(-time.Second)
+	server.generateEvent()
+	until := time.Now().Add(300 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("%s/events?since=%d&until=%d.%09d", server.URL(), start.Unix(), until.Unix(), until.Nanosecond()))
+		if err != nil {
+			done <- err
+			return
+		}
+		defer resp.Body.Close()
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var event docker.APIEvents
+			if err := decoder.Decode(&event); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				done <- err
+				return
+			}
+			if time.Unix(0, event.TimeNano).After(until) {
+				done <- fmt.Errorf("got event after until: %#v", event)
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListEvents: timed out waiting for the stream to end at until")
+	}
+}
+
+func TestGenerateEventActorAttributes(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.addContainer(&docker.Container{
+		ID:   "abc123",
+		Name: "web",
+		Config: &docker.Config{
+			Image:  "nginx:latest",
+			Labels: map[string]string{"app": "frontend", "name": "overridden"},
+		},
+	})
+	event := server.generateEvent()
+	if event.ID != "abc123" || event.Actor.ID != "abc123" {
+		t.Errorf("generateEvent: wrong actor ID. Want %q. Got %q.", "abc123", event.Actor.ID)
+	}
+	if event.Type != "container" || event.Action != event.Status {
+		t.Errorf("generateEvent: wrong type/action. Got %q/%q.", event.Type, event.Action)
+	}
+	expected := map[string]string{"app": "frontend", "image": "nginx:latest", "name": "web"}
+	if !reflect.DeepEqual(event.Actor.Attributes, expected) {
+		t.Errorf("generateEvent: wrong attributes. Want %#v. Got %#v.", expected, event.Actor.Attributes)
+	}
+}
+
+func TestCreateContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
 	server.imgIDs = map[string]string{"base": "a1234"}
-	addContainers(&server, 1)
-	server.containers[0].Name = ""
+	server.uploadedFiles = map[string]map[string]containerFile{"a1234": {"/abcd": {}}}
+	server.buildMuxer()
 	recorder := httptest.NewRecorder()
 	body := `{"Hostname":"", "User":"ubuntu", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
 "PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":"","HostConfig":{"Binds":["/var/run/docker.sock:/var/run/docker.sock:rw"]}}`
@@ -352,339 +669,973 @@ func TestCreateMultipleContainersEmptyName(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	stored := server.containers[1]
+	stored := server.containers[0]
 	if returned.ID != stored.ID {
 		t.Errorf("CreateContainer: ID mismatch. Stored: %q. Returned: %q.", stored.ID, returned.ID)
 	}
 	if stored.State.Running {
 		t.Errorf("CreateContainer should not set container to running state.")
 	}
+	if !stored.State.StartedAt.IsZero() {
+		t.Errorf("CreateContainer should not set startedAt in container state.")
+	}
 	if stored.Config.User != "ubuntu" {
 		t.Errorf("CreateContainer: wrong config. Expected: %q. Returned: %q.", "ubuntu", stored.Config.User)
 	}
+	if stored.Config.Hostname != returned.ID[:12] {
+		t.Errorf("CreateContainer: wrong hostname. Expected: %q. Returned: %q.", returned.ID[:12], stored.Config.Hostname)
+	}
 	expectedBind := []string{"/var/run/docker.sock:/var/run/docker.sock:rw"}
 	if !reflect.DeepEqual(stored.HostConfig.Binds, expectedBind) {
 		t.Errorf("CreateContainer: wrong host config. Expected: %v. Returned %v.", expectedBind, stored.HostConfig.Binds)
 	}
+	if _, ok := server.uploadedFiles[stored.ID]["/abcd"]; !ok {
+		t.Errorf("CreateContainer: wrong uploadedFiles. Want '/abcd', got %v.", server.uploadedFiles[stored.ID])
+	}
 }
 
-func TestCreateContainerInvalidName(t *testing.T) {
+func TestCreateContainerWarnings(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
+	warnings := []string{"Your kernel does not support swap limit capabilities."}
+	server.SetCreateWarnings(warnings)
 	recorder := httptest.NewRecorder()
-	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
-"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"],
-"Image":"base", "Volumes":{}, "VolumesFrom":""}`
-	request, _ := http.NewRequest("POST", "/containers/create?name=myapp/container1", strings.NewReader(body))
+	body := `{"Cmd":["date"], "Image":"base"}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusInternalServerError {
-		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusInternalServerError, recorder.Code)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	var returned docker.Container
+	err := json.NewDecoder(recorder.Body).Decode(&returned)
+	if err != nil {
+		t.Fatal(err)
 	}
-	expectedBody := "Invalid container name\n"
-	if got := recorder.Body.String(); got != expectedBody {
-		t.Errorf("CreateContainer: wrong body. Want %q. Got %q.", expectedBody, got)
+	if !reflect.DeepEqual(returned.Warnings, warnings) {
+		t.Errorf("CreateContainer: wrong warnings. Want %#v. Got %#v.", warnings, returned.Warnings)
+	}
+	if stored := server.containers[0]; stored.Warnings != nil {
+		t.Errorf("CreateContainer: warnings should not be stored in the container. Got %#v.", stored.Warnings)
 	}
 }
 
-func TestCreateContainerImageNotFound(t *testing.T) {
+func TestCreateContainerSecurityProfile(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
+	server.images = []docker.Image{{ID: "a1234"}, {ID: "b1234", OS: "windows"}}
 	server.buildMuxer()
-	recorder := httptest.NewRecorder()
-	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
-"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"],
-"Image":"base", "Volumes":{}, "VolumesFrom":""}`
-	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNotFound {
-		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	server.SetAppArmorProfile("docker-default")
+	var tests = []struct {
+		body     string
+		platform string
+		profile  string
+		os       string
+	}{
+		{`{"Image":"base"}`, "", "docker-default", "linux"},
+		{`{"Image":"b1234"}`, "", "docker-default", "windows"},
+		{`{"Image":"base"}`, "windows/amd64", "docker-default", "windows"},
+		{`{"Image":"base","HostConfig":{"Privileged":true}}`, "", "unconfined", "linux"},
+		{`{"Image":"base","HostConfig":{"Privileged":true,"SecurityOpt":["apparmor=custom"]}}`, "", "custom", "linux"},
+		{`{"Image":"base","HostConfig":{"SecurityOpt":["label=disable","apparmor:legacy"]}}`, "", "legacy", "linux"},
+	}
+	for i, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/create?platform="+tt.platform, strings.NewReader(tt.body))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("CreateContainer(%d): wrong status. Want %d. Got %d.", i, http.StatusCreated, recorder.Code)
+		}
+		var created docker.Container
+		if err := json.NewDecoder(recorder.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("GET", "/containers/"+created.ID+"/json", nil)
+		server.ServeHTTP(recorder, request)
+		var container docker.Container
+		if err := json.NewDecoder(recorder.Body).Decode(&container); err != nil {
+			t.Fatal(err)
+		}
+		if container.AppArmorProfile != tt.profile {
+			t.Errorf("InspectContainer(%d): wrong AppArmor profile. Want %q. Got %q.", i, tt.profile, container.AppArmorProfile)
+		}
+		if container.Platform != tt.os {
+			t.Errorf("InspectContainer(%d): wrong platform. Want %q. Got %q.", i, tt.os, container.Platform)
+		}
 	}
 }
 
-func TestRenameContainer(t *testing.T) {
+func TestCreateContainerInvalidPlatform(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 2)
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	newName := server.containers[0].Name + "abc"
-	path := fmt.Sprintf("/containers/%s/rename?name=%s", server.containers[0].ID, newName)
-	request, _ := http.NewRequest("POST", path, nil)
+	request, _ := http.NewRequest("POST", "/containers/create?platform=linux//arm", strings.NewReader(`{"Image":"base"}`))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNoContent {
-		t.Errorf("RenameContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
-	}
-	container := server.containers[0]
-	if container.Name != newName {
-		t.Errorf("RenameContainer: did not rename the container. Want %q. Got %q.", newName, container.Name)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
 }
 
-func TestRenameContainerNotFound(t *testing.T) {
+func TestCreateContainerShell(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/containers/blabla/rename?name=something", nil)
+	body := `{"Shell":["powershell","-Command"], "Cmd":["dir"], "Image":"base"}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNotFound {
-		t.Errorf("RenameContainer: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/"+server.containers[0].ID+"/json", nil)
+	server.ServeHTTP(recorder, request)
+	var container docker.Container
+	if err := json.NewDecoder(recorder.Body).Decode(&container); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"powershell", "-Command"}
+	if !reflect.DeepEqual(container.Config.Shell, expected) {
+		t.Errorf("InspectContainer: wrong shell. Want %#v. Got %#v.", expected, container.Config.Shell)
 	}
 }
 
-func TestCommitContainer(t *testing.T) {
+func TestCreateContainerHostnameDomainnameAndMacAddress(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 2)
-	server.uploadedFiles = map[string]string{server.containers[0].ID: "/abcd"}
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/commit?container="+server.containers[0].ID, nil)
+	body := `{"Hostname":"licensed", "Domainname":"example.com", "MacAddress":"02:42:ac:11:00:99", "Cmd":["date"], "Image":"base"}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	id := server.containers[0].ID
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/containers/"+id+"/start", strings.NewReader(""))
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
-		t.Errorf("CommitContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		t.Fatalf("StartContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	expected := fmt.Sprintf(`{"ID":"%s"}`, server.images[0].ID)
-	if got := recorder.Body.String(); got != expected {
-		t.Errorf("CommitContainer: wrong response body. Want %q. Got %q.", expected, got)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/"+id+"/json", nil)
+	server.ServeHTTP(recorder, request)
+	var container docker.Container
+	err := json.NewDecoder(recorder.Body).Decode(&container)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if server.images[0].Config == nil {
-		t.Error("CommitContainer: image Config should not be nil.")
+	if container.Config.Hostname != "licensed" {
+		t.Errorf("InspectContainer: wrong hostname. Want %q. Got %q.", "licensed", container.Config.Hostname)
 	}
-	if val, ok := server.uploadedFiles[server.images[0].ID]; !ok {
-		t.Error("CommitContainer: uploadedFiles should exist.")
-	} else if val != "/abcd" {
-		t.Errorf("CommitContainer: wrong uploadedFile. Want '/abcd', got %s.", val)
+	if container.Config.Domainname != "example.com" {
+		t.Errorf("InspectContainer: wrong domainname. Want %q. Got %q.", "example.com", container.Config.Domainname)
+	}
+	if container.Config.MacAddress != "02:42:ac:11:00:99" {
+		t.Errorf("InspectContainer: wrong config mac address. Want %q. Got %q.", "02:42:ac:11:00:99", container.Config.MacAddress)
+	}
+	if container.NetworkSettings.MacAddress != "02:42:ac:11:00:99" {
+		t.Errorf("InspectContainer: wrong mac address. Want %q. Got %q.", "02:42:ac:11:00:99", container.NetworkSettings.MacAddress)
 	}
 }
 
-func TestCommitContainerComplete(t *testing.T) {
+func TestCreateContainerMountTypes(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	server.imgIDs = make(map[string]string)
-	addContainers(&server, 2)
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	queryString := "container=" + server.containers[0].ID + "&repo=tsuru/python&m=saving&author=developers"
-	queryString += `&run={"Cmd": ["cat", "/world"],"PortSpecs":["22"]}`
-	request, _ := http.NewRequest("POST", "/commit?"+queryString, nil)
+	body := `{"Image":"base", "Volumes":{"/anon":{}, "/named":{}},
+"HostConfig":{"Binds":["/etc/app:/etc/app:ro", "data:/named"], "Tmpfs":{"/run":"size=64m"}}}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	image := server.images[0]
-	if image.Parent != server.containers[0].Image {
-		t.Errorf("CommitContainer: wrong parent image. Want %q. Got %q.", server.containers[0].Image, image.Parent)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
 	}
-	if image.Container != server.containers[0].ID {
-		t.Errorf("CommitContainer: wrong container. Want %q. Got %q.", server.containers[0].ID, image.Container)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/"+server.containers[0].ID+"/json", nil)
+	server.ServeHTTP(recorder, request)
+	var container docker.Container
+	err := json.NewDecoder(recorder.Body).Decode(&container)
+	if err != nil {
+		t.Fatal(err)
 	}
-	message := "saving"
-	if image.Comment != message {
-		t.Errorf("CommitContainer: wrong comment (commit message). Want %q. Got %q.", message, image.Comment)
+	if len(container.Mounts) != 4 {
+		t.Fatalf("InspectContainer: wrong number of mounts. Want 4. Got %d.", len(container.Mounts))
 	}
-	author := "developers"
-	if image.Author != author {
-		t.Errorf("CommitContainer: wrong author. Want %q. Got %q.", author, image.Author)
+	mounts := make(map[string]docker.Mount)
+	for _, m := range container.Mounts {
+		mounts[m.Destination] = m
 	}
-	if id := server.imgIDs["tsuru/python"]; id != image.ID {
-		t.Errorf("CommitContainer: wrong ID saved for repository. Want %q. Got %q.", image.ID, id)
+	expected := map[string]docker.Mount{
+		"/etc/app": {Type: "bind", Source: "/etc/app", Destination: "/etc/app", Mode: "ro"},
+		"/named":   {Type: "volume", Name: "data", Source: "/var/lib/docker/volumes/data/_data", Destination: "/named", Driver: "local", RW: true},
+		"/run":     {Type: "tmpfs", Destination: "/run", Mode: "size=64m", RW: true},
 	}
-	portSpecs := []string{"22"}
-	if !reflect.DeepEqual(image.Config.PortSpecs, portSpecs) {
-		t.Errorf("CommitContainer: wrong port spec in config. Want %#v. Got %#v.", portSpecs, image.Config.PortSpecs)
+	for destination, want := range expected {
+		if got := mounts[destination]; !reflect.DeepEqual(got, want) {
+			t.Errorf("InspectContainer: wrong mount for %s.\nWant %#v.\nGot  %#v.", destination, want, got)
+		}
 	}
-	cmd := []string{"cat", "/world"}
-	if !reflect.DeepEqual(image.Config.Cmd, cmd) {
-		t.Errorf("CommitContainer: wrong cmd in config. Want %#v. Got %#v.", cmd, image.Config.Cmd)
+	anon := mounts["/anon"]
+	if anon.Type != "volume" || anon.Name == "" || anon.Source != "/var/lib/docker/volumes/"+anon.Name+"/_data" {
+		t.Errorf("InspectContainer: wrong anonymous volume mount. Got %#v.", anon)
 	}
 }
 
-func TestCommitContainerWithTag(t *testing.T) {
+func TestCreateContainerInvalidMacAddress(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	server.imgIDs = make(map[string]string)
-	addContainers(&server, 2)
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	queryString := "container=" + server.containers[0].ID + "&repo=tsuru/python&tag=v1"
-	request, _ := http.NewRequest("POST", "/commit?"+queryString, nil)
+	body := `{"MacAddress":"02:42:ac:11", "Cmd":["date"], "Image":"base"}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	image := server.images[0]
-	if image.Parent != server.containers[0].Image {
-		t.Errorf("CommitContainer: wrong parent image. Want %q. Got %q.", server.containers[0].Image, image.Parent)
-	}
-	if image.Container != server.containers[0].ID {
-		t.Errorf("CommitContainer: wrong container. Want %q. Got %q.", server.containers[0].ID, image.Container)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
-	if id := server.imgIDs["tsuru/python:v1"]; id != image.ID {
-		t.Errorf("CommitContainer: wrong ID saved for repository. Want %q. Got %q.", image.ID, id)
+	if len(server.containers) != 0 {
+		t.Errorf("CreateContainer: should not create the container. Got %d containers.", len(server.containers))
 	}
 }
 
-func TestCommitContainerInvalidRun(t *testing.T) {
+func TestCreateContainerInvalidResources(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 1)
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/commit?container="+server.containers[0].ID+"&run=abc---", nil)
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusBadRequest {
-		t.Errorf("CommitContainer. Wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	tests := []struct {
+		body    string
+		code    int
+		message string
+	}{
+		{
+			`{"Image":"base", "HostConfig":{"Memory":1048576, "MemorySwap":524288}}`,
+			http.StatusBadRequest,
+			"Minimum memoryswap limit should be larger than memory limit, see usage",
+		},
+		{
+			`{"Image":"base", "Memory":1048576, "MemorySwap":524288}`,
+			http.StatusBadRequest,
+			"Minimum memoryswap limit should be larger than memory limit, see usage",
+		},
+		{
+			`{"Image":"base", "HostConfig":{"CpuShares":-2}}`,
+			http.StatusBadRequest,
+			"Invalid CPU shares (-2): value must be a positive integer",
+		},
+		{
+			`{"Image":"base", "HostConfig":{"CpusetCpus":"0-a"}}`,
+			http.StatusBadRequest,
+			"Invalid value 0-a for cpuset cpus",
+		},
+		{
+			`{"Image":"base", "HostConfig":{"CpusetCpus":"3-1"}}`,
+			http.StatusBadRequest,
+			"Invalid value 3-1 for cpuset cpus",
+		},
+		{`{"Image":"base", "HostConfig":{"Memory":1048576, "MemorySwap":-1}}`, http.StatusCreated, ""},
+		{`{"Image":"base", "HostConfig":{"Memory":1048576, "MemorySwap":2097152}}`, http.StatusCreated, ""},
+		{`{"Image":"base", "HostConfig":{"CpuShares":512, "CpusetCpus":"0-3,5"}}`, http.StatusCreated, ""},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(tt.body))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("CreateContainer(%s): wrong status. Want %d. Got %d.", tt.body, tt.code, recorder.Code)
+		}
+		if tt.message != "" {
+			if msg := strings.TrimSpace(recorder.Body.String()); msg != tt.message {
+				t.Errorf("CreateContainer(%s): wrong message. Want %q. Got %q.", tt.body, tt.message, msg)
+			}
+		}
+	}
+	if len(server.containers) != 3 {
+		t.Errorf("CreateContainer: wrong number of containers. Want 3. Got %d.", len(server.containers))
 	}
 }
 
-func TestCommitContainerNotFound(t *testing.T) {
+func TestCreateContainerWithNotifyChannel(t *testing.T) {
 	t.Parallel()
+	ch := make(chan *docker.Container, 1)
 	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
+	server.cChan = ch
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/commit?container=abc123", nil)
+	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
+"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":""}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNotFound {
-		t.Errorf("CommitContainer. Wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	if notified := <-ch; notified != server.containers[0] {
+		t.Errorf("CreateContainer: did not notify the proper container. Want %q. Got %q.", server.containers[0].ID, notified.ID)
 	}
 }
 
-func TestInspectContainer(t *testing.T) {
+func TestCreateContainerInvalidBody(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 2)
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	path := fmt.Sprintf("/containers/%s/json", server.containers[0].ID)
-	request, _ := http.NewRequest("GET", path, nil)
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader("whaaaaaat---"))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("InspectContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
-	}
-	expected := server.containers[0]
-	var got docker.Container
-	err := json.NewDecoder(recorder.Body).Decode(&got)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !reflect.DeepEqual(got.Config, expected.Config) {
-		t.Errorf("InspectContainer: wrong value. Want %#v. Got %#v.", *expected, got)
-	}
-	if !reflect.DeepEqual(got.NetworkSettings, expected.NetworkSettings) {
-		t.Errorf("InspectContainer: wrong value. Want %#v. Got %#v.", *expected, got)
-	}
-	got.State.StartedAt = expected.State.StartedAt
-	got.State.FinishedAt = expected.State.FinishedAt
-	got.Config = expected.Config
-	got.Created = expected.Created
-	got.NetworkSettings = expected.NetworkSettings
-	if !reflect.DeepEqual(got, *expected) {
-		t.Errorf("InspectContainer: wrong value. Want %#v. Got %#v.", *expected, got)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
 }
 
-func TestInspectContainerNotFound(t *testing.T) {
+func TestCreateContainerDuplicateName(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
+	server.imgIDs = map[string]string{"base": "a1234"}
+	addContainers(&server, 1)
+	renamed := *server.containers[0]
+	renamed.Name = "mycontainer"
+	server.replaceContainer(&renamed)
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/containers/abc123/json", nil)
+	body := `{"Hostname":"", "User":"ubuntu", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
+"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":"","HostConfig":{"Binds":["/var/run/docker.sock:/var/run/docker.sock:rw"]}}`
+	request, _ := http.NewRequest("POST", "/containers/create?name=mycontainer", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNotFound {
-		t.Errorf("InspectContainer: wrong status code. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusConflict, recorder.Code)
 	}
 }
 
-func TestTopContainer(t *testing.T) {
+func TestCreateMultipleContainersEmptyName(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 1)
-	server.containers[0].State.Running = true
 	server.buildMuxer()
+	server.imgIDs = map[string]string{"base": "a1234"}
+	addContainers(&server, 1)
+	renamed := *server.containers[0]
+	renamed.Name = ""
+	server.replaceContainer(&renamed)
 	recorder := httptest.NewRecorder()
-	path := fmt.Sprintf("/containers/%s/top", server.containers[0].ID)
-	request, _ := http.NewRequest("GET", path, nil)
+	body := `{"Hostname":"", "User":"ubuntu", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
+"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":"","HostConfig":{"Binds":["/var/run/docker.sock:/var/run/docker.sock:rw"]}}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("TopContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
 	}
-	var got docker.TopResult
-	err := json.NewDecoder(recorder.Body).Decode(&got)
+	var returned docker.Container
+	err := json.NewDecoder(recorder.Body).Decode(&returned)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(got.Titles, []string{"UID", "PID", "PPID", "C", "STIME", "TTY", "TIME", "CMD"}) {
-		t.Fatalf("TopContainer: Unexpected titles, got: %#v", got.Titles)
+	stored := server.containers[1]
+	if returned.ID != stored.ID {
+		t.Errorf("CreateContainer: ID mismatch. Stored: %q. Returned: %q.", stored.ID, returned.ID)
 	}
-	if len(got.Processes) != 1 {
-		t.Fatalf("TopContainer: Unexpected process len, got: %d", len(got.Processes))
+	if stored.State.Running {
+		t.Errorf("CreateContainer should not set container to running state.")
 	}
-	if got.Processes[0][len(got.Processes[0])-1] != "ls -la .." {
-		t.Fatalf("TopContainer: Unexpected command name, got: %s", got.Processes[0][len(got.Processes[0])-1])
+	if stored.Config.User != "ubuntu" {
+		t.Errorf("CreateContainer: wrong config. Expected: %q. Returned: %q.", "ubuntu", stored.Config.User)
+	}
+	expectedBind := []string{"/var/run/docker.sock:/var/run/docker.sock:rw"}
+	if !reflect.DeepEqual(stored.HostConfig.Binds, expectedBind) {
+		t.Errorf("CreateContainer: wrong host config. Expected: %v. Returned %v.", expectedBind, stored.HostConfig.Binds)
 	}
 }
 
-func TestTopContainerNotFound(t *testing.T) {
+func TestCreateContainerInvalidName(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/containers/xyz/top", nil)
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNotFound {
-		t.Errorf("TopContainer: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
+"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"],
+"Image":"base", "Volumes":{}, "VolumesFrom":""}`
+	var tests = []struct {
+		name string
+		code int
+	}{
+		{"myapp/container1", http.StatusBadRequest},
+		{"_app", http.StatusBadRequest},
+		{"a", http.StatusBadRequest},
+		{"my app", http.StatusBadRequest},
+		{"app_1.web-2", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/create?name="+url.QueryEscape(tt.name), strings.NewReader(body))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("CreateContainer(%q): wrong status. Want %d. Got %d.", tt.name, tt.code, recorder.Code)
+		}
+		if tt.code != http.StatusBadRequest {
+			continue
+		}
+		expectedBody := "Invalid container name (" + tt.name + "), only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed\n"
+		if got := recorder.Body.String(); got != expectedBody {
+			t.Errorf("CreateContainer(%q): wrong body. Want %q. Got %q.", tt.name, expectedBody, got)
+		}
+	}
+	if len(server.containers) != 1 {
+		t.Errorf("CreateContainer: wrong number of containers. Want 1. Got %d.", len(server.containers))
 	}
 }
 
-func TestTopContainerStopped(t *testing.T) {
+func TestCreateContainerImageNotFound(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 1)
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	path := fmt.Sprintf("/containers/%s/top", server.containers[0].ID)
-	request, _ := http.NewRequest("GET", path, nil)
+	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
+"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"],
+"Image":"base", "Volumes":{}, "VolumesFrom":""}`
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusInternalServerError {
-		t.Errorf("TopContainer: wrong status. Want %d. Got %d.", http.StatusInternalServerError, recorder.Code)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
 	}
 }
 
-func TestStartContainer(t *testing.T) {
+func TestRenameContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 1)
+	addContainers(&server, 2)
 	server.buildMuxer()
-	memory := int64(536870912)
-	hostConfig := docker.HostConfig{Memory: memory}
-	configBytes, err := json.Marshal(hostConfig)
-	if err != nil {
-		t.Fatal(err)
-	}
 	recorder := httptest.NewRecorder()
-	path := fmt.Sprintf("/containers/%s/start", server.containers[0].ID)
-	request, _ := http.NewRequest("POST", path, bytes.NewBuffer(configBytes))
+	newName := server.containers[0].Name + "abc"
+	path := fmt.Sprintf("/containers/%s/rename?name=%s", server.containers[0].ID, newName)
+	request, _ := http.NewRequest("POST", path, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("StartContainer: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
-	}
-	if !server.containers[0].State.Running {
-		t.Error("StartContainer: did not set the container to running state")
-	}
-	if server.containers[0].State.StartedAt.IsZero() {
-		t.Error("StartContainer: did not set the startedAt container state")
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("RenameContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
 	}
-	if gotMemory := server.containers[0].HostConfig.Memory; gotMemory != memory {
-		t.Errorf("StartContainer: wrong HostConfig. Wants %d of memory. Got %d", memory, gotMemory)
+	container := server.containers[0]
+	if container.Name != newName {
+		t.Errorf("RenameContainer: did not rename the container. Want %q. Got %q.", newName, container.Name)
 	}
 }
 
-func TestStartContainerNoHostConfig(t *testing.T) {
+func TestRenameContainerNotFound(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addContainers(&server, 1)
 	server.buildMuxer()
-	memory := int64(536870912)
-	hostConfig := docker.HostConfig{Memory: memory}
-	server.containers[0].HostConfig = &hostConfig
 	recorder := httptest.NewRecorder()
-	path := fmt.Sprintf("/containers/%s/start", server.containers[0].ID)
+	request, _ := http.NewRequest("POST", "/containers/blabla/rename?name=something", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("RenameContainer: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestUpdateContainerRestartPolicy(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addContainers(server, 1)
+	id := server.containers[0].ID
+	running := docker.State{Running: true}
+	exited := docker.State{Running: false, ExitCode: 1}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.MutateContainer(id, running)
+	server.MutateContainer(id, exited)
+	if server.containers[0].State.Running {
+		t.Fatal("MutateContainer: container without restart policy should not be restarted")
+	}
+	err = client.UpdateContainer(id, docker.UpdateContainerOptions{
+		Memory:        64 << 20,
+		RestartPolicy: docker.AlwaysRestart(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := server.containers[0].HostConfig
+	if hc.RestartPolicy != docker.AlwaysRestart() || hc.Memory != 64<<20 {
+		t.Errorf("UpdateContainer: wrong host config. Got %#v.", hc)
+	}
+	server.MutateContainer(id, running)
+	server.MutateContainer(id, exited)
+	container, err := client.InspectContainer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !container.State.Running || container.RestartCount != 1 {
+		t.Errorf("MutateContainer: container should be restarted. Running: %v. RestartCount: %d.", container.State.Running, container.RestartCount)
+	}
+	err = client.UpdateContainer(id, docker.UpdateContainerOptions{CPUShares: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.RestartPolicy != docker.AlwaysRestart() || hc.Memory != 64<<20 || hc.CPUShares != 512 {
+		t.Errorf("UpdateContainer: wrong host config after partial update. Got %#v.", hc)
+	}
+	err = client.UpdateContainer(id, docker.UpdateContainerOptions{RestartPolicy: docker.RestartOnFailure(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.MutateContainer(id, exited)
+	if server.containers[0].State.Running {
+		t.Error("MutateContainer: on-failure container should not be restarted after reaching the maximum retry count")
+	}
+}
+
+func TestUpdateContainerInvalid(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 2)
+	server.containers[1].HostConfig = &docker.HostConfig{AutoRemove: true}
+	server.buildMuxer()
+	var tests = []struct {
+		id     string
+		body   string
+		status int
+	}{
+		{server.containers[0].ID, `{"RestartPolicy":{"Name":"sometimes"}}`, http.StatusBadRequest},
+		{server.containers[0].ID, `{"RestartPolicy":{"Name":"always","MaximumRetryCount":3}}`, http.StatusBadRequest},
+		{server.containers[0].ID, `{"CpuShares":-1}`, http.StatusBadRequest},
+		{server.containers[1].ID, `{"RestartPolicy":{"Name":"always"}}`, http.StatusBadRequest},
+		{server.containers[1].ID, `{"Memory":1048576}`, http.StatusOK},
+		{"unknown", `{"RestartPolicy":{"Name":"always"}}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/"+tt.id+"/update", strings.NewReader(tt.body))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("UpdateContainer(%s): wrong status. Want %d. Got %d.", tt.body, tt.status, recorder.Code)
+		}
+	}
+	if policy := server.containers[0].HostConfig; policy != nil && policy.RestartPolicy.Name != "" {
+		t.Errorf("UpdateContainer: invalid update should not change the restart policy. Got %#v.", policy.RestartPolicy)
+	}
+}
+
+func TestCommitContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 2)
+	server.uploadedFiles = map[string]map[string]containerFile{server.containers[0].ID: {"/abcd": {}}}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/commit?container="+server.containers[0].ID, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("CommitContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected := fmt.Sprintf(`{"ID":"%s"}`, server.images[0].ID)
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("CommitContainer: wrong response body. Want %q. Got %q.", expected, got)
+	}
+	if server.images[0].Config == nil {
+		t.Error("CommitContainer: image Config should not be nil.")
+	}
+	if _, ok := server.uploadedFiles[server.images[0].ID]["/abcd"]; !ok {
+		t.Errorf("CommitContainer: wrong uploadedFiles. Want '/abcd', got %v.", server.uploadedFiles[server.images[0].ID])
+	}
+}
+
+func TestCommitContainerComplete(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.imgIDs = make(map[string]string)
+	addContainers(&server, 2)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	queryString := "container=" + server.containers[0].ID + "&repo=tsuru/python&m=saving&author=developers"
+	queryString += `&run={"Cmd": ["cat", "/world"],"PortSpecs":["22"]}`
+	request, _ := http.NewRequest("POST", "/commit?"+queryString, nil)
+	server.ServeHTTP(recorder, request)
+	image := server.images[0]
+	if image.Parent != server.containers[0].Image {
+		t.Errorf("CommitContainer: wrong parent image. Want %q. Got %q.", server.containers[0].Image, image.Parent)
+	}
+	if image.Container != server.containers[0].ID {
+		t.Errorf("CommitContainer: wrong container. Want %q. Got %q.", server.containers[0].ID, image.Container)
+	}
+	message := "saving"
+	if image.Comment != message {
+		t.Errorf("CommitContainer: wrong comment (commit message). Want %q. Got %q.", message, image.Comment)
+	}
+	author := "developers"
+	if image.Author != author {
+		t.Errorf("CommitContainer: wrong author. Want %q. Got %q.", author, image.Author)
+	}
+	if id := server.imgIDs["tsuru/python"]; id != image.ID {
+		t.Errorf("CommitContainer: wrong ID saved for repository. Want %q. Got %q.", image.ID, id)
+	}
+	portSpecs := []string{"22"}
+	if !reflect.DeepEqual(image.Config.PortSpecs, portSpecs) {
+		t.Errorf("CommitContainer: wrong port spec in config. Want %#v. Got %#v.", portSpecs, image.Config.PortSpecs)
+	}
+	cmd := []string{"cat", "/world"}
+	if !reflect.DeepEqual(image.Config.Cmd, cmd) {
+		t.Errorf("CommitContainer: wrong cmd in config. Want %#v. Got %#v.", cmd, image.Config.Cmd)
+	}
+}
+
+func TestCommitContainerOnBuild(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.imgIDs = map[string]string{"base": "a1234"}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	onBuild := []string{"ADD . /app/src", "RUN make -C /app/src"}
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: "base", OnBuild: onBuild},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err = client.InspectContainer(container.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(container.Config.OnBuild, onBuild) {
+		t.Errorf("InspectContainer: wrong OnBuild. Want %#v. Got %#v.", onBuild, container.Config.OnBuild)
+	}
+	_, err = client.CommitContainer(docker.CommitContainerOptions{
+		Container:  container.ID,
+		Repository: "tsuru/onbuild",
+		Run:        &docker.Config{OnBuild: onBuild},
+		Changes:    []string{"ONBUILD RUN make -C /app/src install", "LABEL a=b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := client.InspectImage("tsuru/onbuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(onBuild, "RUN make -C /app/src install")
+	if !reflect.DeepEqual(image.Config.OnBuild, expected) {
+		t.Errorf("InspectImage: wrong OnBuild. Want %#v. Got %#v.", expected, image.Config.OnBuild)
+	}
+}
+
+func TestCommitContainerChanges(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.imgIDs = map[string]string{"base": "a1234"}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:  "base",
+			Cmd:    []string{"run"},
+			Env:    []string{"A=1", "B=2"},
+			Labels: map[string]string{"team": "core"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.CommitContainer(docker.CommitContainerOptions{
+		Container:  container.ID,
+		Repository: "tsuru/snapshot",
+		Message:    "snapshot",
+		Run:        &docker.Config{Env: []string{"B=3"}, WorkingDir: "/app"},
+		Changes: []string{
+			`CMD ["serve", "--port", "8080"]`,
+			"ENV C=4",
+			"EXPOSE 8080",
+			"LABEL version=2",
+			"USER app",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := client.InspectImage("tsuru/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Comment != "snapshot" {
+		t.Errorf("InspectImage: wrong comment. Want %q. Got %q.", "snapshot", image.Comment)
+	}
+	expected := &docker.Config{
+		Hostname:     container.ID[:12],
+		Image:        "base",
+		Cmd:          []string{"serve", "--port", "8080"},
+		Env:          []string{"A=1", "B=3", "C=4"},
+		WorkingDir:   "/app",
+		User:         "app",
+		ExposedPorts: map[docker.Port]struct{}{"8080/tcp": {}},
+		Labels:       map[string]string{"team": "core", "version": "2"},
+	}
+	if !reflect.DeepEqual(image.Config, expected) {
+		t.Errorf("InspectImage: wrong config.\nWant %#v.\nGot  %#v.", expected, image.Config)
+	}
+	_, err = client.CommitContainer(docker.CommitContainerOptions{
+		Container: container.ID,
+		Changes:   []string{"RUN make"},
+	})
+	if e, ok := err.(*docker.Error); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("CommitContainer: wrong error for invalid change. Want 400. Got %#v.", err)
+	}
+}
+
+func TestCommitContainerWithTag(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.imgIDs = make(map[string]string)
+	addContainers(&server, 2)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	queryString := "container=" + server.containers[0].ID + "&repo=tsuru/python&tag=v1"
+	request, _ := http.NewRequest("POST", "/commit?"+queryString, nil)
+	server.ServeHTTP(recorder, request)
+	image := server.images[0]
+	if image.Parent != server.containers[0].Image {
+		t.Errorf("CommitContainer: wrong parent image. Want %q. Got %q.", server.containers[0].Image, image.Parent)
+	}
+	if image.Container != server.containers[0].ID {
+		t.Errorf("CommitContainer: wrong container. Want %q. Got %q.", server.containers[0].ID, image.Container)
+	}
+	if id := server.imgIDs["tsuru/python:v1"]; id != image.ID {
+		t.Errorf("CommitContainer: wrong ID saved for repository. Want %q. Got %q.", image.ID, id)
+	}
+}
+
+func TestCommitContainerInvalidRun(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/commit?container="+server.containers[0].ID+"&run=abc---", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("CommitContainer. Wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestCommitContainerNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/commit?container=abc123", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("CommitContainer. Wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestInspectContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 2)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/json", server.containers[0].ID)
+	request, _ := http.NewRequest("GET", path, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("InspectContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected := server.containers[0]
+	var got docker.Container
+	err := json.NewDecoder(recorder.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Config, expected.Config) {
+		t.Errorf("InspectContainer: wrong value. Want %#v. Got %#v.", *expected, got)
+	}
+	if !reflect.DeepEqual(got.NetworkSettings, expected.NetworkSettings) {
+		t.Errorf("InspectContainer: wrong value. Want %#v. Got %#v.", *expected, got)
+	}
+	got.State.StartedAt = expected.State.StartedAt
+	got.State.FinishedAt = expected.State.FinishedAt
+	got.Config = expected.Config
+	got.Created = expected.Created
+	got.NetworkSettings = expected.NetworkSettings
+	if !reflect.DeepEqual(got, *expected) {
+		t.Errorf("InspectContainer: wrong value. Want %#v. Got %#v.", *expected, got)
+	}
+}
+
+func TestInspectContainerNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/containers/abc123/json", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("InspectContainer: wrong status code. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestTopContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/top", server.containers[0].ID)
+	request, _ := http.NewRequest("GET", path, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("TopContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var got docker.TopResult
+	err := json.NewDecoder(recorder.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Titles, []string{"UID", "PID", "PPID", "C", "STIME", "TTY", "TIME", "CMD"}) {
+		t.Fatalf("TopContainer: Unexpected titles, got: %#v", got.Titles)
+	}
+	if len(got.Processes) != 1 {
+		t.Fatalf("TopContainer: Unexpected process len, got: %d", len(got.Processes))
+	}
+	if got.Processes[0][len(got.Processes[0])-1] != "ls -la .." {
+		t.Fatalf("TopContainer: Unexpected command name, got: %s", got.Processes[0][len(got.Processes[0])-1])
+	}
+}
+
+func TestTopContainerPsArgs(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.buildMuxer()
+	var tests = []struct {
+		psArgs string
+		code   int
+		titles []string
+	}{
+		{"-ef", http.StatusOK, []string{"UID", "PID", "PPID", "C", "STIME", "TTY", "TIME", "CMD"}},
+		{"aux", http.StatusOK, []string{"USER", "PID", "%CPU", "%MEM", "VSZ", "RSS", "TTY", "STAT", "START", "TIME", "COMMAND"}},
+		{"-o pid,comm", http.StatusOK, []string{"PID", "COMMAND"}},
+		{"-opid=ID,user,args", http.StatusOK, []string{"ID", "USER", "COMMAND"}},
+		{"-o pid,bogus", http.StatusInternalServerError, nil},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/top?ps_args=%s", server.containers[0].ID, url.QueryEscape(tt.psArgs))
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("TopContainer(%q): wrong status. Want %d. Got %d.", tt.psArgs, tt.code, recorder.Code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var got docker.TopResult
+		if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Titles, tt.titles) {
+			t.Errorf("TopContainer(%q): wrong titles. Want %#v. Got %#v.", tt.psArgs, tt.titles, got.Titles)
+		}
+		for _, process := range got.Processes {
+			if len(process) != len(got.Titles) {
+				t.Errorf("TopContainer(%q): process %#v doesn't match the titles", tt.psArgs, process)
+			}
+		}
+	}
+}
+
+func TestTopContainerNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/containers/xyz/top", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("TopContainer: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestTopContainerStopped(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/top", server.containers[0].ID)
+	request, _ := http.NewRequest("GET", path, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("TopContainer: wrong status. Want %d. Got %d.", http.StatusInternalServerError, recorder.Code)
+	}
+}
+
+func TestStartContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	memory := int64(536870912)
+	hostConfig := docker.HostConfig{Memory: memory}
+	configBytes, err := json.Marshal(hostConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/start", server.containers[0].ID)
+	request, _ := http.NewRequest("POST", path, bytes.NewBuffer(configBytes))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("StartContainer: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if !server.containers[0].State.Running {
+		t.Error("StartContainer: did not set the container to running state")
+	}
+	if server.containers[0].State.StartedAt.IsZero() {
+		t.Error("StartContainer: did not set the startedAt container state")
+	}
+	if gotMemory := server.containers[0].HostConfig.Memory; gotMemory != memory {
+		t.Errorf("StartContainer: wrong HostConfig. Wants %d of memory. Got %d", memory, gotMemory)
+	}
+	if mac := server.containers[0].NetworkSettings.MacAddress; mac != "02:42:0a:0a:0a:02" {
+		t.Errorf("StartContainer: wrong mac address. Want %q. Got %q.", "02:42:0a:0a:0a:02", mac)
+	}
+}
+
+func TestStartContainerNoHostConfig(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	memory := int64(536870912)
+	hostConfig := docker.HostConfig{Memory: memory}
+	server.containers[0].HostConfig = &hostConfig
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/start", server.containers[0].ID)
 	request, _ := http.NewRequest("POST", path, strings.NewReader(""))
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
@@ -777,6 +1728,56 @@ func TestStartContainerAlreadyRunning(t *testing.T) {
 	}
 }
 
+func TestStartContainerPaused(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.containers[0].State.Paused = true
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/start", server.containers[0].ID)
+	request, _ := http.NewRequest("POST", path, bytes.NewBuffer([]byte("null")))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("StartContainer: wrong status code. Want %d. Got %d.", http.StatusConflict, recorder.Code)
+	}
+	if body := strings.TrimSpace(recorder.Body.String()); body != "container is paused" {
+		t.Errorf("StartContainer: wrong body. Want %q. Got %q.", "container is paused", body)
+	}
+}
+
+func TestStartContainerImageRemoved(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
+	server.images = []docker.Image{{ID: "a1234"}}
+	server.buildMuxer()
+	body := `{"Cmd":["date"], "Image":"base"}`
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/images/base", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("RemoveImage: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/start", server.containers[0].ID)
+	request, _ = http.NewRequest("POST", path, bytes.NewBuffer([]byte("null")))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("StartContainer: wrong status code. Want %d. Got %d.", http.StatusInternalServerError, recorder.Code)
+	}
+	if server.containers[0].State.Running {
+		t.Error("StartContainer: should not start a container whose image was removed")
+	}
+}
+
 func TestStopContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -793,6 +1794,9 @@ func TestStopContainer(t *testing.T) {
 	if server.containers[0].State.Running {
 		t.Error("StopContainer: did not stop the container")
 	}
+	if server.containers[0].State.FinishedAt.IsZero() {
+		t.Error("StopContainer: did not set FinishedAt")
+	}
 }
 
 func TestKillContainer(t *testing.T) {
@@ -811,6 +1815,99 @@ func TestKillContainer(t *testing.T) {
 	if server.containers[0].State.Running {
 		t.Error("KillContainer: did not stop the container")
 	}
+	if server.containers[0].State.FinishedAt.IsZero() {
+		t.Error("KillContainer: did not set FinishedAt")
+	}
+}
+
+func TestRestartContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.buildMuxer()
+	startedAt := server.containers[0].State.StartedAt
+	for i := 1; i <= 2; i++ {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/restart", server.containers[0].ID)
+		request, _ := http.NewRequest("POST", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNoContent {
+			t.Fatalf("RestartContainer: wrong status code. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+		}
+		if server.containers[0].RestartCount != i {
+			t.Errorf("RestartContainer: wrong RestartCount. Want %d. Got %d.", i, server.containers[0].RestartCount)
+		}
+	}
+	state := server.containers[0].State
+	if !state.Running {
+		t.Error("RestartContainer: container should be running")
+	}
+	if state.FinishedAt.IsZero() {
+		t.Error("RestartContainer: did not set FinishedAt")
+	}
+	if !state.StartedAt.After(startedAt) {
+		t.Errorf("RestartContainer: did not update StartedAt. Got %s.", state.StartedAt)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/containers/"+server.containers[0].ID+"/json", nil)
+	server.ServeHTTP(recorder, request)
+	var container docker.Container
+	if err := json.NewDecoder(recorder.Body).Decode(&container); err != nil {
+		t.Fatal(err)
+	}
+	if container.RestartCount != 2 || container.State.FinishedAt.IsZero() {
+		t.Errorf("InspectContainer: wrong RestartCount or FinishedAt. Got %d and %s.", container.RestartCount, container.State.FinishedAt)
+	}
+}
+
+func TestRestartContainerNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/containers/abc123/restart", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("RestartContainer: wrong status code. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestKillContainerSignal(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		signal string
+		status int
+	}{
+		{"SIGKILL", http.StatusNoContent},
+		{"hup", http.StatusNoContent},
+		{"9", http.StatusNoContent},
+		{"RTMIN+3", http.StatusNoContent},
+		{"FOO", http.StatusBadRequest},
+		{"0", http.StatusBadRequest},
+		{"65", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		server := DockerServer{}
+		addContainers(&server, 1)
+		server.containers[0].State.Running = true
+		server.buildMuxer()
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/kill?signal=%s", server.containers[0].ID, url.QueryEscape(tt.signal))
+		request, _ := http.NewRequest("POST", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("KillContainer(%q): wrong status code. Want %d. Got %d.", tt.signal, tt.status, recorder.Code)
+		}
+		if tt.status == http.StatusBadRequest {
+			if expected := "Invalid signal: " + tt.signal + "\n"; recorder.Body.String() != expected {
+				t.Errorf("KillContainer(%q): wrong body. Want %q. Got %q.", tt.signal, expected, recorder.Body.String())
+			}
+			if !server.containers[0].State.Running {
+				t.Errorf("KillContainer(%q): should not stop the container", tt.signal)
+			}
+		}
+	}
 }
 
 func TestStopContainerWithNotifyChannel(t *testing.T) {
@@ -975,6 +2072,105 @@ func TestWaitContainer(t *testing.T) {
 	}
 }
 
+func TestWaitContainerRemovedCondition(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.containers[0].State.ExitCode = 3
+	server.buildMuxer()
+	id := server.containers[0].ID
+	// removed containers report 0, while the default condition reports the
+	// exit code of the killed container.
+	conditions := map[string]string{"removed": `{"StatusCode":0}`, "": `{"StatusCode":3}`}
+	done := make(map[string]chan *httptest.ResponseRecorder)
+	for condition := range conditions {
+		ch := make(chan *httptest.ResponseRecorder, 1)
+		done[condition] = ch
+		go func(condition string) {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", fmt.Sprintf("/containers/%s/wait?condition=%s", id, condition), nil)
+			server.ServeHTTP(recorder, request)
+			ch <- recorder
+		}(condition)
+	}
+	time.Sleep(100 * time.Millisecond)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("DELETE", fmt.Sprintf("/containers/%s?force=1", id), nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("RemoveContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	for condition, expected := range conditions {
+		select {
+		case recorder = <-done[condition]:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %q waiter to return", condition)
+		}
+		if recorder.Code != http.StatusOK {
+			t.Errorf("WaitContainer(%q): wrong status. Want %d. Got %d.", condition, http.StatusOK, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != expected+"\n" {
+			t.Errorf("WaitContainer(%q): wrong body. Want %q. Got %q.", condition, expected+"\n", body)
+		}
+	}
+}
+
+func TestWaitContainerNextExit(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.ExitCode = 5
+	server.containers[0].State.FinishedAt = time.Now()
+	server.buildMuxer()
+	id := server.containers[0].ID
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", fmt.Sprintf("/containers/%s/wait?condition=next-exit", id), nil)
+		server.ServeHTTP(recorder, request)
+		done <- recorder
+	}()
+	select {
+	case <-done:
+		t.Fatal("WaitContainer: next-exit returned for a container that is already stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := server.MutateContainer(id, docker.State{Running: true, ExitCode: 7}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", fmt.Sprintf("/containers/%s/stop", id), nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("StopContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	select {
+	case recorder = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitContainer: timed out waiting for the next exit")
+	}
+	expected := `{"StatusCode":7}` + "\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("WaitContainer: wrong body. Want %q. Got %q.", expected, body)
+	}
+}
+
+func TestWaitContainerInvalidCondition(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/wait?condition=exploded", server.containers[0].ID)
+	request, _ := http.NewRequest("POST", path, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("WaitContainer: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+}
+
 func TestWaitContainerStatus(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -1041,6 +2237,40 @@ func TestLogContainer(t *testing.T) {
 	}
 }
 
+func TestLogContainerGzipEncoding(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addContainers(server, 1)
+	server.SetResponseEncoding("gzip")
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+	// SetResponseEncoding compresses unconditionally, so turning off the
+	// transport compression makes sure the logs are decompressed by the
+	// client rather than by net/http.
+	client.HTTPClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	var buf bytes.Buffer
+	err = client.Logs(docker.LogsOptions{
+		Container:    server.containers[0].ID,
+		OutputStream: &buf,
+		Stdout:       true,
+		RawTerminal:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Container is not running\nWhat happened?\nSomething happened\n"
+	if buf.String() != expected {
+		t.Errorf("Logs: wrong output. Want %q. Got %q.", expected, buf.String())
+	}
+}
+
 func TestLogContainerNotFound(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -1075,6 +2305,111 @@ func TestAttachContainer(t *testing.T) {
 	}
 }
 
+func TestAttachContainerStdinOnce(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.imgIDs = map[string]string{"base": "a1234"}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		stdinOnce bool
+		expected  string
+		closed    bool
+	}{
+		{false, "first\nsecond\n", false},
+		{true, "first\n", true},
+	}
+	for _, tt := range tests {
+		container, err := client.CreateContainer(docker.CreateContainerOptions{
+			Config: &docker.Config{Image: "base", Cmd: []string{"cat"}, OpenStdin: true, StdinOnce: tt.stdinOnce},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range []string{"first\n", "second\n"} {
+			err = client.AttachToContainer(docker.AttachToContainerOptions{
+				Container:    container.ID,
+				InputStream:  strings.NewReader(input),
+				OutputStream: ioutil.Discard,
+				Stdin:        true,
+				Stdout:       true,
+				RawTerminal:  true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, closed, err := server.ContainerStdin(container.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.expected {
+			t.Errorf("AttachToContainer(%v): wrong stdin. Want %q. Got %q.", tt.stdinOnce, tt.expected, data)
+		}
+		if closed != tt.closed {
+			t.Errorf("AttachToContainer(%v): wrong closed stdin. Want %v. Got %v.", tt.stdinOnce, tt.closed, closed)
+		}
+	}
+}
+
+func TestAttachContainerStdinStreaming(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.imgIDs = map[string]string{"base": "a1234"}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: "base", Cmd: []string{"cat"}, OpenStdin: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, writer := io.Pipe()
+	waiter, err := client.AttachToContainerNonBlocking(docker.AttachToContainerOptions{
+		Container:    container.ID,
+		InputStream:  reader,
+		OutputStream: ioutil.Discard,
+		Stdin:        true,
+		Stdout:       true,
+		RawTerminal:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("first\n"))
+	timeout := time.After(5 * time.Second)
+	for {
+		data, _, err := server.ContainerStdin(container.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) == "first\n" {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("AttachToContainer: input not recorded before EOF. Got %q.", data)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	writer.Close()
+	if err := waiter.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestAttachContainerNotFound(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -1088,6 +2423,38 @@ func TestAttachContainerNotFound(t *testing.T) {
 	}
 }
 
+func TestAttachContainerDetachKeys(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	tests := []struct {
+		keys string
+		code int
+	}{
+		{"ctrl-p,ctrl-q", http.StatusOK},
+		{"ctrl-@,ctrl-_", http.StatusOK},
+		{"ctrl-x,y", http.StatusBadRequest},
+		{"a", http.StatusBadRequest},
+		{"ctrl-xy", http.StatusBadRequest},
+		{"ctrl-1", http.StatusBadRequest},
+		{"shift-a", http.StatusBadRequest},
+		{"ctrl-p,", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		recorder := &HijackableResponseRecorder{}
+		path := fmt.Sprintf("/containers/%s/attach?logs=1&detachKeys=%s", server.containers[0].ID, url.QueryEscape(tt.keys))
+		request, _ := http.NewRequest("POST", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("AttachContainer(%q): wrong status. Want %d. Got %d.", tt.keys, tt.code, recorder.Code)
+		}
+		if recorder.Code == http.StatusOK {
+			recorder.HijackBuffer()
+		}
+	}
+}
+
 func TestAttachContainerWithStreamBlocks(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -1167,6 +2534,206 @@ func TestAttachContainerWithStreamBlocksOnCreatedContainers(t *testing.T) {
 	}
 }
 
+func TestLogContainerStreams(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 2)
+	server.containers[1].Config.Tty = true
+	server.buildMuxer()
+	for _, container := range server.containers {
+		server.AddContainerLogs(container.ID,
+			ContainerLogEntry{Line: "out 1"},
+			ContainerLogEntry{Line: "err 1", Stderr: true},
+			ContainerLogEntry{Line: "out 2"},
+		)
+	}
+	var tests = []struct {
+		query  string
+		stdout string
+		stderr string
+		tty    string
+	}{
+		{"stdout=1&stderr=1", "out 1\nout 2\n", "err 1\n", "out 1\nerr 1\nout 2\n"},
+		{"stdout=1&stderr=0", "out 1\nout 2\n", "", "out 1\nout 2\n"},
+		{"stdout=0&stderr=1", "", "err 1\n", "err 1\n"},
+		{"stderr=1&tail=2", "", "err 1\n", "err 1\n"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/logs?%s", server.containers[0].ID, tt.query)
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("LogContainer(%s): wrong status. Want %d. Got %d.", tt.query, http.StatusOK, recorder.Code)
+		}
+		var stdout, stderr bytes.Buffer
+		if _, err := stdcopy.StdCopy(&stdout, &stderr, recorder.Body); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != tt.stdout {
+			t.Errorf("LogContainer(%s): wrong stdout. Want %q. Got %q.", tt.query, tt.stdout, stdout.String())
+		}
+		if stderr.String() != tt.stderr {
+			t.Errorf("LogContainer(%s): wrong stderr. Want %q. Got %q.", tt.query, tt.stderr, stderr.String())
+		}
+		recorder = httptest.NewRecorder()
+		path = fmt.Sprintf("/containers/%s/logs?%s", server.containers[1].ID, tt.query)
+		request, _ = http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Body.String() != tt.tty {
+			t.Errorf("LogContainer(%s): wrong TTY output. Want %q. Got %q.", tt.query, tt.tty, recorder.Body.String())
+		}
+	}
+}
+
+func TestLogContainerStderrOnlyPlaceholder(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/logs?stdout=0&stderr=1", server.containers[0].ID)
+	request, _ := http.NewRequest("GET", path, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("LogContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if body := recorder.Body.String(); body != "" {
+		t.Errorf("LogContainer: wrong body. Want empty output. Got %q.", body)
+	}
+}
+
+func TestLogContainerMaxSize(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].HostConfig = &docker.HostConfig{
+		LogConfig: docker.LogConfig{
+			Type:   "json-file",
+			Config: map[string]string{"max-size": "8", "max-file": "2"},
+		},
+	}
+	server.buildMuxer()
+	id := server.containers[0].ID
+	for _, line := range []string{"one", "two", "three", "four", "five"} {
+		server.AddContainerLogs(id, ContainerLogEntry{Line: line})
+	}
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"stdout=1", []string{"three", "four", "five"}},
+		{"stdout=1&tail=2", []string{"four", "five"}},
+		{"stdout=1&tail=10", []string{"three", "four", "five"}},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/logs?%s", id, tt.query)
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("LogContainer(%s): wrong status. Want %d. Got %d.", tt.query, http.StatusOK, recorder.Code)
+		}
+		var stdout bytes.Buffer
+		if _, err := stdcopy.StdCopy(&stdout, ioutil.Discard, recorder.Body); err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join(tt.expected, "\n") + "\n"
+		if stdout.String() != expected {
+			t.Errorf("LogContainer(%s): wrong output. Want %q. Got %q.", tt.query, expected, stdout.String())
+		}
+	}
+}
+
+func TestAttachContainerLogsRotatedWhileStreaming(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.containers[0].HostConfig = &docker.HostConfig{
+		LogConfig: docker.LogConfig{
+			Type:   "json-file",
+			Config: map[string]string{"max-size": "8"},
+		},
+	}
+	server.buildMuxer()
+	id := server.containers[0].ID
+	server.AddContainerLogs(id, ContainerLogEntry{Line: "old"})
+	path := fmt.Sprintf("/containers/%s/attach?logs=1&stdout=1&stream=1", id)
+	request, _ := http.NewRequest("POST", path, nil)
+	done := make(chan string)
+	go func() {
+		recorder := &HijackableResponseRecorder{}
+		server.ServeHTTP(recorder, request)
+		done <- recorder.HijackBuffer()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// the two new lines don't fit together with the old one, which is
+	// rotated out before the stream catches up.
+	server.AddContainerLogs(id, ContainerLogEntry{Line: "new"}, ContainerLogEntry{Line: "abc"})
+	time.Sleep(100 * time.Millisecond)
+	server.cMut.Lock()
+	server.containers[0].State.Running = false
+	server.cMut.Unlock()
+	var body string
+	select {
+	case body = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for attach to finish")
+	}
+	lines := []string{
+		"\x01\x00\x00\x00\x00\x00\x00\x04old",
+		"\x01\x00\x00\x00\x00\x00\x00\x04new",
+		"\x01\x00\x00\x00\x00\x00\x00\x04abc",
+	}
+	expected := strings.Join(lines, "\n") + "\n"
+	if body != expected {
+		t.Errorf("AttachContainer: wrong body. Want %q. Got %q.", expected, body)
+	}
+}
+
+func TestAttachContainerLogsBeforeStream(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.buildMuxer()
+	id := server.containers[0].ID
+	server.AddContainerLogs(id,
+		ContainerLogEntry{Line: "old out"},
+		ContainerLogEntry{Line: "old err", Stderr: true},
+	)
+	path := fmt.Sprintf("/containers/%s/attach?logs=1&stdout=1&stderr=1&stream=1", id)
+	request, _ := http.NewRequest("POST", path, nil)
+	done := make(chan string)
+	go func() {
+		recorder := &HijackableResponseRecorder{}
+		server.ServeHTTP(recorder, request)
+		done <- recorder.HijackBuffer()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	server.AddContainerLogs(id, ContainerLogEntry{Line: "new out"})
+	time.Sleep(100 * time.Millisecond)
+	server.cMut.Lock()
+	server.containers[0].State.Running = false
+	server.cMut.Unlock()
+	var body string
+	select {
+	case body = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for attach to finish")
+	}
+	lines := []string{
+		"\x01\x00\x00\x00\x00\x00\x00\x08old out",
+		"\x02\x00\x00\x00\x00\x00\x00\x08old err",
+		"\x01\x00\x00\x00\x00\x00\x00\x08new out",
+	}
+	expected := strings.Join(lines, "\n") + "\n"
+	if body != expected {
+		t.Errorf("AttachContainer: wrong body. Want %q. Got %q.", expected, body)
+	}
+}
+
 func TestRemoveContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -1307,6 +2874,105 @@ func TestPullImageWithShaTag(t *testing.T) {
 	}
 }
 
+func TestPullImageReferences(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		query    string
+		expected string
+	}{
+		{"fromImage=localhost:5000/app", "localhost:5000/app"},
+		{"fromImage=localhost:5000/app&tag=1.0", "localhost:5000/app:1.0"},
+		{"fromImage=localhost:5000/app:1.0", "localhost:5000/app:1.0"},
+		{"fromImage=localhost:5000/app:1.0&tag=2.0", "localhost:5000/app:2.0"},
+		{"fromImage=localhost:5000/team/app&tag=sha256:deadc0de", "localhost:5000/team/app@sha256:deadc0de"},
+		{"fromImage=localhost:5000/app:", "localhost:5000/app"},
+		{"fromSrc=-&repo=localhost:5000/imported&tag=v1", "localhost:5000/imported:v1"},
+	}
+	for _, tt := range tests {
+		server := DockerServer{imgIDs: make(map[string]string)}
+		server.buildMuxer()
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/images/create?"+tt.query, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("PullImage(%q): wrong status. Want %d. Got %d.", tt.query, http.StatusOK, recorder.Code)
+		}
+		if len(server.imgIDs) != 1 {
+			t.Errorf("PullImage(%q): want 1 reference. Got %v.", tt.query, server.imgIDs)
+		}
+		if _, ok := server.imgIDs[tt.expected]; !ok {
+			t.Errorf("PullImage(%q): image not registered as %q. Got %v.", tt.query, tt.expected, server.imgIDs)
+		}
+	}
+}
+
+func TestPullImagePlatform(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{imgIDs: make(map[string]string)}
+	server.buildMuxer()
+	server.SetImagePlatforms("base", []string{"linux/amd64", "linux/arm/v6", "linux/arm/v7", "linux/arm64/v8"})
+	var tests = []struct {
+		platform string
+		code     int
+		os       string
+		arch     string
+		variant  string
+	}{
+		{"", http.StatusOK, "linux", "amd64", ""},
+		{"linux/arm/v7", http.StatusOK, "linux", "arm", "v7"},
+		{"linux/arm", http.StatusOK, "linux", "arm", "v6"},
+		{"linux/arm64", http.StatusOK, "linux", "arm64", "v8"},
+		{"linux/s390x", http.StatusNotFound, "", "", ""},
+		{"windows", http.StatusNotFound, "", "", ""},
+		{"linux//v7", http.StatusBadRequest, "", "", ""},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		path := "/images/create?fromImage=base&platform=" + url.QueryEscape(tt.platform)
+		request, _ := http.NewRequest("POST", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("PullImage(%q): wrong status. Want %d. Got %d.", tt.platform, tt.code, recorder.Code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		image := server.images[len(server.images)-1]
+		if server.imgIDs["base"] != image.ID {
+			t.Errorf("PullImage(%q): wrong image for base. Want %q. Got %q.", tt.platform, image.ID, server.imgIDs["base"])
+		}
+		if image.OS != tt.os || image.Architecture != tt.arch || image.Variant != tt.variant {
+			t.Errorf("PullImage(%q): wrong platform. Want %s/%s/%s. Got %s/%s/%s.", tt.platform, tt.os, tt.arch, tt.variant, image.OS, image.Architecture, image.Variant)
+		}
+	}
+}
+
+func TestPullImagePlatformInspect(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.SetImagePlatforms("arm-base", []string{"linux/amd64", "linux/arm/v7"})
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PullImage(docker.PullImageOptions{Repository: "arm-base", Tag: "latest", Platform: "linux/arm/v7"}, docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := client.InspectImage("arm-base:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.OS != "linux" || image.Architecture != "arm" || image.Variant != "v7" {
+		t.Errorf("InspectImage: wrong platform. Want linux/arm/v7. Got %s/%s/%s.", image.OS, image.Architecture, image.Variant)
+	}
+}
+
 func TestPushImage(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{imgIDs: map[string]string{"tsuru/python": "a123"}}
@@ -1343,6 +3009,32 @@ func TestPushImageNotFound(t *testing.T) {
 	}
 }
 
+func TestPushImageTagResolution(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{imgIDs: map[string]string{"tsuru/python:v1": "a123", "tsuru/ruby": "a124"}}
+	server.buildMuxer()
+	var tests = []struct {
+		path     string
+		expected int
+	}{
+		{"/images/tsuru/python/push", http.StatusOK},
+		{"/images/tsuru/python/push?tag=v1", http.StatusOK},
+		{"/images/tsuru/python/push?tag=v2", http.StatusNotFound},
+		{"/images/tsuru/python/push?tag=latest", http.StatusNotFound},
+		{"/images/tsuru/ruby/push?tag=latest", http.StatusOK},
+		{"/images/tsuru/ruby/push?tag=v1", http.StatusNotFound},
+		{"/images/tsuru/py/push", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", tt.path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.expected {
+			t.Errorf("PushImage %s: wrong status. Want %d. Got %d.", tt.path, tt.expected, recorder.Code)
+		}
+	}
+}
+
 func TestTagImage(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{imgIDs: map[string]string{"tsuru/python": "a123"}}
@@ -1427,7 +3119,7 @@ func addContainers(server *DockerServer, n int) {
 			},
 			ResolvConfPath: "/etc/resolv.conf",
 		}
-		server.containers = append(server.containers, &container)
+		server.addContainer(&container)
 	}
 }
 
@@ -1451,32 +3143,103 @@ func addImages(server *DockerServer, n int, repo bool) {
 	}
 }
 
-func TestListImages(t *testing.T) {
+func TestListImages(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addImages(&server, 2, true)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/images/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("ListImages: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected := make([]docker.APIImages, 2)
+	for i, image := range server.images {
+		expected[i] = docker.APIImages{
+			ID:         image.ID,
+			Created:    image.Created.Unix(),
+			RepoTags:   []string{"docker/python-" + image.ID},
+			Containers: -1,
+			SharedSize: -1,
+		}
+	}
+	var got []docker.APIImages
+	err := json.NewDecoder(recorder.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ListImages. Want %#v. Got %#v.", expected, got)
+	}
+}
+
+func TestListImagesContainersCount(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addImages(&server, 3, true)
+	addContainers(&server, 3)
+	server.containers[0].Image = server.images[0].ID
+	server.containers[1].Image = "docker/python-" + server.images[0].ID
+	server.containers[2].Image = server.images[1].ID
+	server.buildMuxer()
+	server.SetImageContainersCount(true)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/images/json", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ListImages: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var got []docker.APIImages
+	if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{2, 1, 0}
+	for i, image := range got {
+		if image.Containers != expected[i] {
+			t.Errorf("ListImages: wrong containers count for image %d. Want %d. Got %d.", i, expected[i], image.Containers)
+		}
+	}
+}
+
+func TestListImagesSharedSize(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addImages(&server, 2, true)
+	addImages(&server, 3, true)
 	server.buildMuxer()
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/images/json?all=1", nil)
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("ListImages: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
-	}
-	expected := make([]docker.APIImages, 2)
-	for i, image := range server.images {
-		expected[i] = docker.APIImages{
-			ID:       image.ID,
-			Created:  image.Created.Unix(),
-			RepoTags: []string{"docker/python-" + image.ID},
+	layers := [][]string{
+		{"sha256:base", "sha256:python", "sha256:app1"},
+		{"sha256:base", "sha256:python", "sha256:app2"},
+		{"sha256:base", "sha256:other"},
+	}
+	for i, l := range layers {
+		if err := server.SetImageLayers(server.images[i].ID, l); err != nil {
+			t.Fatal(err)
 		}
 	}
-	var got []docker.APIImages
-	err := json.NewDecoder(recorder.Body).Decode(&got)
-	if err != nil {
-		t.Fatal(err)
+	var tests = []struct {
+		query    string
+		expected []int64
+	}{
+		{"", []int64{-1, -1, -1}},
+		{"?shared-size=1", []int64{2 << 20, 2 << 20, 1 << 20}},
 	}
-	if !reflect.DeepEqual(got, expected) {
-		t.Errorf("ListImages. Want %#v. Got %#v.", expected, got)
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/images/json"+tt.query, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ListImages: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		var got []docker.APIImages
+		if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		for i, image := range got {
+			if image.SharedSize != tt.expected[i] {
+				t.Errorf("ListImages(%q): wrong shared size for image %d. Want %d. Got %d.", tt.query, i, tt.expected[i], image.SharedSize)
+			}
+		}
 	}
 }
 
@@ -1489,8 +3252,8 @@ func TestRemoveImage(t *testing.T) {
 	path := fmt.Sprintf("/images/%s", server.images[0].ID)
 	request, _ := http.NewRequest("DELETE", path, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNoContent {
-		t.Errorf("RemoveImage: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("RemoveImage: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
 	if len(server.images) > 0 {
 		t.Error("RemoveImage: did not remove the image.")
@@ -1507,8 +3270,8 @@ func TestRemoveImageByName(t *testing.T) {
 	path := "/images/" + imgName
 	request, _ := http.NewRequest("DELETE", path, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusNoContent {
-		t.Errorf("RemoveImage: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("RemoveImage: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
 	if len(server.images) > 0 {
 		t.Error("RemoveImage: did not remove the image.")
@@ -1550,6 +3313,37 @@ func TestRemoveImageWithMultipleTags(t *testing.T) {
 	}
 }
 
+func TestRemoveImageResult(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addImages(&server, 1, true)
+	server.buildMuxer()
+	imgID := server.images[0].ID
+	server.imgIDs["docker/python-wat"] = imgID
+	tests := []struct {
+		name     string
+		expected []docker.ImageDelete
+	}{
+		{"docker/python-wat", []docker.ImageDelete{{Untagged: "docker/python-wat"}}},
+		{"docker/python-" + imgID, []docker.ImageDelete{{Untagged: "docker/python-" + imgID}, {Deleted: imgID}}},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("DELETE", "/images/"+tt.name, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("RemoveImage(%q): wrong status. Want %d. Got %d.", tt.name, http.StatusOK, recorder.Code)
+		}
+		var result []docker.ImageDelete
+		if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("RemoveImage(%q): wrong result. Want %#v. Got %#v.", tt.name, tt.expected, result)
+		}
+	}
+}
+
 func TestPrepareFailure(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{failures: make(map[string]string)}
@@ -1562,145 +3356,604 @@ func TestPrepareFailure(t *testing.T) {
 	if recorder.Code != http.StatusBadRequest {
 		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
-	if recorder.Body.String() != errorID+"\n" {
-		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	if recorder.Body.String() != errorID+"\n" {
+		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	}
+}
+
+func TestPrepareMultiFailures(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{multiFailures: []map[string]string{}}
+	server.buildMuxer()
+	errorID := "multi error"
+	server.PrepareMultiFailures(errorID, "containers/json")
+	server.PrepareMultiFailures(errorID, "containers/json")
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+	if recorder.Body.String() != errorID+"\n" {
+		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+	if recorder.Body.String() != errorID+"\n" {
+		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if recorder.Body.String() == errorID+"\n" {
+		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	}
+}
+
+func TestRemoveFailure(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{failures: make(map[string]string)}
+	server.buildMuxer()
+	errorID := "my_error"
+	server.PrepareFailure(errorID, "containers/json")
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+	server.ResetFailure(errorID)
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("RemoveFailure: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestResetMultiFailures(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{multiFailures: []map[string]string{}}
+	server.buildMuxer()
+	errorID := "multi error"
+	server.PrepareMultiFailures(errorID, "containers/json")
+	server.PrepareMultiFailures(errorID, "containers/json")
+	if len(server.multiFailures) != 2 {
+		t.Errorf("PrepareMultiFailures: error adding multi failures.")
+	}
+	server.ResetMultiFailures()
+	if len(server.multiFailures) != 0 {
+		t.Errorf("ResetMultiFailures: error reseting multi failures.")
+	}
+}
+
+func TestMutateContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{failures: make(map[string]string)}
+	server.buildMuxer()
+	server.addContainer(&docker.Container{ID: "id123"})
+	state := docker.State{Running: false, ExitCode: 1}
+	err := server.MutateContainer("id123", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(server.containers[0].State, state) {
+		t.Errorf("Wrong state after mutation.\nWant %#v.\nGot %#v.",
+			state, server.containers[0].State)
+	}
+}
+
+func TestMutateContainerNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{failures: make(map[string]string)}
+	server.buildMuxer()
+	state := docker.State{Running: false, ExitCode: 1}
+	err := server.MutateContainer("id123", state)
+	if err == nil {
+		t.Error("Unexpected <nil> error")
+	}
+	if err.Error() != "container not found" {
+		t.Errorf("wrong error message. Want %q. Got %q.", "container not found", err)
+	}
+}
+
+func TestSetContainerGraphDriver(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addContainers(server, 1)
+	driver := docker.GraphDriver{
+		Name: "overlay2",
+		Data: map[string]string{
+			"LowerDir":  "/var/lib/docker/overlay2/abc-init/diff",
+			"MergedDir": "/var/lib/docker/overlay2/abc/merged",
+			"UpperDir":  "/var/lib/docker/overlay2/abc/diff",
+			"WorkDir":   "/var/lib/docker/overlay2/abc/work",
+		},
+	}
+	err = server.SetContainerGraphDriver(server.containers[0].Name, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.Data["UpperDir"] = "/changed"
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := client.InspectContainer(server.containers[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.GraphDriver == nil {
+		t.Fatal("InspectContainer: unexpected <nil> GraphDriver")
+	}
+	if container.GraphDriver.Name != "overlay2" {
+		t.Errorf("InspectContainer: wrong graph driver. Want %q. Got %q.", "overlay2", container.GraphDriver.Name)
+	}
+	expected := "/var/lib/docker/overlay2/abc/diff"
+	if upper := container.GraphDriver.Data["UpperDir"]; upper != expected {
+		t.Errorf("InspectContainer: wrong UpperDir. Want %q. Got %q.", expected, upper)
+	}
+}
+
+func TestSetContainerGraphDriverNotFound(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	err := server.SetContainerGraphDriver("id123", docker.GraphDriver{Name: "overlay2"})
+	if err == nil {
+		t.Error("Unexpected <nil> error")
+	}
+}
+
+func TestBuildImageWithContentTypeTar(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{imgIDs: make(map[string]string)}
+	imageName := "teste"
+	recorder := httptest.NewRecorder()
+	tarFile, err := os.Open("data/dockerfile.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	request, _ := http.NewRequest("POST", "/build?t=teste", tarFile)
+	request.Header.Add("Content-Type", "application/tar")
+	server.buildImage(recorder, request)
+	if recorder.Body.String() == "miss Dockerfile" {
+		t.Errorf("BuildImage: miss Dockerfile")
+		return
+	}
+	if _, ok := server.imgIDs[imageName]; !ok {
+		t.Errorf("BuildImage: image %s not builded", imageName)
+	}
+}
+
+func TestBuildImageClientHangUp(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{imgIDs: make(map[string]string)}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := strings.Repeat("RUN true\n", 200)
+	tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(content))})
+	tw.Write([]byte(content))
+	tw.Close()
+	recorder := httptest.NewRecorder()
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()/2])
+	request, _ := http.NewRequest("POST", "/build?t=teste", truncated)
+	request.Header.Add("Content-Type", "application/tar")
+	server.buildImage(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("BuildImage: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+	if _, ok := server.imgIDs["teste"]; ok {
+		t.Error("BuildImage: should not build the image when the client hangs up")
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	manifest := `[{"Config":"abc123.json","RepoTags":["busybox:latest","busybox:1.0"]},{"Config":"def456.json"}]`
+	tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))})
+	tw.Write([]byte(manifest))
+	tw.Close()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := client.ImageLoad(docker.LoadImageOptions{InputStream: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"busybox:latest", "busybox:1.0", "sha256:def456"}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("LoadImage: wrong loaded images. Want %#v. Got %#v.", expected, loaded)
+	}
+	if id := server.imgIDs["busybox:1.0"]; id != "sha256:abc123" {
+		t.Errorf("LoadImage: wrong image ID for tag. Want %q. Got %q.", "sha256:abc123", id)
+	}
+	if len(server.images) != 2 {
+		t.Errorf("LoadImage: wrong number of images. Want 2. Got %d.", len(server.images))
+	}
+}
+
+func TestExportImages(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.images = []docker.Image{
+		{ID: "sha256:aaa111", OS: "linux", Config: &docker.Config{Cmd: []string{"sh"}}},
+		{ID: "sha256:bbb222", OS: "linux"},
+	}
+	server.imgIDs = map[string]string{
+		"busybox:latest": "sha256:aaa111",
+		"busybox:1.0":    "sha256:aaa111",
+		"alpine:latest":  "sha256:bbb222",
+	}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(names ...string) []byte {
+		var buf bytes.Buffer
+		err := client.ExportImages(docker.ExportImagesOptions{Names: names, OutputStream: &buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	data := export("alpine:latest", "busybox:1.0", "sha256:aaa111", "busybox:latest")
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+	}
+	var files []string
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, header.Name)
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectedFiles := []string{"bbb222.json", "aaa111.json", "manifest.json"}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("ExportImages: wrong files. Want %#v. Got %#v.", expectedFiles, files)
+	}
+	expected := []struct {
+		Config   string
+		RepoTags []string
+	}{
+		{"bbb222.json", []string{"alpine:latest"}},
+		{"aaa111.json", []string{"busybox:1.0", "busybox:latest"}},
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("ExportImages: wrong manifest. Want %#v. Got %#v.", expected, manifest)
+	}
+	if again := export("alpine:latest", "busybox:1.0", "sha256:aaa111", "busybox:latest"); !bytes.Equal(data, again) {
+		t.Error("ExportImages: expected the same images to produce the same tarball")
+	}
+	err = client.ExportImages(docker.ExportImagesOptions{Names: []string{"alpine:latest", "unknown"}, OutputStream: ioutil.Discard})
+	if e, ok := err.(*docker.Error); !ok || e.Status != http.StatusNotFound {
+		t.Errorf("ExportImages: wrong error for unknown image. Want 404. Got %#v.", err)
+	}
+}
+
+func TestBuildImageWithRemoteDockerfile(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{imgIDs: make(map[string]string)}
+	imageName := "teste"
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/build?t=teste&remote=http://localhost/Dockerfile", nil)
+	server.buildImage(recorder, request)
+	if _, ok := server.imgIDs[imageName]; !ok {
+		t.Errorf("BuildImage: image %s not builded", imageName)
+	}
+}
+
+func TestBuildImageIsolationAndShmSize(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		query    string
+		code     int
+		expected BuildSettings
+	}{
+		{"isolation=process&shmsize=67108864", http.StatusOK, BuildSettings{Tag: "teste", Isolation: "process", ShmSize: 67108864}},
+		{"isolation=hyperv", http.StatusOK, BuildSettings{Tag: "teste", Isolation: "hyperv"}},
+		{"isolation=vm", http.StatusBadRequest, BuildSettings{}},
+		{"shmsize=-1", http.StatusBadRequest, BuildSettings{}},
+		{"shmsize=64m", http.StatusBadRequest, BuildSettings{}},
+	}
+	for _, tt := range tests {
+		server := DockerServer{imgIDs: make(map[string]string)}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/build?t=teste&remote=http://localhost/Dockerfile&"+tt.query, nil)
+		server.buildImage(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("BuildImage(%s): wrong status. Want %d. Got %d.", tt.query, tt.code, recorder.Code)
+		}
+		if _, ok := server.imgIDs["teste"]; ok != (tt.code == http.StatusOK) {
+			t.Errorf("BuildImage(%s): expected image to be built: %v", tt.query, tt.code == http.StatusOK)
+		}
+		settings := server.LastBuildSettings()
+		if tt.code != http.StatusOK {
+			if settings != nil {
+				t.Errorf("BuildImage(%s): expected no recorded settings. Got %#v.", tt.query, settings)
+			}
+			continue
+		}
+		if settings == nil || *settings != tt.expected {
+			t.Errorf("BuildImage(%s): wrong settings. Want %#v. Got %#v.", tt.query, tt.expected, settings)
+		}
 	}
 }
 
-func TestPrepareMultiFailures(t *testing.T) {
+func TestBuildImageLabels(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{multiFailures: []map[string]string{}}
+	server := DockerServer{imgIDs: make(map[string]string)}
 	server.buildMuxer()
-	errorID := "multi error"
-	server.PrepareMultiFailures(errorID, "containers/json")
-	server.PrepareMultiFailures(errorID, "containers/json")
+	labels := url.QueryEscape(`{"com.example.team":"infra","version":"1.0"}`)
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/containers/json?all=1", nil)
+	request, _ := http.NewRequest("POST", "/build?t=labeled&remote=http://localhost/Dockerfile&labels="+labels, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusBadRequest {
-		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
-	}
-	if recorder.Body.String() != errorID+"\n" {
-		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("BuildImage: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
 	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	request, _ = http.NewRequest("GET", "/images/labeled/json", nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusBadRequest {
-		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	var image docker.Image
+	if err := json.NewDecoder(recorder.Body).Decode(&image); err != nil {
+		t.Fatal(err)
 	}
-	if recorder.Body.String() != errorID+"\n" {
-		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	expected := map[string]string{"com.example.team": "infra", "version": "1.0"}
+	if image.Config == nil || !reflect.DeepEqual(image.Config.Labels, expected) {
+		t.Errorf("InspectImage: wrong labels. Want %#v. Got %#v.", expected, image.Config)
 	}
 	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	request, _ = http.NewRequest("POST", "/build?t=broken&remote=http://localhost/Dockerfile&labels=nope", nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
-	}
-	if recorder.Body.String() == errorID+"\n" {
-		t.Errorf("PrepareFailure: wrong message. Want %s. Got %s.", errorID, recorder.Body.String())
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("BuildImage: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
 }
 
-func TestRemoveFailure(t *testing.T) {
+func TestBuildImageRemoveIntermediateContainers(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{failures: make(map[string]string)}
-	server.buildMuxer()
-	errorID := "my_error"
-	server.PrepareFailure(errorID, "containers/json")
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/containers/json?all=1", nil)
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusBadRequest {
-		t.Errorf("PrepareFailure: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
-	}
-	server.ResetFailure(errorID)
-	recorder = httptest.NewRecorder()
-	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("RemoveFailure: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	var tests = []struct {
+		query    string
+		expected BuildSettings
+		removed  bool
+	}{
+		{"", BuildSettings{Tag: "teste"}, false},
+		{"rm=1", BuildSettings{Tag: "teste", Remove: true}, true},
+		{"forcerm=1", BuildSettings{Tag: "teste", ForceRemove: true}, false},
+		{"rm=1&forcerm=1", BuildSettings{Tag: "teste", Remove: true, ForceRemove: true}, true},
+		{"rm=true&forcerm=True", BuildSettings{Tag: "teste", Remove: true, ForceRemove: true}, true},
+		{"rm=false&forcerm=0", BuildSettings{Tag: "teste"}, false},
+	}
+	for _, tt := range tests {
+		server := DockerServer{imgIDs: make(map[string]string)}
+		if settings := server.LastBuildSettings(); settings != nil {
+			t.Fatalf("LastBuildSettings: expected nil before building. Got %#v.", settings)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/build?t=teste&remote=http://localhost/Dockerfile&"+tt.query, nil)
+		server.buildImage(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("BuildImage(%s): wrong status. Want %d. Got %d.", tt.query, http.StatusOK, recorder.Code)
+		}
+		settings := server.LastBuildSettings()
+		if settings == nil || *settings != tt.expected {
+			t.Errorf("BuildImage(%s): wrong settings. Want %#v. Got %#v.", tt.query, tt.expected, settings)
+		}
+		removed := strings.Contains(recorder.Body.String(), "Removing intermediate container ")
+		if removed != tt.removed {
+			t.Errorf("BuildImage(%s): unexpected output %q", tt.query, recorder.Body.String())
+		}
 	}
 }
 
-func TestResetMultiFailures(t *testing.T) {
+func TestBuildImageError(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{multiFailures: []map[string]string{}}
-	server.buildMuxer()
-	errorID := "multi error"
-	server.PrepareMultiFailures(errorID, "containers/json")
-	server.PrepareMultiFailures(errorID, "containers/json")
-	if len(server.multiFailures) != 2 {
-		t.Errorf("PrepareMultiFailures: error adding multi failures.")
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	server.ResetMultiFailures()
-	if len(server.multiFailures) != 0 {
-		t.Errorf("ResetMultiFailures: error reseting multi failures.")
+	defer server.Stop()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetBuildError(127, "The command '/bin/sh -c make' returned a non-zero code: 127")
+	for _, raw := range []bool{false, true} {
+		var buf bytes.Buffer
+		err = client.BuildImage(docker.BuildImageOptions{
+			Name:          "failed",
+			Remote:        "http://localhost/Dockerfile",
+			OutputStream:  &buf,
+			RawJSONStream: raw,
+		})
+		jsonErr, ok := err.(*jsonmessage.JSONError)
+		if !ok {
+			t.Fatalf("BuildImage(raw=%v): wrong error. Want *jsonmessage.JSONError. Got %#v.", raw, err)
+		}
+		if jsonErr.Code != 127 || jsonErr.Message != "The command '/bin/sh -c make' returned a non-zero code: 127" {
+			t.Errorf("BuildImage(raw=%v): wrong error. Got %#v.", raw, jsonErr)
+		}
+		if raw && !strings.Contains(buf.String(), `"errorDetail"`) {
+			t.Errorf("BuildImage(raw=%v): wrong output. Got %q.", raw, buf.String())
+		}
+	}
+	if _, ok := server.imgIDs["failed"]; ok {
+		t.Error("BuildImage: failed build should not create an image")
+	}
+	server.SetBuildError(0, "")
+	err = client.BuildImage(docker.BuildImageOptions{
+		Name:         "failed",
+		Remote:       "http://localhost/Dockerfile",
+		OutputStream: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.imgIDs["failed"]; !ok {
+		t.Error("BuildImage: image should be built after resetting the error")
 	}
 }
 
-func TestMutateContainer(t *testing.T) {
+func TestImageHistory(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{failures: make(map[string]string)}
-	server.buildMuxer()
-	server.containers = append(server.containers, &docker.Container{ID: "id123"})
-	state := docker.State{Running: false, ExitCode: 1}
-	err := server.MutateContainer("id123", state)
+	server, err := NewServer("127.0.0.1:0", nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(server.containers[0].State, state) {
-		t.Errorf("Wrong state after mutation.\nWant %#v.\nGot %#v.",
-			state, server.containers[0].State)
+	defer server.Stop()
+	created := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	server.images = []docker.Image{
+		{ID: "a1234", Parent: "b1234", Created: created, Size: 1024, Comment: "app", ContainerConfig: docker.Config{Cmd: []string{"/bin/sh", "-c", "make install"}}},
+		{ID: "b1234", Created: created.Add(-time.Hour), Size: 4096},
+	}
+	server.imgIDs = map[string]string{"app:v1": "a1234", "app:latest": "a1234", "base": "b1234"}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := client.ImageHistory("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []docker.ImageHistory{
+		{ID: "a1234", Tags: []string{"app:latest", "app:v1"}, Created: created.Unix(), CreatedBy: "/bin/sh -c make install", Size: 1024, Comment: "app"},
+		{ID: "b1234", Tags: []string{"base"}, Created: created.Add(-time.Hour).Unix(), Size: 4096},
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("ImageHistory: wrong default history. Want %#v. Got %#v.", expected, history)
+	}
+	layers := []docker.ImageHistory{
+		{ID: "a1234", Created: created.Unix(), CreatedBy: "/bin/sh -c #(nop) COPY dir:abc in /app", Size: 52428800, Comment: "bloated"},
+		{ID: "<missing>", Created: created.Unix(), CreatedBy: "/bin/sh -c apt-get install -y build-essential", Size: 209715200},
+	}
+	if err = server.SetImageHistory("app:v1", layers); err != nil {
+		t.Fatal(err)
+	}
+	history, err = client.ImageHistory("a1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, layers) {
+		t.Errorf("ImageHistory: wrong history. Want %#v. Got %#v.", layers, history)
+	}
+	if err = server.SetImageHistory("app:v1", nil); err != nil {
+		t.Fatal(err)
+	}
+	history, err = client.ImageHistory("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("ImageHistory: wrong history after reset. Want %#v. Got %#v.", expected, history)
 	}
 }
 
-func TestMutateContainerNotFound(t *testing.T) {
+func TestImageHistoryNotFound(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{failures: make(map[string]string)}
+	server := DockerServer{}
 	server.buildMuxer()
-	state := docker.State{Running: false, ExitCode: 1}
-	err := server.MutateContainer("id123", state)
-	if err == nil {
-		t.Error("Unexpected <nil> error")
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/images/unknown/history", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("ImageHistory: wrong status. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
 	}
-	if err.Error() != "container not found" {
-		t.Errorf("wrong error message. Want %q. Got %q.", "container not found", err)
+	if err := server.SetImageHistory("unknown", nil); err == nil || err.Error() != "image not found" {
+		t.Errorf("SetImageHistory: wrong error. Want %q. Got %v.", "image not found", err)
 	}
 }
 
-func TestBuildImageWithContentTypeTar(t *testing.T) {
+func TestInspectImageLayers(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{imgIDs: make(map[string]string)}
-	imageName := "teste"
+	server := DockerServer{}
+	server.buildMuxer()
+	server.images = []docker.Image{{ID: "a1234"}}
+	server.imgIDs = map[string]string{"base:latest": "a1234"}
+	layers := []string{"sha256:5f70bf18a086", "sha256:e0f1b7345a52"}
+	if err := server.SetImageLayers("base:latest", layers); err != nil {
+		t.Fatal(err)
+	}
 	recorder := httptest.NewRecorder()
-	tarFile, err := os.Open("data/dockerfile.tar")
-	if err != nil {
+	request, _ := http.NewRequest("GET", "/images/base:latest/json", nil)
+	server.ServeHTTP(recorder, request)
+	var image docker.Image
+	if err := json.NewDecoder(recorder.Body).Decode(&image); err != nil {
 		t.Fatal(err)
 	}
-	defer tarFile.Close()
-	request, _ := http.NewRequest("POST", "/build?t=teste", tarFile)
-	request.Header.Add("Content-Type", "application/tar")
-	server.buildImage(recorder, request)
-	if recorder.Body.String() == "miss Dockerfile" {
-		t.Errorf("BuildImage: miss Dockerfile")
-		return
+	expected := &docker.RootFS{Type: "layers", Layers: layers}
+	if !reflect.DeepEqual(image.RootFS, expected) {
+		t.Errorf("InspectImage: wrong rootfs. Want %#v. Got %#v.", expected, image.RootFS)
 	}
-	if _, ok := server.imgIDs[imageName]; !ok {
-		t.Errorf("BuildImage: image %s not builded", imageName)
+	if err := server.SetImageLayers("unknown", layers); err == nil {
+		t.Error("SetImageLayers: expected error for unknown image, got <nil>")
 	}
 }
 
-func TestBuildImageWithRemoteDockerfile(t *testing.T) {
+func TestInspectImageConfig(t *testing.T) {
 	t.Parallel()
-	server := DockerServer{imgIDs: make(map[string]string)}
-	imageName := "teste"
+	server := DockerServer{}
+	server.buildMuxer()
+	server.images = []docker.Image{{ID: "a1234"}}
+	server.imgIDs = map[string]string{"base:latest": "a1234"}
+	config := docker.Config{
+		Entrypoint:   []string{"/entrypoint.sh"},
+		Cmd:          []string{"serve"},
+		Env:          []string{"PORT=8080"},
+		ExposedPorts: map[docker.Port]struct{}{"8080/tcp": {}},
+		Healthcheck:  &docker.HealthConfig{Test: []string{"CMD", "curl", "-f", "http://localhost:8080"}},
+	}
+	if err := server.SetImageConfig("a1234", config); err != nil {
+		t.Fatal(err)
+	}
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/build?t=teste&remote=http://localhost/Dockerfile", nil)
-	server.buildImage(recorder, request)
-	if _, ok := server.imgIDs[imageName]; !ok {
-		t.Errorf("BuildImage: image %s not builded", imageName)
+	request, _ := http.NewRequest("GET", "/images/base:latest/json", nil)
+	server.ServeHTTP(recorder, request)
+	var image docker.Image
+	if err := json.NewDecoder(recorder.Body).Decode(&image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Config == nil || !reflect.DeepEqual(*image.Config, config) {
+		t.Errorf("InspectImage: wrong config. Want %#v. Got %#v.", config, image.Config)
+	}
+	if !reflect.DeepEqual(image.ContainerConfig, config) {
+		t.Errorf("InspectImage: wrong container config. Want %#v. Got %#v.", config, image.ContainerConfig)
+	}
+	if err := server.SetImageConfig("unknown", config); err == nil {
+		t.Error("SetImageConfig: expected error for unknown image, got <nil>")
 	}
 }
 
@@ -1734,6 +3987,7 @@ func TestCreateExecContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	addContainers(&server, 2)
+	server.containers[0].State.Running = true
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
 	body := `{"Cmd": ["bash", "-c", "ls"]}`
@@ -1767,10 +4021,72 @@ func TestCreateExecContainer(t *testing.T) {
 	}
 }
 
+func TestCreateExecContainerNotRunning(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 2)
+	server.containers[1].State.Running = true
+	server.containers[1].State.Paused = true
+	server.buildMuxer()
+	var tests = []struct {
+		id     string
+		status int
+	}{
+		{server.containers[0].ID, http.StatusConflict},
+		{server.containers[1].ID, http.StatusConflict},
+		{"unknown", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/exec", tt.id)
+		request, _ := http.NewRequest("POST", path, strings.NewReader(`{"Cmd": ["ls"]}`))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("CreateExec(%s): wrong status. Want %d. Got %d.", tt.id, tt.status, recorder.Code)
+		}
+	}
+	expected := fmt.Sprintf("Container %s is not running\n", server.containers[0].ID)
+	recorder := httptest.NewRecorder()
+	path := fmt.Sprintf("/containers/%s/exec", server.containers[0].ID)
+	request, _ := http.NewRequest("POST", path, strings.NewReader(`{"Cmd": ["ls"]}`))
+	server.ServeHTTP(recorder, request)
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("CreateExec: wrong body. Want %q. Got %q.", expected, got)
+	}
+	if len(server.execs) != 0 || len(server.containers[0].ExecIDs) != 0 {
+		t.Errorf("CreateExec: should not register execs. Got %d.", len(server.execs))
+	}
+}
+
+func TestCreateExecContainerProcessConfig(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	body := `{"Cmd": ["sh"], "User": "root", "Privileged": true, "Tty": true, "AttachStdin": true, "AttachStdout": true}`
+	path := fmt.Sprintf("/containers/%s/exec", server.containers[0].ID)
+	request, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("CreateExec: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	serverExec := server.execs[0]
+	expected := docker.ExecProcessConfig{User: "root", Privileged: true, Tty: true, EntryPoint: "sh"}
+	if !reflect.DeepEqual(serverExec.ProcessConfig, expected) {
+		t.Errorf("CreateExec: wrong process config. Want %#v. Got %#v.", expected, serverExec.ProcessConfig)
+	}
+	if !serverExec.OpenStdin || !serverExec.OpenStdout || serverExec.OpenStderr {
+		t.Errorf("CreateExec: wrong open streams. Got %#v.", serverExec)
+	}
+}
+
 func TestInspectExecContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	addContainers(&server, 1)
+	server.containers[0].State.Running = true
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
 	body := `{"Cmd": ["bash", "-c", "ls"]}`
@@ -1815,6 +4131,7 @@ func TestStartExecContainer(t *testing.T) {
 	server, _ := NewServer("127.0.0.1:0", nil, nil)
 	defer server.Stop()
 	addContainers(server, 1)
+	server.containers[0].State.Running = true
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
 	body := `{"Cmd": ["bash", "-c", "ls"]}`
@@ -1863,6 +4180,9 @@ func TestStartExecContainer(t *testing.T) {
 	if execInfo.Running {
 		t.Error("StartExec: expected exec to be not running after start returns, but it's running")
 	}
+	if execInfo.Pid == 0 {
+		t.Error("StartExec: expected exec to have a Pid, got 0")
+	}
 }
 
 func TestStartExecContainerWildcardCallback(t *testing.T) {
@@ -1870,6 +4190,7 @@ func TestStartExecContainerWildcardCallback(t *testing.T) {
 	server, _ := NewServer("127.0.0.1:0", nil, nil)
 	defer server.Stop()
 	addContainers(server, 1)
+	server.containers[0].State.Running = true
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
 	body := `{"Cmd": ["bash", "-c", "ls"]}`
@@ -1908,15 +4229,93 @@ func TestStartExecContainerWildcardCallback(t *testing.T) {
 		t.Error("StartExec: expected exec to be running, but it's not running")
 	}
 	close(unleash)
-	if code := <-codes; code != http.StatusOK {
-		t.Errorf("StartExec: wrong status. Want %d. Got %d.", http.StatusOK, code)
+	if code := <-codes; code != http.StatusOK {
+		t.Errorf("StartExec: wrong status. Want %d. Got %d.", http.StatusOK, code)
+	}
+	execInfo, err = waitExec(server.URL(), exec.ID, false, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if execInfo.Running {
+		t.Error("StartExec: expected exec to be not running after start returns, but it's running")
+	}
+}
+
+func TestStartExecContainerWithHandle(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addContainers(server, 1)
+	server.containers[0].State.Running = true
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    server.containers[0].ID,
+		Cmd:          []string{"bash"},
+		AttachStdin:  true,
+		AttachStdout: true,
+		Tty:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unleash := make(chan bool)
+	server.PrepareExec(exec.ID, func() {
+		<-unleash
+	})
+	var stdout bytes.Buffer
+	success := make(chan struct{})
+	cw, err := client.StartExecWithHandle(exec.ID, docker.StartExecOptions{
+		OutputStream: &stdout,
+		Tty:          true,
+		RawTerminal:  true,
+		Success:      success,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-success:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartExecWithHandle: timed out waiting for the stream to be established")
+	}
+	execInfo, err := client.InspectExec(exec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !execInfo.Running {
+		t.Error("StartExecWithHandle: expected exec to be running, but it's not running")
+	}
+	success <- struct{}{}
+	done := make(chan error, 1)
+	go func() {
+		done <- cw.Wait()
+	}()
+	select {
+	case <-done:
+		t.Fatal("StartExecWithHandle: stream ended before the exec exited")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(unleash)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartExecWithHandle: timed out waiting for the exec to exit")
 	}
-	execInfo, err = waitExec(server.URL(), exec.ID, false, 5)
+	execInfo, err = client.InspectExec(exec.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if execInfo.Running {
-		t.Error("StartExec: expected exec to be not running after start returns, but it's running")
+		t.Error("StartExecWithHandle: expected exec to be not running after the stream ends")
 	}
 }
 
@@ -1979,6 +4378,157 @@ func TestStatsContainer(t *testing.T) {
 	}
 }
 
+func TestStatsContainerPidsStats(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 3)
+	server.containers[0].State.Running = true
+	server.containers[0].HostConfig = &docker.HostConfig{PidsLimit: 100}
+	server.buildMuxer()
+	if err := server.SetContainerPidsStats(server.containers[2].Name, 42, 50); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		current uint64
+		limit   uint64
+	}{
+		{1, 100},
+		{0, 0},
+		{42, 50},
+	}
+	for i, tt := range tests {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/stats?stream=false", server.containers[i].ID)
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("StatsContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		var stats docker.Stats
+		if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.PidsStats.Current != tt.current || stats.PidsStats.Limit != tt.limit {
+			t.Errorf("StatsContainer(%d): wrong pids stats. Want %d/%d. Got %d/%d.", i, tt.current, tt.limit, stats.PidsStats.Current, stats.PidsStats.Limit)
+		}
+	}
+	if err := server.SetContainerPidsStats("unknown", 1, 1); err == nil {
+		t.Error("SetContainerPidsStats: expected error for unknown container")
+	}
+}
+
+func TestStatsContainerCPUDelta(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	var samples []docker.Stats
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/stats?stream=false", server.containers[0].ID)
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("StatsContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		var stats docker.Stats
+		if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, stats)
+	}
+	for _, stats := range samples {
+		cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+		systemDelta := float64(stats.CPUStats.SystemCPUUsage) - float64(stats.PreCPUStats.SystemCPUUsage)
+		if systemDelta <= 0 {
+			t.Fatalf("StatsContainer: system CPU usage should grow between samples. Got %#v.", stats)
+		}
+		percent := cpuDelta / systemDelta * float64(len(stats.CPUStats.CPUUsage.PercpuUsage)) * 100
+		if percent != 100 {
+			t.Errorf("StatsContainer: wrong CPU percentage. Want 100. Got %f.", percent)
+		}
+	}
+	if samples[1].PreCPUStats.SystemCPUUsage < samples[0].CPUStats.SystemCPUUsage {
+		t.Errorf("StatsContainer: CPU usage should keep growing across requests. Got %d after %d.", samples[1].PreCPUStats.SystemCPUUsage, samples[0].CPUStats.SystemCPUUsage)
+	}
+}
+
+func TestStatsContainerSamplesRemovedWithContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	container := server.containers[0]
+	for _, idOrName := range []string{container.ID, container.Name} {
+		recorder := httptest.NewRecorder()
+		path := fmt.Sprintf("/containers/%s/stats?stream=false", idOrName)
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("StatsContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+	}
+	if samples := server.statsSamples[container.ID]; samples != 4 {
+		t.Fatalf("StatsContainer: wrong number of samples for the container. Want 4. Got %d.", samples)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("DELETE", "/containers/"+container.Name+"?force=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("RemoveContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	if len(server.statsSamples) != 0 {
+		t.Errorf("RemoveContainer: stats samples should be removed with the container. Got %v.", server.statsSamples)
+	}
+}
+
+func TestStatsContainerStreamPreCPUStats(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{statsCallbacks: make(map[string]func(string) docker.Stats)}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	var mut sync.Mutex
+	var usage uint64
+	server.PrepareStats(server.containers[0].ID, func(id string) docker.Stats {
+		time.Sleep(20 * time.Millisecond)
+		mut.Lock()
+		defer mut.Unlock()
+		usage++
+		var stats docker.Stats
+		stats.CPUStats.SystemCPUUsage = usage * 100
+		stats.CPUStats.CPUUsage.TotalUsage = usage * 10
+		return stats
+	})
+	recorder := &safeWriter{ResponseRecorder: httptest.NewRecorder()}
+	path := fmt.Sprintf("/containers/%s/stats?stream=true", server.containers[0].ID)
+	request, _ := http.NewRequest("GET", path, nil)
+	go server.ServeHTTP(recorder, request)
+	var samples []docker.Stats
+	for deadline := time.Now().Add(5 * time.Second); len(samples) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for stats samples")
+		}
+		time.Sleep(10 * time.Millisecond)
+		recorder.Lock()
+		decoder := json.NewDecoder(bytes.NewReader(recorder.Body.Bytes()))
+		recorder.Unlock()
+		samples = samples[:0]
+		for {
+			var stats docker.Stats
+			if decoder.Decode(&stats) != nil {
+				break
+			}
+			samples = append(samples, stats)
+		}
+	}
+	if samples[0].PreCPUStats.SystemCPUUsage != 0 {
+		t.Errorf("StatsContainer: first sample should have no PreCPUStats. Got %#v.", samples[0].PreCPUStats)
+	}
+	if samples[1].PreCPUStats.SystemCPUUsage != samples[0].CPUStats.SystemCPUUsage {
+		t.Errorf("StatsContainer: wrong PreCPUStats. Want %d. Got %d.", samples[0].CPUStats.SystemCPUUsage, samples[1].PreCPUStats.SystemCPUUsage)
+	}
+}
+
 type safeWriter struct {
 	sync.Mutex
 	*httptest.ResponseRecorder
@@ -2053,89 +4603,455 @@ func addNetworks(server *DockerServer, n int) {
 	}
 }
 
-func TestListNetworks(t *testing.T) {
+func TestListNetworks(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addNetworks(&server, 2)
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/networks", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("ListNetworks: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected := make([]docker.Network, 2)
+	for i, network := range server.networks {
+		expected[i] = docker.Network{
+			ID:         network.ID,
+			Name:       network.Name,
+			Driver:     network.Driver,
+			Containers: network.Containers,
+		}
+	}
+	var got []docker.Network
+	err := json.NewDecoder(recorder.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ListNetworks. Want %#v. Got %#v.", expected, got)
+	}
+}
+
+type createNetworkResponse struct {
+	ID string `json:"ID"`
+}
+
+func TestCreateNetwork(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	netid := fmt.Sprintf("%x", rand.Int()%10000)
+	netname := fmt.Sprintf("%x", rand.Int()%10000)
+	body := fmt.Sprintf(`{"ID": "%s", "Name": "%s", "Type": "bridge" }`, netid, netname)
+	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+
+	var returned createNetworkResponse
+	err := json.NewDecoder(recorder.Body).Decode(&returned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := server.networks[0]
+	if returned.ID != stored.ID {
+		t.Errorf("CreateNetwork: ID mismatch. Stored: %q. Returned: %q.", stored.ID, returned)
+	}
+}
+
+func TestConnectNetwork(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.networks = []*docker.Network{{ID: "net123", Name: "mynet"}}
+	server.buildMuxer()
+	containerID := server.containers[0].ID
+	var tests = []struct {
+		network string
+		body    string
+		code    int
+	}{
+		{"mynet", fmt.Sprintf(`{"Container":%q,"EndpointConfig":{"IPAMConfig":{"IPv4Address":"10.0.0.10"},"Aliases":["web"]}}`, containerID), http.StatusOK},
+		{"net123", fmt.Sprintf(`{"Container":%q}`, containerID), http.StatusForbidden},
+		{"mynet", `{"Container":`, http.StatusBadRequest},
+		{"mynet", `{}`, http.StatusBadRequest},
+		{"mynet", fmt.Sprintf(`{"Container":%q,"EndpointConfig":{"IPAMConfig":{"IPv4Address":"10.0.0.300"}}}`, containerID), http.StatusBadRequest},
+		{"mynet", fmt.Sprintf(`{"Container":%q,"EndpointConfig":{"IPAMConfig":{"IPv6Address":"10.0.0.1"}}}`, containerID), http.StatusBadRequest},
+		{"mynet", fmt.Sprintf(`{"Container":%q,"EndpointConfig":{"MacAddress":"not-a-mac"}}`, containerID), http.StatusBadRequest},
+		{"othernet", fmt.Sprintf(`{"Container":%q}`, containerID), http.StatusNotFound},
+		{"mynet", `{"Container":"unknown"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/networks/"+tt.network+"/connect", strings.NewReader(tt.body))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("ConnectNetwork(%s, %s): wrong status. Want %d. Got %d.", tt.network, tt.body, tt.code, recorder.Code)
+		}
+		if tt.code == http.StatusForbidden && !strings.Contains(recorder.Body.String(), "endpoint already exists") {
+			t.Errorf("ConnectNetwork: wrong error message. Got %q.", recorder.Body.String())
+		}
+	}
+	endpoint, ok := server.networks[0].Containers[containerID]
+	if !ok || endpoint.IPv4Address != "10.0.0.10" {
+		t.Errorf("ConnectNetwork: wrong endpoint in network. Got %#v.", server.networks[0].Containers)
+	}
+	settings, ok := server.containers[0].NetworkSettings.Networks["mynet"]
+	if !ok || settings.NetworkID != "net123" || settings.EndpointID != endpoint.ID || settings.IPAddress != "10.0.0.10" {
+		t.Errorf("ConnectNetwork: wrong container network settings. Got %#v.", server.containers[0].NetworkSettings.Networks)
+	}
+}
+
+func TestListContainersNetworks(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
+	server.networks = []*docker.Network{{ID: "net123", Name: "mynet"}}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/containers/create?name=web", strings.NewReader(`{"Cmd":["date"], "Image":"base"}`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	body := `{"Container":"web","EndpointConfig":{"IPAMConfig":{"IPv4Address":"10.0.0.10"}}}`
+	request, _ = http.NewRequest("POST", "/networks/mynet/connect", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ConnectNetwork: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	var containers []docker.APIContainers
+	if err := json.NewDecoder(recorder.Body).Decode(&containers); err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 {
+		t.Fatalf("ListContainers: wrong number of containers. Want 1. Got %d.", len(containers))
+	}
+	networks := containers[0].Networks.Networks
+	if len(networks) != 2 {
+		t.Fatalf("ListContainers: wrong number of networks. Want 2. Got %#v.", networks)
+	}
+	if bridge := networks["bridge"]; bridge.IPAddress != server.containers[0].NetworkSettings.IPAddress {
+		t.Errorf("ListContainers: wrong bridge address. Want %q. Got %q.", server.containers[0].NetworkSettings.IPAddress, bridge.IPAddress)
+	}
+	if mynet := networks["mynet"]; mynet.IPAddress != "10.0.0.10" || mynet.NetworkID != "net123" {
+		t.Errorf("ListContainers: wrong network summary. Got %#v.", mynet)
+	}
+}
+
+func TestCreateNetworkFlags(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipam := docker.IPAMOptions{
+		Driver: "default",
+		Config: []docker.IPAMConfig{{Subnet: "10.10.0.0/16"}, {Subnet: "fd00:10::/64"}},
+	}
+	created, err := client.CreateNetwork(docker.CreateNetworkOptions{
+		Name:       "backend",
+		Driver:     "overlay",
+		IPAM:       ipam,
+		Internal:   true,
+		EnableIPv6: true,
+		Attachable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, err := client.NetworkInfo(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !network.Internal || !network.EnableIPv6 || !network.Attachable {
+		t.Errorf("NetworkInfo: wrong flags. Want all set. Got Internal=%v EnableIPv6=%v Attachable=%v.", network.Internal, network.EnableIPv6, network.Attachable)
+	}
+	if !reflect.DeepEqual(network.IPAM, ipam) {
+		t.Errorf("NetworkInfo: wrong IPAM. Want %#v. Got %#v.", ipam, network.IPAM)
+	}
+	var tests = []struct {
+		ipam docker.IPAMOptions
+		code int
+	}{
+		{docker.IPAMOptions{}, http.StatusBadRequest},
+		{docker.IPAMOptions{Config: []docker.IPAMConfig{{Subnet: "10.20.0.0/16"}}}, http.StatusBadRequest},
+		{docker.IPAMOptions{Config: []docker.IPAMConfig{{Subnet: "fd00:20::/64"}}}, http.StatusCreated},
+	}
+	for i, tt := range tests {
+		_, err = client.CreateNetwork(docker.CreateNetworkOptions{
+			Name:       fmt.Sprintf("ipv6-%d", i),
+			IPAM:       tt.ipam,
+			EnableIPv6: true,
+		})
+		code := http.StatusCreated
+		if e, ok := err.(*docker.Error); ok {
+			code = e.Status
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("CreateNetwork(%d): wrong status. Want %d. Got %d.", i, tt.code, code)
+		}
+	}
+}
+
+func TestCreateNetworkInvalidBody(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader("whaaaaaat---"))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+}
+
+func TestCreateNetworkDuplicateName(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	addNetworks(&server, 1)
+	server.networks[0].Name = "mynetwork"
+	recorder := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"ID": "%s", "Name": "mynetwork", "Type": "bridge" }`, fmt.Sprintf("%x", rand.Int()%10000))
+	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusForbidden, recorder.Code)
+	}
+}
+
+func TestCreateNetworkCheckDuplicate(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := docker.CreateNetworkOptions{Name: "mynetwork", Driver: "bridge", CheckDuplicate: true}
+	if _, err = client.CreateNetwork(opts); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.CreateNetwork(opts)
+	if err != docker.ErrNetworkAlreadyExists {
+		t.Errorf("CreateNetwork: wrong error. Want %#v. Got %#v.", docker.ErrNetworkAlreadyExists, err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(`{"Name":"mynetwork","CheckDuplicate":true}`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusConflict, recorder.Code)
+	}
+	expected := "network with name mynetwork already exists\n"
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("CreateNetwork: wrong body. Want %q. Got %q.", expected, got)
+	}
+	if len(server.networks) != 1 {
+		t.Errorf("CreateNetwork: want 1 network. Got %d.", len(server.networks))
+	}
+}
+
+func TestPruneContainersUntil(t *testing.T) {
+	t.Parallel()
+	frozen := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		filters string
+		deleted []int
+	}{
+		{"", []int{0, 1, 3}},
+		{`{"until":["24h"]}`, []int{0, 3}},
+		{`{"until":["30m"]}`, []int{0, 1, 3}},
+		{`{"until":["72h"]}`, nil},
+		{fmt.Sprintf(`{"until":["%d"]}`, frozen.Add(-2*time.Hour).Unix()), []int{0, 3}},
+		{fmt.Sprintf(`{"until":["%d.000000001"]}`, frozen.Add(-time.Hour).Unix()), []int{0, 1, 3}},
+		{`{"until":["24h"],"label!":["keep"]}`, []int{0}},
+		{`{"label":["keep=yes"]}`, []int{3}},
+	}
+	for _, tt := range tests {
+		server := DockerServer{}
+		server.SetClock(func() time.Time { return frozen })
+		addContainers(&server, 4)
+		server.containers[0].Created = frozen.Add(-48 * time.Hour)
+		server.containers[1].Created = frozen.Add(-time.Hour)
+		server.containers[2].Created = frozen.Add(-48 * time.Hour)
+		server.containers[2].State.Running = true
+		server.containers[3].Created = frozen.Add(-48 * time.Hour)
+		server.containers[3].Config.Labels = map[string]string{"keep": "yes"}
+		ids := make([]string, len(server.containers))
+		for i, container := range server.containers {
+			ids[i] = container.ID
+		}
+		server.buildMuxer()
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/prune?filters="+url.QueryEscape(tt.filters), nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("PruneContainers(%s): wrong status. Want %d. Got %d.", tt.filters, http.StatusOK, recorder.Code)
+		}
+		var result docker.PruneContainersResults
+		if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{}
+		for _, i := range tt.deleted {
+			expected = append(expected, ids[i])
+		}
+		if !reflect.DeepEqual(result.ContainersDeleted, expected) {
+			t.Errorf("PruneContainers(%s): wrong deleted containers. Want %v. Got %v.", tt.filters, expected, result.ContainersDeleted)
+		}
+		if remaining := len(server.containers); remaining != len(ids)-len(expected) {
+			t.Errorf("PruneContainers(%s): wrong number of remaining containers. Want %d. Got %d.", tt.filters, len(ids)-len(expected), remaining)
+		}
+	}
+}
+
+func TestPruneContainersInvalidUntil(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.buildMuxer()
+	for _, filters := range []string{`{"until":["yesterday"]}`, `{"until":["1h","2h"]}`, `{"since":["1h"]}`} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/prune?filters="+url.QueryEscape(filters), nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("PruneContainers(%s): wrong status. Want %d. Got %d.", filters, http.StatusBadRequest, recorder.Code)
+		}
+	}
+	if len(server.containers) != 1 {
+		t.Errorf("PruneContainers: invalid filters should not remove containers. Got %d.", len(server.containers))
+	}
+}
+
+func TestCreateContainerUsesClock(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
-	addNetworks(&server, 2)
+	frozen := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	server.SetClock(func() time.Time { return frozen })
+	server.imgIDs = map[string]string{"base": "a1234"}
 	server.buildMuxer()
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/networks", nil)
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(`{"Image":"base"}`))
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusOK {
-		t.Errorf("ListNetworks: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
-	}
-	expected := make([]docker.Network, 2)
-	for i, network := range server.networks {
-		expected[i] = docker.Network{
-			ID:         network.ID,
-			Name:       network.Name,
-			Driver:     network.Driver,
-			Containers: network.Containers,
-		}
-	}
-	var got []docker.Network
-	err := json.NewDecoder(recorder.Body).Decode(&got)
-	if err != nil {
-		t.Fatal(err)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
 	}
-	if !reflect.DeepEqual(got, expected) {
-		t.Errorf("ListNetworks. Want %#v. Got %#v.", expected, got)
+	if created := server.containers[0].Created; !created.Equal(frozen) {
+		t.Errorf("CreateContainer: wrong creation time. Want %s. Got %s.", frozen, created)
 	}
 }
 
-type createNetworkResponse struct {
-	ID string `json:"ID"`
-}
-
-func TestCreateNetwork(t *testing.T) {
+func TestPruneNetworksPreservingLabels(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
+	server.networks = []*docker.Network{
+		{ID: "id1", Name: "unused"},
+		{ID: "id2", Name: "compose", Labels: map[string]string{"com.docker.compose.network": "default"}},
+		{ID: "id3", Name: "busy", Containers: map[string]docker.Endpoint{"c1": {Name: "c1"}}},
+	}
 	recorder := httptest.NewRecorder()
-	netid := fmt.Sprintf("%x", rand.Int()%10000)
-	netname := fmt.Sprintf("%x", rand.Int()%10000)
-	body := fmt.Sprintf(`{"ID": "%s", "Name": "%s", "Type": "bridge" }`, netid, netname)
-	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(body))
+	filters := url.QueryEscape(`{"label!":["com.docker.compose.network"]}`)
+	request, _ := http.NewRequest("POST", "/networks/prune?filters="+filters, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusCreated {
-		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PruneNetworks: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-
-	var returned createNetworkResponse
-	err := json.NewDecoder(recorder.Body).Decode(&returned)
-	if err != nil {
+	var result docker.PruneNetworksResults
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
 		t.Fatal(err)
 	}
-	stored := server.networks[0]
-	if returned.ID != stored.ID {
-		t.Errorf("CreateNetwork: ID mismatch. Stored: %q. Returned: %q.", stored.ID, returned)
+	if expected := []string{"id1"}; !reflect.DeepEqual(result.NetworksDeleted, expected) {
+		t.Errorf("PruneNetworks: wrong deleted networks. Want %#v. Got %#v.", expected, result.NetworksDeleted)
+	}
+	if len(server.networks) != 2 {
+		t.Errorf("PruneNetworks: wrong number of remaining networks. Want 2. Got %d.", len(server.networks))
 	}
 }
 
-func TestCreateNetworkInvalidBody(t *testing.T) {
+func TestPruneNetworksUntil(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader("whaaaaaat---"))
-	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusBadRequest {
-		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	server.SetClock(func() time.Time { return now })
+	createNetwork := func(name string) string {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(fmt.Sprintf(`{"Name":%q}`, name)))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+		}
+		var result struct{ ID string }
+		if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result.ID
+	}
+	oldID := createNetwork("old")
+	now = now.Add(2 * time.Hour)
+	createNetwork("new")
+	var tests = []struct {
+		until    string
+		code     int
+		expected []string
+	}{
+		{`["1h"]`, http.StatusOK, []string{oldID}},
+		{`["1h", "2h"]`, http.StatusBadRequest, nil},
+		{`["yesterday"]`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		filters := url.QueryEscape(`{"until":` + tt.until + `}`)
+		request, _ := http.NewRequest("POST", "/networks/prune?filters="+filters, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Fatalf("PruneNetworks(%s): wrong status. Want %d. Got %d.", tt.until, tt.code, recorder.Code)
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var result docker.PruneNetworksResults
+		if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.NetworksDeleted, tt.expected) {
+			t.Errorf("PruneNetworks(%s): wrong deleted networks. Want %#v. Got %#v.", tt.until, tt.expected, result.NetworksDeleted)
+		}
+	}
+	if len(server.networks) != 1 || server.networks[0].Name != "new" {
+		t.Errorf("PruneNetworks: expected only the new network to be kept. Got %d networks.", len(server.networks))
 	}
 }
 
-func TestCreateNetworkDuplicateName(t *testing.T) {
+func TestPruneNetworksInvalidFilter(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
 	server.buildMuxer()
-	addNetworks(&server, 1)
-	server.networks[0].Name = "mynetwork"
 	recorder := httptest.NewRecorder()
-	body := fmt.Sprintf(`{"ID": "%s", "Name": "mynetwork", "Type": "bridge" }`, fmt.Sprintf("%x", rand.Int()%10000))
-	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(body))
+	filters := url.QueryEscape(`{"driver":["bridge"]}`)
+	request, _ := http.NewRequest("POST", "/networks/prune?filters="+filters, nil)
 	server.ServeHTTP(recorder, request)
-	if recorder.Code != http.StatusForbidden {
-		t.Errorf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusForbidden, recorder.Code)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("PruneNetworks: wrong status. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
 	}
 }
 
@@ -2168,6 +5084,30 @@ func TestRemoveNetwork(t *testing.T) {
 	}
 }
 
+func TestRemoveNetworkByNameDropsCreationTime(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/networks/create", strings.NewReader(`{"Name": "mynet"}`))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateNetwork: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	if len(server.netCreated) != 1 {
+		t.Fatalf("CreateNetwork: expected the creation time to be recorded, got %v", server.netCreated)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/networks/mynet", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("RemoveNetwork: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	if len(server.netCreated) != 0 {
+		t.Errorf("RemoveNetwork: expected the creation time to be removed, got %v", server.netCreated)
+	}
+}
+
 func TestListVolumes(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -2306,6 +5246,30 @@ func TestInspectVolume(t *testing.T) {
 	}
 }
 
+func TestInspectVolumeUsageData(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	server.volStore = map[string]*volumeCounter{
+		"test-volume": {volume: docker.Volume{Name: "test-volume", Driver: "local"}},
+	}
+	server.SetVolumeUsage("test-volume", 1024, 2)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/volumes/test-volume", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("InspectVolume: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var returned docker.Volume
+	if err := json.NewDecoder(recorder.Body).Decode(&returned); err != nil {
+		t.Fatal(err)
+	}
+	expected := &docker.VolumeUsageData{Size: 1024, RefCount: 2}
+	if !reflect.DeepEqual(returned.UsageData, expected) {
+		t.Errorf("InspectVolume: wrong usage data. Want %#v. Got %#v.", expected, returned.UsageData)
+	}
+}
+
 func TestInspectVolumeNotFound(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -2372,6 +5336,45 @@ func TestRemoveVolumeInuse(t *testing.T) {
 	}
 }
 
+func TestRemoveVolumeMountedByContainer(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{imgIDs: map[string]string{"base": "a1234"}}
+	server.buildMuxer()
+	server.volStore = map[string]*volumeCounter{
+		"data": {volume: docker.Volume{Name: "data", Driver: "local"}},
+	}
+	body := `{"Image":"base","Cmd":["ls"],"HostConfig":{"Binds":["data:/data"]}}`
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/containers/create", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	id := server.containers[0].ID
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/volumes/data", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("RemoveVolume: wrong status. Want %d. Got %d.", http.StatusConflict, recorder.Code)
+	}
+	expected := "remove data: volume is in use - [" + id + "]\n"
+	if got := recorder.Body.String(); got != expected {
+		t.Errorf("RemoveVolume: wrong body. Want %q. Got %q.", expected, got)
+	}
+	if _, ok := server.volStore["data"]; !ok {
+		t.Error("RemoveVolume: volume in use should not be removed")
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/volumes/data?force=1", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("RemoveVolume: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	if _, ok := server.volStore["data"]; ok {
+		t.Error("RemoveVolume: volume should be removed with force")
+	}
+}
+
 func TestUploadToContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -2383,18 +5386,15 @@ func TestUploadToContainer(t *testing.T) {
 			ExitCode: 0,
 		},
 	}
-	server.containers = append(server.containers, cont)
-	server.uploadedFiles = make(map[string]string)
+	server.addContainer(cont)
 	recorder := httptest.NewRecorder()
 	request, _ := http.NewRequest("PUT", fmt.Sprintf("/containers/%s/archive?path=abcd", cont.ID), nil)
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
 		t.Errorf("UploadToContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	if val, ok := server.uploadedFiles[cont.ID]; !ok {
-		t.Errorf("UploadToContainer: uploadedFiles should exist.")
-	} else if val != "abcd" {
-		t.Errorf("UploadToContainer: wrong uploadedFiles. Want 'abcd'. Got %s.", val)
+	if _, ok := server.uploadedFiles[cont.ID]["abcd"]; !ok {
+		t.Errorf("UploadToContainer: wrong uploadedFiles. Want 'abcd'. Got %v.", server.uploadedFiles[cont.ID])
 	}
 }
 
@@ -2415,23 +5415,22 @@ func TestUploadToContainerWithBodyTarFile(t *testing.T) {
 	hdr := &tar.Header{
 		Name: "test.tar.gz",
 		Mode: 0600,
-		Size: int64(buf.Len()),
+		Size: int64(len("something")),
 	}
 	tw.WriteHeader(hdr)
 	tw.Write([]byte("something"))
 	tw.Close()
-	server.containers = append(server.containers, cont)
-	server.uploadedFiles = make(map[string]string)
+	server.addContainer(cont)
 	recorder := httptest.NewRecorder()
 	request, _ := http.NewRequest("PUT", fmt.Sprintf("/containers/%s/archive?path=abcd", cont.ID), buf)
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
 		t.Errorf("UploadToContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	if val, ok := server.uploadedFiles[cont.ID]; !ok {
-		t.Errorf("UploadToContainer: uploadedFiles should exist.")
-	} else if val != "abcd/test.tar.gz" {
-		t.Errorf("UploadToContainer: wrong uploadedFiles. Want 'abcd/test.tar.gz'. Got %s.", val)
+	if file, ok := server.uploadedFiles[cont.ID]["abcd/test.tar.gz"]; !ok {
+		t.Errorf("UploadToContainer: wrong uploadedFiles. Want 'abcd/test.tar.gz'. Got %v.", server.uploadedFiles[cont.ID])
+	} else if string(file.content) != "something" || file.mode != 0600 {
+		t.Errorf("UploadToContainer: wrong uploaded file. Want mode 0600 with %q. Got mode %o with %q.", "something", file.mode, file.content)
 	}
 }
 
@@ -2447,18 +5446,15 @@ func TestUploadToContainerBodyNotTarFile(t *testing.T) {
 		},
 	}
 	buf := bytes.NewBufferString("something")
-	server.containers = append(server.containers, cont)
-	server.uploadedFiles = make(map[string]string)
+	server.addContainer(cont)
 	recorder := httptest.NewRecorder()
 	request, _ := http.NewRequest("PUT", fmt.Sprintf("/containers/%s/archive?path=abcd", cont.ID), buf)
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
 		t.Errorf("UploadToContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	if val, ok := server.uploadedFiles[cont.ID]; !ok {
-		t.Errorf("UploadToContainer: uploadedFiles should exist.")
-	} else if val != "abcd" {
-		t.Errorf("UploadToContainer: wrong uploadedFiles. Want 'abcd'. Got %s.", val)
+	if _, ok := server.uploadedFiles[cont.ID]["abcd"]; !ok {
+		t.Errorf("UploadToContainer: wrong uploadedFiles. Want 'abcd'. Got %v.", server.uploadedFiles[cont.ID])
 	}
 }
 
@@ -2527,6 +5523,183 @@ func TestInfoDockerWithSwarm(t *testing.T) {
 	}
 }
 
+func TestInfoDockerWarnings(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	warnings := []string{"WARNING: No swap limit support", "WARNING: bridge-nf-call-iptables is disabled"}
+	server.SetInfoWarnings(warnings)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/info", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("InfoDocker: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var infoData docker.DockerInfo
+	err := json.Unmarshal(recorder.Body.Bytes(), &infoData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(infoData.Warnings, warnings) {
+		t.Errorf("InfoDocker: wrong warnings. Want %#v. Got %#v.", warnings, infoData.Warnings)
+	}
+	server.SetInfoWarnings(nil)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	infoData = docker.DockerInfo{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &infoData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infoData.Warnings) != 0 {
+		t.Errorf("InfoDocker: expected no warnings. Got %#v.", infoData.Warnings)
+	}
+}
+
+func TestPingDockerStarting(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	server.SetDaemonStarting(true)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/_ping", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("PingDocker: wrong status. Want %d. Got %d.", http.StatusServiceUnavailable, recorder.Code)
+	}
+	server.SetDaemonStarting(false)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("PingDocker: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+}
+
+func TestPingLatency(t *testing.T) {
+	t.Parallel()
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.SetPingLatency(time.Minute)
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = client.PingWithContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("PingWithContext: wrong error. Want %#v. Got %#v.", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("PingWithContext: took too long to return: %s", elapsed)
+	}
+	server.SetPingLatency(10 * time.Millisecond)
+	if err := client.PingWithContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPingLatencyDoesNotBlockSetters(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{customHandlers: make(map[string]http.Handler)}
+	server.buildMuxer()
+	server.SetPingLatency(2 * time.Second)
+	done := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/_ping", nil)
+		server.ServeHTTP(recorder, request)
+		done <- recorder.Code
+	}()
+	for {
+		server.requestMut.Lock()
+		inFlight := server.inFlight
+		server.requestMut.Unlock()
+		if inFlight > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	server.SetDaemonStarting(true)
+	server.SetPingLatency(0)
+	server.CustomHandler("/custom", http.NotFoundHandler())
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/version", nil)
+	server.ServeHTTP(recorder, request)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("PingDocker: setters blocked by ping latency for %s", elapsed)
+	}
+	if code := <-done; code != http.StatusServiceUnavailable {
+		t.Errorf("PingDocker: wrong status. Want %d. Got %d.", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestPingLatencyCanceledRequest(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	server.SetPingLatency(time.Minute)
+	server.SetDaemonStarting(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/_ping", nil)
+	server.ServeHTTP(recorder, request.WithContext(ctx))
+	if recorder.Code == http.StatusServiceUnavailable || recorder.Body.Len() != 0 {
+		t.Errorf("PingDocker: unexpected response for canceled request: %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestSetMaxConcurrentRequests(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addContainers(&server, 1)
+	server.containers[0].State.Running = true
+	server.buildMuxer()
+	server.SetMaxConcurrentRequests(1)
+	done := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/containers/"+server.containers[0].ID+"/wait", nil)
+		server.ServeHTTP(recorder, request)
+		done <- recorder.Code
+	}()
+	for {
+		server.requestMut.Lock()
+		inFlight := server.inFlight
+		server.requestMut.Unlock()
+		if inFlight == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/_ping", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("SetMaxConcurrentRequests: wrong status. Want %d. Got %d.", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if body := strings.TrimSpace(recorder.Body.String()); body != "server too busy" {
+		t.Errorf("SetMaxConcurrentRequests: wrong body. Want %q. Got %q.", "server too busy", body)
+	}
+	server.cMut.Lock()
+	server.containers[0].State.Running = false
+	server.cMut.Unlock()
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("WaitContainer: wrong status. Want %d. Got %d.", http.StatusOK, code)
+	}
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("SetMaxConcurrentRequests: wrong status after the request finished. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+}
+
 func TestVersionDocker(t *testing.T) {
 	t.Parallel()
 	server, _ := NewServer("127.0.0.1:0", nil, nil)
@@ -2540,6 +5713,84 @@ func TestVersionDocker(t *testing.T) {
 	}
 }
 
+func TestSetVersion(t *testing.T) {
+	t.Parallel()
+	server, _ := NewServer("127.0.0.1:0", nil, nil)
+	defer server.Stop()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetVersion(map[string]string{
+		"Os":            "windows",
+		"Arch":          "arm64",
+		"KernelVersion": "10.0 17763 (17763.1.amd64fre.rs5_release.180914-1434)",
+		"BuildTime":     "2018-10-04T18:31:05.000000000+00:00",
+	})
+	env, err := client.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"Os":            "windows",
+		"Arch":          "arm64",
+		"KernelVersion": "10.0 17763 (17763.1.amd64fre.rs5_release.180914-1434)",
+		"BuildTime":     "2018-10-04T18:31:05.000000000+00:00",
+		"Version":       "1.10.1",
+	}
+	for key, value := range expected {
+		if got := env.Get(key); got != value {
+			t.Errorf("Version: wrong %s. Want %q. Got %q.", key, value, got)
+		}
+	}
+	server.SetVersion(nil)
+	env, err = client.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := env.Get("Os"); got != "linux" {
+		t.Errorf("Version: wrong Os after reset. Want %q. Got %q.", "linux", got)
+	}
+}
+
+func TestSetMinAPIVersion(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	server.SetMinAPIVersion("1.23")
+	var tests = []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/version", http.StatusOK},
+		{"GET", "/v1.23/version", http.StatusOK},
+		{"GET", "/v1.24/version", http.StatusBadRequest},
+		{"GET", "/containers/json", http.StatusOK},
+		{"GET", "/services", http.StatusNotFound},
+		{"GET", "/v1.23/swarm", http.StatusNotFound},
+		{"POST", "/networks/prune", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(tt.method, tt.path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.status {
+			t.Errorf("%s %s: wrong status. Want %d. Got %d.", tt.method, tt.path, tt.status, recorder.Code)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/version", nil)
+	server.ServeHTTP(recorder, request)
+	var version map[string]interface{}
+	if err := json.NewDecoder(recorder.Body).Decode(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version["ApiVersion"] != "1.23" {
+		t.Errorf("VersionDocker: wrong ApiVersion. Want %q. Got %q.", "1.23", version["ApiVersion"])
+	}
+}
+
 func TestDownloadFromContainer(t *testing.T) {
 	t.Parallel()
 	server := DockerServer{}
@@ -2551,9 +5802,8 @@ func TestDownloadFromContainer(t *testing.T) {
 			ExitCode: 0,
 		},
 	}
-	server.containers = append(server.containers, cont)
-	server.uploadedFiles = make(map[string]string)
-	server.uploadedFiles[cont.ID] = "abcd"
+	server.addContainer(cont)
+	server.uploadedFiles = map[string]map[string]containerFile{cont.ID: {"abcd": {}}}
 	recorder := httptest.NewRecorder()
 	request, _ := http.NewRequest("GET", fmt.Sprintf("/containers/%s/archive?path=abcd", cont.ID), nil)
 	server.ServeHTTP(recorder, request)
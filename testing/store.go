@@ -0,0 +1,326 @@
+// Copyright 2018 go-dockerclient authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+import (
+	"errors"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ContainerStore is the storage backend used by DockerServer for keeping
+// containers. The server serializes the access to the store, so
+// implementations don't need to be safe for concurrent use.
+//
+// By default, containers are kept in a slice. Test suites creating thousands
+// of containers may plug a different implementation using SetStore.
+type ContainerStore interface {
+	// Add stores a new container.
+	Add(container *docker.Container)
+
+	// Get returns the container with the given ID or name, or nil if there's
+	// no such container.
+	Get(idOrName string) *docker.Container
+
+	// Replace replaces the stored container that has the same ID as the
+	// given one.
+	Replace(container *docker.Container)
+
+	// Remove deletes the container with the given ID.
+	Remove(id string)
+
+	// List returns all stored containers, in the order they were added.
+	List() []*docker.Container
+}
+
+// SetStore makes the server keep its containers in the given store. Containers
+// already in the server are moved to the new store.
+func (s *DockerServer) SetStore(store ContainerStore) {
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	for _, container := range s.allContainers() {
+		store.Add(container)
+	}
+	s.containers = nil
+	s.containerIndex = containerIndex{}
+	s.store = store
+}
+
+// ImageStore is the storage backend used by DockerServer for keeping images.
+// Like ContainerStore, the access to the store is serialized by the server.
+// Tags are kept by the server and map to the IDs of the stored images.
+//
+// By default, images are kept in a slice. A different implementation may be
+// plugged using SetImageStore.
+type ImageStore interface {
+	// Add stores a new image.
+	Add(image docker.Image)
+
+	// Get returns the image with the given ID, and whether it was found.
+	Get(id string) (docker.Image, bool)
+
+	// Replace replaces the stored image that has the same ID as the given
+	// one.
+	Replace(image docker.Image)
+
+	// Remove deletes the image with the given ID.
+	Remove(id string)
+
+	// List returns all stored images.
+	List() []docker.Image
+}
+
+// SetImageStore makes the server keep its images in the given store. Images
+// already in the server are moved to the new store.
+func (s *DockerServer) SetImageStore(store ImageStore) {
+	s.iMut.Lock()
+	defer s.iMut.Unlock()
+	for _, image := range s.allImages() {
+		store.Add(image)
+	}
+	s.images = nil
+	s.imageStore = store
+}
+
+// VolumeStore is the storage backend used by DockerServer for keeping
+// volumes. Like ContainerStore, the access to the store is serialized by the
+// server.
+//
+// By default, volumes are kept in a map. A different implementation may be
+// plugged using SetVolumeStore.
+type VolumeStore interface {
+	// Add stores a new volume.
+	Add(volume docker.Volume)
+
+	// Get returns the volume with the given name, and whether it was found.
+	Get(name string) (docker.Volume, bool)
+
+	// Remove deletes the volume with the given name.
+	Remove(name string)
+
+	// List returns all stored volumes.
+	List() []docker.Volume
+}
+
+// SetVolumeStore makes the server keep its volumes in the given store.
+// Volumes already in the server are moved to the new store.
+func (s *DockerServer) SetVolumeStore(store VolumeStore) {
+	s.volMut.Lock()
+	defer s.volMut.Unlock()
+	for _, volume := range s.allVolumes() {
+		store.Add(volume)
+	}
+	s.volStore = nil
+	s.volumeStore = store
+}
+
+// containerIndex maps container IDs and names to the containers kept in the
+// default slice storage, so lookups don't need to scan all containers. It's
+// updated whenever a container is added, replaced or removed.
+type containerIndex struct {
+	ids   map[string]*docker.Container
+	names map[string]*docker.Container
+}
+
+func (idx *containerIndex) get(idOrName string) *docker.Container {
+	if container, ok := idx.ids[idOrName]; ok {
+		return container
+	}
+	return idx.names[idOrName]
+}
+
+func (idx *containerIndex) add(container *docker.Container) {
+	if idx.ids == nil {
+		idx.ids = make(map[string]*docker.Container)
+		idx.names = make(map[string]*docker.Container)
+	}
+	idx.ids[container.ID] = container
+	if container.Name != "" {
+		idx.names[container.Name] = container
+	}
+}
+
+func (idx *containerIndex) remove(container *docker.Container) {
+	if idx.ids[container.ID] == container {
+		delete(idx.ids, container.ID)
+	}
+	if idx.names[container.Name] == container {
+		delete(idx.names, container.Name)
+	}
+}
+
+// The functions below must be called with cMut held.
+
+func (s *DockerServer) allContainers() []*docker.Container {
+	if s.store != nil {
+		return s.store.List()
+	}
+	return s.containers
+}
+
+func (s *DockerServer) getContainer(idOrName string) (*docker.Container, error) {
+	var container *docker.Container
+	if s.store != nil {
+		container = s.store.Get(idOrName)
+	} else {
+		container = s.containerIndex.get(idOrName)
+	}
+	if container == nil {
+		return nil, errors.New("No such container")
+	}
+	return container, nil
+}
+
+func (s *DockerServer) addContainer(container *docker.Container) {
+	if s.store != nil {
+		s.store.Add(container)
+		return
+	}
+	s.containers = append(s.containers, container)
+	s.containerIndex.add(container)
+}
+
+func (s *DockerServer) replaceContainer(container *docker.Container) {
+	if s.store != nil {
+		s.store.Replace(container)
+		return
+	}
+	old := s.containerIndex.ids[container.ID]
+	if old == nil {
+		return
+	}
+	for i := range s.containers {
+		if s.containers[i] == old {
+			s.containers[i] = container
+			break
+		}
+	}
+	s.containerIndex.remove(old)
+	s.containerIndex.add(container)
+}
+
+func (s *DockerServer) deleteContainer(id string) {
+	delete(s.uploadedFiles, id)
+	delete(s.statsSamples, id)
+	if s.store != nil {
+		s.store.Remove(id)
+		return
+	}
+	container := s.containerIndex.ids[id]
+	if container == nil {
+		return
+	}
+	s.containerIndex.remove(container)
+	for i := range s.containers {
+		if s.containers[i] == container {
+			s.containers = append(s.containers[:i], s.containers[i+1:]...)
+			break
+		}
+	}
+}
+
+// The functions below must be called with iMut held.
+
+func (s *DockerServer) allImages() []docker.Image {
+	if s.imageStore != nil {
+		return s.imageStore.List()
+	}
+	return s.images
+}
+
+func (s *DockerServer) imageByID(id string) (docker.Image, bool) {
+	if s.imageStore != nil {
+		return s.imageStore.Get(id)
+	}
+	for _, image := range s.images {
+		if image.ID == id {
+			return image, true
+		}
+	}
+	return docker.Image{}, false
+}
+
+func (s *DockerServer) addImage(image docker.Image) {
+	if s.imageStore != nil {
+		s.imageStore.Add(image)
+		return
+	}
+	s.images = append(s.images, image)
+}
+
+func (s *DockerServer) replaceImage(image docker.Image) {
+	if s.imageStore != nil {
+		s.imageStore.Replace(image)
+		return
+	}
+	for i := range s.images {
+		if s.images[i].ID == image.ID {
+			s.images[i] = image
+			return
+		}
+	}
+}
+
+func (s *DockerServer) deleteImage(id string) {
+	if s.imageStore != nil {
+		s.imageStore.Remove(id)
+		return
+	}
+	for i := range s.images {
+		if s.images[i].ID == id {
+			s.images[i] = s.images[len(s.images)-1]
+			s.images = s.images[:len(s.images)-1]
+			return
+		}
+	}
+}
+
+// The functions below must be called with volMut held.
+
+func (s *DockerServer) allVolumes() []docker.Volume {
+	if s.volumeStore != nil {
+		return s.volumeStore.List()
+	}
+	volumes := make([]docker.Volume, 0, len(s.volStore))
+	for _, counter := range s.volStore {
+		volumes = append(volumes, counter.volume)
+	}
+	return volumes
+}
+
+// findVolume returns the volume with the given name. Volumes kept in a
+// custom store are never counted as in use.
+func (s *DockerServer) findVolume(name string) (*volumeCounter, error) {
+	if s.volumeStore != nil {
+		if volume, ok := s.volumeStore.Get(name); ok {
+			return &volumeCounter{volume: volume}, nil
+		}
+		return nil, errors.New("no such volume")
+	}
+	vol, ok := s.volStore[name]
+	if !ok {
+		return nil, errors.New("no such volume")
+	}
+	return vol, nil
+}
+
+func (s *DockerServer) addVolume(volume docker.Volume) {
+	if s.volumeStore != nil {
+		s.volumeStore.Add(volume)
+		return
+	}
+	if s.volStore == nil {
+		s.volStore = make(map[string]*volumeCounter)
+	}
+	s.volStore[volume.Name] = &volumeCounter{volume: volume}
+}
+
+func (s *DockerServer) deleteVolume(name string) {
+	if s.volumeStore != nil {
+		s.volumeStore.Remove(name)
+		return
+	}
+	delete(s.volStore, name)
+}
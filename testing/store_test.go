@@ -0,0 +1,334 @@
+// Copyright 2018 go-dockerclient authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+type mapStore struct {
+	ids        []string
+	containers map[string]*docker.Container
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{containers: make(map[string]*docker.Container)}
+}
+
+func (m *mapStore) Add(container *docker.Container) {
+	m.ids = append(m.ids, container.ID)
+	m.containers[container.ID] = container
+}
+
+func (m *mapStore) Get(idOrName string) *docker.Container {
+	if container, ok := m.containers[idOrName]; ok {
+		return container
+	}
+	for _, container := range m.containers {
+		if container.Name == idOrName {
+			return container
+		}
+	}
+	return nil
+}
+
+func (m *mapStore) Replace(container *docker.Container) {
+	m.containers[container.ID] = container
+}
+
+func (m *mapStore) Remove(id string) {
+	delete(m.containers, id)
+	for i := range m.ids {
+		if m.ids[i] == id {
+			m.ids = append(m.ids[:i], m.ids[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *mapStore) List() []*docker.Container {
+	result := make([]*docker.Container, len(m.ids))
+	for i, id := range m.ids {
+		result[i] = m.containers[id]
+	}
+	return result
+}
+
+type mapImageStore struct {
+	images map[string]docker.Image
+}
+
+func (m *mapImageStore) Add(image docker.Image) {
+	m.images[image.ID] = image
+}
+
+func (m *mapImageStore) Get(id string) (docker.Image, bool) {
+	image, ok := m.images[id]
+	return image, ok
+}
+
+func (m *mapImageStore) Replace(image docker.Image) {
+	m.images[image.ID] = image
+}
+
+func (m *mapImageStore) Remove(id string) {
+	delete(m.images, id)
+}
+
+func (m *mapImageStore) List() []docker.Image {
+	result := make([]docker.Image, 0, len(m.images))
+	for _, image := range m.images {
+		result = append(result, image)
+	}
+	return result
+}
+
+type mapVolumeStore struct {
+	volumes map[string]docker.Volume
+}
+
+func (m *mapVolumeStore) Add(volume docker.Volume) {
+	m.volumes[volume.Name] = volume
+}
+
+func (m *mapVolumeStore) Get(name string) (docker.Volume, bool) {
+	volume, ok := m.volumes[name]
+	return volume, ok
+}
+
+func (m *mapVolumeStore) Remove(name string) {
+	delete(m.volumes, name)
+}
+
+func (m *mapVolumeStore) List() []docker.Volume {
+	result := make([]docker.Volume, 0, len(m.volumes))
+	for _, volume := range m.volumes {
+		result = append(result, volume)
+	}
+	return result
+}
+
+func TestSetStore(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.imgIDs = map[string]string{"base": "a1234"}
+	addContainers(&server, 2)
+	server.buildMuxer()
+	store := newMapStore()
+	server.SetStore(store)
+	if len(server.containers) != 0 {
+		t.Errorf("SetStore: expected containers to be moved to the store, %d left", len(server.containers))
+	}
+	if len(store.ids) != 2 {
+		t.Fatalf("SetStore: wrong number of containers in the store. Want 2. Got %d.", len(store.ids))
+	}
+	body := `{"Hostname":"", "User":"", "Memory":0, "MemorySwap":0, "AttachStdin":false, "AttachStdout":true, "AttachStderr":true,
+"PortSpecs":null, "Tty":false, "OpenStdin":false, "StdinOnce":false, "Env":null, "Cmd":["date"], "Image":"base", "Volumes":{}, "VolumesFrom":""}`
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/containers/create?name=stored", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("CreateContainer: wrong status. Want %d. Got %d.", http.StatusCreated, recorder.Code)
+	}
+	if store.Get("stored") == nil {
+		t.Fatal("CreateContainer: container not added to the store")
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/containers/stored/rename?name=renamed", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("RenameContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/renamed/json", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("InspectContainer: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/containers/renamed", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("RemoveContainer: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	server.ServeHTTP(recorder, request)
+	var containers []docker.APIContainers
+	if err := json.NewDecoder(recorder.Body).Decode(&containers); err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 {
+		t.Fatalf("ListContainers: wrong number of containers. Want 2. Got %d.", len(containers))
+	}
+	for i, container := range containers {
+		if expected := store.ids[i]; container.ID != expected {
+			t.Errorf("ListContainers: wrong container at position %d. Want %q. Got %q.", i, expected, container.ID)
+		}
+	}
+	if err := server.MutateContainer(store.ids[0], docker.State{Running: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !store.containers[store.ids[0]].State.Running {
+		t.Errorf("MutateContainer: container %q not mutated in the store", store.ids[0])
+	}
+}
+
+func TestContainerIndex(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	for i := 0; i < 100; i++ {
+		server.addContainer(&docker.Container{ID: fmt.Sprintf("id%d", i), Name: fmt.Sprintf("name%d", i)})
+	}
+	if len(server.containerIndex.ids) != 100 || len(server.containerIndex.names) != 100 {
+		t.Fatalf("addContainer: wrong index size. Got %d ids and %d names.", len(server.containerIndex.ids), len(server.containerIndex.names))
+	}
+	server.deleteContainer("id50")
+	if len(server.containerIndex.ids) != 99 || len(server.containerIndex.names) != 99 {
+		t.Fatalf("deleteContainer: wrong index size. Got %d ids and %d names.", len(server.containerIndex.ids), len(server.containerIndex.names))
+	}
+	for _, tt := range [][2]string{{"id0", "id0"}, {"name49", "id49"}, {"id51", "id51"}, {"name99", "id99"}} {
+		container, err := server.findContainer(tt[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if container.ID != tt[1] {
+			t.Errorf("findContainer(%q): wrong container. Want %q. Got %q.", tt[0], tt[1], container.ID)
+		}
+	}
+	for _, idOrName := range []string{"id50", "name50", "unknown"} {
+		if _, err := server.findContainer(idOrName); err == nil {
+			t.Errorf("findContainer(%q): expected container not to be found", idOrName)
+		}
+	}
+	for i, container := range server.containers {
+		expected := i
+		if i >= 50 {
+			expected++
+		}
+		if container.ID != fmt.Sprintf("id%d", expected) {
+			t.Fatalf("deleteContainer: order not preserved. Got %q at position %d.", container.ID, i)
+		}
+	}
+	renamed := *server.containers[0]
+	renamed.Name = "renamed"
+	server.replaceContainer(&renamed)
+	if server.containers[0] != &renamed {
+		t.Error("replaceContainer: container not replaced in the slice")
+	}
+	if container, err := server.findContainer("renamed"); err != nil || container != &renamed {
+		t.Errorf("findContainer(%q): wrong container %#v (%v)", "renamed", container, err)
+	}
+	if _, err := server.findContainer("name0"); err == nil {
+		t.Error("findContainer: expected stale name not to be found")
+	}
+}
+
+func TestSetImageStore(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	addImages(&server, 2, true)
+	server.buildMuxer()
+	existing := server.images[0].ID
+	store := &mapImageStore{images: make(map[string]docker.Image)}
+	server.SetImageStore(store)
+	if len(server.images) != 0 {
+		t.Errorf("SetImageStore: expected images to be moved to the store, %d left", len(server.images))
+	}
+	if len(store.images) != 2 {
+		t.Fatalf("SetImageStore: wrong number of images in the store. Want 2. Got %d.", len(store.images))
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/images/create?fromImage=stored", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PullImage: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if len(store.images) != 3 {
+		t.Fatalf("PullImage: image not added to the store. Got %d images.", len(store.images))
+	}
+	if err := server.SetImageLayers("stored", []string{"sha256:layer"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/images/stored/json", nil)
+	server.ServeHTTP(recorder, request)
+	var image docker.Image
+	if err := json.NewDecoder(recorder.Body).Decode(&image); err != nil {
+		t.Fatal(err)
+	}
+	if image.RootFS == nil || len(image.RootFS.Layers) != 1 {
+		t.Errorf("InspectImage: image not updated in the store. Got %#v.", image.RootFS)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/images/"+existing, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("RemoveImage: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if _, ok := store.images[existing]; ok {
+		t.Error("RemoveImage: image not removed from the store")
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/images/json", nil)
+	server.ServeHTTP(recorder, request)
+	var images []docker.APIImages
+	if err := json.NewDecoder(recorder.Body).Decode(&images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Errorf("ListImages: wrong number of images. Want 2. Got %d.", len(images))
+	}
+}
+
+func TestSetVolumeStore(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{}
+	server.buildMuxer()
+	for _, name := range []string{"before", "after"} {
+		if name == "after" {
+			server.SetVolumeStore(&mapVolumeStore{volumes: make(map[string]docker.Volume)})
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/volumes/create", strings.NewReader(fmt.Sprintf(`{"Name":%q}`, name)))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("CreateVolume(%s): wrong status. Want %d. Got %d.", name, http.StatusCreated, recorder.Code)
+		}
+	}
+	store := server.volumeStore.(*mapVolumeStore)
+	if len(server.volStore) != 0 || len(store.volumes) != 2 {
+		t.Fatalf("SetVolumeStore: wrong volumes. Got %d in the server and %d in the store.", len(server.volStore), len(store.volumes))
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/volumes/before", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("InspectVolume: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/volumes/after", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("RemoveVolume: wrong status. Want %d. Got %d.", http.StatusNoContent, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/volumes", nil)
+	server.ServeHTTP(recorder, request)
+	var result map[string][]docker.Volume
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result["Volumes"]) != 1 || result["Volumes"][0].Name != "before" {
+		t.Errorf("ListVolumes: wrong volumes. Got %#v.", result["Volumes"])
+	}
+}
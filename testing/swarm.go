@@ -6,6 +6,7 @@ package testing
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,10 +15,15 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	libpath "path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/gorilla/mux"
 )
@@ -58,6 +64,9 @@ func (s *DockerServer) MutateTask(id string, newTask swarm.Task) error {
 	defer s.swarmMut.Unlock()
 	for i, task := range s.tasks {
 		if task.ID == id {
+			if newTask.CreatedAt.IsZero() {
+				newTask.CreatedAt = task.CreatedAt
+			}
 			s.tasks[i] = &newTask
 			return nil
 		}
@@ -65,6 +74,239 @@ func (s *DockerServer) MutateTask(id string, newTask swarm.Task) error {
 	return errors.New("task not found")
 }
 
+// SetServiceTasksFailed transitions all tasks of the given service to the
+// failed state, with the given error message, and pauses the service update,
+// as the daemon does when the update failure action is "pause". It returns an
+// error if the given id does not match to any service in the server.
+func (s *DockerServer) SetServiceTasksFailed(serviceID string, message string) error {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
+	var service *swarm.Service
+	for _, srv := range s.services {
+		if srv.ID == serviceID || srv.Spec.Name == serviceID {
+			service = srv
+			break
+		}
+	}
+	if service == nil {
+		return errors.New("service not found")
+	}
+	now := time.Now()
+	var failedTask string
+	for _, task := range s.tasks {
+		if task.ServiceID != service.ID {
+			continue
+		}
+		if failedTask == "" {
+			failedTask = task.ID
+		}
+		task.Status.State = swarm.TaskStateFailed
+		task.Status.Timestamp = now
+		task.Status.Err = message
+		container, err := s.findContainerWithLock(task.Status.ContainerStatus.ContainerID, false)
+		if err == nil {
+			container.State.Running = false
+			container.State.ExitCode = 1
+			container.State.Error = message
+			container.State.FinishedAt = now
+			s.notify(container)
+		}
+	}
+	service.UpdateStatus = &swarm.UpdateStatus{
+		State:     swarm.UpdateStatePaused,
+		StartedAt: &now,
+		Message:   "update paused due to failure or early termination of task " + failedTask,
+	}
+	if s.swarmServer != nil {
+		return s.runNodeOperation(s.swarmServer.URL(), nodeOperation{})
+	}
+	return nil
+}
+
+// SetServiceUpdateWarnings sets the warnings returned by the server whenever a
+// service is updated. Use nil for not returning any warnings.
+func (s *DockerServer) SetServiceUpdateWarnings(warnings []string) {
+	s.swarmMut.Lock()
+	s.svcWarnings = warnings
+	s.swarmMut.Unlock()
+}
+
+// SetNodeGenericResources sets the generic resources advertised by the node
+// with the given id, returning an error if there's no such node. Tasks placed
+// on the node get the generic resources they reserve assigned from these.
+func (s *DockerServer) SetNodeGenericResources(nodeID string, resources ...swarm.GenericResource) error {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	for i := range s.nodes {
+		if s.nodes[i].ID != nodeID {
+			continue
+		}
+		s.nodes[i].Description.Resources.GenericResources = resources
+		if s.swarmServer != nil {
+			return s.runNodeOperation(s.swarmServer.URL(), nodeOperation{
+				Op:   "update",
+				Node: s.nodes[i],
+			})
+		}
+		return nil
+	}
+	return errors.New("node not found")
+}
+
+// SetNodeReachability sets the reachability of the manager node with the given
+// id, returning an error if there's no such manager. Exactly one manager is
+// the leader: when the leader stops being reachable, the leadership moves to
+// the first reachable manager, and it's an error if there's none.
+func (s *DockerServer) SetNodeReachability(nodeID string, reachability swarm.Reachability) error {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	index := -1
+	for i := range s.nodes {
+		if s.nodes[i].ID == nodeID && s.nodes[i].ManagerStatus != nil {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return errors.New("manager node not found")
+	}
+	updated := []swarm.Node{withManagerStatus(s.nodes[index])}
+	updated[0].ManagerStatus.Reachability = reachability
+	if updated[0].ManagerStatus.Leader && reachability != swarm.ReachabilityReachable {
+		successor := -1
+		for i, node := range s.nodes {
+			if i != index && node.ManagerStatus != nil && node.ManagerStatus.Reachability == swarm.ReachabilityReachable {
+				successor = i
+				break
+			}
+		}
+		if successor < 0 {
+			return errors.New("no reachable manager to take over the leadership")
+		}
+		updated[0].ManagerStatus.Leader = false
+		updated = append(updated, withManagerStatus(s.nodes[successor]))
+		updated[1].ManagerStatus.Leader = true
+	}
+	for _, node := range updated {
+		if s.swarmServer == nil {
+			for i := range s.nodes {
+				if s.nodes[i].ID == node.ID {
+					s.nodes[i] = node
+				}
+			}
+			continue
+		}
+		err := s.runNodeOperation(s.swarmServer.URL(), nodeOperation{
+			Op:   "update",
+			Node: node,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withManagerStatus returns a copy of the node that doesn't share its manager
+// status with the original one.
+func withManagerStatus(node swarm.Node) swarm.Node {
+	status := *node.ManagerStatus
+	node.ManagerStatus = &status
+	return node
+}
+
+// AddSecret stores a swarm secret in the server, returning its ID. Services
+// can only reference secrets known by the server.
+func (s *DockerServer) AddSecret(spec swarm.SecretSpec) string {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	now := time.Now()
+	secret := swarm.Secret{
+		ID:   s.generateID(),
+		Meta: swarm.Meta{CreatedAt: now, UpdatedAt: now},
+		Spec: spec,
+	}
+	s.secrets = append(s.secrets, secret)
+	return secret.ID
+}
+
+// AddConfig stores a swarm config in the server, returning its ID. Services
+// can only reference configs known by the server.
+func (s *DockerServer) AddConfig(spec swarm.ConfigSpec) string {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	now := time.Now()
+	config := swarm.Config{
+		ID:   s.generateID(),
+		Meta: swarm.Meta{CreatedAt: now, UpdatedAt: now},
+		Spec: spec,
+	}
+	s.configs = append(s.configs, config)
+	return config.ID
+}
+
+// checkServiceMode returns an error if the service spec sets both the
+// replicated and the global mode.
+func checkServiceMode(spec swarm.ServiceSpec) error {
+	if spec.Mode.Replicated != nil && spec.Mode.Global != nil {
+		return errors.New("must specify only one mode")
+	}
+	return nil
+}
+
+// checkServiceReferences returns an error if the service spec references a
+// secret or config that doesn't exist. References without an ID are resolved
+// by name.
+func (s *DockerServer) checkServiceReferences(spec swarm.ServiceSpec) error {
+	containerSpec := spec.TaskTemplate.ContainerSpec
+	if containerSpec == nil {
+		return nil
+	}
+	for _, ref := range containerSpec.Secrets {
+		if ref == nil {
+			continue
+		}
+		if s.findSecret(ref.SecretID, ref.SecretName) == nil {
+			if ref.SecretID == "" {
+				return fmt.Errorf("secret not found: %s", ref.SecretName)
+			}
+			return fmt.Errorf("secret not found: %s", ref.SecretID)
+		}
+	}
+	for _, ref := range containerSpec.Configs {
+		if ref == nil {
+			continue
+		}
+		if s.findConfig(ref.ConfigID, ref.ConfigName) == nil {
+			if ref.ConfigID == "" {
+				return fmt.Errorf("config not found: %s", ref.ConfigName)
+			}
+			return fmt.Errorf("config not found: %s", ref.ConfigID)
+		}
+	}
+	return nil
+}
+
+func (s *DockerServer) findSecret(id, name string) *swarm.Secret {
+	for i := range s.secrets {
+		if (id != "" && s.secrets[i].ID == id) || (id == "" && name != "" && s.secrets[i].Spec.Name == name) {
+			return &s.secrets[i]
+		}
+	}
+	return nil
+}
+
+func (s *DockerServer) findConfig(id, name string) *swarm.Config {
+	for i := range s.configs {
+		if (id != "" && s.configs[i].ID == id) || (id == "" && name != "" && s.configs[i].Spec.Name == name) {
+			return &s.configs[i]
+		}
+	}
+	return nil
+}
+
 func (s *DockerServer) swarmInit(w http.ResponseWriter, r *http.Request) {
 	s.swarmMut.Lock()
 	defer s.swarmMut.Unlock()
@@ -78,12 +320,16 @@ func (s *DockerServer) swarmInit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	node, err := s.initSwarmNode(req.ListenAddr, req.AdvertiseAddr)
+	node, addr, err := s.initSwarmNode(req.ListenAddr, req.AdvertiseAddr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	node.ManagerStatus.Leader = true
+	node.ManagerStatus = &swarm.ManagerStatus{
+		Leader:       true,
+		Addr:         addr,
+		Reachability: swarm.ReachabilityReachable,
+	}
 	err = s.runNodeOperation(s.swarmServer.URL(), nodeOperation{
 		Op:   "add",
 		Node: node,
@@ -98,6 +344,9 @@ func (s *DockerServer) swarmInit(w http.ResponseWriter, r *http.Request) {
 			Worker:  s.generateID(),
 		},
 	}
+	if req.AutoLockManagers {
+		s.enableAutoLock()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(s.nodeID)
 	if err != nil {
@@ -117,6 +366,45 @@ func (s *DockerServer) swarmInspect(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *DockerServer) swarmUnlockKey(w http.ResponseWriter, r *http.Request) {
+	s.swarmMut.RLock()
+	defer s.swarmMut.RUnlock()
+	if s.swarm == nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"UnlockKey": s.unlockKey})
+}
+
+// SetSwarmAutoLock enables or disables the autolock of the swarm managers,
+// returning an error if the server is not part of a swarm. Enabling it
+// generates the unlock key returned by the unlockkey endpoint, disabling it
+// discards the key.
+func (s *DockerServer) SetSwarmAutoLock(enabled bool) error {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	if s.swarm == nil {
+		return errors.New("node is not part of a swarm")
+	}
+	if enabled {
+		s.enableAutoLock()
+	} else {
+		s.swarm.Spec.EncryptionConfig.AutoLockManagers = false
+		s.unlockKey = ""
+	}
+	return nil
+}
+
+// enableAutoLock must be called with swarmMut held.
+func (s *DockerServer) enableAutoLock() {
+	s.swarm.Spec.EncryptionConfig.AutoLockManagers = true
+	if s.unlockKey == "" {
+		s.unlockKey = "SWMKEY-1-" + s.generateID()
+	}
+}
+
 func (s *DockerServer) swarmJoin(w http.ResponseWriter, r *http.Request) {
 	s.swarmMut.Lock()
 	defer s.swarmMut.Unlock()
@@ -134,11 +422,18 @@ func (s *DockerServer) swarmJoin(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	node, err := s.initSwarmNode(req.ListenAddr, req.AdvertiseAddr)
+	node, addr, err := s.initSwarmNode(req.ListenAddr, req.AdvertiseAddr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// the node joins as a manager unless the remote recognizes the worker
+	// token, and managers are reached at their advertise address when node
+	// operations are propagated.
+	node.ManagerStatus = &swarm.ManagerStatus{
+		Addr:         addr,
+		Reachability: swarm.ReachabilityReachable,
+	}
 	s.swarm = &swarm.Swarm{
 		JoinTokens: swarm.JoinTokens{
 			Manager: s.generateID(),
@@ -149,6 +444,7 @@ func (s *DockerServer) swarmJoin(w http.ResponseWriter, r *http.Request) {
 	err = s.runNodeOperation(fmt.Sprintf("http://%s", req.RemoteAddrs[0]), nodeOperation{
 		Op:        "add",
 		Node:      node,
+		JoinToken: req.JoinToken,
 		forceLock: true,
 	})
 	s.swarmMut.Lock()
@@ -167,6 +463,7 @@ func (s *DockerServer) swarmLeave(w http.ResponseWriter, r *http.Request) {
 	} else {
 		s.swarmServer.listener.Close()
 		s.swarm = nil
+		s.unlockKey = ""
 		s.nodes = nil
 		s.swarmServer = nil
 		s.nodeID = ""
@@ -176,12 +473,21 @@ func (s *DockerServer) swarmLeave(w http.ResponseWriter, r *http.Request) {
 
 func (s *DockerServer) containerForService(srv *swarm.Service, name string) *docker.Container {
 	hostConfig := docker.HostConfig{}
+	if driver := srv.Spec.TaskTemplate.LogDriver; driver != nil {
+		hostConfig.LogConfig.Type = driver.Name
+		if len(driver.Options) > 0 {
+			hostConfig.LogConfig.Config = make(map[string]string, len(driver.Options))
+			for key, value := range driver.Options {
+				hostConfig.LogConfig.Config[key] = value
+			}
+		}
+	}
 	dockerConfig := docker.Config{
 		Entrypoint: srv.Spec.TaskTemplate.ContainerSpec.Command,
 		Cmd:        srv.Spec.TaskTemplate.ContainerSpec.Args,
 		Env:        srv.Spec.TaskTemplate.ContainerSpec.Env,
 	}
-	return &docker.Container{
+	container := docker.Container{
 		ID:         s.generateID(),
 		Name:       name,
 		Image:      srv.Spec.TaskTemplate.ContainerSpec.Image,
@@ -195,6 +501,44 @@ func (s *DockerServer) containerForService(srv *swarm.Service, name string) *doc
 			ExitCode:  0,
 		},
 	}
+	s.mountServiceFiles(container.ID, srv.Spec.TaskTemplate.ContainerSpec)
+	return &container
+}
+
+// mountServiceFiles materializes the secrets and configs referenced by the
+// container spec as files in the container with the given ID. Secrets are
+// placed under /run/secrets, while configs with relative targets are placed
+// in the root directory. Must be called with swarmMut and cMut held.
+func (s *DockerServer) mountServiceFiles(containerID string, spec *swarm.ContainerSpec) {
+	files := make(map[string]containerFile)
+	for _, ref := range spec.Secrets {
+		if ref == nil || ref.File == nil {
+			continue
+		}
+		if secret := s.findSecret(ref.SecretID, ref.SecretName); secret != nil {
+			target := ref.File.Name
+			if !libpath.IsAbs(target) {
+				target = libpath.Join("/run/secrets", target)
+			}
+			files[target] = containerFile{mode: int64(ref.File.Mode), content: secret.Spec.Data}
+		}
+	}
+	for _, ref := range spec.Configs {
+		if ref == nil || ref.File == nil {
+			continue
+		}
+		if config := s.findConfig(ref.ConfigID, ref.ConfigName); config != nil {
+			target := libpath.Join("/", ref.File.Name)
+			files[target] = containerFile{mode: int64(ref.File.Mode), content: config.Spec.Data}
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	if s.uploadedFiles == nil {
+		s.uploadedFiles = make(map[string]map[string]containerFile)
+	}
+	s.uploadedFiles[containerID] = files
 }
 
 func (s *DockerServer) serviceCreate(w http.ResponseWriter, r *http.Request) {
@@ -205,10 +549,14 @@ func (s *DockerServer) serviceCreate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.cMut.Lock()
-	defer s.cMut.Unlock()
+	if err := checkServiceMode(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	s.swarmMut.Lock()
 	defer s.swarmMut.Unlock()
+	s.cMut.Lock()
+	defer s.cMut.Unlock()
 	if len(s.nodes) == 0 || s.swarm == nil {
 		http.Error(w, "no swarm nodes available", http.StatusNotAcceptable)
 		return
@@ -216,17 +564,34 @@ func (s *DockerServer) serviceCreate(w http.ResponseWriter, r *http.Request) {
 	if config.Name == "" {
 		config.Name = s.generateID()
 	}
+	if config.TaskTemplate.Runtime == "" {
+		config.TaskTemplate.Runtime = swarm.RuntimeContainer
+	}
 	for _, s := range s.services {
 		if s.Spec.Name == config.Name {
 			http.Error(w, "there's already a service with this name", http.StatusConflict)
 			return
 		}
 	}
+	if err := s.checkIngressPorts(config.EndpointSpec, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.checkServiceReferences(config); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	vips, err := s.allocateVirtualIPs(config, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	service := swarm.Service{
 		ID:   s.generateID(),
 		Spec: config,
 	}
 	s.setServiceEndpoint(&service)
+	service.Endpoint.VirtualIPs = vips
 	s.addTasks(&service, false)
 	s.services = append(s.services, &service)
 	err = s.runNodeOperation(s.swarmServer.URL(), nodeOperation{})
@@ -246,14 +611,126 @@ func (s *DockerServer) setServiceEndpoint(service *swarm.Service) {
 		Spec: *service.Spec.EndpointSpec,
 	}
 	for _, port := range service.Spec.EndpointSpec.Ports {
-		if port.PublishedPort == 0 {
+		for port.PublishedPort == 0 {
 			port.PublishedPort = uint32(30000 + s.servicePorts)
 			s.servicePorts++
+			if s.ingressPortOwner(port.PublishedPort, service.ID) != nil {
+				port.PublishedPort = 0
+			}
 		}
 		service.Endpoint.Ports = append(service.Endpoint.Ports, port)
 	}
 }
 
+// allocateVirtualIPs returns the virtual IPs of a service with the given spec,
+// one for each network the service is attached to, allocated from the IPAM
+// subnet of the network. Networks unknown to the server get addresses from
+// the default 10.0.0.0/24 subnet, and networks listed more than once get a
+// single virtual IP. The addresses previously allocated to the service are
+// kept. Services using the DNS round-robin mode get no virtual IPs. Must be
+// called with swarmMut held.
+func (s *DockerServer) allocateVirtualIPs(spec swarm.ServiceSpec, previous []swarm.EndpointVirtualIP) ([]swarm.EndpointVirtualIP, error) {
+	networks := spec.TaskTemplate.Networks
+	if len(networks) == 0 {
+		networks = spec.Networks
+	}
+	if spec.EndpointSpec != nil && spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR {
+		return nil, nil
+	}
+	var vips []swarm.EndpointVirtualIP
+	seen := make(map[string]bool)
+	for _, attachment := range networks {
+		network, _, err := s.findNetwork(attachment.Target)
+		if err != nil {
+			network = &docker.Network{ID: attachment.Target, Name: attachment.Target}
+		}
+		if seen[network.ID] {
+			continue
+		}
+		seen[network.ID] = true
+		vip := swarm.EndpointVirtualIP{NetworkID: network.ID}
+		for _, prev := range previous {
+			if prev.NetworkID == network.ID {
+				vip.Addr = prev.Addr
+			}
+		}
+		if vip.Addr == "" {
+			vip.Addr, err = s.nextVirtualIP(network)
+			if err != nil {
+				return nil, err
+			}
+		}
+		vips = append(vips, vip)
+	}
+	return vips, nil
+}
+
+// nextVirtualIP returns the first address in the IPv4 subnet of the network
+// not taken by the virtual IP of a service, in the CIDR notation. The first
+// addresses of the subnet are left for the network and the gateway. Must be
+// called with swarmMut held.
+func (s *DockerServer) nextVirtualIP(network *docker.Network) (string, error) {
+	subnet := "10.0.0.0/24"
+	for _, config := range network.IPAM.Config {
+		if ip, _, err := net.ParseCIDR(config.Subnet); err == nil && ip.To4() != nil {
+			subnet = config.Subnet
+			break
+		}
+	}
+	_, ipNet, _ := net.ParseCIDR(subnet)
+	ones, _ := ipNet.Mask.Size()
+	used := make(map[string]bool)
+	for _, service := range s.services {
+		for _, vip := range service.Endpoint.VirtualIPs {
+			if vip.NetworkID == network.ID {
+				used[vip.Addr] = true
+			}
+		}
+	}
+	base := binary.BigEndian.Uint32(ipNet.IP.To4())
+	ip := make(net.IP, net.IPv4len)
+	for offset := uint32(2); ; offset++ {
+		binary.BigEndian.PutUint32(ip, base+offset)
+		if !ipNet.Contains(ip) {
+			return "", fmt.Errorf("no available virtual IPs in network %s", network.Name)
+		}
+		if addr := fmt.Sprintf("%s/%d", ip, ones); !used[addr] {
+			return addr, nil
+		}
+	}
+}
+
+// checkIngressPorts returns an error if any of the ingress ports published in
+// the given spec is already allocated to a service other than serviceID.
+func (s *DockerServer) checkIngressPorts(spec *swarm.EndpointSpec, serviceID string) error {
+	if spec == nil {
+		return nil
+	}
+	for _, port := range spec.Ports {
+		if port.PublishedPort == 0 || port.PublishMode == swarm.PortConfigPublishModeHost {
+			continue
+		}
+		if owner := s.ingressPortOwner(port.PublishedPort, serviceID); owner != nil {
+			return fmt.Errorf("port '%d' is already in use by service '%s' (%s) as an ingress port", port.PublishedPort, owner.Spec.Name, owner.ID)
+		}
+	}
+	return nil
+}
+
+func (s *DockerServer) ingressPortOwner(publishedPort uint32, serviceID string) *swarm.Service {
+	for _, srv := range s.services {
+		if srv.ID == serviceID {
+			continue
+		}
+		for _, port := range srv.Endpoint.Ports {
+			if port.PublishedPort == publishedPort && port.PublishMode != swarm.PortConfigPublishModeHost {
+				return srv
+			}
+		}
+	}
+	return nil
+}
+
 func (s *DockerServer) addTasks(service *swarm.Service, update bool) {
 	containerCount := 1
 	if service.Spec.Mode.Global != nil {
@@ -263,33 +740,133 @@ func (s *DockerServer) addTasks(service *swarm.Service, update bool) {
 			containerCount = int(*repl.Replicas)
 		}
 	}
+	if len(s.nodes) == 0 {
+		return
+	}
 	for i := 0; i < containerCount; i++ {
 		name := fmt.Sprintf("%s-%d", service.Spec.Name, i)
 		if update {
 			name = fmt.Sprintf("%s-%d-updated", service.Spec.Name, i)
 		}
-		container := s.containerForService(service, name)
-		chosenNode := s.nodes[s.nodeRR]
-		s.nodeRR = (s.nodeRR + 1) % len(s.nodes)
+		// only tasks of the container runtime are backed by containers.
+		var container *docker.Container
+		var containerID string
+		if service.Spec.TaskTemplate.ContainerSpec != nil {
+			container = s.containerForService(service, name)
+			containerID = container.ID
+		}
+		chosenNode := s.nextNode()
+		now := time.Now()
 		task := swarm.Task{
 			ID:        s.generateID(),
+			Meta:      swarm.Meta{CreatedAt: now, UpdatedAt: now},
 			ServiceID: service.ID,
 			NodeID:    chosenNode.ID,
 			Status: swarm.TaskStatus{
 				State: swarm.TaskStateReady,
 				ContainerStatus: swarm.ContainerStatus{
-					ContainerID: container.ID,
+					ContainerID: containerID,
 				},
 			},
 			DesiredState: swarm.TaskStateReady,
 			Spec:         service.Spec.TaskTemplate,
 		}
+		task.GenericResources = s.assignGenericResources(chosenNode, service.Spec.TaskTemplate)
 		s.tasks = append(s.tasks, &task)
-		s.containers = append(s.containers, container)
+		if container == nil {
+			continue
+		}
+		s.addContainer(container)
 		s.notify(container)
 	}
 }
 
+// nextNode returns the node for the next task, advancing the round-robin
+// index. The node list may have shrunk since the index was last advanced.
+// Must be called with swarmMut held.
+func (s *DockerServer) nextNode() swarm.Node {
+	if s.nodeRR >= len(s.nodes) {
+		s.nodeRR = 0
+	}
+	node := s.nodes[s.nodeRR]
+	s.nodeRR = (s.nodeRR + 1) % len(s.nodes)
+	return node
+}
+
+// assignGenericResources picks, from the generic resources advertised by the
+// node, the ones reserved by the task spec. Named resources already assigned
+// to other tasks on the node are not reused, and discrete resources are
+// limited to what is left after the reservations of the other tasks. A
+// reservation the node can't fully satisfy gets nothing assigned.
+func (s *DockerServer) assignGenericResources(node swarm.Node, spec swarm.TaskSpec) []swarm.GenericResource {
+	if spec.Resources == nil || spec.Resources.Reservations == nil {
+		return nil
+	}
+	inUse := make(map[swarm.NamedGenericResource]bool)
+	reserved := make(map[string]int64)
+	for _, task := range s.tasks {
+		if task.NodeID != node.ID || task.DesiredState == swarm.TaskStateShutdown {
+			continue
+		}
+		for _, resource := range task.GenericResources {
+			if resource.NamedResourceSpec != nil {
+				inUse[*resource.NamedResourceSpec] = true
+			}
+			if resource.DiscreteResourceSpec != nil {
+				reserved[resource.DiscreteResourceSpec.Kind] += resource.DiscreteResourceSpec.Value
+			}
+		}
+	}
+	var assigned []swarm.GenericResource
+	for _, wanted := range spec.Resources.Reservations.GenericResources {
+		if wanted.DiscreteResourceSpec == nil {
+			continue
+		}
+		kind, count := wanted.DiscreteResourceSpec.Kind, wanted.DiscreteResourceSpec.Value
+		var picked []swarm.GenericResource
+		pending := reserved[kind]
+		for _, available := range node.Description.Resources.GenericResources {
+			if count <= 0 {
+				break
+			}
+			if named := available.NamedResourceSpec; named != nil && named.Kind == kind && !inUse[*named] {
+				inUse[*named] = true
+				picked = append(picked, swarm.GenericResource{
+					NamedResourceSpec: &swarm.NamedGenericResource{Kind: kind, Value: named.Value},
+				})
+				count--
+			} else if discrete := available.DiscreteResourceSpec; discrete != nil && discrete.Kind == kind {
+				// reservations of other tasks take the first resources of the kind.
+				free := discrete.Value - pending
+				if pending -= discrete.Value; pending < 0 {
+					pending = 0
+				}
+				if free <= 0 {
+					continue
+				}
+				if free > count {
+					free = count
+				}
+				picked = append(picked, swarm.GenericResource{
+					DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: kind, Value: free},
+				})
+				count -= free
+			}
+		}
+		if count > 0 {
+			for _, resource := range picked {
+				if resource.NamedResourceSpec != nil {
+					delete(inUse, *resource.NamedResourceSpec)
+				}
+			}
+			continue
+		}
+		reserved[kind] = pending
+		assigned = append(assigned, picked...)
+	}
+	return assigned
+}
+
 func (s *DockerServer) serviceInspect(w http.ResponseWriter, r *http.Request) {
 	s.swarmMut.Lock()
 	defer s.swarmMut.Unlock()
@@ -298,8 +875,14 @@ func (s *DockerServer) serviceInspect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id := mux.Vars(r)["id"]
+	insertDefaults, _ := strconv.ParseBool(r.URL.Query().Get("insertDefaults"))
 	for _, srv := range s.services {
 		if srv.ID == id || srv.Spec.Name == id {
+			if insertDefaults {
+				withDefaults := *srv
+				withDefaults.Spec = specWithDefaults(srv.Spec)
+				srv = &withDefaults
+			}
 			json.NewEncoder(w).Encode(srv)
 			return
 		}
@@ -307,6 +890,46 @@ func (s *DockerServer) serviceInspect(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "service not found", http.StatusNotFound)
 }
 
+// specWithDefaults returns a copy of the given spec with the update config,
+// the restart policy and the placement filled with the defaults used by the
+// daemon, keeping the values set in the spec.
+func specWithDefaults(spec swarm.ServiceSpec) swarm.ServiceSpec {
+	updateConfig := swarm.UpdateConfig{Parallelism: 1}
+	if spec.UpdateConfig != nil {
+		updateConfig = *spec.UpdateConfig
+	}
+	if updateConfig.FailureAction == "" {
+		updateConfig.FailureAction = swarm.UpdateFailureActionPause
+	}
+	if updateConfig.Monitor == 0 {
+		updateConfig.Monitor = 5 * time.Second
+	}
+	if updateConfig.Order == "" {
+		updateConfig.Order = swarm.UpdateOrderStopFirst
+	}
+	spec.UpdateConfig = &updateConfig
+	var restartPolicy swarm.RestartPolicy
+	if spec.TaskTemplate.RestartPolicy != nil {
+		restartPolicy = *spec.TaskTemplate.RestartPolicy
+	}
+	if restartPolicy.Condition == "" {
+		restartPolicy.Condition = swarm.RestartPolicyConditionAny
+	}
+	if restartPolicy.Delay == nil {
+		delay := 5 * time.Second
+		restartPolicy.Delay = &delay
+	}
+	if restartPolicy.MaxAttempts == nil {
+		maxAttempts := uint64(0)
+		restartPolicy.MaxAttempts = &maxAttempts
+	}
+	spec.TaskTemplate.RestartPolicy = &restartPolicy
+	if spec.TaskTemplate.Placement == nil {
+		spec.TaskTemplate.Placement = &swarm.Placement{}
+	}
+	return spec
+}
+
 func (s *DockerServer) taskInspect(w http.ResponseWriter, r *http.Request) {
 	s.swarmMut.Lock()
 	defer s.swarmMut.Unlock()
@@ -331,21 +954,74 @@ func (s *DockerServer) serviceList(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
+	if err := validateFilters(r, "services"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	filtersRaw := r.FormValue("filters")
 	var filters map[string][]string
 	json.Unmarshal([]byte(filtersRaw), &filters)
-	if filters == nil {
-		json.NewEncoder(w).Encode(s.services)
-		return
-	}
-	var ret []*swarm.Service
+	ret := []*swarm.Service{}
 	for i, srv := range s.services {
 		if inFilter(filters["id"], srv.ID) &&
 			inFilter(filters["name"], srv.Spec.Name) {
 			ret = append(ret, s.services[i])
 		}
 	}
-	json.NewEncoder(w).Encode(ret)
+	if status, _ := strconv.ParseBool(r.FormValue("status")); status {
+		s.cMut.RLock()
+		for i, srv := range ret {
+			withStatus := *srv
+			withStatus.ServiceStatus = s.serviceStatus(srv)
+			ret[i] = &withStatus
+		}
+		s.cMut.RUnlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	// services are encoded one at a time, so large lists are streamed to the
+	// client instead of being buffered in a single array.
+	flusher, _ := w.(http.Flusher)
+	io.WriteString(w, "[")
+	for i, srv := range ret {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		data, err := json.Marshal(srv)
+		if err != nil {
+			return
+		}
+		w.Write(data)
+		if flusher != nil && (i+1)%100 == 0 {
+			flusher.Flush()
+		}
+	}
+	io.WriteString(w, "]\n")
+}
+
+// serviceStatus counts the desired and running tasks of the given service. A
+// task is considered running when its container is running.
+func (s *DockerServer) serviceStatus(service *swarm.Service) *swarm.ServiceStatus {
+	var status swarm.ServiceStatus
+	for _, task := range s.tasks {
+		if task.ServiceID != service.ID || task.DesiredState == swarm.TaskStateShutdown {
+			continue
+		}
+		if service.Spec.Mode.Global != nil {
+			status.DesiredTasks++
+		}
+		container, err := s.findContainerWithLock(task.Status.ContainerStatus.ContainerID, false)
+		if err == nil && container.State.Running {
+			status.RunningTasks++
+		}
+	}
+	if service.Spec.Mode.Global == nil {
+		status.DesiredTasks = 1
+		if repl := service.Spec.Mode.Replicated; repl != nil && repl.Replicas != nil {
+			status.DesiredTasks = *repl.Replicas
+		}
+	}
+	return &status
 }
 
 func (s *DockerServer) taskList(w http.ResponseWriter, r *http.Request) {
@@ -355,15 +1031,22 @@ func (s *DockerServer) taskList(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
+	if err := validateFilters(r, "tasks"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	filtersRaw := r.FormValue("filters")
 	var filters map[string][]string
 	json.Unmarshal([]byte(filtersRaw), &filters)
+	tasks := make([]*swarm.Task, len(s.tasks))
+	copy(tasks, s.tasks)
+	sort.Stable(tasksByCreation(tasks))
 	if filters == nil {
-		json.NewEncoder(w).Encode(s.tasks)
+		json.NewEncoder(w).Encode(tasks)
 		return
 	}
 	var ret []*swarm.Task
-	for i, task := range s.tasks {
+	for i, task := range tasks {
 		var srv *swarm.Service
 		for _, srv = range s.services {
 			if task.ServiceID == srv.ID {
@@ -380,12 +1063,112 @@ func (s *DockerServer) taskList(w http.ResponseWriter, r *http.Request) {
 			inFilter(filters["node"], task.NodeID) &&
 			inFilter(filters["desired-state"], string(task.DesiredState)) &&
 			inLabelFilter(filters["label"], srv.Spec.Annotations.Labels) {
-			ret = append(ret, s.tasks[i])
+			ret = append(ret, tasks[i])
 		}
 	}
 	json.NewEncoder(w).Encode(ret)
 }
 
+type tasksByCreation []*swarm.Task
+
+func (l tasksByCreation) Len() int           { return len(l) }
+func (l tasksByCreation) Less(i, j int) bool { return l[i].CreatedAt.Before(l[j].CreatedAt) }
+func (l tasksByCreation) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type logEntriesByTime []ContainerLogEntry
+
+func (l logEntriesByTime) Len() int           { return len(l) }
+func (l logEntriesByTime) Less(i, j int) bool { return l[i].Time.Before(l[j].Time) }
+func (l logEntriesByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (s *DockerServer) serviceLogs(w http.ResponseWriter, r *http.Request) {
+	s.swarmMut.Lock()
+	defer s.swarmMut.Unlock()
+	if s.swarm == nil {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	var service *swarm.Service
+	for _, srv := range s.services {
+		if srv.ID == id || srv.Spec.Name == id {
+			service = srv
+			break
+		}
+	}
+	if service == nil {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if value := query.Get("since"); value != "" {
+		since, err = parseTimestamp(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		until, err = parseTimestamp(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	stdout := query.Get("stdout") == "1"
+	stderr := query.Get("stderr") == "1"
+	if !stdout && !stderr {
+		stdout, stderr = true, true
+	}
+	var entries []ContainerLogEntry
+	s.cMut.RLock()
+	for _, task := range s.tasks {
+		if task.ServiceID != service.ID {
+			continue
+		}
+		container, err := s.findContainerWithLock(task.Status.ContainerStatus.ContainerID, false)
+		if err == nil && !logsReadable(container) {
+			s.cMut.RUnlock()
+			http.Error(w, errLogsNotReadable.Error(), http.StatusNotImplemented)
+			return
+		}
+		for _, entry := range s.logs[task.Status.ContainerStatus.ContainerID] {
+			if (entry.Stderr && !stderr) || (!entry.Stderr && !stdout) {
+				continue
+			}
+			if (!since.IsZero() && entry.Time.Before(since)) || (!until.IsZero() && entry.Time.After(until)) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	s.cMut.RUnlock()
+	// lines coming from different tasks are merged in chronological order,
+	// tail is applied to the aggregated output.
+	sort.Stable(logEntriesByTime(entries))
+	if tail, err := strconv.Atoi(query.Get("tail")); err == nil && tail >= 0 && tail < len(entries) {
+		entries = entries[len(entries)-tail:]
+	}
+	timestamps := query.Get("timestamps") == "1"
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	w.WriteHeader(http.StatusOK)
+	outStream := stdcopy.NewStdWriter(w, stdcopy.Stdout)
+	errStream := stdcopy.NewStdWriter(w, stdcopy.Stderr)
+	for _, entry := range entries {
+		stream := outStream
+		if entry.Stderr {
+			stream = errStream
+		}
+		line := entry.Line
+		if timestamps {
+			line = entry.Time.UTC().Format(time.RFC3339Nano) + " " + line
+		}
+		fmt.Fprintln(stream, line)
+	}
+}
+
 func inLabelFilter(list []string, labels map[string]string) bool {
 	if len(list) == 0 {
 		return true
@@ -441,10 +1224,7 @@ func (s *DockerServer) serviceDelete(w http.ResponseWriter, r *http.Request) {
 	s.services = s.services[:len(s.services)-1]
 	for i := 0; i < len(s.tasks); i++ {
 		if s.tasks[i].ServiceID == toDelete.ID {
-			_, contIdx, _ := s.findContainerWithLock(s.tasks[i].Status.ContainerStatus.ContainerID, false)
-			if contIdx != -1 {
-				s.containers = append(s.containers[:contIdx], s.containers[contIdx+1:]...)
-			}
+			s.deleteContainer(s.tasks[i].Status.ContainerStatus.ContainerID)
 			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
 			i--
 		}
@@ -454,6 +1234,71 @@ func (s *DockerServer) serviceDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// let callers know which configs and secrets could be cleaned up now,
+	// the daemon doesn't report it.
+	configs, secrets := s.unreferencedByServices(toDelete)
+	if len(configs) > 0 {
+		w.Header().Set("X-Unreferenced-Configs", strings.Join(configs, ","))
+	}
+	if len(secrets) > 0 {
+		w.Header().Set("X-Unreferenced-Secrets", strings.Join(secrets, ","))
+	}
+}
+
+// unreferencedByServices returns the sorted IDs of the configs and secrets
+// referenced by the given service that aren't referenced by any of the
+// services stored in the server. Must be called with swarmMut held.
+func (s *DockerServer) unreferencedByServices(removed *swarm.Service) (configs, secrets []string) {
+	configRefs, secretRefs := s.serviceReferences(removed)
+	if len(configRefs) == 0 && len(secretRefs) == 0 {
+		return nil, nil
+	}
+	for _, srv := range s.services {
+		srvConfigs, srvSecrets := s.serviceReferences(srv)
+		for id := range srvConfigs {
+			delete(configRefs, id)
+		}
+		for id := range srvSecrets {
+			delete(secretRefs, id)
+		}
+	}
+	for id := range configRefs {
+		configs = append(configs, id)
+	}
+	for id := range secretRefs {
+		secrets = append(secrets, id)
+	}
+	sort.Strings(configs)
+	sort.Strings(secrets)
+	return configs, secrets
+}
+
+// serviceReferences returns the IDs of the existing configs and secrets
+// referenced by the service, resolving references without an ID by name.
+func (s *DockerServer) serviceReferences(srv *swarm.Service) (configs, secrets map[string]struct{}) {
+	configs = make(map[string]struct{})
+	secrets = make(map[string]struct{})
+	containerSpec := srv.Spec.TaskTemplate.ContainerSpec
+	if containerSpec == nil {
+		return configs, secrets
+	}
+	for _, ref := range containerSpec.Configs {
+		if ref == nil {
+			continue
+		}
+		if config := s.findConfig(ref.ConfigID, ref.ConfigName); config != nil {
+			configs[config.ID] = struct{}{}
+		}
+	}
+	for _, ref := range containerSpec.Secrets {
+		if ref == nil {
+			continue
+		}
+		if secret := s.findSecret(ref.SecretID, ref.SecretName); secret != nil {
+			secrets[secret.ID] = struct{}{}
+		}
+	}
+	return configs, secrets
 }
 
 func (s *DockerServer) serviceUpdate(w http.ResponseWriter, r *http.Request) {
@@ -483,25 +1328,111 @@ func (s *DockerServer) serviceUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := checkServiceMode(newSpec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkIngressPorts(newSpec.EndpointSpec, toUpdate.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.checkServiceReferences(newSpec); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if newSpec.TaskTemplate.Runtime == "" {
+		newSpec.TaskTemplate.Runtime = swarm.RuntimeContainer
+	}
+	vips, err := s.allocateVirtualIPs(newSpec, toUpdate.Endpoint.VirtualIPs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recreateTasks := tasksChanged(toUpdate.Spec, newSpec)
 	toUpdate.Spec = newSpec
 	s.setServiceEndpoint(toUpdate)
+	toUpdate.Endpoint.VirtualIPs = vips
+	if recreateTasks {
+		s.replaceTasks(toUpdate)
+	}
+	err = s.runNodeOperation(s.swarmServer.URL(), nodeOperation{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Warnings []string `json:",omitempty"`
+	}{Warnings: s.svcWarnings})
+}
+
+// tasksChanged reports whether updating a service from the old spec to the new
+// one affects its tasks. Changes restricted to the annotations or the endpoint
+// of the service keep the running tasks.
+func tasksChanged(old, new swarm.ServiceSpec) bool {
+	return !reflect.DeepEqual(old.TaskTemplate, new.TaskTemplate) ||
+		!reflect.DeepEqual(old.Mode, new.Mode) ||
+		!reflect.DeepEqual(old.Networks, new.Networks)
+}
+
+// replaceTasks removes the tasks of the given service, or schedules their
+// shutdown when they have a stop grace period, and creates new ones. Must be
+// called with swarmMut and cMut held.
+func (s *DockerServer) replaceTasks(service *swarm.Service) {
 	for i := 0; i < len(s.tasks); i++ {
-		if s.tasks[i].ServiceID != toUpdate.ID {
+		if s.tasks[i].ServiceID != service.ID {
 			continue
 		}
-		_, contIdx, _ := s.findContainerWithLock(s.tasks[i].Status.ContainerStatus.ContainerID, false)
-		if contIdx != -1 {
-			s.containers = append(s.containers[:contIdx], s.containers[contIdx+1:]...)
+		if spec := s.tasks[i].Spec.ContainerSpec; spec != nil && spec.StopGracePeriod != nil && *spec.StopGracePeriod > 0 {
+			if s.tasks[i].DesiredState != swarm.TaskStateShutdown {
+				s.tasks[i].DesiredState = swarm.TaskStateShutdown
+				s.shutdownTaskAfter(s.tasks[i].ID, *spec.StopGracePeriod)
+			}
+			continue
 		}
+		s.deleteContainer(s.tasks[i].Status.ContainerStatus.ContainerID)
 		s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
 		i--
 	}
-	s.addTasks(toUpdate, true)
-	err = s.runNodeOperation(s.swarmServer.URL(), nodeOperation{})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	s.addTasks(service, true)
+}
+
+// shutdownTaskAfter moves the given task to the shutdown state, stopping its
+// container, once the grace period expires. The timer is cancelled when the
+// server stops. Must be called with swarmMut held.
+func (s *DockerServer) shutdownTaskAfter(id string, gracePeriod time.Duration) {
+	if s.shutdownTimers == nil {
+		s.shutdownTimers = make(map[string]*time.Timer)
+	}
+	s.shutdownTimers[id] = time.AfterFunc(gracePeriod, func() {
+		s.swarmMut.Lock()
+		defer s.swarmMut.Unlock()
+		if _, ok := s.shutdownTimers[id]; !ok {
+			// the server was stopped while the callback waited for the lock.
+			return
+		}
+		delete(s.shutdownTimers, id)
+		s.cMut.Lock()
+		defer s.cMut.Unlock()
+		for _, task := range s.tasks {
+			if task.ID != id {
+				continue
+			}
+			task.Status.State = swarm.TaskStateShutdown
+			task.Status.Timestamp = time.Now()
+			container, err := s.findContainerWithLock(task.Status.ContainerStatus.ContainerID, false)
+			if err == nil {
+				container.State.Running = false
+				container.State.FinishedAt = time.Now()
+				s.notify(container)
+			}
+			break
+		}
+		if s.swarmServer != nil {
+			s.runNodeOperation(s.swarmServer.URL(), nodeOperation{})
+		}
+	})
 }
 
 func (s *DockerServer) nodeUpdate(w http.ResponseWriter, r *http.Request) {
@@ -529,7 +1460,13 @@ func (s *DockerServer) nodeUpdate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	drain := spec.Availability == swarm.NodeAvailabilityDrain && n.Spec.Availability != swarm.NodeAvailabilityDrain
 	n.Spec = spec
+	if drain {
+		s.cMut.Lock()
+		s.drainNode(n.ID)
+		s.cMut.Unlock()
+	}
 	err = s.runNodeOperation(s.swarmServer.URL(), nodeOperation{
 		Op:   "update",
 		Node: *n,
@@ -540,6 +1477,66 @@ func (s *DockerServer) nodeUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// drainNode reschedules the tasks of replicated services running on the given
+// node to the active nodes, replacing their containers, and shuts down the
+// tasks of global services. Tasks are left in place when there are no other
+// active nodes. Must be called with swarmMut and cMut held.
+func (s *DockerServer) drainNode(nodeID string) {
+	var active []swarm.Node
+	for _, node := range s.nodes {
+		if node.ID != nodeID && (node.Spec.Availability == "" || node.Spec.Availability == swarm.NodeAvailabilityActive) {
+			active = append(active, node)
+		}
+	}
+	moved := 0
+	for _, task := range s.tasks {
+		if task.NodeID != nodeID || task.DesiredState == swarm.TaskStateShutdown {
+			continue
+		}
+		var service *swarm.Service
+		for _, srv := range s.services {
+			if srv.ID == task.ServiceID {
+				service = srv
+				break
+			}
+		}
+		now := time.Now()
+		if service != nil && service.Spec.Mode.Global != nil {
+			task.DesiredState = swarm.TaskStateShutdown
+			task.Status.State = swarm.TaskStateShutdown
+			task.Status.Timestamp = now
+			task.UpdatedAt = now
+			container, err := s.findContainerWithLock(task.Status.ContainerStatus.ContainerID, false)
+			if err == nil {
+				container.State.Running = false
+				container.State.FinishedAt = now
+				s.notify(container)
+			}
+			continue
+		}
+		if len(active) == 0 {
+			continue
+		}
+		node := active[moved%len(active)]
+		moved++
+		task.NodeID = node.ID
+		task.Status.Timestamp = now
+		task.UpdatedAt = now
+		// the task releases the resources assigned on its previous node.
+		task.GenericResources = nil
+		task.GenericResources = s.assignGenericResources(node, task.Spec)
+		old, err := s.findContainerWithLock(task.Status.ContainerStatus.ContainerID, false)
+		if err != nil || service == nil {
+			continue
+		}
+		container := s.containerForService(service, old.Name)
+		s.deleteContainer(old.ID)
+		s.addContainer(container)
+		s.notify(container)
+		task.Status.ContainerStatus.ContainerID = container.ID
+	}
+}
+
 func (s *DockerServer) nodeDelete(w http.ResponseWriter, r *http.Request) {
 	s.swarmMut.Lock()
 	defer s.swarmMut.Unlock()
@@ -587,17 +1584,31 @@ func (s *DockerServer) nodeList(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
-	err := json.NewEncoder(w).Encode(s.nodes)
+	if err := validateFilters(r, "nodes"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodes := make([]swarm.Node, len(s.nodes))
+	copy(nodes, s.nodes)
+	sort.Sort(nodesByID(nodes))
+	err := json.NewEncoder(w).Encode(nodes)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+type nodesByID []swarm.Node
+
+func (l nodesByID) Len() int           { return len(l) }
+func (l nodesByID) Less(i, j int) bool { return l[i].ID < l[j].ID }
+func (l nodesByID) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
 type nodeOperation struct {
 	Op        string
 	Node      swarm.Node
 	Tasks     []*swarm.Task
 	Services  []*swarm.Service
+	JoinToken string
 	forceLock bool
 }
 
@@ -639,6 +1650,13 @@ func (s *DockerServer) internalUpdateNodes(w http.ResponseWriter, r *http.Reques
 	}
 	switch nodeOp.Op {
 	case "add":
+		// nodes joining with the worker token don't take part in the
+		// propagation of node operations, only managers do.
+		if nodeOp.JoinToken != "" && s.swarm != nil && nodeOp.JoinToken == s.swarm.JoinTokens.Worker {
+			nodeOp.Node.Spec.Role = swarm.NodeRoleWorker
+			nodeOp.Node.ManagerStatus = nil
+		}
+		nodeOp.JoinToken = ""
 		s.nodes = append(s.nodes, nodeOp.Node)
 	case "update":
 		for i, n := range s.nodes {
@@ -660,7 +1678,7 @@ func (s *DockerServer) internalUpdateNodes(w http.ResponseWriter, r *http.Reques
 		nodeOp.Tasks = s.tasks
 		data, _ = json.Marshal(nodeOp)
 		for _, node := range s.nodes {
-			if s.nodeID == node.ID {
+			if s.nodeID == node.ID || node.ManagerStatus == nil {
 				continue
 			}
 			url := fmt.Sprintf("http://%s/internal/updatenodes?propagate=0", node.ManagerStatus.Addr)
@@ -5,18 +5,23 @@
 package testing
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/fsouza/go-dockerclient"
 )
 
@@ -166,6 +171,136 @@ func TestSwarmJoin(t *testing.T) {
 	}
 }
 
+func TestSwarmJoinWorker(t *testing.T) {
+	server1, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+	server2, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Stop()
+	server3, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server3.Stop()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/swarm/init", bytes.NewReader(nil))
+	server1.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("SwarmJoin: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	join := func(server *DockerServer, token string) {
+		data, err := json.Marshal(swarm.JoinRequest{
+			RemoteAddrs: []string{server1.SwarmAddress()},
+			JoinToken:   token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/swarm/join", bytes.NewReader(data))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("SwarmJoin: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+	}
+	join(server2, server1.swarm.JoinTokens.Worker)
+	join(server3, server1.swarm.JoinTokens.Manager)
+	if len(server1.nodes) != 3 {
+		t.Fatalf("SwarmJoin: expected node len to be 3, got: %d", len(server1.nodes))
+	}
+	worker := server1.nodes[1]
+	if worker.ID != server2.nodeID {
+		t.Fatalf("SwarmJoin: expected nodes[1] to be %q, got %q", server2.nodeID, worker.ID)
+	}
+	if worker.Spec.Role != swarm.NodeRoleWorker {
+		t.Errorf("SwarmJoin: wrong role for worker. Want %q. Got %q.", swarm.NodeRoleWorker, worker.Spec.Role)
+	}
+	if worker.ManagerStatus != nil {
+		t.Errorf("SwarmJoin: expected worker not to have manager status, got %#v", worker.ManagerStatus)
+	}
+	manager := server1.nodes[2]
+	if manager.Spec.Role != swarm.NodeRoleManager {
+		t.Errorf("SwarmJoin: wrong role for manager. Want %q. Got %q.", swarm.NodeRoleManager, manager.Spec.Role)
+	}
+	if manager.ManagerStatus == nil || manager.ManagerStatus.Addr != server3.SwarmAddress() {
+		t.Fatalf("SwarmJoin: expected manager to have addr %q, got: %#v", server3.SwarmAddress(), manager.ManagerStatus)
+	}
+	if !reflect.DeepEqual(server1.nodes, server3.nodes) {
+		t.Fatalf("SwarmJoin: expected nodes to be equal in server1 and server3, got:\n%#v\n%#v", server1.nodes, server3.nodes)
+	}
+	if len(server2.nodes) != 2 {
+		t.Fatalf("SwarmJoin: expected worker not to receive further updates, got %d nodes", len(server2.nodes))
+	}
+}
+
+func TestSwarmJoinManagerAdvertiseAddr(t *testing.T) {
+	server1, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server1.Stop()
+	server2, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server2.Stop()
+	server3, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server3.Stop()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/swarm/init", bytes.NewReader(nil))
+	server1.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("SwarmJoin: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	join := func(server *DockerServer, advertiseAddr string) {
+		data, err := json.Marshal(swarm.JoinRequest{
+			AdvertiseAddr: advertiseAddr,
+			RemoteAddrs:   []string{server1.SwarmAddress()},
+			JoinToken:     server1.swarm.JoinTokens.Manager,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/swarm/join", bytes.NewReader(data))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("SwarmJoin: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+	}
+	join(server2, "localhost")
+	if len(server1.nodes) != 2 {
+		t.Fatalf("SwarmJoin: expected node len to be 2, got: %d", len(server1.nodes))
+	}
+	manager := server1.nodes[1]
+	if manager.ID != server2.nodeID {
+		t.Fatalf("SwarmJoin: expected nodes[1] to be %q, got %q", server2.nodeID, manager.ID)
+	}
+	_, port, _ := net.SplitHostPort(server2.SwarmAddress())
+	expectedAddr := fmt.Sprintf("localhost:%s", port)
+	if manager.ManagerStatus == nil || manager.ManagerStatus.Addr != expectedAddr {
+		t.Fatalf("SwarmJoin: expected manager to have addr %q, got: %#v", expectedAddr, manager.ManagerStatus)
+	}
+	if manager.ManagerStatus.Leader {
+		t.Errorf("SwarmJoin: expected joined manager not to be the leader")
+	}
+	join(server3, "")
+	if len(server2.nodes) != 3 {
+		t.Fatalf("SwarmJoin: expected the join to propagate to the advertise address, got %d nodes", len(server2.nodes))
+	}
+	if !reflect.DeepEqual(server1.nodes, server2.nodes) {
+		t.Fatalf("SwarmJoin: expected nodes to be equal in server1 and server2, got:\n%#v\n%#v", server1.nodes, server2.nodes)
+	}
+}
+
 func TestSwarmJoinWithService(t *testing.T) {
 	server1, err := NewServer("127.0.0.1:0", nil, nil)
 	if err != nil {
@@ -315,6 +450,60 @@ func TestSwarmInspect(t *testing.T) {
 	}
 }
 
+func TestSwarmUnlockKey(t *testing.T) {
+	server, err := NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetSwarmUnlockKey(nil); err != docker.ErrNodeNotInSwarm {
+		t.Fatalf("SwarmUnlockKey: wrong error. Want %#v. Got %#v.", docker.ErrNodeNotInSwarm, err)
+	}
+	if err = server.SetSwarmAutoLock(true); err == nil {
+		t.Fatal("SetSwarmAutoLock: expected error when not in a swarm")
+	}
+	_, err = client.InitSwarm(docker.InitSwarmOptions{
+		InitRequest: swarm.InitRequest{ListenAddr: "127.0.0.1:0", AutoLockManagers: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := client.GetSwarmUnlockKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "SWMKEY-1-") {
+		t.Errorf("SwarmUnlockKey: wrong key format. Got %q.", key)
+	}
+	info, err := client.InspectSwarm(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Spec.EncryptionConfig.AutoLockManagers {
+		t.Error("SwarmUnlockKey: expected autolock to be enabled in the swarm spec")
+	}
+	if err = server.SetSwarmAutoLock(true); err != nil {
+		t.Fatal(err)
+	}
+	if newKey, _ := client.GetSwarmUnlockKey(nil); newKey != key {
+		t.Errorf("SetSwarmAutoLock: expected key to be kept. Want %q. Got %q.", key, newKey)
+	}
+	if err = server.SetSwarmAutoLock(false); err != nil {
+		t.Fatal(err)
+	}
+	key, err = client.GetSwarmUnlockKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		t.Errorf("SwarmUnlockKey: expected empty key with autolock disabled. Got %q.", key)
+	}
+}
+
 func TestSwarmInspectNotInSwarm(t *testing.T) {
 	server, err := NewServer("127.0.0.1:0", nil, nil)
 	if err != nil {
@@ -395,6 +584,7 @@ func TestServiceCreate(t *testing.T) {
 	if !reflect.DeepEqual(cont, expectedContainer) {
 		t.Fatalf("ServiceCreate: wrong cont. Want\n%#v\nGot\n%#v", expectedContainer, cont)
 	}
+	serviceCreateOpts.ServiceSpec.TaskTemplate.Runtime = swarm.RuntimeContainer
 	srv := server.services[0]
 	expectedService := &swarm.Service{
 		ID:   srv.ID,
@@ -410,6 +600,7 @@ func TestServiceCreate(t *testing.T) {
 	task := server.tasks[0]
 	expectedTask := &swarm.Task{
 		ID:        task.ID,
+		Meta:      task.Meta,
 		ServiceID: srv.ID,
 		NodeID:    server.nodes[0].ID,
 		Status: swarm.TaskStatus{
@@ -426,6 +617,166 @@ func TestServiceCreate(t *testing.T) {
 	}
 }
 
+func TestServiceCreateRuntime(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	var tests = []struct {
+		spec       swarm.TaskSpec
+		expected   swarm.RuntimeType
+		containers int
+	}{
+		{swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "test/test"}}, swarm.RuntimeContainer, 1},
+		{swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "test/test"}, Runtime: swarm.RuntimeContainer}, swarm.RuntimeContainer, 1},
+		{swarm.TaskSpec{Runtime: swarm.RuntimePlugin}, swarm.RuntimePlugin, 0},
+	}
+	for i, tt := range tests {
+		before := len(server.containers)
+		data, err := json.Marshal(swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: fmt.Sprintf("runtime-%d", i)},
+			TaskTemplate: tt.spec,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(data))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceCreate(%d): wrong status code. Want %d. Got %d.", i, http.StatusOK, recorder.Code)
+		}
+		srv := server.services[len(server.services)-1]
+		if srv.Spec.TaskTemplate.Runtime != tt.expected {
+			t.Errorf("ServiceCreate(%d): wrong runtime. Want %q. Got %q.", i, tt.expected, srv.Spec.TaskTemplate.Runtime)
+		}
+		task := server.tasks[len(server.tasks)-1]
+		if task.Spec.Runtime != tt.expected {
+			t.Errorf("ServiceCreate(%d): wrong task runtime. Want %q. Got %q.", i, tt.expected, task.Spec.Runtime)
+		}
+		if got := len(server.containers) - before; got != tt.containers {
+			t.Errorf("ServiceCreate(%d): wrong number of containers created. Want %d. Got %d.", i, tt.containers, got)
+		}
+	}
+}
+
+func TestServiceVirtualIPs(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	server.networks = []*docker.Network{
+		{ID: "net1", Name: "frontend", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{{Subnet: "10.1.0.0/24"}}}},
+		{ID: "net2", Name: "backend", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{{Subnet: "fd00::/64"}, {Subnet: "10.2.0.0/16"}}}},
+	}
+	send := func(method, path string, spec swarm.ServiceSpec) *httptest.ResponseRecorder {
+		data, err := json.Marshal(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, path, bytes.NewReader(data))
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+	spec := func(name string, networks ...string) swarm.ServiceSpec {
+		spec := swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: name},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+			},
+		}
+		for _, network := range networks {
+			spec.TaskTemplate.Networks = append(spec.TaskTemplate.Networks, swarm.NetworkAttachmentConfig{Target: network})
+		}
+		return spec
+	}
+	vips := func(name string) []swarm.EndpointVirtualIP {
+		for _, service := range server.services {
+			if service.Spec.Name == name {
+				return service.Endpoint.VirtualIPs
+			}
+		}
+		t.Fatalf("service %q not found", name)
+		return nil
+	}
+	for _, s := range []swarm.ServiceSpec{spec("web", "frontend", "net2"), spec("api", "net1")} {
+		if recorder := send("POST", "/services/create", s); recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+	}
+	expected := []swarm.EndpointVirtualIP{{NetworkID: "net1", Addr: "10.1.0.2/24"}, {NetworkID: "net2", Addr: "10.2.0.2/16"}}
+	if got := vips("web"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ServiceCreate: wrong virtual IPs. Want %#v. Got %#v.", expected, got)
+	}
+	expected = []swarm.EndpointVirtualIP{{NetworkID: "net1", Addr: "10.1.0.3/24"}}
+	if got := vips("api"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ServiceCreate: wrong virtual IPs. Want %#v. Got %#v.", expected, got)
+	}
+	if recorder := send("POST", "/services/api/update", spec("api", "net1", "backend")); recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceUpdate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected = []swarm.EndpointVirtualIP{{NetworkID: "net1", Addr: "10.1.0.3/24"}, {NetworkID: "net2", Addr: "10.2.0.3/16"}}
+	if got := vips("api"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ServiceUpdate: wrong virtual IPs. Want %#v. Got %#v.", expected, got)
+	}
+	dnsrr := spec("dnsrr", "frontend")
+	dnsrr.EndpointSpec = &swarm.EndpointSpec{Mode: swarm.ResolutionModeDNSRR}
+	if recorder := send("POST", "/services/create", dnsrr); recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if got := vips("dnsrr"); len(got) != 0 {
+		t.Errorf("ServiceCreate: expected no virtual IPs in dnsrr mode. Got %#v.", got)
+	}
+	if recorder := send("POST", "/services/create", spec("unknown", "unknown")); recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code for unknown network. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected = []swarm.EndpointVirtualIP{{NetworkID: "unknown", Addr: "10.0.0.2/24"}}
+	if got := vips("unknown"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ServiceCreate: wrong virtual IPs for unknown network. Want %#v. Got %#v.", expected, got)
+	}
+	if recorder := send("POST", "/services/create", spec("repeated", "frontend", "net1", "backend")); recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	expected = []swarm.EndpointVirtualIP{{NetworkID: "net1", Addr: "10.1.0.4/24"}, {NetworkID: "net2", Addr: "10.2.0.4/16"}}
+	if got := vips("repeated"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ServiceCreate: wrong virtual IPs for repeated network. Want %#v. Got %#v.", expected, got)
+	}
+}
+
+func TestServiceCreateModeConflict(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	replicas := uint64(2)
+	data, err := json.Marshal(swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "conflict"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+		},
+		Mode: swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+			Global:     &swarm.GlobalService{},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(data))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+	if msg := strings.TrimSpace(recorder.Body.String()); msg != "must specify only one mode" {
+		t.Errorf("ServiceCreate: wrong error message. Want %q. Got %q.", "must specify only one mode", msg)
+	}
+	if len(server.services) != 0 {
+		t.Errorf("ServiceCreate: should not create services. Got %d.", len(server.services))
+	}
+	if len(server.tasks) != 0 {
+		t.Errorf("ServiceCreate: should not create tasks. Got %d.", len(server.tasks))
+	}
+}
+
 func TestServiceCreateDynamicPort(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
@@ -469,6 +820,7 @@ func TestServiceCreateDynamicPort(t *testing.T) {
 	if len(server.services) != 1 || len(server.tasks) != 1 || len(server.containers) != 1 {
 		t.Fatalf("ServiceCreate: wrong item count. Want 1. Got services: %d, tasks: %d, containers: %d.", len(server.services), len(server.tasks), len(server.containers))
 	}
+	serviceCreateOpts.ServiceSpec.TaskTemplate.Runtime = swarm.RuntimeContainer
 	srv := server.services[0]
 	expectedService := &swarm.Service{
 		ID:   srv.ID,
@@ -483,6 +835,58 @@ func TestServiceCreateDynamicPort(t *testing.T) {
 	}
 }
 
+func TestServiceCreateConflictingPublishedPort(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	createService := func(name string, publishedPort uint32) *httptest.ResponseRecorder {
+		opts := docker.CreateServiceOptions{
+			ServiceSpec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{Name: name},
+				TaskTemplate: swarm.TaskSpec{
+					ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+				},
+				EndpointSpec: &swarm.EndpointSpec{
+					Ports: []swarm.PortConfig{{
+						Protocol:      swarm.PortConfigProtocolTCP,
+						TargetPort:    80,
+						PublishedPort: publishedPort,
+					}},
+				},
+			},
+		}
+		buf, err := json.Marshal(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewBuffer(buf))
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+	if recorder := createService("first", 30000); recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	recorder := createService("second", 30000)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusInternalServerError, recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "port '30000' is already in use") {
+		t.Errorf("ServiceCreate: wrong error message. Got %q.", recorder.Body.String())
+	}
+	recorder = createService("third", 0)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var srv swarm.Service
+	if err := json.NewDecoder(recorder.Body).Decode(&srv); err != nil {
+		t.Fatal(err)
+	}
+	if port := srv.Endpoint.Ports[0].PublishedPort; port != 30001 {
+		t.Errorf("ServiceCreate: wrong dynamic port. Want %d. Got %d.", 30001, port)
+	}
+}
+
 func TestServiceCreateMultipleServers(t *testing.T) {
 	server1, server2 := setUpSwarm(t)
 	defer server1.Stop()
@@ -508,57 +912,340 @@ func TestServiceCreateMultipleServers(t *testing.T) {
 	}
 }
 
-func compareServices(srv1 *swarm.Service, srv2 *swarm.Service) bool {
-	srv1.CreatedAt = srv2.CreatedAt
-	srv1.UpdatedAt = srv2.UpdatedAt
-	if srv1.UpdateStatus != nil {
-		srv1.UpdateStatus.StartedAt = srv2.UpdateStatus.StartedAt
-		srv1.UpdateStatus.CompletedAt = srv2.UpdateStatus.CompletedAt
-	}
-	return reflect.DeepEqual(srv1, srv2)
-}
-
-func compareTasks(task1 *swarm.Task, task2 *swarm.Task) bool {
-	task1.CreatedAt = task2.CreatedAt
-	task1.UpdatedAt = task2.UpdatedAt
-	task1.Status.Timestamp = task2.Status.Timestamp
-	return reflect.DeepEqual(task1, task2)
-}
-
-func TestServiceInspect(t *testing.T) {
+func TestServiceCreateSecretsAndConfigs(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
 	defer unused.Stop()
-	srv, err := addTestService(server)
-	if err != nil {
-		t.Fatal(err)
+	secretID := server.AddSecret(swarm.SecretSpec{Annotations: swarm.Annotations{Name: "db-password"}, Data: []byte("s3cr3t")})
+	configID := server.AddConfig(swarm.ConfigSpec{Annotations: swarm.Annotations{Name: "app-config"}, Data: []byte("debug=1")})
+	secretRef := &swarm.SecretReference{
+		SecretID:   secretID,
+		SecretName: "db-password",
+		File:       &swarm.SecretReferenceFileTarget{Name: "db-password", UID: "0", GID: "0", Mode: 0400},
+	}
+	configRef := &swarm.ConfigReference{
+		ConfigID:   configID,
+		ConfigName: "app-config",
+		File:       &swarm.ConfigReferenceFileTarget{Name: "/etc/app.conf", UID: "0", GID: "0", Mode: 0444},
+	}
+	var tests = []struct {
+		name    string
+		secrets []*swarm.SecretReference
+		configs []*swarm.ConfigReference
+		code    int
+	}{
+		{"valid", []*swarm.SecretReference{secretRef}, []*swarm.ConfigReference{configRef}, http.StatusOK},
+		{"by-name", []*swarm.SecretReference{{SecretName: "db-password"}}, nil, http.StatusOK},
+		{"unknown-secret", []*swarm.SecretReference{{SecretID: "unknown", SecretName: "db-password"}}, nil, http.StatusNotFound},
+		{"unknown-config", nil, []*swarm.ConfigReference{{ConfigID: "unknown"}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		buf, err := json.Marshal(swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: tt.name},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{
+					Image:   "test/test",
+					Secrets: tt.secrets,
+					Configs: tt.configs,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(buf))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("ServiceCreate(%s): wrong status code. Want %d. Got %d.", tt.name, tt.code, recorder.Code)
+		}
 	}
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/services/"+srv.ID, nil)
+	request, _ := http.NewRequest("GET", "/services/valid", nil)
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
 		t.Fatalf("ServiceInspect: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	var srvInspect swarm.Service
-	err = json.Unmarshal(recorder.Body.Bytes(), &srvInspect)
-	if err != nil {
-		t.Fatalf("ServiceInspect: unable to unmarshal response body: %s", err)
+	var service swarm.Service
+	if err := json.NewDecoder(recorder.Body).Decode(&service); err != nil {
+		t.Fatal(err)
 	}
-	if !compareServices(srv, &srvInspect) {
-		t.Fatalf("ServiceInspect: wrong service. Want\n%#v\nGot\n%#v", srv, &srvInspect)
+	containerSpec := service.Spec.TaskTemplate.ContainerSpec
+	if len(containerSpec.Secrets) != 1 || !reflect.DeepEqual(containerSpec.Secrets[0], secretRef) {
+		t.Errorf("ServiceInspect: wrong secret references. Got %#v.", containerSpec.Secrets)
+	}
+	if len(containerSpec.Configs) != 1 || !reflect.DeepEqual(containerSpec.Configs[0], configRef) {
+		t.Errorf("ServiceInspect: wrong config references. Got %#v.", containerSpec.Configs)
 	}
 }
 
-func TestServiceInspectByName(t *testing.T) {
+func TestServiceSecretsAndConfigsMounted(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
 	defer unused.Stop()
-	srv, err := addTestService(server)
+	secretID := server.AddSecret(swarm.SecretSpec{Annotations: swarm.Annotations{Name: "db-password"}, Data: []byte("s3cr3t")})
+	configID := server.AddConfig(swarm.ConfigSpec{Annotations: swarm.Annotations{Name: "app-config"}, Data: []byte("debug=1")})
+	buf, err := json.Marshal(swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "app"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image: "test/test",
+				Secrets: []*swarm.SecretReference{{
+					SecretID:   secretID,
+					SecretName: "db-password",
+					File:       &swarm.SecretReferenceFileTarget{Name: "db-password", Mode: 0400},
+				}},
+				Configs: []*swarm.ConfigReference{{
+					ConfigID:   configID,
+					ConfigName: "app-config",
+					File:       &swarm.ConfigReferenceFileTarget{Name: "/etc/app.conf", Mode: 0444},
+				}},
+			},
+		},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("GET", "/services/"+srv.Spec.Name, nil)
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(buf))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	containerID := server.tasks[0].Status.ContainerStatus.ContainerID
+	var tests = []struct {
+		path    string
+		mode    int64
+		content string
+	}{
+		{"/run/secrets/db-password", 0400, "s3cr3t"},
+		{"/etc/app.conf", 0444, "debug=1"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", fmt.Sprintf("/containers/%s/archive?path=%s", containerID, tt.path), nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("DownloadFromContainer(%s): wrong status. Want %d. Got %d.", tt.path, http.StatusOK, recorder.Code)
+		}
+		tr := tar.NewReader(recorder.Body)
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if header.Mode != tt.mode || string(content) != tt.content {
+			t.Errorf("DownloadFromContainer(%s): wrong file. Want mode %o with %q. Got mode %o with %q.", tt.path, tt.mode, tt.content, header.Mode, content)
+		}
+	}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.UpdateServiceImage("app", "test/test:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, ok := server.uploadedFiles[containerID]; ok {
+		t.Errorf("ServiceUpdate: files of the replaced container should be removed. Got %v.", files)
+	}
+	newContainerID := server.tasks[0].Status.ContainerStatus.ContainerID
+	if files := server.uploadedFiles[newContainerID]; len(files) != len(tests) {
+		t.Errorf("ServiceUpdate: wrong files in the new container. Want %d. Got %v.", len(tests), files)
+	}
+	err = client.RemoveContainer(docker.RemoveContainerOptions{ID: newContainerID, Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, ok := server.uploadedFiles[newContainerID]; ok {
+		t.Errorf("RemoveContainer: files of the removed container should be removed. Got %v.", files)
+	}
+}
+
+func TestServiceCreateConcurrent(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	const count = 10
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			buf, err := json.Marshal(swarm.ServiceSpec{
+				Annotations: swarm.Annotations{Name: fmt.Sprintf("test-%d", i)},
+				TaskTemplate: swarm.TaskSpec{
+					ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+				},
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(buf))
+			server.ServeHTTP(recorder, request)
+			if recorder.Code != http.StatusOK {
+				errs <- fmt.Errorf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < count; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if len(server.services) != count {
+		t.Fatalf("ServiceCreate: wrong number of services. Want %d. Got %d.", count, len(server.services))
+	}
+	nodeTasks := make(map[string]int)
+	for _, task := range server.tasks {
+		nodeTasks[task.NodeID]++
+	}
+	for _, node := range server.nodes {
+		if nodeTasks[node.ID] != count/len(server.nodes) {
+			t.Errorf("ServiceCreate: wrong number of tasks in node %q. Want %d. Got %d.", node.ID, count/len(server.nodes), nodeTasks[node.ID])
+		}
+	}
+}
+
+func TestServiceCreateAfterNodeRemoval(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	server.swarmMut.Lock()
+	server.nodeRR = len(server.nodes)
+	server.swarmMut.Unlock()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.tasks) != 1 {
+		t.Fatalf("ServiceCreate: wrong number of tasks. Want 1. Got %d.", len(server.tasks))
+	}
+	if task := server.tasks[0]; task.ServiceID != srv.ID || task.NodeID != server.nodes[0].ID {
+		t.Errorf("ServiceCreate: wrong task placement. Want node %q. Got %q.", server.nodes[0].ID, task.NodeID)
+	}
+}
+
+func compareServices(srv1 *swarm.Service, srv2 *swarm.Service) bool {
+	srv1.CreatedAt = srv2.CreatedAt
+	srv1.UpdatedAt = srv2.UpdatedAt
+	if srv1.UpdateStatus != nil {
+		srv1.UpdateStatus.StartedAt = srv2.UpdateStatus.StartedAt
+		srv1.UpdateStatus.CompletedAt = srv2.UpdateStatus.CompletedAt
+	}
+	return reflect.DeepEqual(srv1, srv2)
+}
+
+func compareTasks(task1 *swarm.Task, task2 *swarm.Task) bool {
+	task1.CreatedAt = task2.CreatedAt
+	task1.UpdatedAt = task2.UpdatedAt
+	task1.Status.Timestamp = task2.Status.Timestamp
+	return reflect.DeepEqual(task1, task2)
+}
+
+func TestServiceInspect(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/services/"+srv.ID, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceInspect: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var srvInspect swarm.Service
+	err = json.Unmarshal(recorder.Body.Bytes(), &srvInspect)
+	if err != nil {
+		t.Fatalf("ServiceInspect: unable to unmarshal response body: %s", err)
+	}
+	if !compareServices(srv, &srvInspect) {
+		t.Fatalf("ServiceInspect: wrong service. Want\n%#v\nGot\n%#v", srv, &srvInspect)
+	}
+}
+
+func TestServiceInspectInsertDefaults(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	data, err := json.Marshal(swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "defaults"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+			RestartPolicy: &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionOnFailure},
+		},
+		UpdateConfig: &swarm.UpdateConfig{Parallelism: 2, Order: swarm.UpdateOrderStartFirst},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(data))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	delay := 5 * time.Second
+	maxAttempts := uint64(0)
+	expectedUpdateConfig := &swarm.UpdateConfig{
+		Parallelism:   2,
+		FailureAction: swarm.UpdateFailureActionPause,
+		Monitor:       5 * time.Second,
+		Order:         swarm.UpdateOrderStartFirst,
+	}
+	expectedRestartPolicy := &swarm.RestartPolicy{
+		Condition:   swarm.RestartPolicyConditionOnFailure,
+		Delay:       &delay,
+		MaxAttempts: &maxAttempts,
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/services/defaults?insertDefaults=true", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceInspect: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var srvInspect swarm.Service
+	err = json.Unmarshal(recorder.Body.Bytes(), &srvInspect)
+	if err != nil {
+		t.Fatalf("ServiceInspect: unable to unmarshal response body: %s", err)
+	}
+	if !reflect.DeepEqual(srvInspect.Spec.UpdateConfig, expectedUpdateConfig) {
+		t.Errorf("ServiceInspect: wrong update config. Want %#v. Got %#v.", expectedUpdateConfig, srvInspect.Spec.UpdateConfig)
+	}
+	if !reflect.DeepEqual(srvInspect.Spec.TaskTemplate.RestartPolicy, expectedRestartPolicy) {
+		t.Errorf("ServiceInspect: wrong restart policy. Want %#v. Got %#v.", expectedRestartPolicy, srvInspect.Spec.TaskTemplate.RestartPolicy)
+	}
+	if srvInspect.Spec.TaskTemplate.Placement == nil {
+		t.Error("ServiceInspect: expected default placement, got <nil>")
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/services/defaults", nil)
+	server.ServeHTTP(recorder, request)
+	srvInspect = swarm.Service{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &srvInspect)
+	if err != nil {
+		t.Fatalf("ServiceInspect: unable to unmarshal response body: %s", err)
+	}
+	if srvInspect.Spec.TaskTemplate.Placement != nil || srvInspect.Spec.UpdateConfig.Monitor != 0 {
+		t.Errorf("ServiceInspect: defaults should not be stored in the service. Got %#v.", srvInspect.Spec)
+	}
+}
+
+func TestServiceInspectByName(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/services/"+srv.Spec.Name, nil)
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
 		t.Fatalf("ServiceInspect: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
@@ -646,6 +1333,88 @@ func TestServiceList(t *testing.T) {
 	}
 }
 
+func TestServiceListStream(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	const count = 2500
+	server.swarmMut.Lock()
+	for i := 0; i < count; i++ {
+		server.services = append(server.services, &swarm.Service{
+			ID:   fmt.Sprintf("svc-%d", i),
+			Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: fmt.Sprintf("service-%d", i)}},
+		})
+	}
+	server.swarmMut.Unlock()
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed int
+	err = client.ListServicesStream(docker.ListServicesOptions{}, func(service *swarm.Service) error {
+		if expected := fmt.Sprintf("svc-%d", listed); service.ID != expected {
+			return fmt.Errorf("wrong service at position %d. Want %q. Got %q", listed, expected, service.ID)
+		}
+		listed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed != count {
+		t.Errorf("ListServicesStream: wrong number of services. Want %d. Got %d.", count, listed)
+	}
+	services, err := client.ListServices(docker.ListServicesOptions{
+		Filters: map[string][]string{"name": {"service-42"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].ID != "svc-42" {
+		t.Errorf("ListServices: wrong filtered services. Got %#v.", services)
+	}
+}
+
+func TestServiceListWithStatus(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/services", nil)
+	server.ServeHTTP(recorder, request)
+	var services []swarm.Service
+	err = json.Unmarshal(recorder.Body.Bytes(), &services)
+	if err != nil {
+		t.Fatalf("ServiceList: unable to unmarshal response body: %s", err)
+	}
+	if services[0].ServiceStatus != nil {
+		t.Errorf("ServiceList: expected no status without the status parameter. Got %#v.", services[0].ServiceStatus)
+	}
+	server.containers[0].State.Running = false
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/services?status=true", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceList: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	services = nil
+	err = json.Unmarshal(recorder.Body.Bytes(), &services)
+	if err != nil {
+		t.Fatalf("ServiceList: unable to unmarshal response body: %s", err)
+	}
+	expected := &swarm.ServiceStatus{RunningTasks: 0, DesiredTasks: 1}
+	if len(services) != 1 || !reflect.DeepEqual(services[0].ServiceStatus, expected) {
+		t.Errorf("ServiceList: wrong service status. Want %#v. Got %#v.", expected, services)
+	}
+	if srv.ServiceStatus != nil {
+		t.Error("ServiceList: status should not be stored in the service")
+	}
+}
+
 func TestServiceListFilterID(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
@@ -718,6 +1487,23 @@ func TestServiceListFilterEmpty(t *testing.T) {
 	}
 }
 
+func TestServiceListEmptyArray(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	for _, path := range []string{"/services", "/services?status=true"} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", path, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceList(%s): wrong status code. Want %d. Got %d.", path, http.StatusOK, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != "[]\n" {
+			t.Errorf("ServiceList(%s): wrong body for empty list. Want %q. Got %q.", path, "[]\n", body)
+		}
+	}
+}
+
 func TestTaskList(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
@@ -743,6 +1529,47 @@ func TestTaskList(t *testing.T) {
 	}
 }
 
+func TestTaskListSortedByCreation(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	_, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.tasks[0].CreatedAt.IsZero() {
+		t.Fatal("TaskList: expected CreatedAt to be set on new tasks")
+	}
+	now := time.Now()
+	server.tasks = []*swarm.Task{
+		{ID: "task-c", Meta: swarm.Meta{CreatedAt: now.Add(2 * time.Second)}},
+		{ID: "task-a", Meta: swarm.Meta{CreatedAt: now}},
+		{ID: "task-b", Meta: swarm.Meta{CreatedAt: now.Add(time.Second)}},
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/tasks", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("TaskList: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	var tasks []swarm.Task
+	err = json.Unmarshal(recorder.Body.Bytes(), &tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	expected := []string{"task-a", "task-b", "task-c"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("TaskList: wrong order. Want %v. Got %v.", expected, ids)
+	}
+	if server.tasks[0].ID != "task-c" {
+		t.Errorf("TaskList: server tasks should not be reordered. Got %q first.", server.tasks[0].ID)
+	}
+}
+
 func TestTaskListFilterID(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
@@ -891,6 +1718,22 @@ func TestTaskListFilterNotFound(t *testing.T) {
 	}
 }
 
+func TestTaskListInvalidFilter(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	_, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", `/tasks?filters={"desired_state":["running"]}`, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("TaskList: wrong status code. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+}
+
 func TestTaskListFilterLabel(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
@@ -942,37 +1785,295 @@ func TestTaskListFilterLabel(t *testing.T) {
 	}
 }
 
-func TestServiceDelete(t *testing.T) {
+func TestServiceLogs(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
 	defer unused.Stop()
-	srv, err := addTestService(server)
+	replicas := uint64(2)
+	data, err := json.Marshal(swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "logger"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+		},
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("DELETE", "/services/"+srv.ID, nil)
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(data))
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusOK {
-		t.Fatalf("ServiceDelete: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		t.Fatalf("ServiceLogs: wrong status code creating service. Want %d. Got %d.", http.StatusOK, recorder.Code)
 	}
-	if len(server.services) != 0 {
-		t.Fatalf("ServiceDelete: expected empty services, got %d", len(server.services))
+	if len(server.tasks) != 2 {
+		t.Fatalf("ServiceLogs: expected 2 tasks, got %d", len(server.tasks))
 	}
-	if len(server.tasks) != 0 {
-		t.Fatalf("ServiceDelete: expected empty tasks, got %d", len(server.tasks))
+	base := time.Unix(1500000000, 0)
+	err = server.AddContainerLogs(server.tasks[0].Status.ContainerStatus.ContainerID,
+		ContainerLogEntry{Time: base, Line: "task0 line0"},
+		ContainerLogEntry{Time: base.Add(2 * time.Second), Line: "task0 line1", Stderr: true},
+		ContainerLogEntry{Time: base.Add(4 * time.Second), Line: "task0 line2"},
+	)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(server.containers) != 0 {
-		t.Fatalf("ServiceDelete: expected empty containers, got %d", len(server.containers))
+	err = server.AddContainerLogs(server.tasks[1].Status.ContainerStatus.ContainerID,
+		ContainerLogEntry{Time: base.Add(time.Second), Line: "task1 line0"},
+		ContainerLogEntry{Time: base.Add(3 * time.Second), Line: "task1 line1"},
+	)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestServiceDeleteNotFound(t *testing.T) {
-	server, unused := setUpSwarm(t)
-	defer server.Stop()
-	defer unused.Stop()
-	recorder := httptest.NewRecorder()
-	request, _ := http.NewRequest("DELETE", "/services/blahblah", nil)
+	var tests = []struct {
+		query  string
+		stdout string
+		stderr string
+	}{
+		{
+			"",
+			"task0 line0\ntask1 line0\ntask1 line1\ntask0 line2\n",
+			"task0 line1\n",
+		},
+		{
+			"stdout=1",
+			"task0 line0\ntask1 line0\ntask1 line1\ntask0 line2\n",
+			"",
+		},
+		{
+			"since=1500000001&until=1500000003",
+			"task1 line0\ntask1 line1\n",
+			"task0 line1\n",
+		},
+		{
+			"since=1500000001&tail=2",
+			"task1 line1\ntask0 line2\n",
+			"",
+		},
+		{
+			"since=1500000003.5&timestamps=1",
+			"2017-07-14T02:40:04Z task0 line2\n",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("GET", "/services/logger/logs?"+tt.query, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceLogs(%q): wrong status code. Want %d. Got %d.", tt.query, http.StatusOK, recorder.Code)
+		}
+		var stdout, stderr bytes.Buffer
+		_, err = stdcopy.StdCopy(&stdout, &stderr, recorder.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != tt.stdout {
+			t.Errorf("ServiceLogs(%q): wrong stdout. Want %q. Got %q.", tt.query, tt.stdout, stdout.String())
+		}
+		if stderr.String() != tt.stderr {
+			t.Errorf("ServiceLogs(%q): wrong stderr. Want %q. Got %q.", tt.query, tt.stderr, stderr.String())
+		}
+	}
+}
+
+func TestServiceLogsLogDriver(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	var tests = []struct {
+		name   string
+		driver *swarm.Driver
+		code   int
+	}{
+		{"default", nil, http.StatusOK},
+		{"json", &swarm.Driver{Name: "json-file", Options: map[string]string{"max-size": "10m"}}, http.StatusOK},
+		{"syslog", &swarm.Driver{Name: "syslog", Options: map[string]string{"syslog-address": "udp://1.2.3.4:1111"}}, http.StatusNotImplemented},
+		{"none", &swarm.Driver{Name: "none"}, http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: tt.name},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+				LogDriver:     tt.driver,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(data))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceCreate(%s): wrong status code. Want %d. Got %d.", tt.name, http.StatusOK, recorder.Code)
+		}
+		task := server.tasks[len(server.tasks)-1]
+		container, err := server.findContainer(task.Status.ContainerStatus.ContainerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected docker.LogConfig
+		if tt.driver != nil {
+			expected = docker.LogConfig{Type: tt.driver.Name, Config: tt.driver.Options}
+		}
+		if !reflect.DeepEqual(container.HostConfig.LogConfig, expected) {
+			t.Errorf("ServiceCreate(%s): wrong log config. Want %#v. Got %#v.", tt.name, expected, container.HostConfig.LogConfig)
+		}
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("GET", "/services/"+tt.name+"/logs", nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("ServiceLogs(%s): wrong status code. Want %d. Got %d.", tt.name, tt.code, recorder.Code)
+		}
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("GET", "/containers/"+container.ID+"/logs", nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != tt.code {
+			t.Errorf("LogContainer(%s): wrong status code. Want %d. Got %d.", tt.name, tt.code, recorder.Code)
+		}
+	}
+}
+
+func TestServiceLogsNotFound(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/services/abcd/logs", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("ServiceLogs: wrong status code. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestServiceDelete(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("DELETE", "/services/"+srv.ID, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceDelete: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	if len(server.services) != 0 {
+		t.Fatalf("ServiceDelete: expected empty services, got %d", len(server.services))
+	}
+	if len(server.tasks) != 0 {
+		t.Fatalf("ServiceDelete: expected empty tasks, got %d", len(server.tasks))
+	}
+	if len(server.containers) != 0 {
+		t.Fatalf("ServiceDelete: expected empty containers, got %d", len(server.containers))
+	}
+}
+
+func TestServiceDeleteUnreferenced(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	sharedSecret := server.AddSecret(swarm.SecretSpec{Annotations: swarm.Annotations{Name: "shared"}})
+	ownSecret := server.AddSecret(swarm.SecretSpec{Annotations: swarm.Annotations{Name: "own"}})
+	config := server.AddConfig(swarm.ConfigSpec{Annotations: swarm.Annotations{Name: "app-config"}})
+	createService := func(name string, secrets []*swarm.SecretReference, configs []*swarm.ConfigReference) string {
+		buf, err := json.Marshal(swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: name},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{
+					Image:   "test/test",
+					Secrets: secrets,
+					Configs: configs,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewBuffer(buf))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		return name
+	}
+	first := createService("first", []*swarm.SecretReference{
+		{SecretID: sharedSecret},
+		{SecretName: "own"},
+	}, []*swarm.ConfigReference{{ConfigID: config}})
+	second := createService("second", []*swarm.SecretReference{{SecretName: "shared"}}, nil)
+	var tests = []struct {
+		service string
+		configs string
+		secrets string
+	}{
+		{first, config, ownSecret},
+		{second, "", sharedSecret},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("DELETE", "/services/"+tt.service, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceDelete: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		if configs := recorder.Header().Get("X-Unreferenced-Configs"); configs != tt.configs {
+			t.Errorf("ServiceDelete(%s): wrong unreferenced configs. Want %q. Got %q.", tt.service, tt.configs, configs)
+		}
+		if secrets := recorder.Header().Get("X-Unreferenced-Secrets"); secrets != tt.secrets {
+			t.Errorf("ServiceDelete(%s): wrong unreferenced secrets. Want %q. Got %q.", tt.service, tt.secrets, secrets)
+		}
+	}
+}
+
+func TestServiceDeleteUnreferencedClient(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	secret := server.AddSecret(swarm.SecretSpec{Annotations: swarm.Annotations{Name: "secret"}})
+	config := server.AddConfig(swarm.ConfigSpec{Annotations: swarm.Annotations{Name: "config"}})
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := client.CreateService(docker.CreateServiceOptions{
+		ServiceSpec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: "app"},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{
+					Image:   "test/test",
+					Secrets: []*swarm.SecretReference{{SecretID: secret}},
+					Configs: []*swarm.ConfigReference{{ConfigID: config}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.RemoveServiceWithResult(docker.RemoveServiceOptions{ID: service.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := docker.RemoveServiceResult{
+		UnreferencedConfigs: []string{config},
+		UnreferencedSecrets: []string{secret},
+	}
+	if !reflect.DeepEqual(*result, expected) {
+		t.Errorf("RemoveServiceWithResult: wrong result. Want %#v. Got %#v.", expected, *result)
+	}
+}
+
+func TestServiceDeleteNotFound(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("DELETE", "/services/blahblah", nil)
 	server.ServeHTTP(recorder, request)
 	if recorder.Code != http.StatusNotFound {
 		t.Fatalf("ServiceDelete: wrong status code. Want %d. Got %d.", http.StatusNotFound, recorder.Code)
@@ -1042,6 +2143,7 @@ func TestServiceUpdate(t *testing.T) {
 	if !reflect.DeepEqual(cont, expectedContainer) {
 		t.Fatalf("ServiceUpdate: wrong cont. Want\n%#v\nGot\n%#v", expectedContainer, cont)
 	}
+	updateOpts.TaskTemplate.Runtime = swarm.RuntimeContainer
 	srv = server.services[0]
 	expectedService := &swarm.Service{
 		ID:   srv.ID,
@@ -1057,6 +2159,7 @@ func TestServiceUpdate(t *testing.T) {
 	task := server.tasks[0]
 	expectedTask := &swarm.Task{
 		ID:        task.ID,
+		Meta:      task.Meta,
 		ServiceID: srv.ID,
 		NodeID:    server.nodes[1].ID,
 		Status: swarm.TaskStatus{
@@ -1123,6 +2226,271 @@ func TestServiceUpdateMoreReplicas(t *testing.T) {
 	}
 }
 
+func TestServiceUpdateModeConflict(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := uint64(3)
+	original := srv.Spec
+	spec := srv.Spec
+	spec.Mode = swarm.ServiceMode{
+		Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+		Global:     &swarm.GlobalService{},
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", fmt.Sprintf("/services/%s/update", srv.ID), bytes.NewReader(buf))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("ServiceUpdate: wrong status code. Want %d. Got %d.", http.StatusBadRequest, recorder.Code)
+	}
+	if msg := strings.TrimSpace(recorder.Body.String()); msg != "must specify only one mode" {
+		t.Errorf("ServiceUpdate: wrong error message. Want %q. Got %q.", "must specify only one mode", msg)
+	}
+	if !reflect.DeepEqual(server.services[0].Spec, original) {
+		t.Errorf("ServiceUpdate: should not change the service spec. Want %#v. Got %#v.", original, server.services[0].Spec)
+	}
+	if len(server.tasks) != 1 || len(server.containers) != 1 {
+		t.Errorf("ServiceUpdate: should not touch tasks. Got tasks: %d, containers: %d.", len(server.tasks), len(server.containers))
+	}
+}
+
+func TestServiceUpdateImage(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.UpdateServiceImage(srv.Spec.Name, "test/test:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image := server.services[0].Spec.TaskTemplate.ContainerSpec.Image; image != "test/test:v2" {
+		t.Errorf("ServiceUpdate: wrong image. Want %q. Got %q.", "test/test:v2", image)
+	}
+	if args := server.services[0].Spec.TaskTemplate.ContainerSpec.Args; !reflect.DeepEqual(args, []string{"--test"}) {
+		t.Errorf("ServiceUpdate: args should be preserved. Got %#v.", args)
+	}
+	if len(server.containers) != 1 || server.containers[0].Image != "test/test:v2" {
+		t.Errorf("ServiceUpdate: expected a single container running the new image. Got %d containers.", len(server.containers))
+	}
+}
+
+func TestServiceUpdateLabelsKeepsTasks(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskID := server.tasks[0].ID
+	containerID := server.containers[0].ID
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := srv.Spec
+	spec.Labels = map[string]string{"mykey": "othervalue"}
+	spec.EndpointSpec = &swarm.EndpointSpec{
+		Ports: []swarm.PortConfig{{Protocol: swarm.PortConfigProtocolTCP, TargetPort: 80, PublishedPort: 8080}},
+	}
+	err = client.UpdateService(srv.ID, docker.UpdateServiceOptions{ServiceSpec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels := server.services[0].Spec.Labels; labels["mykey"] != "othervalue" {
+		t.Errorf("ServiceUpdate: wrong labels. Got %#v.", labels)
+	}
+	if len(server.tasks) != 1 || server.tasks[0].ID != taskID {
+		t.Errorf("ServiceUpdate: tasks should be preserved when only labels and endpoint change")
+	}
+	if len(server.containers) != 1 || server.containers[0].ID != containerID {
+		t.Errorf("ServiceUpdate: containers should be preserved when only labels and endpoint change")
+	}
+	spec.TaskTemplate.ContainerSpec.Env = []string{"ENV=2"}
+	err = client.UpdateService(srv.ID, docker.UpdateServiceOptions{ServiceSpec: spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.tasks) != 1 || server.tasks[0].ID == taskID {
+		t.Errorf("ServiceUpdate: tasks should be replaced when the task template changes")
+	}
+}
+
+func TestServiceUpdateStopGracePeriod(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	gracePeriod := 200 * time.Millisecond
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "graceful"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image:           "test/test",
+				StopGracePeriod: &gracePeriod,
+			},
+		},
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(buf))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	oldTaskID := server.tasks[0].ID
+	oldContainerID := server.tasks[0].Status.ContainerStatus.ContainerID
+	spec.TaskTemplate.ContainerSpec.Image = "test/test2"
+	buf, err = json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/services/graceful/update", bytes.NewReader(buf))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceUpdate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	findTask := func() swarm.Task {
+		server.swarmMut.Lock()
+		defer server.swarmMut.Unlock()
+		for _, task := range server.tasks {
+			if task.ID == oldTaskID {
+				return *task
+			}
+		}
+		t.Fatalf("ServiceUpdate: task %q removed before its grace period", oldTaskID)
+		return swarm.Task{}
+	}
+	task := findTask()
+	if task.DesiredState != swarm.TaskStateShutdown {
+		t.Errorf("ServiceUpdate: wrong desired state. Want %q. Got %q.", swarm.TaskStateShutdown, task.DesiredState)
+	}
+	if task.Status.State != swarm.TaskStateReady {
+		t.Errorf("ServiceUpdate: task should keep running during grace period. Got state %q.", task.Status.State)
+	}
+	server.swarmMut.Lock()
+	taskCount := len(server.tasks)
+	server.swarmMut.Unlock()
+	if taskCount != 2 {
+		t.Errorf("ServiceUpdate: wrong task count. Want 2. Got %d.", taskCount)
+	}
+	timeout := time.After(5 * time.Second)
+	for task.Status.State != swarm.TaskStateShutdown {
+		select {
+		case <-timeout:
+			t.Fatal("ServiceUpdate: timed out waiting for task shutdown")
+		case <-time.After(50 * time.Millisecond):
+		}
+		task = findTask()
+	}
+	container, err := server.findContainer(oldContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.cMut.RLock()
+	running := container.State.Running
+	server.cMut.RUnlock()
+	if running {
+		t.Error("ServiceUpdate: container should be stopped after the grace period")
+	}
+}
+
+func TestStopCancelsTaskShutdown(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer unused.Stop()
+	gracePeriod := time.Hour
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "graceful"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{
+				Image:           "test/test",
+				StopGracePeriod: &gracePeriod,
+			},
+		},
+	}
+	for _, path := range []string{"/services/create", "/services/graceful/update"} {
+		buf, err := json.Marshal(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", path, bytes.NewReader(buf))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: wrong status code. Want %d. Got %d.", path, http.StatusOK, recorder.Code)
+		}
+		spec.TaskTemplate.ContainerSpec.Image = "test/test2"
+	}
+	server.swarmMut.Lock()
+	timers := make([]*time.Timer, 0, len(server.shutdownTimers))
+	for _, timer := range server.shutdownTimers {
+		timers = append(timers, timer)
+	}
+	server.swarmMut.Unlock()
+	if len(timers) != 1 {
+		t.Fatalf("ServiceUpdate: wrong number of pending shutdowns. Want 1. Got %d.", len(timers))
+	}
+	server.Stop()
+	if timers[0].Stop() {
+		t.Error("Stop: the task shutdown timer should be stopped")
+	}
+	if len(server.shutdownTimers) != 0 {
+		t.Errorf("Stop: wrong number of pending shutdowns. Want 0. Got %d.", len(server.shutdownTimers))
+	}
+}
+
+func TestServiceUpdateWarnings(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := []string{"image test/test2 could not be accessed on a registry to record its digest"}
+	var tests = []struct {
+		warnings []string
+		expected string
+	}{
+		{nil, "{}\n"},
+		{warnings, `{"Warnings":["image test/test2 could not be accessed on a registry to record its digest"]}` + "\n"},
+	}
+	for _, tt := range tests {
+		server.SetServiceUpdateWarnings(tt.warnings)
+		buf, err := json.Marshal(srv.Spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", fmt.Sprintf("/services/%s/update", srv.ID), bytes.NewReader(buf))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceUpdate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != tt.expected {
+			t.Errorf("ServiceUpdate: wrong body. Want %q. Got %q.", tt.expected, body)
+		}
+	}
+}
+
 func TestServiceUpdateNotFound(t *testing.T) {
 	server, unused := setUpSwarm(t)
 	defer server.Stop()
@@ -1176,13 +2544,79 @@ func TestNodeList(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if !reflect.DeepEqual(nodes, srv1.nodes) {
-			t.Fatalf("expected nodes to equal %#v, got: %#v", srv1.nodes, nodes)
+		for _, expected := range [][]swarm.Node{srv1.nodes, srv2.nodes} {
+			expected = append([]swarm.Node(nil), expected...)
+			sort.Sort(nodesByID(expected))
+			if !reflect.DeepEqual(nodes, expected) {
+				t.Fatalf("expected nodes to equal %#v, got: %#v", expected, nodes)
+			}
+		}
+	}
+}
+
+func TestNodeListSortedByID(t *testing.T) {
+	t.Parallel()
+	server := DockerServer{swarm: &swarm.Swarm{}}
+	server.buildMuxer()
+	for _, id := range []string{"c3", "a1", "d4", "b2"} {
+		server.nodes = append(server.nodes, swarm.Node{ID: id})
+	}
+	server.nodes = append(server.nodes[:1], server.nodes[2:]...)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/nodes", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("invalid status code: %d", recorder.Code)
+	}
+	var nodes []swarm.Node
+	err := json.NewDecoder(recorder.Body).Decode(&nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+	expected := []string{"b2", "c3", "d4"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("NodeList: wrong order. Want %#v. Got %#v.", expected, ids)
+	}
+	if server.nodes[0].ID != "c3" {
+		t.Errorf("NodeList: stored nodes should not be reordered, got %q first", server.nodes[0].ID)
+	}
+}
+
+func TestNodeListHostnameAndAddr(t *testing.T) {
+	srv1, srv2 := setUpSwarm(t)
+	defer srv1.Stop()
+	defer srv2.Stop()
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/nodes", nil)
+	srv1.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("invalid status code: %d", recorder.Code)
+	}
+	var nodes []swarm.Node
+	err := json.NewDecoder(recorder.Body).Decode(&nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("NodeList: wrong number of nodes. Want 2. Got %d.", len(nodes))
+	}
+	hostnames := make(map[string]bool)
+	for _, node := range nodes {
+		if expected := "node-" + node.ID[:12]; node.Description.Hostname != expected {
+			t.Errorf("NodeList: wrong hostname. Want %q. Got %q.", expected, node.Description.Hostname)
 		}
-		if !reflect.DeepEqual(nodes, srv2.nodes) {
-			t.Fatalf("expected nodes to equal %#v, got: %#v", srv2.nodes, nodes)
+		hostnames[node.Description.Hostname] = true
+		if node.Status.Addr != "127.0.0.1" {
+			t.Errorf("NodeList: wrong status address. Want %q. Got %q.", "127.0.0.1", node.Status.Addr)
 		}
 	}
+	if len(hostnames) != 2 {
+		t.Errorf("NodeList: expected hostnames to be unique, got %#v", hostnames)
+	}
 }
 
 func TestNodeInfo(t *testing.T) {
@@ -1238,6 +2672,95 @@ func TestNodeUpdate(t *testing.T) {
 	}
 }
 
+func TestNodeUpdateDrain(t *testing.T) {
+	srv1, srv2 := setUpSwarm(t)
+	defer srv1.Stop()
+	defer srv2.Stop()
+	replicas := uint64(4)
+	for _, spec := range []swarm.ServiceSpec{
+		{
+			Annotations:  swarm.Annotations{Name: "replicated"},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "test/test"}},
+			Mode:         swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		},
+		{
+			Annotations:  swarm.Annotations{Name: "global"},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "test/test"}},
+			Mode:         swarm.ServiceMode{Global: &swarm.GlobalService{}},
+		},
+	} {
+		data, err := json.Marshal(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewReader(data))
+		srv1.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+	}
+	drained := srv1.nodes[0].ID
+	oldContainers := make(map[string]string)
+	for _, task := range srv1.tasks {
+		if task.NodeID == drained {
+			oldContainers[task.ID] = task.Status.ContainerStatus.ContainerID
+		}
+	}
+	if len(oldContainers) != 3 {
+		t.Fatalf("NodeUpdate: expected 3 tasks in the drained node, got %d", len(oldContainers))
+	}
+	data, err := json.Marshal(swarm.NodeSpec{Availability: swarm.NodeAvailabilityDrain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/nodes/"+drained+"/update", bytes.NewReader(data))
+	srv1.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("NodeUpdate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	for _, srv := range []*DockerServer{srv1, srv2} {
+		for _, task := range srv.tasks {
+			old, ok := oldContainers[task.ID]
+			if !ok {
+				continue
+			}
+			if task.DesiredState == swarm.TaskStateShutdown {
+				if task.NodeID != drained {
+					t.Errorf("NodeUpdate: global task %s should not be moved", task.ID)
+				}
+				continue
+			}
+			if task.NodeID == drained {
+				t.Errorf("NodeUpdate: task %s was not moved out of the drained node", task.ID)
+			}
+			if task.Status.ContainerStatus.ContainerID == old {
+				t.Errorf("NodeUpdate: container of task %s was not replaced", task.ID)
+			}
+		}
+	}
+	var shutdown int
+	for _, task := range srv1.tasks {
+		if _, ok := oldContainers[task.ID]; !ok {
+			continue
+		}
+		if task.DesiredState == swarm.TaskStateShutdown {
+			shutdown++
+			continue
+		}
+		if _, err := srv1.findContainer(oldContainers[task.ID]); err == nil {
+			t.Errorf("NodeUpdate: old container of task %s should be removed", task.ID)
+		}
+		if _, err := srv1.findContainer(task.Status.ContainerStatus.ContainerID); err != nil {
+			t.Errorf("NodeUpdate: new container of task %s not found: %s", task.ID, err)
+		}
+	}
+	if shutdown != 1 {
+		t.Errorf("NodeUpdate: expected 1 global task to be shut down, got %d", shutdown)
+	}
+}
+
 func TestNodeDelete(t *testing.T) {
 	srv1, srv2 := setUpSwarm(t)
 	defer srv1.Stop()
@@ -1361,3 +2884,288 @@ func TestMutateTaskNotFound(t *testing.T) {
 		t.Errorf("wrong error message. Want %q. Got %q.", "task not found", err)
 	}
 }
+
+func TestSetServiceTasksFailed(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	srv, err := addTestService(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.SetServiceTasksFailed(srv.ID, "task: non-zero exit (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range server.tasks {
+		if task.Status.State != swarm.TaskStateFailed || task.Status.Err != "task: non-zero exit (1)" {
+			t.Errorf("SetServiceTasksFailed: wrong task status. Got %#v.", task.Status)
+		}
+		container, err := server.findContainer(task.Status.ContainerStatus.ContainerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if container.State.Running || container.State.ExitCode != 1 {
+			t.Errorf("SetServiceTasksFailed: expected container to be stopped with exit code 1. Got %#v.", container.State)
+		}
+	}
+	updateStatus := server.services[0].UpdateStatus
+	if updateStatus == nil || updateStatus.State != swarm.UpdateStatePaused {
+		t.Errorf("SetServiceTasksFailed: wrong update status. Got %#v.", updateStatus)
+	}
+}
+
+func TestServiceCreateAssignsGenericResources(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	for i, node := range server.nodes {
+		err := server.SetNodeGenericResources(node.ID,
+			swarm.GenericResource{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "gpu", Value: fmt.Sprintf("UUID-%d-1", i)}},
+			swarm.GenericResource{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "gpu", Value: fmt.Sprintf("UUID-%d-2", i)}},
+			swarm.GenericResource{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 4}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "gpu-service"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+			Resources: &swarm.ResourceRequirements{
+				Reservations: &swarm.Resources{
+					GenericResources: []swarm.GenericResource{
+						{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "gpu", Value: 1}},
+						{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 2}},
+					},
+				},
+			},
+		},
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewBuffer(buf))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	task := server.tasks[0]
+	var nodeIndex int
+	for i, node := range server.nodes {
+		if node.ID == task.NodeID {
+			nodeIndex = i
+		}
+	}
+	expected := []swarm.GenericResource{
+		{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "gpu", Value: fmt.Sprintf("UUID-%d-1", nodeIndex)}},
+		{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 2}},
+	}
+	if !reflect.DeepEqual(task.GenericResources, expected) {
+		t.Errorf("ServiceCreate: wrong assigned generic resources. Want %#v. Got %#v.", expected, task.GenericResources)
+	}
+}
+
+func TestServiceCreateDiscreteGenericResourcesCapacity(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	for _, node := range server.nodes {
+		err := server.SetNodeGenericResources(node.ID,
+			swarm.GenericResource{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 5}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	replicas := uint64(3 * len(server.nodes))
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{Name: "ssd-service"},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+			Resources: &swarm.ResourceRequirements{
+				Reservations: &swarm.Resources{
+					GenericResources: []swarm.GenericResource{
+						{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 2}},
+					},
+				},
+			},
+		},
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+	}
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/services/create", bytes.NewBuffer(buf))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+	}
+	assigned := make(map[string][]int64)
+	for _, task := range server.tasks {
+		var value int64
+		for _, resource := range task.GenericResources {
+			value += resource.DiscreteResourceSpec.Value
+		}
+		assigned[task.NodeID] = append(assigned[task.NodeID], value)
+	}
+	for _, node := range server.nodes {
+		if expected := []int64{2, 2, 0}; !reflect.DeepEqual(assigned[node.ID], expected) {
+			t.Errorf("ServiceCreate: wrong ssd assigned to the tasks of node %s. Want %v. Got %v.", node.ID, expected, assigned[node.ID])
+		}
+	}
+}
+
+func TestServiceCreateGenericResourcesExceedNode(t *testing.T) {
+	server, unused := setUpSwarm(t)
+	defer server.Stop()
+	defer unused.Stop()
+	for i, node := range server.nodes {
+		err := server.SetNodeGenericResources(node.ID,
+			swarm.GenericResource{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "gpu", Value: fmt.Sprintf("UUID-%d", i)}},
+			swarm.GenericResource{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 3}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	createService := func(name string, gpus, ssds int64) *swarm.Task {
+		replicas := uint64(len(server.nodes))
+		buf, err := json.Marshal(swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Name: name},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: &swarm.ContainerSpec{Image: "test/test"},
+				Resources: &swarm.ResourceRequirements{
+					Reservations: &swarm.Resources{
+						GenericResources: []swarm.GenericResource{
+							{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "gpu", Value: gpus}},
+							{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: ssds}},
+						},
+					},
+				},
+			},
+			Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/services/create", bytes.NewBuffer(buf))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("ServiceCreate: wrong status code. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		return server.tasks[len(server.tasks)-1]
+	}
+	task := createService("too-much", 2, 4)
+	if len(task.GenericResources) != 0 {
+		t.Errorf("ServiceCreate: expected no generic resources when the node can't satisfy the reservations. Got %#v.", task.GenericResources)
+	}
+	task = createService("fits", 1, 3)
+	var nodeIndex int
+	for i, node := range server.nodes {
+		if node.ID == task.NodeID {
+			nodeIndex = i
+		}
+	}
+	expected := []swarm.GenericResource{
+		{NamedResourceSpec: &swarm.NamedGenericResource{Kind: "gpu", Value: fmt.Sprintf("UUID-%d", nodeIndex)}},
+		{DiscreteResourceSpec: &swarm.DiscreteGenericResource{Kind: "ssd", Value: 3}},
+	}
+	if !reflect.DeepEqual(task.GenericResources, expected) {
+		t.Errorf("ServiceCreate: unsatisfied reservations should not use up the node resources. Want %#v. Got %#v.", expected, task.GenericResources)
+	}
+}
+
+func TestSetNodeGenericResourcesNotFound(t *testing.T) {
+	server := DockerServer{}
+	err := server.SetNodeGenericResources("abc")
+	if err == nil || err.Error() != "node not found" {
+		t.Errorf("SetNodeGenericResources: wrong error. Want %q. Got %v.", "node not found", err)
+	}
+}
+
+func TestSetNodeReachability(t *testing.T) {
+	server1, server2 := setUpSwarm(t)
+	defer server1.Stop()
+	defer server2.Stop()
+	leaderID := server1.nodes[0].ID
+	otherID := server1.nodes[1].ID
+	inspect := func(server *DockerServer, id string) swarm.Node {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/nodes/"+id, nil)
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("NodeInspect: wrong status. Want %d. Got %d.", http.StatusOK, recorder.Code)
+		}
+		var node swarm.Node
+		if err := json.NewDecoder(recorder.Body).Decode(&node); err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	for _, id := range []string{leaderID, otherID} {
+		if node := inspect(server1, id); node.ManagerStatus.Reachability != swarm.ReachabilityReachable {
+			t.Errorf("NodeInspect: wrong reachability. Want %q. Got %q.", swarm.ReachabilityReachable, node.ManagerStatus.Reachability)
+		}
+	}
+	var tests = []struct {
+		id           string
+		reachability swarm.Reachability
+		err          string
+		leader       string
+	}{
+		{otherID, swarm.ReachabilityUnreachable, "", leaderID},
+		{leaderID, swarm.ReachabilityUnreachable, "no reachable manager to take over the leadership", leaderID},
+		{otherID, swarm.ReachabilityReachable, "", leaderID},
+		{leaderID, swarm.ReachabilityUnreachable, "", otherID},
+		{leaderID, swarm.ReachabilityReachable, "", otherID},
+	}
+	for i, tt := range tests {
+		err := server1.SetNodeReachability(tt.id, tt.reachability)
+		if tt.err == "" && err != nil {
+			t.Fatalf("SetNodeReachability(%d): unexpected error: %s", i, err)
+		}
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("SetNodeReachability(%d): wrong error. Want %q. Got %v.", i, tt.err, err)
+			}
+			continue
+		}
+		for _, server := range []*DockerServer{server1, server2} {
+			if node := inspect(server, tt.id); node.ManagerStatus.Reachability != tt.reachability {
+				t.Errorf("SetNodeReachability(%d): wrong reachability. Want %q. Got %q.", i, tt.reachability, node.ManagerStatus.Reachability)
+			}
+			var leaders []string
+			for _, id := range []string{leaderID, otherID} {
+				if inspect(server, id).ManagerStatus.Leader {
+					leaders = append(leaders, id)
+				}
+			}
+			if len(leaders) != 1 || leaders[0] != tt.leader {
+				t.Errorf("SetNodeReachability(%d): wrong leaders. Want [%s]. Got %v.", i, tt.leader, leaders)
+			}
+		}
+	}
+}
+
+func TestSetNodeReachabilityNotFound(t *testing.T) {
+	server := DockerServer{}
+	err := server.SetNodeReachability("abc", swarm.ReachabilityUnreachable)
+	if err == nil || err.Error() != "manager node not found" {
+		t.Errorf("SetNodeReachability: wrong error. Want %q. Got %v.", "manager node not found", err)
+	}
+}
+
+func TestSetServiceTasksFailedNotFound(t *testing.T) {
+	server := DockerServer{}
+	err := server.SetServiceTasksFailed("abc", "failed")
+	if err == nil || err.Error() != "service not found" {
+		t.Errorf("SetServiceTasksFailed: wrong error. Want %q. Got %v.", "service not found", err)
+	}
+}
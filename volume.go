@@ -27,6 +27,15 @@ type Volume struct {
 	Driver     string            `json:"Driver,omitempty" yaml:"Driver,omitempty" toml:"Driver,omitempty"`
 	Mountpoint string            `json:"Mountpoint,omitempty" yaml:"Mountpoint,omitempty" toml:"Mountpoint,omitempty"`
 	Labels     map[string]string `json:"Labels,omitempty" yaml:"Labels,omitempty" toml:"Labels,omitempty"`
+	UsageData  *VolumeUsageData  `json:"UsageData,omitempty" yaml:"UsageData,omitempty" toml:"UsageData,omitempty"`
+}
+
+// VolumeUsageData contains usage information about a volume. It's only
+// available on volume drivers that support collecting it, Size and RefCount
+// are set to -1 when the value is not available.
+type VolumeUsageData struct {
+	Size     int64 `json:"Size" yaml:"Size" toml:"Size"`
+	RefCount int64 `json:"RefCount" yaml:"RefCount" toml:"RefCount"`
 }
 
 // ListVolumesOptions specify parameters to the ListVolumes function.
@@ -97,6 +106,38 @@ func (c *Client) CreateVolume(opts CreateVolumeOptions) (*Volume, error) {
 	return &volume, nil
 }
 
+// GetOrCreateVolume returns the volume with the given name, creating it when
+// it doesn't exist. The returned boolean tells whether the volume was created
+// by this call.
+//
+// The daemon answers the creation of an existing volume as if it was
+// created, so the volume is inspected first. A volume created by another
+// client between the inspection and the creation is still reported as created
+// by this call.
+//
+// See https://goo.gl/pBUbZ9 for more details.
+func (c *Client) GetOrCreateVolume(opts CreateVolumeOptions) (*Volume, bool, error) {
+	if opts.Name != "" {
+		resp, err := c.do("GET", "/volumes/"+opts.Name, doOptions{context: opts.Context})
+		if err == nil {
+			defer resp.Body.Close()
+			var volume Volume
+			if err := json.NewDecoder(resp.Body).Decode(&volume); err != nil {
+				return nil, false, err
+			}
+			return &volume, false, nil
+		}
+		if e, ok := err.(*Error); !ok || e.Status != http.StatusNotFound {
+			return nil, false, err
+		}
+	}
+	volume, err := c.CreateVolume(opts)
+	if err != nil {
+		return nil, false, err
+	}
+	return volume, true, nil
+}
+
 // InspectVolume returns a volume by its name.
 //
 // See https://goo.gl/0g9A6i for more details.
@@ -118,9 +159,38 @@ func (c *Client) InspectVolume(name string) (*Volume, error) {
 
 // RemoveVolume removes a volume by its name.
 //
+// For backwards compatibility, it only reports the ErrNoSuchVolume and
+// ErrVolumeInUse errors, ignoring any other failure. Use
+// RemoveVolumeWithOptions to get every error.
+//
 // See https://goo.gl/79GNQz for more details.
 func (c *Client) RemoveVolume(name string) error {
-	resp, err := c.do("DELETE", "/volumes/"+name, doOptions{})
+	err := c.RemoveVolumeWithOptions(RemoveVolumeOptions{Name: name})
+	if err == ErrNoSuchVolume || err == ErrVolumeInUse {
+		return err
+	}
+	return nil
+}
+
+// RemoveVolumeOptions specify parameters to the RemoveVolumeWithOptions
+// function.
+//
+// See https://goo.gl/79GNQz for more details.
+type RemoveVolumeOptions struct {
+	Context context.Context
+	Name    string `qs:"-"`
+
+	// Force removes the volume even if it's in use by containers.
+	Force bool
+}
+
+// RemoveVolumeWithOptions removes a volume by its name, using the given
+// options.
+//
+// See https://goo.gl/79GNQz for more details.
+func (c *Client) RemoveVolumeWithOptions(opts RemoveVolumeOptions) error {
+	path := "/volumes/" + opts.Name + "?" + queryString(opts)
+	resp, err := c.do("DELETE", path, doOptions{context: opts.Context})
 	if err != nil {
 		if e, ok := err.(*Error); ok {
 			if e.Status == http.StatusNotFound {
@@ -130,7 +200,7 @@ func (c *Client) RemoveVolume(name string) error {
 				return ErrVolumeInUse
 			}
 		}
-		return nil
+		return err
 	}
 	defer resp.Body.Close()
 	return nil
@@ -7,6 +7,7 @@ package docker
 import (
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"testing"
@@ -80,6 +81,67 @@ func TestCreateVolume(t *testing.T) {
 	}
 }
 
+func TestGetOrCreateVolume(t *testing.T) {
+	t.Parallel()
+	body := `{"Name":"tardis","Driver":"local","Mountpoint":"/var/lib/docker/volumes/tardis"}`
+	var tests = []struct {
+		exists   bool
+		created  bool
+		requests []string
+	}{
+		{true, false, []string{"GET /volumes/tardis"}},
+		{false, true, []string{"GET /volumes/tardis", "POST /volumes/create"}},
+	}
+	for _, tt := range tests {
+		var requests []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch {
+			case r.Method == "GET" && !tt.exists:
+				http.Error(w, "no such volume", http.StatusNotFound)
+			case r.Method == "GET":
+				w.Write([]byte(body))
+			default:
+				// the daemon replies with 201 even when the volume exists.
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(body))
+			}
+		}))
+		client, err := NewClient(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SkipServerVersionCheck = true
+		volume, created, err := client.GetOrCreateVolume(CreateVolumeOptions{Name: "tardis"})
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if volume.Name != "tardis" {
+			t.Errorf("GetOrCreateVolume: wrong volume name. Want %q. Got %q.", "tardis", volume.Name)
+		}
+		if created != tt.created {
+			t.Errorf("GetOrCreateVolume(exists=%v): wrong created flag. Want %v. Got %v.", tt.exists, tt.created, created)
+		}
+		if !reflect.DeepEqual(requests, tt.requests) {
+			t.Errorf("GetOrCreateVolume(exists=%v): wrong requests. Want %v. Got %v.", tt.exists, tt.requests, requests)
+		}
+	}
+}
+
+func TestGetOrCreateVolumeInspectError(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: "something went wrong", status: http.StatusInternalServerError}
+	client := newTestClient(fakeRT)
+	_, _, err := client.GetOrCreateVolume(CreateVolumeOptions{Name: "tardis"})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusInternalServerError {
+		t.Errorf("GetOrCreateVolume: wrong error. Want status %d. Got %#v.", http.StatusInternalServerError, err)
+	}
+	if len(fakeRT.requests) != 1 {
+		t.Errorf("GetOrCreateVolume: should not create the volume after a failed inspection. Got %d requests.", len(fakeRT.requests))
+	}
+}
+
 func TestInspectVolume(t *testing.T) {
 	t.Parallel()
 	body := `{
@@ -112,6 +174,26 @@ func TestInspectVolume(t *testing.T) {
 	}
 }
 
+func TestInspectVolumeUsageData(t *testing.T) {
+	t.Parallel()
+	body := `{
+		"Name": "tardis",
+		"Driver": "local",
+		"Mountpoint": "/var/lib/docker/volumes/tardis",
+		"UsageData": {"Size": 2048, "RefCount": 1}
+	}`
+	fakeRT := &FakeRoundTripper{message: body, status: http.StatusOK}
+	client := newTestClient(fakeRT)
+	volume, err := client.InspectVolume("tardis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &VolumeUsageData{Size: 2048, RefCount: 1}
+	if !reflect.DeepEqual(volume.UsageData, expected) {
+		t.Errorf("InspectVolume: Wrong usage data. Want %#v. Got %#v.", expected, volume.UsageData)
+	}
+}
+
 func TestRemoveVolume(t *testing.T) {
 	t.Parallel()
 	name := "test"
@@ -147,6 +229,36 @@ func TestRemoveVolumeInUse(t *testing.T) {
 	}
 }
 
+func TestRemoveVolumeWithOptions(t *testing.T) {
+	t.Parallel()
+	fakeRT := &FakeRoundTripper{message: "", status: http.StatusNoContent}
+	client := newTestClient(fakeRT)
+	if err := client.RemoveVolumeWithOptions(RemoveVolumeOptions{Name: "test", Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	req := fakeRT.requests[0]
+	u, _ := url.Parse(client.getURL("/volumes/test"))
+	if req.URL.Path != u.Path {
+		t.Errorf("RemoveVolumeWithOptions: Wrong request path. Want %q. Got %q.", u.Path, req.URL.Path)
+	}
+	expected := url.Values{"force": {"1"}}
+	if got := req.URL.Query(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("RemoveVolumeWithOptions: Wrong query string. Want %#v. Got %#v.", expected, got)
+	}
+}
+
+func TestRemoveVolumeWithOptionsServerError(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(&FakeRoundTripper{message: "something went wrong", status: http.StatusInternalServerError})
+	err := client.RemoveVolumeWithOptions(RemoveVolumeOptions{Name: "test"})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusInternalServerError {
+		t.Errorf("RemoveVolumeWithOptions: wrong error. Want status %d. Got %#v.", http.StatusInternalServerError, err)
+	}
+	if err := client.RemoveVolume("test"); err != nil {
+		t.Errorf("RemoveVolume: expected other errors to be ignored. Got %#v.", err)
+	}
+}
+
 func TestPruneVolumes(t *testing.T) {
 	t.Parallel()
 	results := `{